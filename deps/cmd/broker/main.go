@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"example.com/deps/internal/broker"
 )
@@ -13,12 +18,63 @@ func main() {
 	// Command-line flags
 	port := flag.Int("port", 8080, "Port to listen on")
 	dataDir := flag.String("data-dir", "./data", "Directory to store broker data")
+	tcpPort := flag.Int("tcp-port", 8081, "Port for the binary protocol (0 to disable)")
+	kafkaPort := flag.Int("kafka-port", 0, "Port for the Kafka-compatible listener (0 to disable)")
+	redisPort := flag.Int("redis-port", 0, "Port for the Redis Streams listener (0 to disable)")
+	mqttPort := flag.Int("mqtt-port", 0, "Port for the MQTT listener (0 to disable)")
+	fsync := flag.Bool("fsync", false, "Fsync each batch of appends before acknowledging it")
+	commitWindow := flag.Duration("commit-window", 0, "How long to gather concurrent publishes into one write (0 = only those that arrive during the previous write)")
+	cacheEvents := flag.Int("cache-events", 10000, "Events of each partition's tail kept in memory for fetches (0 = no count limit)")
+	cacheBytes := flag.Int64("cache-bytes", 16<<20, "Bytes of each partition's tail kept in memory for fetches (0 = no size limit; both 0 disables the cache)")
+	keyfile := flag.String("keyfile", "", "JSON file of AES keys for topics with encryption.enabled (empty = no encryption)")
+	storage := flag.String("storage", "file", "Where new topics store their events: file, or memory to keep them only until the broker stops")
+	segmentBytes := flag.Int64("segment-bytes", 0, "Seal each partition's active log file as a segment once it reaches this size (0 = only when tiering)")
+	tierAfter := flag.Duration("tier-after", 0, "Offload sealed segments whose newest event is older than this to the cold tier (0 = disabled)")
+	tierDir := flag.String("tier-dir", "", "Directory to use as the cold tier")
+	tierS3 := flag.String("tier-s3", "", "S3-compatible bucket to use as the cold tier, as http(s)://host:port/bucket; credentials come from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	tierS3Region := flag.String("tier-s3-region", "us-east-1", "Region to sign requests to -tier-s3 for")
+	tierCacheBytes := flag.Int64("tier-cache-bytes", 1<<30, "Bytes of cold segments kept on local disk once read back")
+	maxBatchBytes := flag.Int64("max-batch-bytes", 16<<20, "Largest batch body accepted by POST /topics/events/batch, as sent and once decompressed (0 = no limit)")
+	snapshotDir := flag.String("snapshot-dir", "", "Directory for snapshots taken with POST /admin/snapshot (empty = disabled)")
+	restore := flag.String("restore", "", "Validate this snapshot and restore it into the empty data directory before starting")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "How long to wait for in-flight requests on SIGINT/SIGTERM before closing connections")
 	flag.Parse()
 
 	// Validate flags
 	if *port <= 0 || *port > 65535 {
 		log.Fatal("Invalid port number")
 	}
+	if *tcpPort < 0 || *tcpPort > 65535 {
+		log.Fatal("Invalid TCP port number")
+	}
+	if *kafkaPort < 0 || *kafkaPort > 65535 {
+		log.Fatal("Invalid Kafka port number")
+	}
+	if *redisPort < 0 || *redisPort > 65535 {
+		log.Fatal("Invalid Redis port number")
+	}
+	if *mqttPort < 0 || *mqttPort > 65535 {
+		log.Fatal("Invalid MQTT port number")
+	}
+	if *commitWindow < 0 {
+		log.Fatal("Invalid commit window")
+	}
+	if *cacheEvents < 0 || *cacheBytes < 0 {
+		log.Fatal("Invalid cache limits")
+	}
+	if *shutdownTimeout <= 0 {
+		log.Fatal("Invalid shutdown timeout")
+	}
+	storageType, err := broker.ParseStorageType(*storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *segmentBytes < 0 || *tierAfter < 0 || *tierCacheBytes < 0 {
+		log.Fatal("Invalid segment or tiering limits")
+	}
+	if *tierAfter > 0 && (*tierDir == "") == (*tierS3 == "") {
+		log.Fatal("Tiering needs exactly one of -tier-dir and -tier-s3")
+	}
 
 	// Convert to absolute path
 	absDataDir, err := filepath.Abs(*dataDir)
@@ -28,10 +84,68 @@ func main() {
 
 	fmt.Printf("Starting broker...\n")
 	fmt.Printf("  Port: %d\n", *port)
+	fmt.Printf("  TCP port: %d\n", *tcpPort)
+	fmt.Printf("  Kafka port: %d\n", *kafkaPort)
+	fmt.Printf("  Redis port: %d\n", *redisPort)
+	fmt.Printf("  MQTT port: %d\n", *mqttPort)
 	fmt.Printf("  Data directory: %s\n", absDataDir)
+	fmt.Printf("  Fsync: %t (commit window %s)\n", *fsync, *commitWindow)
+	fmt.Printf("  Storage: %s\n", storageType)
+	fmt.Printf("  Tail cache: %d events / %d bytes per partition\n", *cacheEvents, *cacheBytes)
+	if *keyfile != "" {
+		fmt.Printf("  Keyfile: %s\n", *keyfile)
+	}
+	if *snapshotDir != "" {
+		fmt.Printf("  Snapshot directory: %s\n", *snapshotDir)
+	}
+	if *segmentBytes > 0 {
+		fmt.Printf("  Segment size: %d bytes\n", *segmentBytes)
+	}
+	if *tierAfter > 0 {
+		fmt.Printf("  Cold tier: %s%s after %s (cache %d bytes)\n", *tierDir, *tierS3, *tierAfter, *tierCacheBytes)
+	}
+
+	if *restore != "" {
+		manifest, err := broker.RestoreSnapshot(*restore, absDataDir)
+		if err != nil {
+			log.Fatalf("Failed to restore snapshot: %v", err)
+		}
+		fmt.Printf("Restored %d logs from snapshot %s taken %s\n", len(manifest.Logs), *restore, manifest.CreatedAt.Format(time.RFC3339))
+	}
 
 	// Create broker instance
 	b := broker.NewBroker(*port, absDataDir)
+	b.EnableTCP(*tcpPort)
+	b.EnableKafka(*kafkaPort)
+	b.EnableRedis(*redisPort)
+	b.EnableMQTT(*mqttPort)
+	b.SetStorage(storageType)
+	b.SetWriteOptions(broker.WriteOptions{CommitWindow: *commitWindow, Sync: *fsync, SegmentBytes: *segmentBytes})
+	b.SetCacheOptions(broker.CacheOptions{MaxEvents: *cacheEvents, MaxBytes: *cacheBytes})
+	if *keyfile != "" {
+		keyring, err := broker.LoadKeyring(*keyfile)
+		if err != nil {
+			log.Fatalf("Failed to load keyfile: %v", err)
+		}
+		b.SetKeyring(keyring)
+	}
+	b.SetSnapshotDir(*snapshotDir)
+	b.SetMaxBatchBytes(*maxBatchBytes)
+	if *tierAfter > 0 {
+		var store broker.ColdStore = broker.NewDirStore(*tierDir)
+		if *tierS3 != "" {
+			s3, err := broker.NewS3Store(*tierS3, *tierS3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+			if err != nil {
+				log.Fatalf("Failed to set up the cold tier: %v", err)
+			}
+			store = s3
+		}
+		b.SetTiering(broker.TieringOptions{Store: store, After: *tierAfter, CacheBytes: *tierCacheBytes})
+	}
+
+	if err := b.Listen(); err != nil {
+		log.Fatalf("Broker failed: %v", err)
+	}
 
 	// Add some test topics
 	testTopics := map[string]int{
@@ -40,15 +154,33 @@ func main() {
 		"shipments": 1,
 	}
 
+	// Once the data directory is loaded, so topics already in it are kept as they are
 	for name, partitions := range testTopics {
+		if b.GetTopic(name) != nil {
+			continue
+		}
 		if err := b.AddTopic(name, partitions); err != nil {
 			log.Fatalf("Failed to add topic %q: %v", name, err)
 		}
 		fmt.Printf("Created topic %q with %d partitions\n", name, partitions)
 	}
+	served := make(chan error, 1)
+	go func() { served <- b.Serve() }()
 
-	// Start the broker (blocks until error)
-	if err := b.Start(); err != nil {
+	// Run until SIGINT/SIGTERM; a second signal kills the process immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-served:
 		log.Fatalf("Broker failed: %v", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	fmt.Printf("Shutting down (waiting up to %s)...\n", *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := b.Shutdown(shutdownCtx); err != nil {
+		log.Fatalf("Shutdown incomplete: %v", err)
 	}
+	fmt.Printf("Broker stopped\n")
 }
@@ -1,158 +1,292 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
+
+	"example.com/deps/pkg/client"
 )
 
 func main() {
 	// Command-line flags
 	broker := flag.String("broker", "localhost:8080", "Broker address (host:port)")
-	topic := flag.String("topic", "", "Topic name")
+	topic := flag.String("topic", "", "Topic name, or a comma-separated list of topics")
+	topicPattern := flag.String("topic-pattern", "", "Subscribe to every topic matching this regular expression")
 	group := flag.String("group", "default", "Consumer group name")
-	partition := flag.Int("partition", 0, "Partition ID to consume from")
-	offset := flag.Int64("offset", 0, "Starting offset (0 = earliest)")
+	partition := flag.Int("partition", -1, "Consume only this partition, outside of group management (-1 = join the group)")
+	offset := flag.Int64("offset", 0, "Starting offset when -partition is set")
+	fromTime := flag.String("from-time", "", "Start from the first message at or after this RFC 3339 time, such as 2026-10-01T00:00:00Z")
 	maxBytes := flag.Int("maxBytes", 1048576, "Maximum bytes to fetch (default 1MB)")
-	count := flag.Int("count", 10, "Number of messages to fetch (0 = fetch once)")
+	maxWait := flag.Duration("maxWait", 5*time.Second, "How long the broker may hold a fetch waiting for new messages")
+	count := flag.Int("count", 10, "Number of messages to consume (0 = run until interrupted)")
 	commitInterval := flag.Duration("commitInterval", 5*time.Second, "Interval to commit offsets")
+	autoOffsetReset := flag.String("auto-offset-reset", "earliest", "Where to start when the group has no committed offset (earliest|latest)")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 1*time.Second, "Interval between group heartbeats")
 	flag.Parse()
 
 	// Validate flags
-	if *topic == "" {
-		log.Fatal("Topic is required (use -topic)")
+	if *topic == "" && *topicPattern == "" {
+		log.Fatal("Topic is required (use -topic or -topic-pattern)")
+	}
+	if *autoOffsetReset != "earliest" && *autoOffsetReset != "latest" {
+		log.Fatal("Invalid -auto-offset-reset (use earliest or latest)")
+	}
+
+	var from time.Time
+	if *fromTime != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339Nano, *fromTime); err != nil {
+			log.Fatalf("Invalid -from-time: %v", err)
+		}
+	}
+
+	var pattern *regexp.Regexp
+	if *topicPattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(*topicPattern); err != nil {
+			log.Fatalf("Invalid topic pattern: %v", err)
+		}
+	}
+
+	var topics []string
+	for _, t := range strings.Split(*topic, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			topics = append(topics, t)
+		}
 	}
 
 	fmt.Printf("Starting consumer...\n")
 	fmt.Printf("  Broker:         %s\n", *broker)
-	fmt.Printf("  Topic:          %s\n", *topic)
+	if pattern != nil {
+		fmt.Printf("  Topic pattern:  %s\n", pattern)
+	} else {
+		fmt.Printf("  Topics:         %s\n", strings.Join(topics, ", "))
+	}
 	fmt.Printf("  Group:          %s\n", *group)
-	fmt.Printf("  Partition:      %d\n", *partition)
-	fmt.Printf("  Starting offset: %d\n", *offset)
+	switch {
+	case !from.IsZero():
+		if *partition >= 0 {
+			fmt.Printf("  Partition:      %d\n", *partition)
+		}
+		fmt.Printf("  Starting time:  %s\n", from.Format(time.RFC3339Nano))
+	case *partition >= 0:
+		fmt.Printf("  Partition:      %d\n", *partition)
+		fmt.Printf("  Starting offset: %d\n", *offset)
+	default:
+		fmt.Printf("  Offset reset:   %s\n", *autoOffsetReset)
+	}
 	fmt.Printf("  Max bytes:      %d\n", *maxBytes)
+	fmt.Printf("  Max wait:       %s\n", *maxWait)
 	fmt.Printf("\n")
 
-	currentOffset := *offset
-	messagesConsumed := 0
-	commitTicker := time.NewTicker(*commitInterval)
-	defer commitTicker.Stop()
+	// Stop on SIGINT/SIGTERM, committing positions on the way out
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	for {
-		// Fetch messages
-		url := fmt.Sprintf(
-			"http://%s/messages?topic=%s&partition=%d&offset=%d&maxBytes=%d",
-			*broker, *topic, *partition, currentOffset, *maxBytes,
-		)
+	// With -from-time, each partition starts from the time the first time it is
+	// assigned; after that the group's commits take over
+	c := client.New(*broker)
+	sought := make(map[client.TopicPartition]bool)
+	var consumer *client.Consumer
+	consumer = c.NewConsumer(client.ConsumerConfig{
+		Group:             *group,
+		MaxBytes:          *maxBytes,
+		MaxWait:           *maxWait,
+		AutoOffsetReset:   *autoOffsetReset,
+		HeartbeatInterval: *heartbeatInterval,
+		OnAssign: func(generation int, partitions []client.TopicPartition) {
+			fmt.Printf("[%s] Assigned by group %q (generation %d): %s\n",
+				time.Now().Format("15:04:05"), *group, generation, formatAssignment(partitions))
+			if !from.IsZero() {
+				if err := seekToTime(ctx, c, consumer, partitions, from, sought); err != nil {
+					log.Printf("Failed to seek to %s: %v", from.Format(time.RFC3339Nano), err)
+				}
+			}
+		},
+	})
 
-		resp, err := http.Get(url)
-		if err != nil {
-			log.Printf("Failed to fetch messages: %v", err)
-			time.Sleep(1 * time.Second)
-			continue
+	var err error
+	switch {
+	case *partition >= 0:
+		// Manual mode: a single partition from an explicit offset
+		if len(topics) != 1 {
+			log.Fatal("-partition requires exactly one -topic")
 		}
-
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			log.Printf("Failed to read response: %v", err)
-			continue
+		tp := client.TopicPartition{Topic: topics[0], Partition: *partition}
+		if err = consumer.Assign(tp); err != nil {
+			break
 		}
-
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Failed to fetch messages (status %d): %s", resp.StatusCode, string(body))
-			time.Sleep(1 * time.Second)
-			continue
+		if from.IsZero() {
+			err = consumer.Seek(tp, *offset)
+		} else {
+			err = seekToTime(ctx, c, consumer, []client.TopicPartition{tp}, from, sought)
 		}
+	case pattern != nil:
+		err = consumer.SubscribePattern(pattern)
+	default:
+		err = consumer.Subscribe(topics...)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		// Parse the response
-		var result map[string]interface{}
-		if err := json.Unmarshal(body, &result); err != nil {
-			log.Printf("Failed to parse response: %v", err)
-			continue
-		}
+	committed := make(map[client.TopicPartition]int64)
+	consumed := consume(ctx, consumer, *count, *commitInterval, committed)
+
+	// Final commit on shutdown, then leave the group
+	if err := consumer.Commit(context.Background()); err != nil {
+		log.Printf("Failed to commit final offsets: %v", err)
+	} else {
+		printCommitted(consumer, committed, "final offset committed")
+	}
+	if err := consumer.Close(); err != nil {
+		log.Printf("Failed to leave group: %v", err)
+	}
 
-		// Process messages
-		messages, ok := result["messages"].([]interface{})
-		if !ok || len(messages) == 0 {
-			// No messages, wait and retry
-			fmt.Printf("No messages available. Waiting...\n")
-			time.Sleep(1 * time.Second)
+	fmt.Printf("\nConsumed %d messages. Exiting.\n", consumed)
+}
+
+// Print messages until count is reached or ctx is cancelled, committing every
+// commitInterval. Returns the number of messages consumed.
+func consume(ctx context.Context, consumer *client.Consumer, count int, commitInterval time.Duration, committed map[client.TopicPartition]int64) int {
+	consumed := 0
+	lastCommit := time.Now()
+
+	for ctx.Err() == nil {
+		messages, err := consumer.Poll(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				break
+			}
+			log.Printf("Poll failed: %v", err)
+			sleep(ctx, 1*time.Second)
 			continue
 		}
 
-		for _, msg := range messages {
-			msgMap := msg.(map[string]interface{})
-			offset := int64(msgMap["offset"].(float64))
-			key := msgMap["key"].(string)
-			payload := msgMap["payload"].(string) // Payload is bytes encoded as base64 string
-
-			fmt.Printf("[%s] Offset: %d | Key: %s | Payload: %s\n",
+		for i, msg := range messages {
+			fmt.Printf("[%s] %s/%d Offset: %d | Key: %s | Payload: %s\n",
 				time.Now().Format("15:04:05"),
-				offset,
-				key,
-				payload,
+				msg.Topic,
+				msg.Partition,
+				msg.Offset,
+				msg.Key,
+				msg.Payload,
 			)
 
-			currentOffset = offset + 1
-			messagesConsumed++
-		}
-
-		// Check if we should stop
-		if *count > 0 && messagesConsumed >= *count {
-			fmt.Printf("\nConsumed %d messages. Exiting.\n", messagesConsumed)
-			break
+			// Check if we should stop
+			consumed++
+			if count > 0 && consumed >= count {
+				rewind(consumer, messages[i+1:])
+				return consumed
+			}
 		}
 
-		// Try to commit offset
-		select {
-		case <-commitTicker.C:
-			if err := commitOffset(*broker, *group, *topic, *partition, currentOffset); err != nil {
-				log.Printf("Failed to commit offset: %v", err)
+		if time.Since(lastCommit) >= commitInterval {
+			if err := consumer.Commit(ctx); err != nil {
+				log.Printf("Failed to commit offsets: %v", err)
 			} else {
-				fmt.Printf("[%s] Committed offset: %d\n", time.Now().Format("15:04:05"), currentOffset)
+				lastCommit = time.Now()
+				printCommitted(consumer, committed, "committed offset")
 			}
-		default:
 		}
 	}
+	return consumed
+}
 
-	// Final commit
-	if err := commitOffset(*broker, *group, *topic, *partition, currentOffset); err != nil {
-		log.Printf("Failed to commit final offset: %v", err)
-	} else {
-		fmt.Printf("Final offset committed: %d\n", currentOffset)
+// Move positions back to the first of the unprinted messages on each partition,
+// which Poll has already moved past, so they are not committed.
+func rewind(consumer *client.Consumer, unprinted []client.Message) {
+	rewound := make(map[client.TopicPartition]bool)
+	for _, msg := range unprinted {
+		tp := client.TopicPartition{Topic: msg.Topic, Partition: msg.Partition}
+		if rewound[tp] {
+			continue
+		}
+		if err := consumer.Seek(tp, msg.Offset); err != nil {
+			log.Printf("Failed to rewind %s: %v", tp, err)
+		}
+		rewound[tp] = true
 	}
 }
 
-// Send a commit offset request to the broker
-func commitOffset(broker, group, topic string, partition int, offset int64) error {
-	url := fmt.Sprintf("http://%s/consumer-groups/offsets/commit?group=%s", broker, group)
+// Move each partition not sought yet to its first message at or after from,
+// looking up the offsets once per topic, and mark it sought.
+func seekToTime(ctx context.Context, c *client.Client, consumer *client.Consumer, partitions []client.TopicPartition, from time.Time, sought map[client.TopicPartition]bool) error {
+	offsets := make(map[string][]client.TimeOffset)
+	for _, tp := range partitions {
+		if sought[tp] {
+			continue
+		}
+		if _, ok := offsets[tp.Topic]; !ok {
+			topicOffsets, err := c.OffsetsForTime(ctx, tp.Topic, from)
+			if err != nil {
+				return err
+			}
+			offsets[tp.Topic] = topicOffsets
+		}
+		for _, offset := range offsets[tp.Topic] {
+			if offset.Partition != tp.Partition {
+				continue
+			}
+			if err := consumer.Seek(tp, offset.Offset); err != nil {
+				return err
+			}
+			sought[tp] = true
+			fmt.Printf("[%s] %s starting from offset %d\n", time.Now().Format("15:04:05"), tp, offset.Offset)
+		}
+	}
+	return nil
+}
 
-	commitData := map[string]interface{}{
-		"topic":     topic,
-		"partition": partition,
-		"offset":    offset,
+// Print the positions that changed since they were last printed.
+func printCommitted(consumer *client.Consumer, printed map[client.TopicPartition]int64, label string) {
+	for _, tp := range consumer.Assignment() {
+		offset, ok := consumer.Position(tp)
+		if last, seen := printed[tp]; !ok || (seen && last == offset) {
+			continue
+		}
+		printed[tp] = offset
+		fmt.Printf("[%s] %s %s: %d\n", time.Now().Format("15:04:05"), tp, label, offset)
 	}
+}
 
-	commitJSON, err := json.Marshal(commitData)
-	if err != nil {
-		return fmt.Errorf("failed to marshal commit data: %w", err)
+// Render an assignment as "orders[0 2] payments[1]".
+func formatAssignment(partitions []client.TopicPartition) string {
+	if len(partitions) == 0 {
+		return "no partitions"
 	}
 
-	resp, err := http.Post(url, "application/json", strings.NewReader(string(commitJSON)))
-	if err != nil {
-		return fmt.Errorf("failed to send commit request: %w", err)
+	byTopic := make(map[string][]int)
+	for _, tp := range partitions {
+		byTopic[tp.Topic] = append(byTopic[tp.Topic], tp.Partition)
 	}
-	defer resp.Body.Close()
+	topics := make([]string, 0, len(byTopic))
+	for topic := range byTopic {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("commit failed (status %d): %s", resp.StatusCode, string(body))
+	parts := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		parts = append(parts, fmt.Sprintf("%s%v", topic, byTopic[topic]))
 	}
+	return strings.Join(parts, " ")
+}
 
-	return nil
+// Sleep for d, returning early if ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
 }
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"example.com/deps/internal/broker"
+)
+
+const usage = `Usage: depslog <command> [flags] <partition log | data directory>
+
+Commands:
+  dump     print the records of a log as text or JSON
+  check    validate a log end to end and report gaps and out-of-order offsets
+  repair   copy the sound records of a log with a corrupt tail into a new file
+  migrate  upgrade a data directory to the current format version
+
+Run depslog <command> -h for the flags of each command.
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "dump":
+		dump(os.Args[2:])
+	case "check":
+		check(os.Args[2:])
+	case "repair":
+		repair(os.Args[2:])
+	case "migrate":
+		migrate(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// Print every event in a log, stopping with an error at a corrupt record.
+func dump(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print one JSON object per event")
+	keyfile := flags.String("keyfile", "", "Keyfile to decrypt encrypted records with")
+	from := flags.Int64("from", 0, "Skip events before this offset")
+	path := parseArgs(flags, args, "partition log")
+	keys := loadKeys(*keyfile)
+
+	file := openLog(path)
+	defer file.Close()
+
+	encoder := json.NewEncoder(os.Stdout)
+	_, err := broker.ReadLog(file, keys, func(record broker.LogRecord) error {
+		if record.Offset+int64(record.Count) <= *from {
+			return nil
+		}
+		if record.Events == nil {
+			// Encrypted, and no keyfile to open it with
+			if *asJSON {
+				return encoder.Encode(recordJSON(record, nil))
+			}
+			fmt.Printf("offset=%d position=%d size=%d events=%d encrypted (no keyfile)\n",
+				record.Offset, record.Position, record.Size, record.Count)
+			return nil
+		}
+
+		for _, event := range record.Events {
+			if event.Offset < *from {
+				continue
+			}
+			if *asJSON {
+				if err := encoder.Encode(recordJSON(record, event)); err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Printf("offset=%d position=%d size=%d timestamp=%s key=%q payloadSize=%d%s payload=%s\n",
+				event.Offset, record.Position, record.Size, formatTimestamp(event.Timestamp),
+				event.Key, len(event.Payload), recordFlags(record), event.Payload)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+}
+
+// One event of a dump in JSON. Payloads are printed as text, since they are JSON.
+type eventJSON struct {
+	Offset      int64  `json:"offset"`
+	Position    int64  `json:"position"`
+	RecordSize  int    `json:"recordSize"`
+	Codec       string `json:"codec,omitempty"`
+	BatchEvents int    `json:"batchEvents,omitempty"`
+	Encrypted   bool   `json:"encrypted,omitempty"`
+	Timestamp   string `json:"timestamp,omitempty"`
+	Key         string `json:"key"`
+	PayloadSize int    `json:"payloadSize"`
+	Payload     string `json:"payload"`
+}
+
+func recordJSON(record broker.LogRecord, event *broker.StoredEvent) eventJSON {
+	e := eventJSON{
+		Offset:     record.Offset,
+		Position:   record.Position,
+		RecordSize: record.Size,
+		Encrypted:  record.Encrypted,
+	}
+	if record.Codec != broker.CodecNone {
+		e.Codec = record.Codec.String()
+		e.BatchEvents = record.Count
+	}
+	if event != nil {
+		e.Offset = event.Offset
+		e.Timestamp = formatTimestamp(event.Timestamp)
+		e.Key = event.Key
+		e.PayloadSize = len(event.Payload)
+		e.Payload = string(event.Payload)
+	}
+	return e
+}
+
+// Validate a log end to end. Exits with status 1 if anything is wrong.
+func check(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	keyfile := flags.String("keyfile", "", "Keyfile to decrypt encrypted records with; without it they are checked for structure only")
+	path := parseArgs(flags, args, "partition log")
+	keys := loadKeys(*keyfile)
+
+	file := openLog(path)
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+
+	// Offsets are assigned consecutively, so each record should start where the
+	// previous one ended; a sealed segment starts at its first offset
+	var records, events, problems int64
+	var next int64
+	sound, err := broker.ReadLog(file, keys, func(record broker.LogRecord) error {
+		if records == 0 {
+			next = record.Offset
+		}
+		switch {
+		case record.Offset > next:
+			fmt.Printf("gap: offset %d at byte %d follows offset %d (%d missing)\n",
+				record.Offset, record.Position, next-1, record.Offset-next)
+			problems++
+		case record.Offset < next:
+			fmt.Printf("out of order: offset %d at byte %d follows offset %d\n",
+				record.Offset, record.Position, next-1)
+			problems++
+		}
+		records++
+		events += int64(record.Count)
+		next = record.Offset + int64(record.Count)
+		return nil
+	})
+
+	var corrupt *broker.CorruptRecordError
+	if errors.As(err, &corrupt) {
+		fmt.Printf("%v; %d bytes from there on are unreadable (depslog repair drops them)\n", corrupt, info.Size()-sound)
+		problems++
+	} else if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+
+	fmt.Printf("%s: %d records, %d events, %d of %d bytes sound, %d problems\n",
+		path, records, events, sound, info.Size(), problems)
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
+
+// Copy the records of a log up to its first corrupt one into a new file. The
+// original is left untouched.
+func repair(args []string) {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	output := flags.String("o", "", "File to write the sound records to (default: <log>.repaired)")
+	keyfile := flags.String("keyfile", "", "Keyfile to decrypt encrypted records with, so their contents are checked too")
+	path := parseArgs(flags, args, "partition log")
+	keys := loadKeys(*keyfile)
+	if *output == "" {
+		*output = path + ".repaired"
+	}
+
+	file := openLog(path)
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+
+	var records int64
+	sound, err := broker.ReadLog(file, keys, func(broker.LogRecord) error {
+		records++
+		return nil
+	})
+	var corrupt *broker.CorruptRecordError
+	if err != nil && !errors.As(err, &corrupt) {
+		log.Fatalf("%s: %v", path, err)
+	}
+	if corrupt == nil {
+		fmt.Printf("%s: all %d records are sound; nothing to repair\n", path, records)
+		return
+	}
+
+	// Never overwrite: the original may be needed to recover more by hand
+	out, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %v", *output, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	if _, err := io.CopyN(out, file, sound); err != nil {
+		out.Close()
+		log.Fatalf("Failed to write %s: %v", *output, err)
+	}
+	if err := out.Sync(); err != nil {
+		log.Fatalf("Failed to write %s: %v", *output, err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatalf("Failed to write %s: %v", *output, err)
+	}
+
+	fmt.Printf("%v\n", corrupt)
+	fmt.Printf("Wrote %d records (%d bytes) to %s, dropping %d bytes\n", records, sound, *output, info.Size()-sound)
+	fmt.Printf("Stop the broker and replace %s with it to use it\n", path)
+}
+
+// Upgrade a data directory to the current format version, in place or into a new
+// directory. The broker must be stopped.
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	output := flags.String("o", "", "Empty or new directory to write the migrated data to (default: migrate in place)")
+	dataDir := parseArgs(flags, args, "data directory")
+
+	migrated, err := broker.Migrate(dataDir, *output)
+	for _, file := range migrated {
+		if file.Version == broker.FormatVersion {
+			fmt.Printf("%s: copied\n", file.Path)
+			continue
+		}
+		if strings.HasSuffix(file.Path, ".log") {
+			fmt.Printf("%s: version %d -> %d, %d records\n", file.Path, file.Version, broker.FormatVersion, file.Records)
+			continue
+		}
+		fmt.Printf("%s: version %d -> %d\n", file.Path, file.Version, broker.FormatVersion)
+	}
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+
+	target := dataDir
+	if *output != "" {
+		target = *output
+	}
+	if len(migrated) == 0 {
+		fmt.Printf("%s is already in format version %d\n", target, broker.FormatVersion)
+		return
+	}
+	fmt.Printf("%s is in format version %d\n", target, broker.FormatVersion)
+}
+
+// Parse a command's flags and return its one argument, a log file or data directory.
+func parseArgs(flags *flag.FlagSet, args []string, argument string) string {
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: depslog %s [flags] <%s>\n", flags.Name(), argument)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	return flags.Arg(0)
+}
+
+func loadKeys(path string) *broker.Keyring {
+	if path == "" {
+		return nil
+	}
+	keys, err := broker.LoadKeyring(path)
+	if err != nil {
+		log.Fatalf("Failed to load keyfile: %v", err)
+	}
+	return keys
+}
+
+// Open a partition log file, refusing directories and other non-regular files,
+// which would read as one corrupt record.
+func openLog(path string) *os.File {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		log.Fatalf("Failed to open log: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		what := "not a regular file"
+		if info.IsDir() {
+			what = "a directory"
+		}
+		log.Fatalf("%s is %s; give the path of a partition log file, such as data/orders/partition-0.log", path, what)
+	}
+	return file
+}
+
+// Attributes worth showing next to an event in a text dump.
+func recordFlags(record broker.LogRecord) string {
+	var flags string
+	if record.Codec != broker.CodecNone {
+		flags += fmt.Sprintf(" codec=%s batch=%d", record.Codec, record.Count)
+	}
+	if record.Encrypted {
+		flags += " encrypted"
+	}
+	return flags
+}
+
+func formatTimestamp(nanos int64) string {
+	return time.Unix(0, nanos).UTC().Format(time.RFC3339Nano)
+}
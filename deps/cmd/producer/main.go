@@ -1,14 +1,14 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"time"
+
+	"example.com/deps/pkg/client"
 )
 
 func main() {
@@ -17,6 +17,8 @@ func main() {
 	topic := flag.String("topic", "", "Topic name")
 	key := flag.String("key", "", "Event key")
 	payload := flag.String("payload", "{}", "Event payload (JSON)")
+	timeout := flag.Duration("timeout", 30*time.Second, "How long to wait for the event to be stored")
+	compression := flag.String("compression", "", "Publish compressed with gzip, zlib or flate")
 	flag.Parse()
 
 	// Validate flags
@@ -24,54 +26,37 @@ func main() {
 		log.Fatal("Topic is required (use -topic)")
 	}
 
-	// Parse the payload JSON
+	if *compression != "" && *compression != "gzip" && *compression != "zlib" && *compression != "flate" {
+		log.Fatal("Compression must be gzip, zlib or flate")
+	}
+
+	// Validate the payload JSON
 	var payloadData map[string]interface{}
 	if err := json.Unmarshal([]byte(*payload), &payloadData); err != nil {
 		log.Fatalf("Invalid payload JSON: %v", err)
 	}
 
-	// Create the event
-	event := map[string]interface{}{
-		"key":     *key,
-		"payload": payloadData,
-	}
+	producer := client.New(*broker).NewProducer(client.ProducerConfig{Compression: *compression})
+	defer producer.Close()
 
-	// Marshal the event to JSON
-	eventJSON, err := json.Marshal(event)
-	if err != nil {
-		log.Fatalf("Failed to marshal event: %v", err)
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
 
 	// Send the event to the broker
-	url := fmt.Sprintf("http://%s/topics/events?topic=%s", *broker, *topic)
-	resp, err := http.Post(url, "application/json", bytes.NewReader(eventJSON))
+	result, err := producer.Publish(ctx, client.Record{
+		Topic:   *topic,
+		Key:     *key,
+		Payload: json.RawMessage(*payload),
+	})
 	if err != nil {
 		log.Fatalf("Failed to publish event: %v", err)
 	}
-	defer resp.Body.Close()
-
-	// Read the response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Failed to read response: %v", err)
-	}
-
-	// Check the response status
-	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Failed to publish event (status %d): %s", resp.StatusCode, string(body))
-	}
-
-	// Parse the response
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		log.Fatalf("Failed to parse response: %v", err)
-	}
 
 	// Print success
 	fmt.Printf("Event published successfully!\n")
 	fmt.Printf("  Timestamp: %s\n", time.Now().Format(time.RFC3339))
 	fmt.Printf("  Topic:     %s\n", *topic)
 	fmt.Printf("  Key:       %s\n", *key)
-	fmt.Printf("  Partition: %.0f\n", result["partition"])
-	fmt.Printf("  Offset:    %.0f\n", result["offset"])
+	fmt.Printf("  Partition: %d\n", result.Partition)
+	fmt.Printf("  Offset:    %d\n", result.Offset)
 }
@@ -1,53 +1,125 @@
 package broker
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"net"
 	"sync"
 )
 
 // Broker manages topics, partitions, and consumer groups.
 type Broker struct {
-	port           int
-	topics         map[string]*Topic
-	consumerGroups map[string]*ConsumerGroup
-	offsets        *ConsumerGroupOffsets
-	dataDir        string
-	httpServer     *HTTPServer
-	metadata       *MetadataManager
+	port       int
+	topics     map[string]*Topic
+	offsets    *ConsumerGroupOffsets
+	dataDir    string
+	httpServer *HTTPServer
+	metadata   *MetadataManager
+
+	// binary protocol listener; disabled when tcpPort is 0
+	tcpPort   int
+	tcpServer *TCPServer
+
+	// Kafka-compatible listener; disabled when kafkaPort is 0
+	kafkaPort   int
+	kafkaServer *KafkaServer
+
+	// Redis Streams listener; disabled when redisPort is 0
+	redisPort   int
+	redisServer *RedisServer
+
+	// MQTT listener; disabled when mqttPort is 0
+	mqttPort   int
+	mqttServer *MQTTServer
+
+	// storage of topics without a storage.type; file when empty
+	storage StorageType
+
+	// filesystem the data directory is read and written through; tests swap it
+	// for one that injects faults
+	fs fileSystem
+
+	// applied to every partition log as it is opened
+	writeOptions WriteOptions
+	cacheOptions CacheOptions
+	keyring      *Keyring
+
+	// where snapshots requested over HTTP are written; disabled when empty
+	snapshotDir string
+
+	// largest batch body accepted over HTTP, compressed and decompressed; no limit when 0
+	maxBatchBytes int64
+
+	// cold tier sealed segments are offloaded to; disabled when tier is nil
+	tiering TieringOptions
+	tier    *tier
+
+	// loops running until the broker stops: tiering and read-only recovery
+	background sync.WaitGroup
 
 	mu sync.RWMutex
 
 	partitionManager *PartitionManager
 
 	offsetManager *OffsetManager
+
+	coordinator *GroupCoordinator
+
+	// cancelled when Shutdown begins, releasing long polls and streams
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+// Without a data directory nothing is written to disk: metadata and committed
+// offsets are kept in memory, and topics must use StorageMemory.
 func NewBroker(port int, dataDir string) *Broker {
 	metadataPath := fmt.Sprintf("%s/metadata.json", dataDir)
+	offsetsPath := fmt.Sprintf("%s/offsets.json", dataDir)
+	if dataDir == "" {
+		metadataPath, offsetsPath = "", ""
+	}
 	broker := &Broker{
-		port:           port,
-		topics:         make(map[string]*Topic),
-		consumerGroups: make(map[string]*ConsumerGroup),
+		port:   port,
+		topics: make(map[string]*Topic),
 		offsets: &ConsumerGroupOffsets{
 			offsets: make(map[string]int64),
 		},
 		dataDir:  dataDir,
+		fs:       osFS{},
 		metadata: NewMetadataManager(metadataPath),
 
-		offsetManager: NewOffsetManager(fmt.Sprintf("%s/offsets.json", dataDir)),
+		cacheOptions:  CacheOptions{MaxEvents: 10000, MaxBytes: 16 << 20},
+		maxBatchBytes: 16 << 20,
+
+		offsetManager: NewOffsetManager(offsetsPath),
 	}
 
+	broker.ctx, broker.cancel = context.WithCancel(context.Background())
 	broker.partitionManager = NewPartitionManager(broker)
+	broker.coordinator = NewGroupCoordinator(broker)
 
 	return broker
 }
 
 // Initialize the broker and begin accepting HTTP requests.
+// Blocks until the HTTP server stops.
 func (b *Broker) Start() error {
+	if err := b.Listen(); err != nil {
+		return err
+	}
+	return b.Serve()
+}
+
+// Load state from disk and bind every listener, serving the non-HTTP protocols
+// in the background. Separate from Serve so callers can learn Addr before blocking.
+// If it fails, what it started is stopped again and it may be retried.
+func (b *Broker) Listen() (err error) {
 	// Ensure data directory exists
-	if err := os.MkdirAll(b.dataDir, 0755); err != nil {
-		return fmt.Errorf("failed to create data directory: %w", err)
+	if b.dataDir != "" {
+		if err := b.fs.MkdirAll(b.dataDir, 0755); err != nil {
+			return fmt.Errorf("failed to create data directory: %w", err)
+		}
 	}
 
 	// Load metadata
@@ -55,55 +127,423 @@ func (b *Broker) Start() error {
 		return fmt.Errorf("failed to load metadata: %w", err)
 	}
 
+	// Load offsets before opening logs, so a broker that fails to start never
+	// saves an empty set over them
+	if err := b.offsetManager.load(); err != nil {
+		return fmt.Errorf("failed to load offsets: %w", err)
+	}
+
+	// Undo whatever was started below if a later step fails, so Listen can be retried
+	var loaded []*Topic
+	defer func() {
+		if err != nil {
+			b.abortListen(loaded)
+		}
+	}()
+
 	// Populate in-memory topics and initialize log storage for each partition
 	for topicName, topic := range b.metadata.GetTopics() {
+		if _, ok := b.topics[topicName]; ok {
+			continue // created by AddTopic before Start, with its storage open
+		}
 		b.topics[topicName] = topic
+		loaded = append(loaded, topic)
 
 		// Initialize log storage for each partition
 		for partitionID, partition := range topic.Partitions {
 			logPath := fmt.Sprintf("%s/%s/partition-%d.log", b.dataDir, topicName, partitionID)
-			logStorage, err := NewLogStorage(logPath)
-			if err != nil {
+			if err := b.openLog(topic, partition, logPath); err != nil {
 				return fmt.Errorf("failed to initialize log storage for partition %d: %w", partitionID, err)
 			}
-			partition.logStorage = logStorage
 		}
 	}
 
-	// Load offsets
-	if err := b.offsetManager.load(); err != nil {
-		return fmt.Errorf("failed to load offsets: %w", err)
+	// Offload cold segments in the background; what was cached by a previous run
+	// may be stale
+	if b.tier != nil {
+		if err := b.fs.RemoveAll(b.tier.cache.dir); err != nil {
+			return fmt.Errorf("failed to clear tier cache: %w", err)
+		}
+		b.background.Add(1)
+		go b.runTiering()
+	}
+
+	// Bring partitions made read-only by failed writes back once the disk recovers
+	b.background.Add(1)
+	go b.runRecovery()
+
+	// Start the binary protocol listener alongside HTTP
+	if b.tcpPort > 0 {
+		server := NewTCPServer(b, b.tcpPort)
+		if err := server.Listen(); err != nil {
+			return err
+		}
+		b.tcpServer = server
+		go server.Serve()
+	}
+
+	// Start the Kafka-compatible listener alongside HTTP
+	if b.kafkaPort > 0 {
+		server := NewKafkaServer(b, b.kafkaPort)
+		if err := server.Listen(); err != nil {
+			return err
+		}
+		b.kafkaServer = server
+		go server.Serve()
+	}
+
+	// Start the Redis Streams listener alongside HTTP
+	if b.redisPort > 0 {
+		server := NewRedisServer(b, b.redisPort)
+		if err := server.Listen(); err != nil {
+			return err
+		}
+		b.redisServer = server
+		go server.Serve()
+	}
+
+	// Start the MQTT listener alongside HTTP
+	if b.mqttPort > 0 {
+		retainedPath := ""
+		if b.dataDir != "" {
+			retainedPath = fmt.Sprintf("%s/mqtt-retained.json", b.dataDir)
+		}
+		server := NewMQTTServer(b, b.mqttPort, retainedPath)
+		if err := server.Listen(); err != nil {
+			return err
+		}
+		b.mqttServer = server
+		go server.Serve()
 	}
 
 	// Create HTTP server
-	b.httpServer = NewHTTPServer(b, b.port)
+	server := NewHTTPServer(b, b.port)
+	if err := server.Listen(); err != nil {
+		return err
+	}
+	b.httpServer = server
+	return nil
+}
+
+// Stop the listeners and background loops a failed Listen started, and close and
+// forget the topics it loaded, leaving the broker as it was before.
+func (b *Broker) abortListen(loaded []*Topic) {
+	b.cancel()
+
+	if b.tcpServer != nil {
+		b.tcpServer.Close()
+		b.tcpServer = nil
+	}
+	if b.kafkaServer != nil {
+		b.kafkaServer.Close()
+		b.kafkaServer = nil
+	}
+	if b.redisServer != nil {
+		b.redisServer.Close()
+		b.redisServer = nil
+	}
+	if b.mqttServer != nil {
+		b.mqttServer.Close()
+		b.mqttServer = nil
+	}
+	b.background.Wait()
+
+	for _, topic := range loaded {
+		for _, partition := range topic.Partitions {
+			if partition.logStorage != nil {
+				partition.logStorage.Close()
+				partition.logStorage = nil
+			}
+		}
+		delete(b.topics, topic.Name)
+	}
+
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+}
+
+// Serve HTTP requests until Close. Listen must have succeeded.
+func (b *Broker) Serve() error {
+	return b.httpServer.Serve()
+}
+
+// Return the address the HTTP server is listening on.
+func (b *Broker) Addr() net.Addr {
+	return b.httpServer.Addr()
+}
+
+// Stop the broker gracefully. Listeners stop accepting connections, long polls
+// answer at once with whatever is available, streams end, and in-flight requests
+// are allowed to finish. Then every partition log is fsynced and closed, and
+// offsets and metadata are saved. Connections still open when ctx expires are
+// dropped and ctx.Err() is returned, but the logs are closed either way.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.cancel()
+
+	var servers []interface{ Shutdown(context.Context) error }
+	if b.httpServer != nil {
+		servers = append(servers, b.httpServer)
+	}
+	if b.tcpServer != nil {
+		servers = append(servers, b.tcpServer)
+	}
+	if b.kafkaServer != nil {
+		servers = append(servers, b.kafkaServer)
+	}
+	if b.redisServer != nil {
+		servers = append(servers, b.redisServer)
+	}
+	if b.mqttServer != nil {
+		servers = append(servers, b.mqttServer)
+	}
+
+	// Listeners drain concurrently so they share the deadline
+	results := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server interface{ Shutdown(context.Context) error }) {
+			results <- server.Shutdown(ctx)
+		}(server)
+	}
+	var errs []error
+	expired := false
+	for range servers {
+		if err := <-results; ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			expired = true
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if expired {
+		errs = append(errs, ctx.Err())
+	}
+
+	b.background.Wait()
+	return errors.Join(append(errs, b.closeStorage())...)
+}
+
+// Stop every listener and close the partition logs without waiting. Open
+// connections are dropped; in-flight requests may fail.
+func (b *Broker) Close() error {
+	b.cancel()
+
+	var errs []error
+	if b.httpServer != nil {
+		errs = append(errs, b.httpServer.Close())
+	}
+	if b.tcpServer != nil {
+		errs = append(errs, b.tcpServer.Close())
+	}
+	if b.kafkaServer != nil {
+		errs = append(errs, b.kafkaServer.Close())
+	}
+	if b.redisServer != nil {
+		errs = append(errs, b.redisServer.Close())
+	}
+	if b.mqttServer != nil {
+		errs = append(errs, b.mqttServer.Close())
+	}
+	b.background.Wait()
+	return errors.Join(append(errs, b.closeStorage())...)
+}
+
+// Fsync and close every partition log, then save offsets and metadata.
+func (b *Broker) closeStorage() error {
+	var errs []error
+
+	b.mu.RLock()
+	for _, topic := range b.topics {
+		for _, partition := range topic.Partitions {
+			if partition.logStorage == nil {
+				continue
+			}
+			if err := partition.logStorage.Sync(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to sync log of %s partition %d: %w", partition.Topic, partition.ID, err))
+			}
+			errs = append(errs, partition.logStorage.Close())
+		}
+	}
+	b.mu.RUnlock()
+
+	errs = append(errs, b.offsetManager.Save(), b.metadata.Save())
+	return errors.Join(errs...)
+}
+
+// Closed once Shutdown begins. Nil, and so never ready, for brokers not made by NewBroker.
+func (b *Broker) stopping() <-chan struct{} {
+	if b.ctx == nil {
+		return nil
+	}
+	return b.ctx.Done()
+}
+
+// Derive a context that is also cancelled when the broker starts shutting down.
+func (b *Broker) shutdownContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	if b.ctx == nil {
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(b.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// Serve the binary protocol on the given port when the broker starts.
+// Must be called before Start.
+func (b *Broker) EnableTCP(port int) {
+	b.tcpPort = port
+}
+
+// Serve the Kafka wire protocol subset on the given port when the broker starts.
+// Must be called before Start.
+func (b *Broker) EnableKafka(port int) {
+	b.kafkaPort = port
+}
+
+// Serve the Redis Streams commands on the given port when the broker starts.
+// Must be called before Start.
+func (b *Broker) EnableRedis(port int) {
+	b.redisPort = port
+}
+
+// Serve MQTT 3.1.1 on the given port when the broker starts.
+// Must be called before Start.
+func (b *Broker) EnableMQTT(port int) {
+	b.mqttPort = port
+}
+
+// Store the partitions of new topics as storage says, unless a topic's
+// storage.type overrides it. Must be called before topics are added or the broker
+// starts; topics already created keep the storage they were created with.
+func (b *Broker) SetStorage(storage StorageType) {
+	b.storage = storage
+}
+
+// Batch and fsync partition log writes as configured. Must be called before
+// topics are added or the broker starts.
+func (b *Broker) SetWriteOptions(options WriteOptions) {
+	b.writeOptions = options
+}
+
+// Bound the in-memory tail cache of each partition. Must be called before the
+// broker starts; the zero value disables the cache.
+func (b *Broker) SetCacheOptions(options CacheOptions) {
+	b.cacheOptions = options
+}
+
+// Encrypt the payloads of topics with encryption.enabled using keys. Must be
+// called before the broker starts; without a keyring no topic can be encrypted.
+func (b *Broker) SetKeyring(keys *Keyring) {
+	b.keyring = keys
+}
+
+// Write snapshots requested over HTTP as named subdirectories of dir. Without it
+// they can only be taken with Snapshot.
+func (b *Broker) SetSnapshotDir(dir string) {
+	b.snapshotDir = dir
+}
 
-	// Start listening (blocks until error or shutdown)
-	return b.httpServer.Start()
+// Refuse batches published over HTTP whose body is larger than n bytes, either as
+// sent or once decompressed. 0 removes the limit.
+func (b *Broker) SetMaxBatchBytes(n int64) {
+	b.maxBatchBytes = n
+}
+
+// Open the log of a partition with the storage its topic uses. A log file is
+// opened with the broker's write options and its topic's encryption setting. Both
+// feed the partition's tail cache.
+func (b *Broker) openLog(topic *Topic, partition *Partition, path string) error {
+	if topic.encrypted() && b.keyring == nil {
+		return fmt.Errorf("topic %q is encrypted but no keyfile is loaded", topic.Name)
+	}
+
+	onAppend := func(events []*StoredEvent) {
+		partition.cacheEvents(events, b.cacheOptions)
+	}
+	if b.topicStorage(topic) == StorageMemory {
+		memory := NewMemoryLog()
+		memory.onAppend = onAppend
+		partition.logStorage = memory
+		return nil
+	}
+	if b.dataDir == "" {
+		return fmt.Errorf("topic %q is stored in files but the broker has no data directory", topic.Name)
+	}
+
+	logStorage, err := openLogStorage(b.fs, path)
+	if err != nil {
+		return err
+	}
+	logStorage.options = b.writeOptions
+	logStorage.keys = b.keyring
+	logStorage.tier = b.tier
+	logStorage.encrypt.Store(topic.encrypted())
+	logStorage.onAppend = onAppend
+	partition.logStorage = logStorage
+	return nil
+}
+
+// The storage a topic's partitions use: its storage.type, or the broker's default.
+func (b *Broker) topicStorage(topic *Topic) StorageType {
+	if storage := topic.storageType(); storage != "" {
+		return storage
+	}
+	if b.storage == "" {
+		return StorageFile
+	}
+	return b.storage
 }
 
 // New topic with the specified number of partitions.
 func (b *Broker) AddTopic(name string, numPartitions int) error {
+	return b.AddTopicWithConfig(name, numPartitions, nil)
+}
+
+// New topic with the specified number of partitions and settings, as
+// SetTopicConfig takes them. "storage.type" can only be set here.
+func (b *Broker) AddTopicWithConfig(name string, numPartitions int, config map[string]string) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	for key, value := range config {
+		if err := b.validateTopicSetting(name, key, value); err != nil {
+			return err
+		}
+	}
+
 	// Check if topic already exists
 	if _, exists := b.metadata.GetTopics()[name]; exists {
 		return fmt.Errorf("topic %q already exists", name)
 	}
 
-	// Create topic directory
-	topicDir := fmt.Sprintf("%s/%s", b.dataDir, name)
-	if err := os.MkdirAll(topicDir, 0755); err != nil {
-		return fmt.Errorf("failed to create topic directory: %w", err)
-	}
-
 	// Create topic and its partitions
 	topic := &Topic{
 		Name:          name,
 		NumPartitions: numPartitions,
 		Partitions:    make(map[int]*Partition),
 	}
+	if len(config) > 0 {
+		topic.Config = make(map[string]string, len(config))
+		for key, value := range config {
+			topic.Config[key] = value
+		}
+	}
+
+	// A topic keeps the storage it was created with, whatever the default later
+	switch storage := b.topicStorage(topic); {
+	case storage != StorageFile:
+		if topic.Config == nil {
+			topic.Config = make(map[string]string)
+		}
+		topic.Config[storageTypeConfig] = string(storage)
+	case b.dataDir == "":
+		return fmt.Errorf("topic %q is stored in files but the broker has no data directory", name)
+	default:
+		topicDir := fmt.Sprintf("%s/%s", b.dataDir, name)
+		if err := b.fs.MkdirAll(topicDir, 0755); err != nil {
+			return fmt.Errorf("failed to create topic directory: %w", err)
+		}
+	}
 
 	// Create each partition
 	for i := 0; i < numPartitions; i++ {
@@ -112,15 +552,12 @@ func (b *Broker) AddTopic(name string, numPartitions int) error {
 			ID:            i,
 			logPath:       fmt.Sprintf("%s/%s/partition-%d.log", b.dataDir, name, i),
 			currentOffset: 0,
-			events:        make([]*StoredEvent, 0),
 		}
 
 		// Initialize log storage for each partition
-		logStorage, err := NewLogStorage(partition.logPath)
-		if err != nil {
+		if err := b.openLog(topic, partition, partition.logPath); err != nil {
 			return fmt.Errorf("failed to initialize log storage for partition %d: %w", i, err)
 		}
-		partition.logStorage = logStorage
 
 		topic.Partitions[i] = partition
 	}
@@ -128,6 +565,7 @@ func (b *Broker) AddTopic(name string, numPartitions int) error {
 	if err := b.metadata.AddTopic(name, topic); err != nil {
 		return err
 	}
+	b.topics[name] = topic
 
 	// Persist metadata
 	if err := b.metadata.Save(); err != nil {
@@ -137,6 +575,85 @@ func (b *Broker) AddTopic(name string, numPartitions int) error {
 	return nil
 }
 
+// Change a topic setting and persist it with the topic's metadata. Settings:
+//   - "compression.type": "producer" keeps the codec producers compress with, and
+//     none, gzip, zlib or flate recompresses appended records with it.
+//   - "encryption.enabled": "true" seals appended payloads with the keyring's
+//     active key. Records already written stay as they are.
+//   - "storage.type": file or memory; see StorageType. Only set by
+//     AddTopicWithConfig, since events are never moved between storages.
+func (b *Broker) SetTopicConfig(name, key, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topic, ok := b.topics[name]
+	if !ok {
+		return fmt.Errorf("topic %q not found", name)
+	}
+	if key == storageTypeConfig {
+		return fmt.Errorf("%s can only be set when a topic is created", storageTypeConfig)
+	}
+	if err := b.validateTopicSetting(name, key, value); err != nil {
+		return err
+	}
+
+	topic.mu.Lock()
+	if topic.Config == nil {
+		topic.Config = make(map[string]string)
+	}
+	topic.Config[key] = value
+	for _, partition := range topic.Partitions {
+		if storage, ok := partition.logStorage.(*LogStorage); ok {
+			storage.encrypt.Store(topic.Config[encryptionConfig] == "true")
+		}
+	}
+	topic.mu.Unlock()
+
+	// Persist metadata
+	if err := b.metadata.Save(); err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	return nil
+}
+
+// Check a value for one of the settings SetTopicConfig describes.
+func (b *Broker) validateTopicSetting(name, key, value string) error {
+	switch key {
+	case compressionTypeConfig:
+		return validateCompressionType(value)
+	case encryptionConfig:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%s must be true or false", encryptionConfig)
+		}
+		if value == "true" && b.keyring == nil {
+			return fmt.Errorf("cannot encrypt topic %q: no keyfile is loaded", name)
+		}
+		return nil
+	case storageTypeConfig:
+		_, err := ParseStorageType(value)
+		return err
+	}
+	return fmt.Errorf("unknown topic setting %q", key)
+}
+
+// Return a copy of a topic's settings, or nil if the topic doesn't exist.
+func (b *Broker) TopicConfig(name string) map[string]string {
+	topic := b.GetTopic(name)
+	if topic == nil {
+		return nil
+	}
+
+	topic.mu.RLock()
+	defer topic.mu.RUnlock()
+
+	config := make(map[string]string, len(topic.Config))
+	for key, value := range topic.Config {
+		config[key] = value
+	}
+	return config
+}
+
 // GetTopic retrieves a topic by name.
 // Returns nil if topic doesn't exist.
 func (b *Broker) GetTopic(name string) *Topic {
@@ -0,0 +1,104 @@
+package broker
+
+// Limits on the tail of each partition kept in memory. Fetches that start inside
+// the cached tail are answered without reading the log file, which covers
+// consumers keeping up with producers. A zero limit leaves that dimension
+// unbounded; with both zero nothing is cached.
+type CacheOptions struct {
+	MaxEvents int
+	MaxBytes  int64
+}
+
+func (o CacheOptions) enabled() bool {
+	return o.MaxEvents > 0 || o.MaxBytes > 0
+}
+
+// Hit and miss counts and current contents of a partition's tail cache.
+type CacheStats struct {
+	Partition   int   `json:"partition"`
+	Events      int   `json:"events"`
+	Bytes       int64 `json:"bytes"`
+	FirstOffset int64 `json:"firstOffset"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+}
+
+// Add freshly written events, which directly follow the cached ones, and evict
+// the oldest until the cache is within its limits.
+func (p *Partition) cacheEvents(events []*StoredEvent, options CacheOptions) {
+	if !options.enabled() {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, event := range events {
+		p.events = append(p.events, event)
+		p.eventBytes += storedSize(event)
+	}
+
+	drop := 0
+	for drop < len(p.events) &&
+		((options.MaxEvents > 0 && len(p.events)-drop > options.MaxEvents) ||
+			(options.MaxBytes > 0 && p.eventBytes > options.MaxBytes)) {
+		p.eventBytes -= storedSize(p.events[drop])
+		p.events[drop] = nil // let the payload be collected
+		drop++
+	}
+	p.events = p.events[drop:]
+}
+
+// Return the cached events from startOffset that fit in maxBytes, and at least one,
+// as LogStorage.Read would. The second result is false when startOffset is older
+// than the cached tail.
+func (p *Partition) cachedEvents(startOffset int64, maxBytes int) ([]*StoredEvent, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.events) == 0 {
+		return nil, false
+	}
+	first := p.events[0].Offset
+	if startOffset < first {
+		return nil, false
+	}
+	if startOffset >= first+int64(len(p.events)) {
+		// Caught up: nothing newer has been written
+		return make([]*StoredEvent, 0), true
+	}
+
+	events := make([]*StoredEvent, 0)
+	var size int64
+	for _, event := range p.events[startOffset-first:] {
+		size += storedSize(event)
+		if size > int64(maxBytes) && len(events) > 0 {
+			break
+		}
+		events = append(events, event)
+	}
+	return events, true
+}
+
+// Report the cache's counters and contents.
+func (p *Partition) cacheStats() CacheStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	stats := CacheStats{
+		Partition: p.ID,
+		Events:    len(p.events),
+		Bytes:     p.eventBytes,
+		Hits:      p.cacheHits.Load(),
+		Misses:    p.cacheMisses.Load(),
+	}
+	if len(p.events) > 0 {
+		stats.FirstOffset = p.events[0].Offset
+	}
+	return stats
+}
+
+// Size of an event's record in the log file.
+func storedSize(event *StoredEvent) int64 {
+	return int64(24 + len(event.Key) + len(event.Payload))
+}
@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestTailCacheServesRecentFetches(t *testing.T) {
+	b, _ := startTestBroker(t, t.TempDir())
+	b.SetCacheOptions(CacheOptions{MaxEvents: 3})
+	partition, _ := b.GetPartition("orders", 0)
+	for i := 0; i < 5; i++ {
+		b.partitionManager.AppendEvent(partition, "k", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	// Only the last three events are kept
+	if stats := partition.cacheStats(); stats.Events != 3 || stats.FirstOffset != 2 {
+		t.Fatalf("Expected offsets 2-4 cached, got %+v", stats)
+	}
+
+	// Inside the tail: served from memory
+	events, err := b.partitionManager.FetchEvents(partition, 3, 1<<20)
+	if err != nil || len(events) != 2 || events[0].Offset != 3 || string(events[1].Payload) != `{"n":4}` {
+		t.Errorf("Unexpected cached fetch %+v (%v)", events, err)
+	}
+	// Caught up: nothing to read, and no need to look at the file
+	if events, _ := b.partitionManager.FetchEvents(partition, 5, 1<<20); len(events) != 0 {
+		t.Errorf("Expected nothing past the end, got %d events", len(events))
+	}
+	// Older than the tail: read from the log file
+	if events, _ := b.partitionManager.FetchEvents(partition, 0, 1<<20); len(events) != 5 {
+		t.Errorf("Expected 5 events from disk, got %d", len(events))
+	}
+	// maxBytes applies as it does on disk
+	if events, _ := b.partitionManager.FetchEvents(partition, 2, int(storedSize(events[0])*2)); len(events) != 2 {
+		t.Errorf("Expected maxBytes to allow 2 events, got %d", len(events))
+	}
+
+	rec := httptest.NewRecorder()
+	b.httpServer.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/topics/cache?topic=orders", nil))
+	var response struct {
+		Partitions []CacheStats `json:"partitions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || len(response.Partitions) != 1 {
+		t.Fatalf("Unexpected cache stats %s (%v)", rec.Body, err)
+	}
+	if stats := response.Partitions[0]; stats.Hits != 3 || stats.Misses != 1 || stats.Events != 3 {
+		t.Errorf("Expected 3 hits and 1 miss, got %+v", stats)
+	}
+
+	// A byte limit evicts by size
+	b.SetCacheOptions(CacheOptions{MaxBytes: 2 * storedSize(events[0])})
+	b.partitionManager.AppendEvent(partition, "k", []byte(`{"n":5}`))
+	if stats := partition.cacheStats(); stats.Events != 2 || stats.FirstOffset != 4 {
+		t.Errorf("Expected offsets 4-5 cached, got %+v", stats)
+	}
+}
+
+// Run with -race: the cache is filled by concurrent appends while tailing readers use it.
+func TestTailCacheConcurrentAppendFetch(t *testing.T) {
+	b, _ := startTestBroker(t, t.TempDir())
+	b.SetCacheOptions(CacheOptions{MaxEvents: 50})
+	partition, _ := b.GetPartition("orders", 0)
+
+	const appends = 400
+	var wg sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < appends/4; i++ {
+				b.partitionManager.AppendEvent(partition, "k", []byte(`{}`))
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Tail the partition, reading whenever something is appended
+	var next int64
+	for next < appends {
+		changed := partition.logStorage.Changed()
+		if partition.logStorage.NextOffset() == next {
+			select {
+			case <-changed:
+			case <-done:
+			}
+		}
+		events, err := b.partitionManager.FetchEvents(partition, next, 1<<20)
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		for i, event := range events {
+			if event.Offset != next+int64(i) {
+				t.Fatalf("Expected offset %d, got %d", next+int64(i), event.Offset)
+			}
+		}
+		next += int64(len(events))
+	}
+}
@@ -0,0 +1,222 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/deps/pkg/client"
+)
+
+func TestLogStorageCompressedBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partition-0.log")
+	storage, err := NewLogStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer storage.Close()
+
+	events := func(n int) []*StoredEvent {
+		batch := make([]*StoredEvent, n)
+		for i := range batch {
+			batch[i] = &StoredEvent{Key: "k", Payload: []byte(`{"status":"shipped","carrier":"postal","warehouse":"north"}`)}
+		}
+		return batch
+	}
+	// Offsets 0-1 plain, 2-6 gzip, 7 plain, 8-10 flate
+	for _, append := range []struct {
+		count int
+		codec Codec
+		first int64
+	}{{2, CodecNone, 0}, {5, CodecGzip, 2}, {1, CodecNone, 7}, {3, CodecFlate, 8}} {
+		if first, err := storage.AppendBatch(events(append.count), append.codec); err != nil || first != append.first {
+			t.Fatalf("Expected %s batch at offset %d, got %d (%v)", append.codec, append.first, first, err)
+		}
+	}
+
+	read, err := storage.Read(0, 1<<20)
+	if err != nil || len(read) != 11 {
+		t.Fatalf("Expected 11 events, got %d (%v)", len(read), err)
+	}
+	for i, event := range read {
+		if event.Offset != int64(i) || event.Key != "k" || string(event.Payload) != string(events(1)[0].Payload) {
+			t.Errorf("Unexpected event at offset %d: %+v", i, event)
+		}
+	}
+
+	// Starting inside a batch skips its earlier events; a batch larger than
+	// maxBytes is still returned whole
+	read, err = storage.Read(4, 1)
+	if err != nil || len(read) != 3 || read[0].Offset != 4 || read[2].Offset != 6 {
+		t.Errorf("Expected offsets 4-6, got %d events (%v)", len(read), err)
+	}
+	section, first, count, err := storage.Section(4, 1)
+	if err != nil || first != 2 || count != 5 {
+		t.Errorf("Expected the gzip batch (offsets 2-6), got first %d count %d (%v)", first, count, err)
+	}
+	if uncompressed := 5 * storedSize(events(1)[0]); section.Size() >= uncompressed {
+		t.Errorf("Expected the batch to take less than %d bytes, got %d", uncompressed, section.Size())
+	}
+
+	// The index rebuilt from disk maps each offset into its batch
+	storage.Close()
+	reopened, err := NewLogStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen log: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.NextOffset() != 11 {
+		t.Errorf("Expected 11 events after reopening, got %d", reopened.NextOffset())
+	}
+	if read, err := reopened.Read(9, 1<<20); err != nil || len(read) != 2 || read[0].Offset != 9 {
+		t.Errorf("Expected offsets 9-10 after reopening, got %+v (%v)", read, err)
+	}
+}
+
+func TestPublishBatchTooLarge(t *testing.T) {
+	s := setupTestServer()
+	s.broker.SetMaxBatchBytes(4 << 10)
+
+	publish := func(body []byte, codec Codec, encoding string) int {
+		data, err := compress(codec, body)
+		if err != nil {
+			t.Fatalf("Compress failed: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/topics/events/batch?topic=test-topic", bytes.NewReader(data))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	small := []byte(`[{"key":"k","payload":{"n":1}}]`)
+	// A few hundred compressed bytes that expand to a megabyte
+	bomb := []byte(`[{"key":"k","payload":{"pad":"` + strings.Repeat("x", 1<<20) + `"}}]`)
+
+	for _, test := range []struct {
+		name     string
+		body     []byte
+		codec    Codec
+		encoding string
+		status   int
+	}{
+		{"small", small, CodecNone, "", http.StatusOK},
+		{"small gzip", small, CodecGzip, "gzip", http.StatusOK},
+		{"large", bomb, CodecNone, "", http.StatusRequestEntityTooLarge},
+		{"large gzip", bomb, CodecGzip, "gzip", http.StatusRequestEntityTooLarge},
+		{"large zlib", bomb, CodecZlib, "deflate", http.StatusRequestEntityTooLarge},
+	} {
+		if status := publish(test.body, test.codec, test.encoding); status != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+		}
+	}
+
+	// Without a limit the large batch is accepted
+	s.broker.SetMaxBatchBytes(0)
+	if status := publish(bomb, CodecGzip, "gzip"); status != http.StatusOK {
+		t.Errorf("Expected the batch to be accepted without a limit, got %d", status)
+	}
+}
+
+func TestPublishCompressedBatch(t *testing.T) {
+	dataDir := t.TempDir()
+	b, addr := startTestBroker(t, dataDir)
+	cl := client.New(addr)
+	ctx := context.Background()
+
+	batch := make([]client.BatchEvent, 20)
+	for i := range batch {
+		batch[i] = client.BatchEvent{Key: "k", Payload: map[string]interface{}{"n": i, "status": "shipped", "carrier": "postal"}}
+	}
+	results, err := cl.PublishBatch(ctx, "orders", batch, "gzip")
+	if err != nil || len(results) != 20 || results[19].Offset != 19 {
+		t.Fatalf("Expected offsets 0-19, got %+v (%v)", results, err)
+	}
+
+	// Raw fetches get the batch as stored, from its first offset
+	resp, err := http.Get(fmt.Sprintf("http://%s/messages?topic=orders&partition=0&offset=5&format=raw", addr))
+	if err != nil {
+		t.Fatalf("Raw fetch failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("X-Deps-First-Offset") != "0" || resp.Header.Get("X-Deps-Record-Count") != "20" || Codec(body[16]) != CodecGzip {
+		t.Errorf("Expected the gzip batch from offset 0, got %v", resp.Header)
+	}
+	// or, on request, decompressed from the offset asked for
+	resp, err = http.Get(fmt.Sprintf("http://%s/messages?topic=orders&partition=0&offset=5&format=raw&decompress=true", addr))
+	if err != nil {
+		t.Fatalf("Raw fetch failed: %v", err)
+	}
+	plain, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("X-Deps-First-Offset") != "5" || Codec(plain[16]) != CodecNone || len(plain) <= len(body) {
+		t.Errorf("Expected uncompressed records from offset 5, got %d bytes (%v)", len(plain), resp.Header)
+	}
+
+	// The client decodes either form the same way
+	for _, options := range []client.FetchOptions{{}, {Raw: true}} {
+		result, err := cl.Fetch(ctx, "orders", 0, 5, options)
+		if err != nil || len(result.Messages) != 15 || result.Messages[0].Offset != 5 || string(result.Messages[14].Payload) != `{"carrier":"postal","n":19,"status":"shipped"}` {
+			t.Errorf("Unexpected fetch with %+v: %+v (%v)", options, result, err)
+		}
+	}
+
+	// The topic setting recompresses everything appended, and survives a restart
+	if _, err := cl.SetTopicConfig(ctx, "orders", map[string]string{"compression.type": "lz4"}); !client.IsStatus(err, http.StatusBadRequest) {
+		t.Errorf("Expected an unknown codec to be rejected, got %v", err)
+	}
+	if _, err := cl.SetTopicConfig(ctx, "orders", map[string]string{"compression.type": "zlib"}); err != nil {
+		t.Fatalf("Failed to set compression.type: %v", err)
+	}
+	if _, err := cl.Publish(ctx, "orders", "k", map[string]int{"n": 20}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	partition, _ := b.GetPartition("orders", 0)
+	section, _, _, _ := b.partitionManager.FetchRaw(partition, 20, 1<<20)
+	header := make([]byte, 20)
+	if _, err := section.ReadAt(header, 0); err != nil || Codec(header[16]) != CodecZlib {
+		t.Errorf("Expected offset 20 stored with zlib, got attributes %d (%v)", header[16], err)
+	}
+
+	b.Close()
+	restarted := NewBroker(0, dataDir)
+	if err := restarted.Listen(); err != nil {
+		t.Fatalf("Failed to restart broker: %v", err)
+	}
+	go restarted.Serve()
+	defer restarted.Close()
+	cl = client.New(fmt.Sprintf("127.0.0.1:%d", restarted.Addr().(*net.TCPAddr).Port))
+	if config, err := cl.TopicConfig(ctx, "orders"); err != nil || config["compression.type"] != "zlib" {
+		t.Errorf("Expected compression.type zlib after restart, got %v (%v)", config, err)
+	}
+	if result, err := cl.Fetch(ctx, "orders", 0, 0, client.FetchOptions{Raw: true}); err != nil || len(result.Messages) != 21 {
+		t.Errorf("Expected 21 messages after restart, got %+v (%v)", result, err)
+	}
+
+	// A compressing producer sends each topic's records in one request
+	producer := cl.NewProducer(client.ProducerConfig{Linger: time.Millisecond, Compression: "flate"})
+	defer producer.Close()
+	var offsets []string
+	for i := 0; i < 3; i++ {
+		result, err := producer.Publish(ctx, client.Record{Topic: "orders", Key: "k", Payload: map[string]int{"n": i}})
+		if err != nil {
+			t.Fatalf("Producer publish failed: %v", err)
+		}
+		offsets = append(offsets, strconv.FormatInt(result.Offset, 10))
+	}
+	if fmt.Sprint(offsets) != "[21 22 23]" {
+		t.Errorf("Expected offsets 21-23, got %v", offsets)
+	}
+}
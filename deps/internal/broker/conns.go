@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// The open connections of one listener, tracked so a graceful shutdown can let
+// each finish the request it is handling and wait for its handler to return.
+type connSet struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// Track conn until its handler calls done. Returns false once the set is
+// draining, in which case the caller closes conn without serving it.
+func (c *connSet) add(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.draining {
+		return false
+	}
+	if c.conns == nil {
+		c.conns = make(map[net.Conn]struct{})
+	}
+	c.conns[conn] = struct{}{}
+	c.wg.Add(1)
+	return true
+}
+
+// Stop tracking a connection whose handler has returned.
+func (c *connSet) done(conn net.Conn) {
+	c.mu.Lock()
+	delete(c.conns, conn)
+	c.mu.Unlock()
+	c.wg.Done()
+}
+
+// Make every pending and future read fail at once, so each handler returns after
+// writing the response it is working on, then wait for the handlers. Connections
+// still open when ctx expires are closed outright.
+func (c *connSet) shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.draining = true
+	for conn := range c.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	c.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		for conn := range c.conns {
+			conn.Close()
+		}
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
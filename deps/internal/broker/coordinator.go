@@ -0,0 +1,233 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a member may go without a heartbeat before it is evicted.
+const defaultSessionTimeout = 10 * time.Second
+
+// Returned by Heartbeat when the member is not part of the group,
+// either because it never joined or because its session expired.
+var errUnknownMember = errors.New("unknown consumer group member")
+
+// Track consumer group membership and assign partitions to members.
+// Rebalancing is stop-the-world: any membership change reassigns every partition
+// and bumps the generation, and members pick up the new assignment on their next heartbeat.
+type GroupCoordinator struct {
+	broker         *Broker
+	sessionTimeout time.Duration
+
+	mu     sync.Mutex
+	groups map[string]*ConsumerGroup
+}
+
+// Membership view returned to a member after join and heartbeat.
+type GroupAssignment struct {
+	Generation int              `json:"generation"`
+	Partitions map[string][]int `json:"partitions"` // topic → partition IDs
+}
+
+func NewGroupCoordinator(broker *Broker) *GroupCoordinator {
+	return &GroupCoordinator{
+		broker:         broker,
+		sessionTimeout: defaultSessionTimeout,
+		groups:         make(map[string]*ConsumerGroup),
+	}
+}
+
+// Add a member to a group (or update its subscription) and return its assignment.
+func (c *GroupCoordinator) Join(group, consumerID string, topics []string) (*GroupAssignment, error) {
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("no topics to subscribe to")
+	}
+	for _, topic := range topics {
+		if c.broker.GetTopic(topic) == nil {
+			return nil, fmt.Errorf("topic %q not found", topic)
+		}
+	}
+
+	g := c.getOrCreateGroup(group)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	changed := c.expireMembers(g, now)
+
+	subscribed := append([]string(nil), topics...)
+	sort.Strings(subscribed)
+	if !g.ActiveConsumers[consumerID] || !slices.Equal(g.subscriptions[consumerID], subscribed) {
+		g.ActiveConsumers[consumerID] = true
+		g.subscriptions[consumerID] = subscribed
+		changed = true
+	}
+	g.lastHeartbeat[consumerID] = now
+
+	if changed {
+		c.rebalance(g)
+	}
+
+	return assignmentFor(g, consumerID), nil
+}
+
+// Refresh a member's session and return its current assignment.
+func (c *GroupCoordinator) Heartbeat(group, consumerID string) (*GroupAssignment, error) {
+	g := c.getGroup(group)
+	if g == nil {
+		return nil, errUnknownMember
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if c.expireMembers(g, now) {
+		c.rebalance(g)
+	}
+	if !g.ActiveConsumers[consumerID] {
+		return nil, errUnknownMember
+	}
+	g.lastHeartbeat[consumerID] = now
+
+	return assignmentFor(g, consumerID), nil
+}
+
+// Remove a member from a group and hand its partitions to the remaining members.
+func (c *GroupCoordinator) Leave(group, consumerID string) error {
+	g := c.getGroup(group)
+	if g == nil {
+		return errUnknownMember
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.ActiveConsumers[consumerID] {
+		return errUnknownMember
+	}
+	removeMember(g, consumerID)
+	c.rebalance(g)
+
+	return nil
+}
+
+func (c *GroupCoordinator) getGroup(name string) *ConsumerGroup {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.groups[name]
+}
+
+func (c *GroupCoordinator) getOrCreateGroup(name string) *ConsumerGroup {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, exists := c.groups[name]
+	if !exists {
+		g = &ConsumerGroup{
+			Name:                 name,
+			ActiveConsumers:      make(map[string]bool),
+			PartitionAssignments: make(map[string]string),
+			subscriptions:        make(map[string][]string),
+			lastHeartbeat:        make(map[string]time.Time),
+		}
+		c.groups[name] = g
+	}
+	return g
+}
+
+// Evict members whose session has expired. Caller must hold g.mu.
+// Reports whether any member was removed.
+func (c *GroupCoordinator) expireMembers(g *ConsumerGroup, now time.Time) bool {
+	expired := false
+	for consumerID := range g.ActiveConsumers {
+		if now.Sub(g.lastHeartbeat[consumerID]) > c.sessionTimeout {
+			removeMember(g, consumerID)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// Reassign every subscribed partition across the current members. Caller must hold g.mu.
+// Partitions of each topic are dealt round-robin to the members subscribed to it,
+// continuing from where the previous topic left off so single-partition topics spread out.
+func (c *GroupCoordinator) rebalance(g *ConsumerGroup) {
+	members := make([]string, 0, len(g.ActiveConsumers))
+	topicSet := make(map[string]bool)
+	for consumerID := range g.ActiveConsumers {
+		members = append(members, consumerID)
+		for _, topic := range g.subscriptions[consumerID] {
+			topicSet[topic] = true
+		}
+	}
+	sort.Strings(members)
+
+	topics := make([]string, 0, len(topicSet))
+	for topic := range topicSet {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	g.PartitionAssignments = make(map[string]string)
+	next := 0
+	for _, topic := range topics {
+		t := c.broker.GetTopic(topic)
+		if t == nil {
+			continue
+		}
+
+		subscribers := make([]string, 0, len(members))
+		for _, consumerID := range members {
+			if slices.Contains(g.subscriptions[consumerID], topic) {
+				subscribers = append(subscribers, consumerID)
+			}
+		}
+
+		for partitionID := 0; partitionID < t.NumPartitions; partitionID++ {
+			key := fmt.Sprintf("%s-%d", topic, partitionID)
+			g.PartitionAssignments[key] = subscribers[next%len(subscribers)]
+			next++
+		}
+	}
+
+	g.Generation++
+	g.LastRebalance = time.Now()
+}
+
+// Build the assignment view for one member. Caller must hold g.mu.
+func assignmentFor(g *ConsumerGroup, consumerID string) *GroupAssignment {
+	partitions := make(map[string][]int)
+	for key, owner := range g.PartitionAssignments {
+		if owner != consumerID {
+			continue
+		}
+		// Keys are "{topic}-{partitionID}"; topic names may themselves contain dashes
+		sep := strings.LastIndex(key, "-")
+		partitionID, err := strconv.Atoi(key[sep+1:])
+		if err != nil {
+			continue
+		}
+		partitions[key[:sep]] = append(partitions[key[:sep]], partitionID)
+	}
+	for topic := range partitions {
+		sort.Ints(partitions[topic])
+	}
+
+	return &GroupAssignment{
+		Generation: g.Generation,
+		Partitions: partitions,
+	}
+}
+
+func removeMember(g *ConsumerGroup, consumerID string) {
+	delete(g.ActiveConsumers, consumerID)
+	delete(g.subscriptions, consumerID)
+	delete(g.lastHeartbeat, consumerID)
+}
@@ -0,0 +1,248 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+)
+
+// Write the broker's storage through fsys.
+func useFS(b *Broker, fsys fileSystem) {
+	b.fs = fsys
+	b.metadata.fs = fsys
+	b.offsetManager.fs = fsys
+}
+
+// The consumer group crash workloads commit offsets for.
+const crashGroup = "crash-group"
+
+// The event appended at offset i, with payloads of varying length.
+func crashKey(i int64) string { return fmt.Sprintf("k%d", i) }
+func crashPayload(i int64) []byte {
+	return []byte(fmt.Sprintf(`{"n":%d,"pad":"%0*d"}`, i, int(i%7)*9, 0))
+}
+
+// What a crash workload saw acknowledged before it stopped.
+type crashResult struct {
+	acked     int64 // events appended to orders
+	committed int64 // last committed offset of crash-group
+	audit     bool  // whether the audit topic was added
+}
+
+// Append events to a topic with strict fsync and small segments, committing an
+// offset every ten events and adding a second topic halfway, until an operation
+// fails or the workload is done.
+func runCrashWorkload(dataDir string, fsys fileSystem) crashResult {
+	var result crashResult
+
+	b := NewBroker(0, dataDir)
+	useFS(b, fsys)
+	b.SetWriteOptions(WriteOptions{Sync: true, SegmentBytes: 512})
+	defer b.Close()
+
+	if err := b.AddTopic("orders", 1); err != nil {
+		return result
+	}
+	partition, _ := b.GetPartition("orders", 0)
+	for i := int64(0); i < 60; i++ {
+		if _, err := b.partitionManager.AppendEvent(partition, crashKey(i), crashPayload(i)); err != nil {
+			return result
+		}
+		result.acked = i + 1
+		if i%10 == 9 {
+			if err := b.offsetManager.CommitOffset(crashGroup, "orders", 0, i+1); err != nil {
+				return result
+			}
+			result.committed = i + 1
+		}
+		if i == 30 {
+			if err := b.AddTopic("audit", 1); err != nil {
+				return result
+			}
+			result.audit = true
+		}
+	}
+	return result
+}
+
+// Fetch every event of the partition and check each is the one appended at its
+// offset: nothing corrupt, missing or out of place.
+func checkCrashEvents(t *testing.T, b *Broker, partition *Partition) {
+	t.Helper()
+	next := partition.logStorage.NextOffset()
+	for offset := int64(0); offset < next; {
+		events, err := b.partitionManager.FetchEvents(partition, offset, 100)
+		if err != nil {
+			t.Fatalf("Fetch at offset %d failed: %v", offset, err)
+		}
+		if len(events) == 0 {
+			t.Fatalf("Fetch at offset %d returned nothing, expected events up to %d", offset, next)
+		}
+		for _, event := range events {
+			if event.Offset != offset || event.Key != crashKey(offset) || string(event.Payload) != string(crashPayload(offset)) {
+				t.Fatalf("Expected %s at offset %d, got %s at %d with %q", crashKey(offset), offset, event.Key, event.Offset, event.Payload)
+			}
+			offset++
+		}
+	}
+}
+
+// Restart the broker on the real filesystem and check the recovery invariants:
+// every acknowledged event, commit and topic is there, and everything fetched is
+// intact. Then append and restart again, so a damaged tail would show.
+func checkCrashRecovery(t *testing.T, dataDir string, result crashResult) {
+	t.Helper()
+
+	for round := 0; round < 2; round++ {
+		b := NewBroker(0, dataDir)
+		if err := b.Listen(); err != nil {
+			t.Fatalf("Failed to restart: %v", err)
+		}
+		partition, err := b.GetPartition("orders", 0)
+		if err != nil {
+			b.Close()
+			if result.acked > 0 {
+				t.Fatalf("Expected the topic to survive: %v", err)
+			}
+			return
+		}
+		next := partition.logStorage.NextOffset()
+		if next < result.acked {
+			t.Errorf("Lost acknowledged events: %d acknowledged, %d recovered", result.acked, next)
+		}
+		checkCrashEvents(t, b, partition)
+
+		if committed, err := b.offsetManager.GetOffset(crashGroup, "orders", 0); result.committed > 0 && (err != nil || committed < result.committed) {
+			t.Errorf("Lost a committed offset: %d acknowledged, %d recovered (%v)", result.committed, committed, err)
+		}
+		if result.audit && b.GetTopic("audit") == nil {
+			t.Errorf("Lost the audit topic")
+		}
+
+		// The recovered log takes appends where it ends
+		if round == 0 {
+			if offset, err := b.partitionManager.AppendEvent(partition, crashKey(next), crashPayload(next)); err != nil || offset != next {
+				t.Errorf("Expected an append at offset %d after recovery, got %d (%v)", next, offset, err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	// A clean run measures how much the workload writes
+	clean := newFaultFS()
+	if result := runCrashWorkload(t.TempDir(), clean); result.acked != 60 || !result.audit {
+		t.Fatalf("Expected the workload to complete without faults, got %+v", result)
+	}
+	total := clean.bytesWritten()
+
+	// Crash at points spread over the run, and at its very first bytes
+	step := total/97 + 1
+	for crashAt := int64(0); crashAt < total; crashAt += step {
+		for _, powerLoss := range []bool{false, true} {
+			t.Run(fmt.Sprintf("byte-%d/power-loss-%v", crashAt, powerLoss), func(t *testing.T) {
+				dataDir := t.TempDir()
+				fsys := newFaultFS()
+				fsys.crashAfter(crashAt)
+				result := runCrashWorkload(dataDir, fsys)
+				if powerLoss {
+					if err := fsys.powerLoss(); err != nil {
+						t.Fatalf("Power loss failed: %v", err)
+					}
+				}
+				checkCrashRecovery(t, dataDir, result)
+			})
+		}
+	}
+}
+
+func TestWriteFaultsFailCleanly(t *testing.T) {
+	dataDir := t.TempDir()
+
+	fsys := newFaultFS()
+	b := NewBroker(0, dataDir)
+	useFS(b, fsys)
+	b.SetWriteOptions(WriteOptions{Sync: true, SegmentBytes: 512})
+	if err := b.AddTopic("orders", 1); err != nil {
+		t.Fatalf("Failed to add topic: %v", err)
+	}
+	partition, _ := b.GetPartition("orders", 0)
+
+	// Each fault fails one append and makes the partition read-only. Once it
+	// recovers, the next append lands at the offset the failed one would have had
+	faults := map[int64]struct {
+		op    faultOp
+		short int
+		err   error
+	}{
+		3:  {faultWrite, 0, syscall.ENOSPC},
+		7:  {faultWrite, 30, syscall.ENOSPC},
+		11: {faultWrite, 10, io.ErrShortWrite},
+		15: {faultSync, 0, syscall.EIO},
+	}
+	var next int64
+	for i := int64(0); i < 40; i++ {
+		fault, faulty := faults[i]
+		if faulty {
+			fsys.inject(fault.op, "partition-0.log", fault.short, fault.err, 1)
+		}
+		offset, err := b.partitionManager.AppendEvent(partition, crashKey(next), crashPayload(next))
+		if faulty {
+			if !errors.Is(err, fault.err) {
+				t.Errorf("Expected append %d to fail with %v, got %v", i, fault.err, err)
+			}
+			var readOnly *ReadOnlyError
+			if _, err := b.partitionManager.AppendEvent(partition, crashKey(next), crashPayload(next)); !errors.As(err, &readOnly) {
+				t.Errorf("Expected appends after a failed write to be refused, got %v", err)
+			}
+			if err := partition.logStorage.(*LogStorage).recover(); err != nil {
+				t.Fatalf("Recovery failed: %v", err)
+			}
+			continue
+		}
+		if err != nil || offset != next {
+			t.Fatalf("Expected append %d at offset %d, got %d (%v)", i, next, offset, err)
+		}
+		next++
+	}
+	checkCrashEvents(t, b, partition)
+
+	// A commit that fails to save leaves the previous one on disk
+	if err := b.offsetManager.CommitOffset(crashGroup, "orders", 0, 10); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	fsys.inject(faultWrite, "offsets.json", 5, syscall.ENOSPC, 1)
+	if err := b.offsetManager.CommitOffset(crashGroup, "orders", 0, 20); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected the commit to fail with ENOSPC, got %v", err)
+	}
+	fsys.inject(faultSync, "offsets.json", 0, syscall.EIO, 1)
+	if err := b.offsetManager.CommitOffset(crashGroup, "orders", 0, 30); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected the commit to fail with EIO, got %v", err)
+	}
+
+	// Crash before shutdown can save anything, losing whatever wasn't synced
+	fsys.crashAfter(fsys.bytesWritten())
+	b.Close()
+	if err := fsys.powerLoss(); err != nil {
+		t.Fatalf("Power loss failed: %v", err)
+	}
+
+	b = NewBroker(0, dataDir)
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Failed to restart: %v", err)
+	}
+	defer b.Close()
+	partition, _ = b.GetPartition("orders", 0)
+	if recovered := partition.logStorage.NextOffset(); recovered != next {
+		t.Errorf("Expected exactly the %d acknowledged events, recovered %d", next, recovered)
+	}
+	checkCrashEvents(t, b, partition)
+	if committed, err := b.offsetManager.GetOffset(crashGroup, "orders", 0); err != nil || committed != 10 {
+		t.Errorf("Expected committed offset 10 on disk, got %d (%v)", committed, err)
+	}
+}
@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Flag in a record's attributes marking its payload as encrypted; the low bits
+// hold the codec.
+const (
+	attributeEncrypted = 0x08
+	attributeCodecMask = 0x07
+)
+
+// The topic setting choosing whether payloads appended to it are encrypted:
+// "true" or "false" (the default). Records keep the state they were written in.
+const encryptionConfig = "encryption.enabled"
+
+// AES-GCM keys for encrypting partition logs at rest, by ID. New records are
+// sealed with the active key; the others stay loaded to open records written
+// before a rotation.
+type Keyring struct {
+	active uint32
+	keys   map[uint32]cipher.AEAD
+}
+
+// Load a keyfile. It is JSON naming the active key and mapping key IDs to
+// base64-encoded AES keys of 16, 24 or 32 bytes:
+//
+//	{"active": 2, "keys": {"1": "<base64>", "2": "<base64>"}}
+//
+// To rotate, add a key and make it active; keep old keys while records sealed
+// with them remain.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+
+	var keyfile struct {
+		Active uint32            `json:"active"`
+		Keys   map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &keyfile); err != nil {
+		return nil, fmt.Errorf("failed to decode keyfile: %w", err)
+	}
+
+	keyring := &Keyring{active: keyfile.Active, keys: make(map[uint32]cipher.AEAD)}
+	for idStr, encoded := range keyfile.Keys {
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key ID %q in keyfile", idStr)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %d in keyfile: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %d in keyfile: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %d in keyfile: %w", id, err)
+		}
+		keyring.keys[uint32(id)] = aead
+	}
+	if _, ok := keyring.keys[keyring.active]; !ok {
+		return nil, fmt.Errorf("active key %d is not in the keyfile", keyring.active)
+	}
+
+	return keyring, nil
+}
+
+// Encrypt data with the active key.
+// Format: [keyID(4)][nonce(12)][ciphertext and tag]
+func (k *Keyring) seal(data []byte) ([]byte, error) {
+	aead := k.keys[k.active]
+	sealed := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(data)+aead.Overhead())
+	binary.BigEndian.PutUint32(sealed[0:4], k.active)
+	nonce := sealed[4:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(sealed, nonce, data, nil), nil
+}
+
+// Decrypt data sealed with any key in the keyring.
+func (k *Keyring) open(sealed []byte) ([]byte, error) {
+	if k == nil {
+		return nil, errors.New("record is encrypted but no keyfile is loaded")
+	}
+	if len(sealed) < 4 {
+		return nil, errors.New("encrypted payload is truncated")
+	}
+	id := binary.BigEndian.Uint32(sealed[0:4])
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("record is encrypted with key %d, which is not in the keyfile", id)
+	}
+	if len(sealed) < 4+aead.NonceSize() {
+		return nil, errors.New("encrypted payload is truncated")
+	}
+	nonce, ciphertext := sealed[4:4+aead.NonceSize()], sealed[4+aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record with key %d: %w", id, err)
+	}
+	return data, nil
+}
+
+// Copy a serialized plain record with its payload sealed.
+func sealRecord(keys *Keyring, data []byte) ([]byte, error) {
+	_, _, keyLength := recordAttributes(data[16:20])
+	sealed, err := keys.seal(data[24+keyLength:])
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, 24+keyLength, 24+keyLength+len(sealed))
+	copy(record, data[:20+keyLength])
+	record[16] |= attributeEncrypted
+	binary.BigEndian.PutUint32(record[20+keyLength:24+keyLength], uint32(len(sealed)))
+	return append(record, sealed...), nil
+}
+
+// Whether payloads appended to the topic are encrypted.
+func (t *Topic) encrypted() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.Config[encryptionConfig] == "true"
+}
@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example.com/deps/pkg/client"
+)
+
+func TestEncryptedTopic(t *testing.T) {
+	dataDir := t.TempDir()
+	ctx := context.Background()
+	secret := `{"ssn":"123-45-6789"}`
+
+	b, cl := startKeyedBroker(t, dataDir, writeKeyfile(t, 1, 1), "orders", "public")
+	if err := b.SetTopicConfig("public", encryptionConfig, "maybe"); err == nil {
+		t.Errorf("Expected an invalid encryption.enabled to be rejected")
+	}
+	if err := b.SetTopicConfig("orders", encryptionConfig, "true"); err != nil {
+		t.Fatalf("Failed to enable encryption: %v", err)
+	}
+	for _, topic := range []string{"orders", "public"} {
+		if _, err := cl.Publish(ctx, topic, "k", json.RawMessage(secret)); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	if _, err := cl.PublishBatch(ctx, "orders", []client.BatchEvent{{Key: "k", Payload: json.RawMessage(secret)}}, "gzip"); err != nil {
+		t.Fatalf("Batch publish failed: %v", err)
+	}
+
+	// Only the unencrypted topic has the payload on disk
+	for topic, want := range map[string]bool{"orders": false, "public": true} {
+		data, _ := os.ReadFile(filepath.Join(dataDir, topic, "partition-0.log"))
+		if bytes.Contains(data, []byte("123-45-6789")) != want {
+			t.Errorf("%s: expected payload on disk to be %t", topic, want)
+		}
+	}
+
+	// Fetches decrypt, including raw ones
+	for _, options := range []client.FetchOptions{{}, {Raw: true}} {
+		result, err := cl.Fetch(ctx, "orders", 0, 0, options)
+		if err != nil || len(result.Messages) != 2 || string(result.Messages[0].Payload) != secret || string(result.Messages[1].Payload) != secret {
+			t.Errorf("Unexpected fetch with %+v: %+v (%v)", options, result, err)
+		}
+	}
+
+	// After rotating, new records use the new key and old ones still open
+	b.Close()
+	b, cl = startKeyedBroker(t, dataDir, writeKeyfile(t, 2, 1, 2))
+	if _, err := cl.Publish(ctx, "orders", "k", json.RawMessage(secret)); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	partition, _ := b.GetPartition("orders", 0)
+	if id := sealedKeyID(t, partition.logStorage.(*LogStorage), 0); id != 1 {
+		t.Errorf("Expected offset 0 sealed with key 1, got %d", id)
+	}
+	if id := sealedKeyID(t, partition.logStorage.(*LogStorage), 2); id != 2 {
+		t.Errorf("Expected offset 2 sealed with key 2, got %d", id)
+	}
+	if result, err := cl.Fetch(ctx, "orders", 0, 0, client.FetchOptions{}); err != nil || len(result.Messages) != 3 {
+		t.Errorf("Expected 3 messages after rotation, got %+v (%v)", result, err)
+	}
+
+	// Dropping a key that records still use makes them unreadable
+	b.Close()
+	b, cl = startKeyedBroker(t, dataDir, writeKeyfile(t, 2, 2))
+	if _, err := cl.Fetch(ctx, "orders", 0, 0, client.FetchOptions{}); err == nil || !strings.Contains(err.Error(), "key 1") {
+		t.Errorf("Expected fetching records sealed with a dropped key to fail, got %v", err)
+	}
+	if result, err := cl.Fetch(ctx, "orders", 0, 2, client.FetchOptions{}); err != nil || len(result.Messages) != 1 {
+		t.Errorf("Expected the record sealed with key 2 to open, got %+v (%v)", result, err)
+	}
+
+	// An encrypted topic needs a keyfile
+	b.Close()
+	unkeyed := NewBroker(0, dataDir)
+	if err := unkeyed.Listen(); err == nil || !strings.Contains(err.Error(), "no keyfile") {
+		t.Errorf("Expected starting without a keyfile to fail, got %v", err)
+	}
+	unkeyed.Close()
+}
+
+func TestLoadKeyringRejectsMissingActiveKey(t *testing.T) {
+	if _, err := LoadKeyring(writeKeyfile(t, 3, 1, 2)); err == nil {
+		t.Errorf("Expected a keyfile without its active key to be rejected")
+	}
+}
+
+// writeKeyfile writes a keyfile holding the given key IDs, each with a key
+// derived from its ID, and returns its path.
+func writeKeyfile(t *testing.T, active uint32, ids ...uint32) string {
+	t.Helper()
+
+	var keys []string
+	for _, id := range ids {
+		key := bytes.Repeat([]byte{byte(id)}, 32)
+		keys = append(keys, fmt.Sprintf(`"%d": %q`, id, base64.StdEncoding.EncodeToString(key)))
+	}
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data := fmt.Sprintf(`{"active": %d, "keys": {%s}}`, active, strings.Join(keys, ", "))
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write keyfile: %v", err)
+	}
+	return path
+}
+
+// startKeyedBroker starts a broker in dataDir with the keyfile at path, adding the
+// given topics with one partition each, and returns it with a client for it.
+func startKeyedBroker(t *testing.T, dataDir, keyfile string, topics ...string) (*Broker, *client.Client) {
+	t.Helper()
+
+	keys, err := LoadKeyring(keyfile)
+	if err != nil {
+		t.Fatalf("Failed to load keyfile: %v", err)
+	}
+	b := NewBroker(0, dataDir)
+	b.SetKeyring(keys)
+	for _, topic := range topics {
+		if err := b.AddTopic(topic, 1); err != nil {
+			t.Fatalf("Failed to add topic: %v", err)
+		}
+	}
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	go b.Serve()
+	t.Cleanup(func() { b.Close() })
+
+	return b, client.New(fmt.Sprintf("127.0.0.1:%d", b.Addr().(*net.TCPAddr).Port))
+}
+
+// sealedKeyID returns the ID of the key the plain record at offset was sealed with.
+func sealedKeyID(t *testing.T, storage *LogStorage, offset int64) uint32 {
+	t.Helper()
+
+	section, _, _, err := storage.Section(offset, 1)
+	if err != nil {
+		t.Fatalf("Failed to locate offset %d: %v", offset, err)
+	}
+	record := make([]byte, section.Size())
+	section.ReadAt(record, 0)
+	_, encrypted, keyLength := recordAttributes(record[16:20])
+	if !encrypted {
+		t.Fatalf("Offset %d is not encrypted", offset)
+	}
+	return binary.BigEndian.Uint32(record[24+keyLength : 28+keyLength])
+}
@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// The error appends to a read-only partition fail with. A partition becomes
+// read-only when writing or syncing its log fails, typically because the disk is
+// full or failing: the partial batch is cut off and no further appends are tried
+// until recover finds that the disk takes writes again. Reads carry on.
+type ReadOnlyError struct {
+	// the write or sync that failed
+	Err   error
+	Since time.Time
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("partition is read-only since a write failed: %v", e.Err)
+}
+
+func (e *ReadOnlyError) Unwrap() error {
+	return e.Err
+}
+
+// How often read-only partitions are checked for recovery, unless
+// WriteOptions.RecoveryInterval says otherwise.
+const defaultRecoveryInterval = 5 * time.Second
+
+// Size of the file a read-only partition writes to check that the disk has room
+// again.
+const probeBytes = 64 << 10
+
+// The failed write that made the log read-only, or nil while it takes appends.
+func (l *LogStorage) ReadOnly() *ReadOnlyError {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.failure
+}
+
+// Take appends again once the disk does: a probe file is written and synced next
+// to the log, then the active file is cut back to its last whole record, in case
+// undoing the failed write failed too. Returns why it is still read-only.
+func (l *LogStorage) recover() error {
+	if l.ReadOnly() == nil {
+		return nil
+	}
+
+	probe := l.path + ".probe"
+	err := writeFileAtomic(l.fs, probe, func(out io.Writer) error {
+		_, err := out.Write(make([]byte, probeBytes))
+		return err
+	})
+	l.fs.Remove(probe)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Truncate(l.offset); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.failure = nil
+	return nil
+}
+
+// A partition that takes no appends, as /health and /metadata report it.
+type ReadOnlyPartition struct {
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Error     string    `json:"error"`
+	Since     time.Time `json:"since"`
+}
+
+// The partitions made read-only by failed writes, by topic and partition. The
+// broker is degraded while there are any.
+func (b *Broker) ReadOnlyPartitions() []ReadOnlyPartition {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var partitions []ReadOnlyPartition
+	for _, topic := range b.topics {
+		for _, partition := range topic.Partitions {
+			if partition.logStorage == nil {
+				continue
+			}
+			if failure := partition.logStorage.ReadOnly(); failure != nil {
+				partitions = append(partitions, ReadOnlyPartition{
+					Topic:     partition.Topic,
+					Partition: partition.ID,
+					Error:     failure.Err.Error(),
+					Since:     failure.Since,
+				})
+			}
+		}
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].Topic != partitions[j].Topic {
+			return partitions[i].Topic < partitions[j].Topic
+		}
+		return partitions[i].Partition < partitions[j].Partition
+	})
+	return partitions
+}
+
+// Try to recover read-only partitions each interval until the broker stops.
+func (b *Broker) runRecovery() {
+	defer b.background.Done()
+
+	interval := b.writeOptions.RecoveryInterval
+	if interval <= 0 {
+		interval = defaultRecoveryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+			b.recoverPartitions()
+		}
+	}
+}
+
+// Try once to recover every read-only partition, logging those that do.
+func (b *Broker) recoverPartitions() {
+	b.mu.RLock()
+	var partitions []*Partition
+	for _, topic := range b.topics {
+		for _, partition := range topic.Partitions {
+			if partition.logStorage != nil && partition.logStorage.ReadOnly() != nil {
+				partitions = append(partitions, partition)
+			}
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, partition := range partitions {
+		storage, ok := partition.logStorage.(*LogStorage)
+		if !ok {
+			continue
+		}
+		if err := storage.recover(); err == nil {
+			log.Printf("Partition %d of topic %s is writable again", partition.ID, partition.Topic)
+		}
+	}
+}
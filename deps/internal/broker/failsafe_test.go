@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDiskFullMakesPartitionReadOnly(t *testing.T) {
+	fsys := newFaultFS()
+	b := NewBroker(0, t.TempDir())
+	useFS(b, fsys)
+	b.SetWriteOptions(WriteOptions{RecoveryInterval: 10 * time.Millisecond})
+	if err := b.AddTopic("orders", 2); err != nil {
+		t.Fatalf("Failed to add topic: %v", err)
+	}
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	defer b.Close()
+	mux := NewHTTPServer(b, 0).mux
+	get := func(path string, v any) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode %s: %v", path, err)
+		}
+	}
+	type health struct {
+		Status             string              `json:"status"`
+		ReadOnlyPartitions []ReadOnlyPartition `json:"readOnlyPartitions"`
+	}
+
+	full, _ := b.GetPartition("orders", 0)
+	other, _ := b.GetPartition("orders", 1)
+	for i := int64(0); i < 3; i++ {
+		if _, err := b.partitionManager.AppendEvent(full, crashKey(i), crashPayload(i)); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	// The disk fills up halfway through a write to partition 0, and stays full
+	fsys.inject(faultWrite, "orders/partition-0", 11, syscall.ENOSPC, -1)
+	fsys.inject(faultWrite, ".probe", 0, syscall.ENOSPC, -1)
+	var readOnly *ReadOnlyError
+	if _, err := b.partitionManager.AppendEvent(full, crashKey(3), crashPayload(3)); !errors.As(err, &readOnly) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected a read-only error for ENOSPC, got %v", err)
+	}
+
+	// Publishes to it are refused with 507, while the rest of the broker carries on
+	key := "a"
+	for partition, _ := b.partitionManager.RouteEvent("orders", key); partition != full; partition, _ = b.partitionManager.RouteEvent("orders", key) {
+		key += "a"
+	}
+	body, _ := json.Marshal(Event{Key: key, Payload: map[string]interface{}{"n": 3}})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/topics/events?topic=orders", bytes.NewReader(body)))
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 Insufficient Storage, got %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := b.partitionManager.AppendEvent(other, "k", []byte(`{}`)); err != nil {
+		t.Errorf("Expected the other partition to take appends, got %v", err)
+	}
+	checkCrashEvents(t, b, full)
+
+	var status health
+	get("/health", &status)
+	if status.Status != "degraded" || len(status.ReadOnlyPartitions) != 1 || status.ReadOnlyPartitions[0].Partition != 0 {
+		t.Errorf("Expected a degraded broker with partition 0 read-only, got %+v", status)
+	}
+	var metadata struct {
+		Topics []struct {
+			Name               string `json:"name"`
+			ReadOnlyPartitions []int  `json:"readOnlyPartitions"`
+		} `json:"topics"`
+	}
+	get("/metadata", &metadata)
+	if len(metadata.Topics) != 1 || len(metadata.Topics[0].ReadOnlyPartitions) != 1 {
+		t.Errorf("Expected metadata to list partition 0 as read-only, got %+v", metadata)
+	}
+
+	// Stays read-only while the disk is full, and recovers once space frees up
+	time.Sleep(50 * time.Millisecond)
+	if full.logStorage.ReadOnly() == nil {
+		t.Fatalf("Expected the partition to stay read-only while the disk is full")
+	}
+	fsys.clearFaults()
+	deadline := time.Now().Add(5 * time.Second)
+	for full.logStorage.ReadOnly() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	get("/health", &status)
+	if status.Status != "healthy" {
+		t.Fatalf("Expected the broker to recover, got %+v", status)
+	}
+	if offset, err := b.partitionManager.AppendEvent(full, crashKey(3), crashPayload(3)); err != nil || offset != 3 {
+		t.Errorf("Expected the next append at offset 3, got %d (%v)", offset, err)
+	}
+	checkCrashEvents(t, b, full)
+}
@@ -0,0 +1,310 @@
+package broker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A fileSystem over the real one that injects faults into writes and syncs, and
+// can crash: once crashAt bytes have been written through it, the write that
+// reaches that point is cut short and every later operation fails, as if the
+// process had died there.
+//
+// It also models what a power loss keeps. Bytes written to a file since its last
+// successful sync may be lost, so powerLoss cuts every file written through it back
+// to its synced length. Renames and removals are taken to be durable at once.
+type faultFS struct {
+	mu      sync.Mutex
+	inodes  map[string]*faultInode // files written through it, by current name
+	written int64                  // bytes written through it
+	crashAt int64                  // crash once this many bytes are written; -1 never
+	crashed bool
+	faults  []*fault
+}
+
+// A file written through a faultFS, tracked across renames.
+type faultInode struct {
+	name   string
+	synced int64 // length known to be on stable storage
+}
+
+// A fault injected into the next count operations op on files whose name contains
+// match, or every one until cleared if count is negative. A failed write writes
+// short bytes first.
+type fault struct {
+	op    faultOp
+	match string
+	short int
+	err   error
+	count int
+}
+
+type faultOp int
+
+const (
+	faultWrite faultOp = iota
+	faultSync
+)
+
+var errCrashed = errors.New("crashed")
+
+func newFaultFS() *faultFS {
+	return &faultFS{inodes: make(map[string]*faultInode), crashAt: -1}
+}
+
+// Fail the next count writes or syncs of files whose name contains match with err.
+func (f *faultFS) inject(op faultOp, match string, short int, err error, count int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault{op: op, match: match, short: short, err: err, count: count})
+}
+
+// Remove every injected fault, as if the disk had recovered.
+func (f *faultFS) clearFaults() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+// Crash once n bytes in total have been written.
+func (f *faultFS) crashAfter(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashAt = n
+}
+
+// Bytes written through it so far.
+func (f *faultFS) bytesWritten() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.written
+}
+
+// Drop every byte not synced, as a power loss after the crash would.
+func (f *faultFS) powerLoss() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, inode := range f.inodes {
+		info, err := os.Stat(inode.name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if info.Size() > inode.synced {
+			if err := os.Truncate(inode.name, inode.synced); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The injected fault for op on name, if any. mu must be held.
+func (f *faultFS) fault(op faultOp, name string) *fault {
+	for i, fault := range f.faults {
+		if fault.op == op && strings.Contains(name, fault.match) {
+			if fault.count--; fault.count == 0 {
+				f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			}
+			return fault
+		}
+	}
+	return nil
+}
+
+func (f *faultFS) check() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return errCrashed
+	}
+	return nil
+}
+
+func (f *faultFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	var synced int64
+	if info, err := os.Stat(name); err == nil && flag&os.O_TRUNC == 0 {
+		synced = info.Size() // written before, and so durable as far as we know
+	}
+	osFile, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &faultFile{File: osFile, fs: f}, nil
+	}
+	return &faultFile{File: osFile, fs: f, inode: f.track(name, synced)}, nil
+}
+
+func (f *faultFS) CreateTemp(dir, pattern string) (file, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	osFile, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: osFile, fs: f, inode: f.track(osFile.Name(), 0)}, nil
+}
+
+func (f *faultFS) track(name string, synced int64) *faultInode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	inode, ok := f.inodes[name]
+	if !ok {
+		inode = &faultInode{name: name, synced: synced}
+		f.inodes[name] = inode
+	}
+	return inode
+}
+
+func (f *faultFS) ReadFile(name string) ([]byte, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(name)
+}
+
+func (f *faultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return os.Stat(name)
+}
+
+func (f *faultFS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return errCrashed
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	delete(f.inodes, newpath)
+	if inode, ok := f.inodes[oldpath]; ok {
+		delete(f.inodes, oldpath)
+		inode.name = newpath
+		f.inodes[newpath] = inode
+	}
+	return nil
+}
+
+func (f *faultFS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return errCrashed
+	}
+	delete(f.inodes, name)
+	return os.Remove(name)
+}
+
+func (f *faultFS) RemoveAll(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return errCrashed
+	}
+	for name := range f.inodes {
+		if name == path || strings.HasPrefix(name, path+string(filepath.Separator)) {
+			delete(f.inodes, name)
+		}
+	}
+	return os.RemoveAll(path)
+}
+
+func (f *faultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return os.MkdirAll(path, perm)
+}
+
+// A file opened through a faultFS; inode is nil for files only read.
+type faultFile struct {
+	*os.File
+	fs    *faultFS
+	inode *faultInode
+}
+
+// The file's current name, which a rename since it was opened changes.
+func (f *faultFile) name() string {
+	if f.inode != nil {
+		return f.inode.name
+	}
+	return f.Name()
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.crashed {
+		return 0, errCrashed
+	}
+
+	n, err := len(p), error(nil)
+	if f.fs.crashAt >= 0 && f.fs.written+int64(n) >= f.fs.crashAt {
+		n, err = int(f.fs.crashAt-f.fs.written), errCrashed
+		f.fs.crashed = true
+	} else if fault := f.fs.fault(faultWrite, f.name()); fault != nil {
+		n, err = min(fault.short, n), fault.err
+	}
+	written, writeErr := f.File.Write(p[:n])
+	f.fs.written += int64(written)
+	if writeErr != nil {
+		return written, writeErr
+	}
+	return written, err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.crashed {
+		return errCrashed
+	}
+	if fault := f.fs.fault(faultSync, f.name()); fault != nil {
+		return fault.err
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	if f.inode != nil {
+		info, err := f.File.Stat()
+		if err != nil {
+			return err
+		}
+		f.inode.synced = info.Size()
+	}
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.crashed {
+		return errCrashed
+	}
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	if f.inode != nil {
+		f.inode.synced = min(f.inode.synced, size)
+	}
+	return nil
+}
+
+func (f *faultFile) Chmod(mode os.FileMode) error {
+	if err := f.fs.check(); err != nil {
+		return err
+	}
+	return f.File.Chmod(mode)
+}
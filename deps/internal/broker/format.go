@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Version of the on-disk format the broker reads and writes: the header of every
+// partition log and the "version" field of metadata.json and offsets.json.
+//
+// Version 1 is the format from before it was versioned: logs start with their
+// first record, and metadata.json and offsets.json hold bare maps. Version 2 adds
+// the version markers; the records themselves are unchanged. Version 3 lets a
+// partition's log be split into sealed segments, listed in
+// partition-{id}.segments.json, which older brokers would not read. Use Migrate
+// to upgrade a data directory.
+const FormatVersion = 3
+
+// Every log starts with an 8 byte header: [magic "DEPS"(4)][version(4)].
+const (
+	logMagic      = "DEPS"
+	logHeaderSize = 8
+)
+
+// Error for a data file in a format version the broker doesn't use.
+type FormatVersionError struct {
+	Path    string
+	Version int
+}
+
+func (e *FormatVersionError) Error() string {
+	name := e.Path
+	if name == "" {
+		name = "log"
+	}
+	if e.Version < FormatVersion {
+		return fmt.Sprintf("%s is in format version %d, but this broker uses version %d; stop the broker and run depslog migrate on its data directory",
+			name, e.Version, FormatVersion)
+	}
+	return fmt.Sprintf("%s is in format version %d, which is newer than this broker supports (version %d)",
+		name, e.Version, FormatVersion)
+}
+
+func logHeader() []byte {
+	header := make([]byte, logHeaderSize)
+	copy(header, logMagic)
+	binary.BigEndian.PutUint32(header[4:8], FormatVersion)
+	return header
+}
+
+// Read the format version from the first bytes of a log. A log without the magic
+// predates versioning and is version 1; an empty one is new, in the current version.
+// The first record of a version 1 log starts with its offset, which can't spell
+// the magic.
+func logVersion(header []byte) int {
+	if len(header) == 0 {
+		return FormatVersion
+	}
+	if len(header) < logHeaderSize || !bytes.Equal(header[:4], []byte(logMagic)) {
+		return 1
+	}
+	return int(binary.BigEndian.Uint32(header[4:8]))
+}
+
+// Check the header of a log file opened for appending, writing it if the file is
+// new. A header cut short by a crash while the file was created is rewritten.
+func prepareLogHeader(file file, path string) error {
+	header := make([]byte, logHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if n < logHeaderSize && bytes.Equal(header[:n], logHeader()[:n]) {
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Write(logHeader()); err != nil {
+			return err
+		}
+		return nil
+	}
+	if version := logVersion(header[:n]); version != FormatVersion {
+		return &FormatVersionError{Path: path, Version: version}
+	}
+	return nil
+}
+
+// metadata.json: the topics by name.
+type metadataFile struct {
+	Version int               `json:"version"`
+	Topics  map[string]*Topic `json:"topics"`
+}
+
+// offsets.json: committed offsets by "consumerGroup-topic-partition".
+type offsetsFile struct {
+	Version int              `json:"version"`
+	Offsets map[string]int64 `json:"offsets"`
+}
+
+// Read the format version of metadata.json or offsets.json. Version 1 files are a
+// bare map, whose keys are topic names or offset keys; later ones have a numeric
+// "version" field, which a topic named "version" can't be mistaken for.
+func jsonVersion(data []byte) (int, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return 0, err
+	}
+	var version int
+	if raw, ok := fields["version"]; ok && json.Unmarshal(raw, &version) == nil {
+		return version, nil
+	}
+	return 1, nil
+}
+
+// Decode metadata.json or offsets.json into v, which must be the file's struct,
+// if it is in the current format version.
+func decodeVersioned(path string, data []byte, v any) error {
+	version, err := jsonVersion(data)
+	if err != nil {
+		return err
+	}
+	if version != FormatVersion {
+		return &FormatVersionError{Path: path, Version: version}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Check that the metadata.json or offsets.json at path, if there is one, is in the
+// current format version, so a broker never overwrites a file it couldn't load.
+func checkOverwrite(fsys fileSystem, path string) error {
+	data, err := fsys.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	version, err := jsonVersion(data)
+	if err != nil {
+		return fmt.Errorf("%s is unreadable, not overwriting it: %w", path, err)
+	}
+	if version != FormatVersion {
+		return &FormatVersionError{Path: path, Version: version}
+	}
+	return nil
+}
@@ -1,17 +1,32 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 )
 
+// Upper bound on how long a long-polling fetch may be held open.
+const maxFetchWait = 30 * time.Second
+
 // wrap the broker and exposes it via HTTP endpoints.
 type HTTPServer struct {
-	broker *Broker
-	mux    *http.ServeMux
-	port   int
+	broker   *Broker
+	mux      *http.ServeMux
+	port     int
+	listener net.Listener
+	server   *http.Server
+
+	// upgraded WebSocket connections
+	websockets connSet
 }
 
 // New HTTP server for the broker.
@@ -38,25 +53,62 @@ func (s *HTTPServer) registerRoutes() {
 
 	// Producer: publish events to a topic
 	s.mux.HandleFunc("/topics/events", s.handlePublishEvent)
+	s.mux.HandleFunc("/topics/events/batch", s.handlePublishBatch)
+
+	// Topic settings, such as compression.type
+	s.mux.HandleFunc("/topics/config", s.handleTopicConfig)
 
 	// Consumer: fetch messages from a partition
 	s.mux.HandleFunc("/messages", s.handleFetchMessages)
 
-	// Consumer group management: commit offsets
+	// Consumer: stream messages as Server-Sent Events
+	s.mux.HandleFunc("/topics/stream", s.handleStream)
+
+	// Publish and subscribe over a WebSocket connection
+	s.mux.HandleFunc("/ws", s.handleWebSocket)
+
+	// Partition offsets: earliest and next offset of a partition
+	s.mux.HandleFunc("/topics/offsets", s.handlePartitionOffsets)
+
+	// Offsets by time: the first offset at or after a time in each partition
+	s.mux.HandleFunc("/topics/offsets/by-time", s.handleOffsetsForTime)
+
+	// Tail cache: contents and hit/miss counts per partition
+	s.mux.HandleFunc("/topics/cache", s.handleCacheStats)
+
+	// Consumer group management: commit and fetch offsets
 	s.mux.HandleFunc("/consumer-groups/offsets/commit", s.handleCommitOffset)
+	s.mux.HandleFunc("/consumer-groups/offsets", s.handleFetchOffset)
+
+	// Consumer group membership: join, heartbeat, leave
+	s.mux.HandleFunc("/consumer-groups/join", s.handleJoinGroup)
+	s.mux.HandleFunc("/consumer-groups/heartbeat", s.handleHeartbeat)
+	s.mux.HandleFunc("/consumer-groups/leave", s.handleLeaveGroup)
+
+	// Admin: point-in-time snapshot of every log, the metadata and offsets
+	s.mux.HandleFunc("/admin/snapshot", s.handleSnapshot)
 }
 
-// return the server status.
+// return the server status: "healthy", or "degraded" while partitions are
+// read-only after failed writes, listing them. Either way the broker serves
+// reads, so the status code is 200.
 func (s *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	type HealthResponse struct {
+		Status             string              `json:"status"`
+		ReadOnlyPartitions []ReadOnlyPartition `json:"readOnlyPartitions,omitempty"`
+	}
+	response := HealthResponse{Status: "healthy", ReadOnlyPartitions: s.broker.ReadOnlyPartitions()}
+	if len(response.ReadOnlyPartitions) > 0 {
+		response.Status = "degraded"
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "healthy",
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
 // return information about all topics and their partitions.
@@ -66,6 +118,11 @@ func (s *HTTPServer) handleMetadata(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	readOnly := make(map[string][]int)
+	for _, partition := range s.broker.ReadOnlyPartitions() {
+		readOnly[partition.Topic] = append(readOnly[partition.Topic], partition.Partition)
+	}
+
 	s.broker.mu.RLock()
 	defer s.broker.mu.RUnlock()
 
@@ -73,6 +130,9 @@ func (s *HTTPServer) handleMetadata(w http.ResponseWriter, r *http.Request) {
 	type TopicInfo struct {
 		Name       string `json:"name"`
 		Partitions int    `json:"partitions"`
+
+		// partitions refusing publishes after a failed write
+		ReadOnlyPartitions []int `json:"readOnlyPartitions,omitempty"`
 	}
 
 	type MetadataResponse struct {
@@ -82,8 +142,9 @@ func (s *HTTPServer) handleMetadata(w http.ResponseWriter, r *http.Request) {
 	topics := make([]TopicInfo, 0, len(s.broker.topics))
 	for _, topic := range s.broker.topics {
 		topics = append(topics, TopicInfo{
-			Name:       topic.Name,
-			Partitions: topic.NumPartitions,
+			Name:               topic.Name,
+			Partitions:         topic.NumPartitions,
+			ReadOnlyPartitions: readOnly[topic.Name],
 		})
 	}
 
@@ -122,15 +183,9 @@ func (s *HTTPServer) handlePublishEvent(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	storedEvent := &StoredEvent{
-		Offset:    partition.currentOffset,
-		Timestamp: time.Now().UnixNano(),
-		Key:       event.Key,
-		Payload:   payloadBytes,
-	}
-	offset, err := partition.logStorage.Append(storedEvent)
+	offset, err := s.broker.partitionManager.AppendEvent(partition, event.Key, payloadBytes)
 	if err != nil {
-		http.Error(w, "Failed to append event", http.StatusInternalServerError)
+		appendError(w, err, "Failed to append event")
 		return
 	}
 
@@ -142,6 +197,154 @@ func (s *HTTPServer) handlePublishEvent(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(response)
 }
 
+// Reply to a failed append: 507 Insufficient Storage with the cause while the
+// partition is read-only, so producers can tell it from other failures and retry
+// later, and 500 with message otherwise.
+func appendError(w http.ResponseWriter, err error, message string) {
+	status, message := appendErrorStatus(err, message)
+	http.Error(w, message, status)
+}
+
+// The status and message a failed append is reported with.
+func appendErrorStatus(err error, message string) (int, string) {
+	var readOnly *ReadOnlyError
+	if errors.As(err, &readOnly) {
+		return http.StatusInsufficientStorage, readOnly.Error()
+	}
+	return http.StatusInternalServerError, message
+}
+
+// Handle publishing a batch of events to a topic. The body is a JSON array of
+// events, optionally compressed as given by Content-Encoding; the events of each
+// partition are stored together, compressed the same way unless the topic's
+// compression.type overrides it. Partitions are appended to one by one, so if some
+// fail and others don't the response is 207 Multi-Status, with the status and
+// error of each event not stored, and only those should be sent again. A body
+// larger than the broker's batch limit, as sent or decompressed, is refused with
+// 413 Request Entity Too Large.
+func (s *HTTPServer) handlePublishBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		http.Error(w, "Missing topic", http.StatusBadRequest)
+		return
+	}
+
+	codec, err := contentEncodingCodec(r.Header.Get("Content-Encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	limit := s.broker.maxBatchBytes
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	body, err := decompressReader(codec, r.Body)
+	if err != nil {
+		batchBodyError(w, err, "Invalid compressed body")
+		return
+	}
+	defer body.Close()
+	if limit > 0 {
+		// A few compressed bytes can expand to far more
+		body = http.MaxBytesReader(w, body, limit)
+	}
+
+	var events []Event
+	if err := json.NewDecoder(body).Decode(&events); err != nil {
+		batchBodyError(w, err, "Invalid batch format")
+		return
+	}
+	if len(events) == 0 {
+		http.Error(w, "Empty batch", http.StatusBadRequest)
+		return
+	}
+
+	// Group the events by partition, keeping their order within each
+	type partitionBatch struct {
+		partition *Partition
+		events    []*StoredEvent
+		indexes   []int
+	}
+	var batches []*partitionBatch
+	byPartition := make(map[*Partition]*partitionBatch)
+	for i, event := range events {
+		partition, err := s.broker.partitionManager.RouteEvent(topic, event.Key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		payloadBytes, err := json.Marshal(event.Payload)
+		if err != nil {
+			http.Error(w, "Failed to serialize payload", http.StatusInternalServerError)
+			return
+		}
+
+		batch, ok := byPartition[partition]
+		if !ok {
+			batch = &partitionBatch{partition: partition}
+			byPartition[partition] = batch
+			batches = append(batches, batch)
+		}
+		batch.events = append(batch.events, &StoredEvent{Key: event.Key, Payload: payloadBytes})
+		batch.indexes = append(batch.indexes, i)
+	}
+
+	type publishResult struct {
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`           // -1 if not stored
+		Status    int    `json:"status,omitempty"` // why not, as for a whole request
+		Error     string `json:"error,omitempty"`
+	}
+	results := make([]publishResult, len(events))
+	var stored int
+	var failure error
+	for _, batch := range batches {
+		offset, err := s.broker.partitionManager.AppendEvents(batch.partition, batch.events, codec)
+		if err != nil {
+			failure = err
+			status, message := appendErrorStatus(err, "Failed to append events")
+			for _, index := range batch.indexes {
+				results[index] = publishResult{Partition: batch.partition.ID, Offset: -1, Status: status, Error: message}
+			}
+			continue
+		}
+		stored++
+		for i, index := range batch.indexes {
+			results[index] = publishResult{Partition: batch.partition.ID, Offset: offset + int64(i)}
+		}
+	}
+	if stored == 0 {
+		// Nothing was stored, so the whole batch can be sent again
+		appendError(w, failure, "Failed to append events")
+		return
+	}
+
+	response := map[string]interface{}{
+		"results": results,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if failure != nil {
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Answer a batch body that couldn't be read: 413 if it was over the limit, and
+// 400 with message otherwise.
+func batchBodyError(w http.ResponseWriter, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Batch larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, message, http.StatusBadRequest)
+}
+
 // handleFetchMessages handles fetching messages from a partition.
 func (s *HTTPServer) handleFetchMessages(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -153,11 +356,24 @@ func (s *HTTPServer) handleFetchMessages(w http.ResponseWriter, r *http.Request)
 	partitionStr := r.URL.Query().Get("partition")
 	offsetStr := r.URL.Query().Get("offset")
 	maxBytesStr := r.URL.Query().Get("maxBytes")
+	format := r.URL.Query().Get("format")
 
 	if topic == "" || partitionStr == "" || offsetStr == "" {
 		http.Error(w, "Missing required parameters: topic, partition, offset", http.StatusBadRequest)
 		return
 	}
+	if format != "" && format != "json" && format != "raw" {
+		http.Error(w, "Invalid format (use json or raw)", http.StatusBadRequest)
+		return
+	}
+	decompress := false
+	if decompressStr := r.URL.Query().Get("decompress"); decompressStr != "" {
+		var err error
+		if decompress, err = strconv.ParseBool(decompressStr); err != nil {
+			http.Error(w, "Invalid decompress", http.StatusBadRequest)
+			return
+		}
+	}
 
 	var partitionID int
 	var startOffset int64
@@ -181,6 +397,27 @@ func (s *HTTPServer) handleFetchMessages(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	// Long polling: hold the request until minBytes are available or maxWait (ms) expires
+	minBytes := 1
+	if minBytesStr := r.URL.Query().Get("minBytes"); minBytesStr != "" {
+		if _, err := fmt.Sscanf(minBytesStr, "%d", &minBytes); err != nil || minBytes < 0 {
+			http.Error(w, "Invalid minBytes", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var maxWaitMs int
+	if maxWaitStr := r.URL.Query().Get("maxWait"); maxWaitStr != "" {
+		if _, err := fmt.Sscanf(maxWaitStr, "%d", &maxWaitMs); err != nil || maxWaitMs < 0 {
+			http.Error(w, "Invalid maxWait", http.StatusBadRequest)
+			return
+		}
+	}
+	maxWait := time.Duration(maxWaitMs) * time.Millisecond
+	if maxWait > maxFetchWait {
+		maxWait = maxFetchWait
+	}
+
 	t := s.broker.GetTopic(topic)
 	if t == nil {
 		http.Error(w, "Topic not found", http.StatusNotFound)
@@ -193,12 +430,27 @@ func (s *HTTPServer) handleFetchMessages(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if maxWait > 0 {
+		s.broker.partitionManager.WaitForEvents(r.Context(), partition, startOffset, minBytes, maxWait)
+	}
+
+	// The stored bytes of encrypted records never leave the broker
+	if format == "raw" && !decompress && !partition.logStorage.Encrypted() {
+		s.writeRawMessages(w, partition, startOffset, maxBytes)
+		return
+	}
+
 	events, err := s.broker.partitionManager.FetchEvents(partition, startOffset, maxBytes)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if format == "raw" {
+		s.writeDecompressedMessages(w, events, startOffset)
+		return
+	}
+
 	response := map[string]interface{}{
 		"topic":     topic,
 		"partition": partitionID,
@@ -208,6 +460,43 @@ func (s *HTTPServer) handleFetchMessages(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(response)
 }
 
+// Send records as they are stored in the log, copied straight from the file.
+// Offsets are positional: the records are X-Deps-First-Offset onwards, which is
+// before the requested offset when it falls inside a compressed batch.
+func (s *HTTPServer) writeRawMessages(w http.ResponseWriter, partition *Partition, startOffset int64, maxBytes int) {
+	section, first, count, err := s.broker.partitionManager.FetchRaw(partition, startOffset, maxBytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(section.Size(), 10))
+	w.Header().Set("X-Deps-First-Offset", strconv.FormatInt(first, 10))
+	w.Header().Set("X-Deps-Record-Count", strconv.Itoa(count))
+	io.Copy(w, section)
+}
+
+// Send events in the raw format as plain records, for clients that can't
+// decompress batches themselves and for logs holding encrypted records.
+func (s *HTTPServer) writeDecompressedMessages(w http.ResponseWriter, events []*StoredEvent, startOffset int64) {
+	var body []byte
+	for _, event := range events {
+		record, err := serializeEvent(event)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = append(body, record...)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("X-Deps-First-Offset", strconv.FormatInt(startOffset, 10))
+	w.Header().Set("X-Deps-Record-Count", strconv.Itoa(len(events)))
+	w.Write(body)
+}
+
 // handleCommitOffset handles committing offsets for a consumer group.
 func (s *HTTPServer) handleCommitOffset(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -244,11 +533,384 @@ func (s *HTTPServer) handleCommitOffset(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(response)
 }
 
+// handleFetchOffset returns the last committed offset for a consumer group.
+func (s *HTTPServer) handleFetchOffset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	consumerGroup := r.URL.Query().Get("group")
+	topic := r.URL.Query().Get("topic")
+	partitionStr := r.URL.Query().Get("partition")
+
+	if consumerGroup == "" || topic == "" || partitionStr == "" {
+		http.Error(w, "Missing required parameters: group, topic, partition", http.StatusBadRequest)
+		return
+	}
+
+	var partitionID int
+	if _, err := fmt.Sscanf(partitionStr, "%d", &partitionID); err != nil {
+		http.Error(w, "Invalid partition ID", http.StatusBadRequest)
+		return
+	}
+
+	offset, err := s.broker.offsetManager.GetOffset(consumerGroup, topic, partitionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"group":     consumerGroup,
+		"topic":     topic,
+		"partition": partitionID,
+		"offset":    offset,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handlePartitionOffsets returns the earliest offset and the next offset to be written for a partition.
+func (s *HTTPServer) handlePartitionOffsets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	partitionStr := r.URL.Query().Get("partition")
+
+	if topic == "" || partitionStr == "" {
+		http.Error(w, "Missing required parameters: topic, partition", http.StatusBadRequest)
+		return
+	}
+
+	var partitionID int
+	if _, err := fmt.Sscanf(partitionStr, "%d", &partitionID); err != nil {
+		http.Error(w, "Invalid partition ID", http.StatusBadRequest)
+		return
+	}
+
+	partition, err := s.broker.GetPartition(topic, partitionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"topic":       topic,
+		"partition":   partitionID,
+		"startOffset": 0,
+		"endOffset":   partition.logStorage.NextOffset(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleOffsetsForTime returns, for every partition of a topic, the first offset
+// whose event is stamped at or after the RFC 3339 time given, to replay from.
+func (s *HTTPServer) handleOffsetsForTime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	timeStr := r.URL.Query().Get("time")
+	if topic == "" || timeStr == "" {
+		http.Error(w, "Missing required parameters: topic, time", http.StatusBadRequest)
+		return
+	}
+	at, err := time.Parse(time.RFC3339Nano, timeStr)
+	if err != nil {
+		http.Error(w, "Invalid time, expected RFC 3339: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.broker.GetTopic(topic) == nil {
+		http.Error(w, "Topic not found", http.StatusNotFound)
+		return
+	}
+	offsets, err := s.broker.OffsetsForTime(topic, at)
+	if err != nil {
+		http.Error(w, "Failed to look up offsets: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"topic":      topic,
+		"time":       at,
+		"partitions": offsets,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleCacheStats reports the tail cache of every partition of a topic.
+func (s *HTTPServer) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		http.Error(w, "Missing required parameter: topic", http.StatusBadRequest)
+		return
+	}
+
+	t := s.broker.GetTopic(topic)
+	if t == nil {
+		http.Error(w, "Topic not found", http.StatusNotFound)
+		return
+	}
+
+	stats := make([]CacheStats, 0, len(t.Partitions))
+	for partitionID := 0; partitionID < t.NumPartitions; partitionID++ {
+		if partition, ok := t.Partitions[partitionID]; ok {
+			stats = append(stats, partition.cacheStats())
+		}
+	}
+
+	response := map[string]interface{}{
+		"topic":      topic,
+		"partitions": stats,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleTopicConfig returns a topic's settings, or on POST changes the settings
+// given as a JSON object and returns the result.
+func (s *HTTPServer) handleTopicConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		http.Error(w, "Missing required parameter: topic", http.StatusBadRequest)
+		return
+	}
+	if s.broker.GetTopic(topic) == nil {
+		http.Error(w, "Topic not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var settings map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		for key, value := range settings {
+			if err := s.broker.SetTopicConfig(topic, key, value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	response := map[string]interface{}{
+		"topic":  topic,
+		"config": s.broker.TopicConfig(topic),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleSnapshot takes a snapshot into the named subdirectory of the broker's
+// snapshot directory and returns its manifest.
+func (s *HTTPServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.broker.snapshotDir == "" {
+		http.Error(w, "Snapshots are disabled; start the broker with a snapshot directory", http.StatusNotFound)
+		return
+	}
+
+	// A plain name, so snapshots stay inside the snapshot directory
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing required parameter: name", http.StatusBadRequest)
+		return
+	}
+	if !filepath.IsLocal(name) || filepath.Base(name) != name {
+		http.Error(w, "Invalid snapshot name", http.StatusBadRequest)
+		return
+	}
+
+	dir := filepath.Join(s.broker.snapshotDir, name)
+	if _, err := os.Stat(dir); err == nil {
+		http.Error(w, "Snapshot already exists", http.StatusConflict)
+		return
+	}
+	manifest, err := s.broker.Snapshot(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"name":      name,
+		"path":      dir,
+		"createdAt": manifest.CreatedAt,
+		"logs":      manifest.Logs,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleJoinGroup adds a consumer to a group and returns its partition assignment.
+func (s *HTTPServer) handleJoinGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	consumerGroup := r.URL.Query().Get("group")
+	if consumerGroup == "" {
+		http.Error(w, "Missing consumer group", http.StatusBadRequest)
+		return
+	}
+
+	var joinRequest struct {
+		ConsumerID string   `json:"consumerId"`
+		Topics     []string `json:"topics"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&joinRequest); err != nil || joinRequest.ConsumerID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	assignment, err := s.broker.coordinator.Join(consumerGroup, joinRequest.ConsumerID, joinRequest.Topics)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assignment)
+}
+
+// handleHeartbeat keeps a consumer's session alive and returns its current assignment.
+// Responds with 409 Conflict if the consumer must rejoin the group.
+func (s *HTTPServer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	consumerGroup := r.URL.Query().Get("group")
+	if consumerGroup == "" {
+		http.Error(w, "Missing consumer group", http.StatusBadRequest)
+		return
+	}
+
+	var heartbeatRequest struct {
+		ConsumerID string `json:"consumerId"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&heartbeatRequest); err != nil || heartbeatRequest.ConsumerID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	assignment, err := s.broker.coordinator.Heartbeat(consumerGroup, heartbeatRequest.ConsumerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assignment)
+}
+
+// handleLeaveGroup removes a consumer from a group so its partitions are reassigned.
+func (s *HTTPServer) handleLeaveGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	consumerGroup := r.URL.Query().Get("group")
+	if consumerGroup == "" {
+		http.Error(w, "Missing consumer group", http.StatusBadRequest)
+		return
+	}
+
+	var leaveRequest struct {
+		ConsumerID string `json:"consumerId"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&leaveRequest); err != nil || leaveRequest.ConsumerID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.broker.coordinator.Leave(consumerGroup, leaveRequest.ConsumerID); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status": "left",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // Begin listening for HTTP requests on the configured port.
 func (s *HTTPServer) Start() error {
-	addr := fmt.Sprintf(":%d", s.port)
-	fmt.Printf("Broker HTTP server listening on %s\n", addr)
-	return http.ListenAndServe(addr, s.mux)
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Bind the listening socket. Port 0 picks a free port; see Addr.
+func (s *HTTPServer) Listen() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", s.port, err)
+	}
+	s.listener = listener
+	s.server = &http.Server{Handler: s.mux}
+	fmt.Printf("Broker HTTP server listening on %s\n", listener.Addr())
+	return nil
+}
+
+// Serve requests until the server is closed.
+func (s *HTTPServer) Serve() error {
+	if err := s.server.Serve(s.listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Return the address the server is listening on.
+func (s *HTTPServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop the server, dropping open connections including long polls.
+func (s *HTTPServer) Close() error {
+	return s.server.Close()
+}
+
+// Stop accepting connections and wait for in-flight requests and WebSocket
+// connections to finish. Whatever is still open when ctx expires is closed.
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		s.server.Close()
+	}
+	return errors.Join(err, s.websockets.shutdown(ctx))
 }
 
 // Allows the HTTPServer to be used directly as a handler.
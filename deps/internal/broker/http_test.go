@@ -1,12 +1,21 @@
 package broker
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"example.com/deps/pkg/client"
 )
 
 func TestHandlePublishEvent(t *testing.T) {
@@ -81,6 +90,153 @@ func TestHandleFetchMessages(t *testing.T) {
 	}
 }
 
+func TestHandleFetchMessagesLongPoll(t *testing.T) {
+	s := setupTestServer()
+
+	// Several consumers wait on the same empty partition
+	const waiters = 5
+	results := make(chan int, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			req := httptest.NewRequest(http.MethodGet, "/messages?topic=test-topic&partition=1&offset=0&minBytes=1&maxWait=5000", nil)
+			rec := httptest.NewRecorder()
+			s.mux.ServeHTTP(rec, req)
+
+			var response struct {
+				Messages []StoredEvent `json:"messages"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &response)
+			results <- len(response.Messages)
+		}()
+	}
+
+	// Give the waiters time to block, then append one event
+	time.Sleep(100 * time.Millisecond)
+	partition, _ := s.broker.GetPartition("test-topic", 1)
+	start := time.Now()
+	if _, err := partition.logStorage.Append(&StoredEvent{Key: "k", Payload: []byte("{}")}); err != nil {
+		t.Fatalf("Failed to append event: %v", err)
+	}
+
+	for i := 0; i < waiters; i++ {
+		select {
+		case n := <-results:
+			if n != 1 {
+				t.Errorf("Expected 1 message, got %d", n)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Waiter not woken by append")
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Waiters took %v to wake", elapsed)
+	}
+}
+
+func TestHandleFetchMessagesLongPollTimeout(t *testing.T) {
+	s := setupTestServer()
+
+	start := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "/messages?topic=test-topic&partition=2&offset=0&minBytes=1&maxWait=200", nil)
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status OK, got %v", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected fetch to wait for maxWait, returned after %v", elapsed)
+	}
+}
+
+func TestHandleFetchMessagesRaw(t *testing.T) {
+	s := setupTestServer()
+	partition, _ := s.broker.GetPartition("test-topic", 0)
+	var stored [][]byte
+	for i := 0; i < 5; i++ {
+		event := &StoredEvent{Key: "k", Payload: []byte(fmt.Sprintf(`{"n":%d}`, i))}
+		partition.logStorage.Append(event)
+		data, _ := serializeEvent(event)
+		stored = append(stored, data)
+	}
+
+	// maxBytes covers two and a half records: only whole records are sent
+	maxBytes := len(stored[1]) + len(stored[2]) + len(stored[3])/2
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/messages?topic=test-topic&partition=0&offset=1&maxBytes=%d&format=raw", maxBytes), nil)
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Content-Type") != "application/octet-stream" || rec.Header().Get("X-Deps-First-Offset") != "1" || rec.Header().Get("X-Deps-Record-Count") != "2" {
+		t.Errorf("Unexpected headers %v", rec.Header())
+	}
+	if want := append(append([]byte{}, stored[1]...), stored[2]...); !bytes.Equal(rec.Body.Bytes(), want) {
+		t.Errorf("Expected records 1-2 as stored, got %q", rec.Body.Bytes())
+	}
+
+	// Past the end of the log: an empty body
+	req = httptest.NewRequest(http.MethodGet, "/messages?topic=test-topic&partition=0&offset=5&format=raw", nil)
+	rec = httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("X-Deps-Record-Count") != "0" {
+		t.Errorf("Expected an empty raw fetch, got %v %q", rec.Code, rec.Body.Bytes())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/messages?topic=test-topic&partition=0&offset=0&format=xml", nil)
+	rec = httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %v", rec.Code)
+	}
+}
+
+// Compare fetching 1MB of records as JSON and raw:
+//
+//	go test -bench FetchMessages -benchmem ./internal/broker/
+func BenchmarkFetchMessages(b *testing.B) {
+	s := setupTestServer()
+	partition, _ := s.broker.GetPartition("test-topic", 0)
+	payload := bytes.Repeat([]byte("x"), 200)
+	for partition.logStorage.BytesAfter(0) < 1<<20 {
+		partition.logStorage.Append(&StoredEvent{Key: "user123", Payload: payload})
+	}
+
+	for _, format := range []string{"json", "raw"} {
+		b.Run(format, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/messages?topic=test-topic&partition=0&offset=0&format="+format, nil)
+			b.SetBytes(partition.logStorage.BytesAfter(0))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := &discardResponse{header: make(http.Header)}
+				s.mux.ServeHTTP(w, req)
+				if w.code != http.StatusOK {
+					b.Fatalf("Fetch failed: %v", w.code)
+				}
+			}
+		})
+	}
+}
+
+// A ResponseWriter that drops the body, so benchmarks measure the handler rather
+// than a buffer holding the response.
+type discardResponse struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardResponse) Header() http.Header { return w.header }
+
+func (w *discardResponse) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (w *discardResponse) WriteHeader(code int) { w.code = code }
+
 func TestHandleCommitOffset(t *testing.T) {
 	s := setupTestServer()
 
@@ -115,6 +271,285 @@ func TestHandleCommitOffset(t *testing.T) {
 	}
 }
 
+func TestHandleFetchOffset(t *testing.T) {
+	s := setupTestServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/consumer-groups/offsets?group=test-group&topic=test-topic&partition=0", nil)
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status NotFound before commit, got %v", rec.Code)
+	}
+
+	if err := s.broker.offsetManager.CommitOffset("test-group", "test-topic", 0, 7); err != nil {
+		t.Fatalf("Failed to commit offset: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v", rec.Code)
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	if response["offset"] != float64(7) {
+		t.Errorf("Expected offset 7, got %v", response["offset"])
+	}
+}
+
+func TestHandleJoinGroup(t *testing.T) {
+	s := setupTestServer()
+
+	join := func(consumerID string) GroupAssignment {
+		body, _ := json.Marshal(map[string]interface{}{
+			"consumerId": consumerID,
+			"topics":     []string{"test-topic"},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/consumer-groups/join?group=test-group", bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v: %s", rec.Code, rec.Body.String())
+		}
+
+		var assignment GroupAssignment
+		if err := json.Unmarshal(rec.Body.Bytes(), &assignment); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return assignment
+	}
+
+	first := join("consumer-a")
+	if got := len(first.Partitions["test-topic"]); got != 3 {
+		t.Errorf("Expected sole member to own 3 partitions, got %d", got)
+	}
+
+	second := join("consumer-b")
+	if second.Generation <= first.Generation {
+		t.Errorf("Expected generation to advance after rebalance, got %d then %d", first.Generation, second.Generation)
+	}
+
+	// The first member learns its reduced assignment via heartbeat
+	body, _ := json.Marshal(map[string]string{"consumerId": "consumer-a"})
+	req := httptest.NewRequest(http.MethodPost, "/consumer-groups/heartbeat?group=test-group", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+
+	var heartbeat GroupAssignment
+	if err := json.Unmarshal(rec.Body.Bytes(), &heartbeat); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	owned := len(heartbeat.Partitions["test-topic"]) + len(second.Partitions["test-topic"])
+	if owned != 3 {
+		t.Errorf("Expected 3 partitions split across members, got %d", owned)
+	}
+
+	// Unknown members must rejoin
+	body, _ = json.Marshal(map[string]string{"consumerId": "consumer-z"})
+	req = httptest.NewRequest(http.MethodPost, "/consumer-groups/heartbeat?group=test-group", bytes.NewReader(body))
+	rec = httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected status Conflict for unknown member, got %v", rec.Code)
+	}
+}
+
+func TestHandleStream(t *testing.T) {
+	s := setupTestServer()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	partition, _ := s.broker.GetPartition("test-topic", 0)
+	for i := 0; i < 3; i++ {
+		partition.logStorage.Append(&StoredEvent{Key: "k", Payload: []byte("{}")})
+	}
+
+	// Resume after offset 0 and auto-commit for a group
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/topics/stream?topic=test-topic&partition=0&group=stream-group", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %q", ct)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	var ids []string
+	for len(ids) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read stream: %v", err)
+		}
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+		}
+	}
+
+	if ids[0] != "1" || ids[1] != "2" {
+		t.Errorf("Expected ids [1 2], got %v", ids)
+	}
+
+	// Delivered offsets are committed for the group
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		offset, err := s.broker.offsetManager.GetOffset("stream-group", "test-topic", 0)
+		if err == nil && offset == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected committed offset 3, got %d (%v)", offset, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// A partition log whose reads fail, as one whose cold store is down would,
+// counting them.
+type unreadableLog struct {
+	*MemoryLog
+	reads atomic.Int64
+}
+
+func (l *unreadableLog) Read(int64, int) ([]*StoredEvent, error) {
+	l.reads.Add(1)
+	return nil, errors.New("cold store unavailable")
+}
+
+func TestHandleStreamReadError(t *testing.T) {
+	s := setupTestServer()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	partition, _ := s.broker.GetPartition("test-topic", 0)
+	partition.logStorage = &unreadableLog{MemoryLog: NewMemoryLog()}
+	partition.logStorage.Append(&StoredEvent{Key: "k", Payload: []byte("{}")})
+
+	resp, err := http.Get(server.URL + "/topics/stream?topic=test-topic&partition=0")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The failure is reported once, then the stream ends rather than retrying
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read stream: %v", err)
+	}
+	if !strings.Contains(string(body), "event: error\ndata: ") || !strings.Contains(string(body), "cold store unavailable") {
+		t.Errorf("Expected an error event, got %q", body)
+	}
+}
+
+// A partition log whose appends fail as on a full disk, the given number of times.
+type fullDiskLog struct {
+	*MemoryLog
+	failures atomic.Int64
+}
+
+func (l *fullDiskLog) AppendBatch(events []*StoredEvent, codec Codec) (int64, error) {
+	if l.failures.Add(-1) >= 0 {
+		return 0, &ReadOnlyError{Err: syscall.ENOSPC, Since: time.Now()}
+	}
+	return l.MemoryLog.AppendBatch(events, codec)
+}
+
+func TestHandlePublishBatchPartialFailure(t *testing.T) {
+	s := setupTestServer()
+
+	// Partition 0 is out of space for its first two appends
+	full := &fullDiskLog{MemoryLog: NewMemoryLog()}
+	full.failures.Store(2)
+	partition, _ := s.broker.GetPartition("test-topic", 0)
+	partition.logStorage = full
+
+	var body []map[string]interface{}
+	onFull := make(map[int]bool)
+	for i := 0; i < 12; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		routed, _ := s.broker.partitionManager.RouteEvent("test-topic", key)
+		onFull[i] = routed.ID == 0
+		body = append(body, map[string]interface{}{"key": key, "payload": map[string]int{"n": i}})
+	}
+	publish := func() *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/topics/events/batch?topic=test-topic", bytes.NewReader(data)))
+		return rec
+	}
+
+	// Only partition 0: nothing is stored, so the request fails as a whole
+	all := body
+	body = nil
+	for i, event := range all {
+		if onFull[i] {
+			body = append(body, event)
+		}
+	}
+	if rec := publish(); rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 when nothing is stored, got %d", rec.Code)
+	}
+
+	// Every partition: the others' events are stored, and partition 0's reported failed
+	body = all
+	rec := publish()
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("Expected 207, got %d: %s", rec.Code, rec.Body)
+	}
+	var response struct {
+		Results []struct {
+			Partition int    `json:"partition"`
+			Offset    int64  `json:"offset"`
+			Status    int    `json:"status"`
+			Error     string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || len(response.Results) != len(body) {
+		t.Fatalf("Unexpected response %s (%v)", rec.Body, err)
+	}
+	for i, result := range response.Results {
+		switch {
+		case onFull[i] && (result.Offset != -1 || result.Status != http.StatusInsufficientStorage || result.Error == ""):
+			t.Errorf("Event %d: expected a 507 failure, got %+v", i, result)
+		case !onFull[i] && (result.Offset < 0 || result.Status != 0):
+			t.Errorf("Event %d: expected an offset, got %+v", i, result)
+		}
+	}
+
+	// Once the disk has room the whole batch goes through
+	if rec := publish(); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", rec.Code)
+	}
+}
+
+// setupTestClient serves the test broker over HTTP, optionally through a middleware,
+// and returns a client for it.
+func setupTestClient(t *testing.T, middleware func(http.Handler) http.Handler) (*client.Client, *HTTPServer) {
+	t.Helper()
+
+	s := setupTestServer()
+	var handler http.Handler = s
+	if middleware != nil {
+		handler = middleware(handler)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return client.New(server.URL), s
+}
+
 // setupTestServer sets up a test HTTP server with a mock broker.
 func setupTestServer() *HTTPServer {
 	broker := &Broker{
@@ -124,6 +559,7 @@ func setupTestServer() *HTTPServer {
 	// Initialize partition manager with reference to broker
 	broker.partitionManager = NewPartitionManager(broker)
 	broker.offsetManager = NewOffsetManager("") // Mock with empty path
+	broker.coordinator = NewGroupCoordinator(broker)
 
 	// Create a test topic with partitions
 	topic := &Topic{
@@ -132,29 +568,14 @@ func setupTestServer() *HTTPServer {
 		Partitions:    make(map[int]*Partition),
 	}
 
-	// Initialize partitions for the topic
+	// Initialize partitions for the topic, kept in memory
 	for i := 0; i < topic.NumPartitions; i++ {
-		// Create a temporary log file for testing
-		tmpfile, err := os.CreateTemp("", "test-partition-*.log")
-		if err != nil {
-			panic(err)
-		}
-		defer tmpfile.Close()
-
-		logStorage, err := NewLogStorage(tmpfile.Name())
-		if err != nil {
-			panic(err)
-		}
-
-		partition := &Partition{
-			Topic:         topic.Name,
-			ID:            i,
-			logPath:       tmpfile.Name(),
-			currentOffset: 0,
-			events:        make([]*StoredEvent, 0),
-			logStorage:    logStorage,
+		topic.Partitions[i] = &Partition{
+			Topic:      topic.Name,
+			ID:         i,
+			events:     make([]*StoredEvent, 0),
+			logStorage: NewMemoryLog(),
 		}
-		topic.Partitions[i] = partition
 	}
 
 	broker.topics["test-topic"] = topic
@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A record of a partition log, as read by ReadLog.
+type LogRecord struct {
+	// byte position of the record in the file, and how many bytes it takes.
+	Position int64
+	Size     int
+
+	// offset stored in the record, and how many events it holds: one, or a
+	// compressed batch's count.
+	Offset int64
+	Count  int
+
+	Codec     Codec
+	Encrypted bool
+
+	// the decoded events, with the offsets stored in them. Nil for an encrypted
+	// record read without keys.
+	Events []*StoredEvent
+}
+
+// Error for a record that is cut short or doesn't decode. Everything before
+// Position is sound.
+type CorruptRecordError struct {
+	Position int64
+	Err      error
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record at byte %d: %v", e.Position, e.Err)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return e.Err
+}
+
+// Read a partition log record by record and call fn with each. Records are
+// decoded with deserializeEvents, opening encrypted ones with keys; with nil keys
+// encrypted records are only checked for structure. Logs in earlier format
+// versions are read too, including version 1 without a header; newer ones are a
+// *FormatVersionError. A log file is one segment of a partition, whose first
+// record need not be at offset 0.
+//
+// Returns the number of bytes of the header and sound records read. The walk
+// stops at the first record that is cut short or doesn't decode, with a
+// *CorruptRecordError, or at the first error from fn, which is returned as is.
+func ReadLog(r io.Reader, keys *Keyring, fn func(LogRecord) error) (int64, error) {
+	reader := bufio.NewReader(r)
+
+	var position int64
+	header, _ := reader.Peek(logHeaderSize)
+	switch version := logVersion(header); {
+	case version == 1:
+		// The first record starts right away
+	case version <= FormatVersion:
+		if len(header) > 0 {
+			reader.Discard(logHeaderSize)
+			position = logHeaderSize
+		}
+	default:
+		return 0, &FormatVersionError{Version: version}
+	}
+
+	for {
+		record, err := readRecord(reader)
+		if err == io.EOF {
+			return position, nil
+		}
+		if err != nil {
+			return position, &CorruptRecordError{Position: position, Err: err}
+		}
+
+		codec, encrypted, keyLength := recordAttributes(record[16:20])
+		logRecord := LogRecord{
+			Position:  position,
+			Size:      len(record),
+			Offset:    int64(binary.BigEndian.Uint64(record[0:8])),
+			Count:     1,
+			Codec:     codec,
+			Encrypted: encrypted,
+		}
+		if codec != CodecNone {
+			payload := record[24+keyLength:]
+			if len(payload) < 4 {
+				return position, &CorruptRecordError{Position: position, Err: errors.New("batch has no event count")}
+			}
+			logRecord.Count = int(binary.BigEndian.Uint32(payload[0:4]))
+		}
+
+		if !encrypted || keys != nil {
+			events, err := deserializeEvents(record, keys)
+			if err != nil {
+				return position, &CorruptRecordError{Position: position, Err: err}
+			}
+			logRecord.Events = events
+		}
+
+		if err := fn(logRecord); err != nil {
+			return position, err
+		}
+		position += int64(len(record))
+	}
+}
+
+// Read the next whole record. Returns io.EOF at a clean end of the log and
+// io.ErrUnexpectedEOF for a partial record.
+func readRecord(reader *bufio.Reader) ([]byte, error) {
+	// [offset(8)][timestamp(8)][attributes(1)][keyLength(3)]
+	header := make([]byte, 20)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	codec, _, keyLength := recordAttributes(header[16:20])
+	if codec > CodecFlate {
+		return nil, fmt.Errorf("unknown codec %d", byte(codec))
+	}
+
+	// [key][payloadLength(4)]
+	rest := make([]byte, keyLength+4)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	payloadLength := int(binary.BigEndian.Uint32(rest[keyLength:]))
+
+	// Grow the record as the payload arrives, so a corrupt length can't force a
+	// huge allocation
+	var record bytes.Buffer
+	record.Write(header)
+	record.Write(rest)
+	if _, err := io.CopyN(&record, reader, int64(payloadLength)); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return record.Bytes(), nil
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partition-0.log")
+	storage, err := NewLogStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	keys, err := LoadKeyring(writeKeyfile(t, 1, 1))
+	if err != nil {
+		t.Fatalf("Failed to load keyfile: %v", err)
+	}
+	storage.keys = keys
+
+	storage.Append(&StoredEvent{Key: "a", Payload: []byte(`{"n":0}`)})
+	storage.AppendBatch([]*StoredEvent{{Key: "b", Payload: []byte(`{"n":1}`)}, {Key: "c", Payload: []byte(`{"n":2}`)}}, CodecZlib)
+	storage.encrypt.Store(true)
+	storage.Append(&StoredEvent{Key: "d", Payload: []byte(`{"n":3}`)})
+	storage.Close()
+	data, _ := os.ReadFile(path)
+
+	// Each record with its events; the encrypted one is opened with the keys
+	var records []LogRecord
+	sound, err := ReadLog(bytes.NewReader(data), keys, func(record LogRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil || sound != int64(len(data)) || len(records) != 3 {
+		t.Fatalf("Expected 3 sound records in %d bytes, got %d in %d (%v)", len(data), len(records), sound, err)
+	}
+	if batch := records[1]; batch.Offset != 1 || batch.Count != 2 || batch.Codec != CodecZlib || len(batch.Events) != 2 || batch.Events[1].Offset != 2 {
+		t.Errorf("Unexpected batch record %+v", batch)
+	}
+	if sealed := records[2]; !sealed.Encrypted || len(sealed.Events) != 1 || string(sealed.Events[0].Payload) != `{"n":3}` {
+		t.Errorf("Unexpected encrypted record %+v", sealed)
+	}
+	if records[2].Position != records[1].Position+int64(records[1].Size) {
+		t.Errorf("Expected records to be contiguous, got %+v", records)
+	}
+
+	// Without keys an encrypted record is still walked, but not decoded
+	ReadLog(bytes.NewReader(data), nil, func(record LogRecord) error {
+		if record.Encrypted && record.Events != nil {
+			t.Errorf("Expected no events for an encrypted record read without keys")
+		}
+		return nil
+	})
+
+	// A torn tail ends the walk at the last sound record
+	torn := data[:len(data)-3]
+	sound, err = ReadLog(bytes.NewReader(torn), keys, func(LogRecord) error { return nil })
+	var corrupt *CorruptRecordError
+	if !errors.As(err, &corrupt) || !errors.Is(err, io.ErrUnexpectedEOF) || sound != records[2].Position || corrupt.Position != sound {
+		t.Errorf("Expected a torn record at byte %d, got %d (%v)", records[2].Position, sound, err)
+	}
+
+	// So does a batch that doesn't decompress
+	damaged := bytes.Clone(data)
+	damaged[records[1].Position+30] ^= 0xff
+	if sound, err = ReadLog(bytes.NewReader(damaged), keys, func(LogRecord) error { return nil }); !errors.As(err, &corrupt) || sound != records[1].Position {
+		t.Errorf("Expected a corrupt batch at byte %d, got %d (%v)", records[1].Position, sound, err)
+	}
+}
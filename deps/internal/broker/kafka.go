@@ -0,0 +1,837 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"example.com/deps/internal/protocol"
+	"example.com/deps/internal/protocol/kafka"
+)
+
+// Node ID and cluster ID reported to Kafka clients. DEPS is a single broker,
+// so it is the leader of every partition and the coordinator of every group.
+const (
+	kafkaNodeID    = 0
+	kafkaClusterID = "deps"
+)
+
+// Authorized operations are never computed.
+const kafkaOperationsOmitted = math.MinInt32
+
+// The API versions the listener accepts. Only non-flexible versions are listed;
+// clients pick the highest version both sides support.
+var kafkaAPIVersions = []struct {
+	key, min, max int16
+}{
+	{kafka.APIProduce, 3, 8},
+	{kafka.APIFetch, 4, 11},
+	{kafka.APIListOffsets, 1, 5},
+	{kafka.APIMetadata, 0, 8},
+	{kafka.APIOffsetCommit, 2, 7},
+	{kafka.APIOffsetFetch, 1, 5},
+	{kafka.APIFindCoordinator, 0, 2},
+	{kafka.APIApiVersions, 0, 2},
+	{kafka.APIInitProducerID, 0, 1},
+}
+
+// Serve a subset of the Kafka wire protocol so existing Kafka clients can
+// produce, consume and commit offsets against the broker.
+//
+// Records are mapped one-to-one onto events: the record key becomes the event key
+// and the record value its payload. Headers are dropped and timestamps are assigned
+// by the broker. Producers choose partitions themselves, so keyed records may land
+// on a different partition than the same key published over HTTP.
+type KafkaServer struct {
+	broker   *Broker
+	port     int
+	listener net.Listener
+	conns    connSet
+
+	// last producer ID handed out by InitProducerId
+	producerID atomic.Int64
+}
+
+// New Kafka-compatible server for the broker.
+func NewKafkaServer(broker *Broker, port int) *KafkaServer {
+	return &KafkaServer{
+		broker: broker,
+		port:   port,
+	}
+}
+
+// Bind the listening socket. Separate from Serve so startup errors surface before the broker blocks.
+func (s *KafkaServer) Listen() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", s.port, err)
+	}
+	s.listener = listener
+	fmt.Printf("Broker Kafka listener on %s\n", listener.Addr())
+	return nil
+}
+
+// Accept connections until the listener is closed.
+func (s *KafkaServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !s.conns.add(conn) {
+			conn.Close()
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Return the address the server is listening on.
+func (s *KafkaServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop accepting connections.
+func (s *KafkaServer) Close() error {
+	return s.listener.Close()
+}
+
+// Stop accepting connections and wait for open ones to finish the request in
+// progress. Connections still open when ctx expires are closed.
+func (s *KafkaServer) Shutdown(ctx context.Context) error {
+	return errors.Join(s.listener.Close(), s.conns.shutdown(ctx))
+}
+
+// Answer requests on one connection strictly in order, as Kafka brokers do.
+// Malformed requests and unsupported APIs or versions close the connection.
+func (s *KafkaServer) handleConn(conn net.Conn) {
+	defer s.conns.done(conn)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Advertise the address the client reached us on
+	host, port := "localhost", int32(s.port)
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		host, port = addr.IP.String(), int32(addr.Port)
+	}
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		payload, err := protocol.ReadFrame(reader)
+		if err != nil {
+			return
+		}
+
+		header, body, err := kafka.ReadRequestHeader(payload)
+		if err != nil {
+			return
+		}
+
+		w := kafka.NewResponse(header.CorrelationID)
+		respond, err := s.dispatch(ctx, header, body, w, host, port)
+		if err != nil {
+			fmt.Printf("Kafka listener: closing connection from %s: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+		if !respond {
+			continue
+		}
+
+		if err := protocol.WriteFrame(writer, w.Bytes()); err != nil {
+			return
+		}
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Decode one request, run it against the broker and write the response body to w.
+// Returns false when the request expects no response (produce with acks=0).
+func (s *KafkaServer) dispatch(ctx context.Context, header kafka.RequestHeader, r *kafka.Reader, w *kafka.Writer, host string, port int32) (bool, error) {
+	version := header.APIVersion
+
+	// ApiVersions must answer any version, so clients can discover what is supported
+	if header.APIKey == kafka.APIApiVersions {
+		s.apiVersions(version, w)
+		return true, nil
+	}
+
+	if !kafkaSupports(header.APIKey, version) {
+		return false, fmt.Errorf("unsupported api key %d version %d", header.APIKey, version)
+	}
+
+	switch header.APIKey {
+	case kafka.APIProduce:
+		return s.produce(version, r, w)
+	case kafka.APIFetch:
+		return true, s.fetch(ctx, version, r, w)
+	case kafka.APIListOffsets:
+		return true, s.listOffsets(version, r, w)
+	case kafka.APIMetadata:
+		return true, s.metadata(version, r, w, host, port)
+	case kafka.APIOffsetCommit:
+		return true, s.offsetCommit(version, r, w)
+	case kafka.APIOffsetFetch:
+		return true, s.offsetFetch(version, r, w)
+	case kafka.APIFindCoordinator:
+		return true, s.findCoordinator(version, r, w, host, port)
+	case kafka.APIInitProducerID:
+		return true, s.initProducerID(version, r, w)
+	}
+	return false, fmt.Errorf("unsupported api key %d", header.APIKey)
+}
+
+func kafkaSupports(apiKey, version int16) bool {
+	for _, api := range kafkaAPIVersions {
+		if api.key == apiKey {
+			return version >= api.min && version <= api.max
+		}
+	}
+	return false
+}
+
+// Versions beyond those supported are answered in v0 with UNSUPPORTED_VERSION,
+// which tells the client to retry with a version from the returned list.
+func (s *KafkaServer) apiVersions(version int16, w *kafka.Writer) {
+	errorCode := kafka.ErrNone
+	if !kafkaSupports(kafka.APIApiVersions, version) {
+		errorCode = kafka.ErrUnsupportedVersion
+		version = 0
+	}
+
+	w.PutInt16(errorCode)
+	w.PutArrayLen(len(kafkaAPIVersions))
+	for _, api := range kafkaAPIVersions {
+		w.PutInt16(api.key)
+		w.PutInt16(api.min)
+		w.PutInt16(api.max)
+	}
+	if version >= 1 {
+		w.PutInt32(0) // throttle_time_ms
+	}
+}
+
+func (s *KafkaServer) metadata(version int16, r *kafka.Reader, w *kafka.Writer, host string, port int32) error {
+	// A null topic list (v1+) or an empty one (v0) asks for every topic
+	var requested []string
+	n := r.ReadArrayLen()
+	allTopics := n < 0 || (n == 0 && version == 0)
+	for i := 0; i < n; i++ {
+		requested = append(requested, r.ReadString())
+	}
+	if version >= 4 {
+		r.ReadBool() // allow_auto_topic_creation: topics are never created implicitly
+	}
+	if version >= 8 {
+		r.ReadBool() // include_cluster_authorized_operations
+		r.ReadBool() // include_topic_authorized_operations
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	s.broker.mu.RLock()
+	if allTopics {
+		for name := range s.broker.topics {
+			requested = append(requested, name)
+		}
+		sort.Strings(requested)
+	}
+	partitionCounts := make([]int, len(requested))
+	for i, name := range requested {
+		partitionCounts[i] = -1
+		if topic, exists := s.broker.topics[name]; exists {
+			partitionCounts[i] = topic.NumPartitions
+		}
+	}
+	s.broker.mu.RUnlock()
+
+	if version >= 3 {
+		w.PutInt32(0) // throttle_time_ms
+	}
+
+	w.PutArrayLen(1)
+	w.PutInt32(kafkaNodeID)
+	w.PutString(host)
+	w.PutInt32(port)
+	if version >= 1 {
+		w.PutNullableString(nil) // rack
+	}
+	if version >= 2 {
+		clusterID := kafkaClusterID
+		w.PutNullableString(&clusterID)
+	}
+	if version >= 1 {
+		w.PutInt32(kafkaNodeID) // controller_id
+	}
+
+	w.PutArrayLen(len(requested))
+	for i, name := range requested {
+		numPartitions := partitionCounts[i]
+		if numPartitions < 0 {
+			w.PutInt16(kafka.ErrUnknownTopicOrPartition)
+			numPartitions = 0
+		} else {
+			w.PutInt16(kafka.ErrNone)
+		}
+		w.PutString(name)
+		if version >= 1 {
+			w.PutBool(false) // is_internal
+		}
+
+		w.PutArrayLen(numPartitions)
+		for partitionID := 0; partitionID < numPartitions; partitionID++ {
+			w.PutInt16(kafka.ErrNone)
+			w.PutInt32(int32(partitionID))
+			w.PutInt32(kafkaNodeID) // leader
+			if version >= 7 {
+				w.PutInt32(0) // leader_epoch
+			}
+			w.PutArrayLen(1) // replicas
+			w.PutInt32(kafkaNodeID)
+			w.PutArrayLen(1) // in-sync replicas
+			w.PutInt32(kafkaNodeID)
+			if version >= 5 {
+				w.PutArrayLen(0) // offline replicas
+			}
+		}
+		if version >= 8 {
+			w.PutInt32(kafkaOperationsOmitted)
+		}
+	}
+	if version >= 8 {
+		w.PutInt32(kafkaOperationsOmitted)
+	}
+	return nil
+}
+
+type kafkaProducePartition struct {
+	index   int32
+	records []byte
+}
+
+type kafkaProduceTopic struct {
+	name       string
+	partitions []kafkaProducePartition
+}
+
+// Append each partition's record batches. Records keep the offsets the broker assigns;
+// the base offset reported back is that of the partition's first record.
+func (s *KafkaServer) produce(version int16, r *kafka.Reader, w *kafka.Writer) (bool, error) {
+	r.ReadNullableString() // transactional_id
+	acks := r.ReadInt16()
+	r.ReadInt32() // timeout_ms
+
+	var topics []kafkaProduceTopic
+	numTopics := r.ReadArrayLen()
+	for i := 0; i < numTopics; i++ {
+		topic := kafkaProduceTopic{name: r.ReadString()}
+		numPartitions := r.ReadArrayLen()
+		for j := 0; j < numPartitions; j++ {
+			topic.partitions = append(topic.partitions, kafkaProducePartition{
+				index:   r.ReadInt32(),
+				records: r.ReadBytes(),
+			})
+		}
+		topics = append(topics, topic)
+	}
+	if err := r.Err(); err != nil {
+		return false, err
+	}
+
+	w.PutArrayLen(len(topics))
+	for _, topic := range topics {
+		w.PutString(topic.name)
+		w.PutArrayLen(len(topic.partitions))
+		for _, p := range topic.partitions {
+			baseOffset, errorCode := s.appendRecords(topic.name, p.index, p.records)
+
+			w.PutInt32(p.index)
+			w.PutInt16(errorCode)
+			w.PutInt64(baseOffset)
+			w.PutInt64(-1) // log_append_time_ms: timestamps are create time
+			if version >= 5 {
+				w.PutInt64(0) // log_start_offset
+			}
+			if version >= 8 {
+				w.PutArrayLen(0)         // record_errors
+				w.PutNullableString(nil) // error_message
+			}
+		}
+	}
+	w.PutInt32(0) // throttle_time_ms
+
+	return acks != 0, nil
+}
+
+// Decode record batches and append their records to a partition.
+// Returns the offset of the first record appended, or -1 with an error code.
+func (s *KafkaServer) appendRecords(topic string, partitionID int32, data []byte) (int64, int16) {
+	partition, err := s.broker.GetPartition(topic, int(partitionID))
+	if err != nil {
+		return -1, kafka.ErrUnknownTopicOrPartition
+	}
+
+	records, err := kafka.ReadRecordBatches(data)
+	if errors.Is(err, kafka.ErrUnsupportedCompression) {
+		return -1, kafka.ErrUnsupportedCompressionType
+	} else if err != nil {
+		return -1, kafka.ErrCorruptMessage
+	}
+
+	if len(records) == 0 {
+		return partition.logStorage.NextOffset(), kafka.ErrNone
+	}
+
+	// Append the records together, so they get consecutive offsets and are stored
+	// all or none
+	events := make([]*StoredEvent, len(records))
+	for i, record := range records {
+		events[i] = &StoredEvent{Key: string(record.Key), Payload: record.Value}
+	}
+	baseOffset, err := s.broker.partitionManager.AppendEvents(partition, events, CodecNone)
+	if err != nil {
+		return -1, kafka.ErrKafkaStorageError
+	}
+	return baseOffset, kafka.ErrNone
+}
+
+type kafkaFetchPartition struct {
+	index       int32
+	fetchOffset int64
+	maxBytes    int32
+
+	partition *Partition
+	errorCode int16
+}
+
+type kafkaFetchTopic struct {
+	name       string
+	partitions []*kafkaFetchPartition
+}
+
+// Fetch sessions are not supported: every request is treated as a full fetch and
+// answered with session ID 0, which keeps clients sending full requests.
+func (s *KafkaServer) fetch(ctx context.Context, version int16, r *kafka.Reader, w *kafka.Writer) error {
+	r.ReadInt32() // replica_id
+	maxWait := time.Duration(r.ReadInt32()) * time.Millisecond
+	minBytes := r.ReadInt32()
+	maxBytes := r.ReadInt32()
+	r.ReadInt8() // isolation_level: there are no transactions, so everything is committed
+	if version >= 7 {
+		r.ReadInt32() // session_id
+		r.ReadInt32() // session_epoch
+	}
+
+	var topics []kafkaFetchTopic
+	numTopics := r.ReadArrayLen()
+	for i := 0; i < numTopics; i++ {
+		topic := kafkaFetchTopic{name: r.ReadString()}
+		numPartitions := r.ReadArrayLen()
+		for j := 0; j < numPartitions; j++ {
+			p := &kafkaFetchPartition{index: r.ReadInt32()}
+			if version >= 9 {
+				r.ReadInt32() // current_leader_epoch
+			}
+			p.fetchOffset = r.ReadInt64()
+			if version >= 5 {
+				r.ReadInt64() // log_start_offset
+			}
+			p.maxBytes = r.ReadInt32()
+			topic.partitions = append(topic.partitions, p)
+		}
+		topics = append(topics, topic)
+	}
+	if version >= 7 {
+		numForgotten := r.ReadArrayLen()
+		for i := 0; i < numForgotten; i++ {
+			r.ReadString()
+			numPartitions := r.ReadArrayLen()
+			for j := 0; j < numPartitions; j++ {
+				r.ReadInt32()
+			}
+		}
+	}
+	if version >= 11 {
+		r.ReadString() // rack_id
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	// Resolve partitions and check offsets before waiting
+	var waitable []*kafkaFetchPartition
+	ready := false
+	for _, topic := range topics {
+		for _, p := range topic.partitions {
+			partition, err := s.broker.GetPartition(topic.name, int(p.index))
+			if err != nil {
+				p.errorCode = kafka.ErrUnknownTopicOrPartition
+				continue
+			}
+			if p.fetchOffset < 0 || p.fetchOffset > partition.logStorage.NextOffset() {
+				p.errorCode = kafka.ErrOffsetOutOfRange
+				ready = true
+				continue
+			}
+			p.partition = partition
+			waitable = append(waitable, p)
+			if partition.logStorage.BytesAfter(p.fetchOffset) > 0 {
+				ready = true
+			}
+		}
+	}
+
+	if maxWait > maxFetchWait {
+		maxWait = maxFetchWait
+	}
+	if !ready && minBytes > 0 && maxWait > 0 && len(waitable) > 0 {
+		partitions := make([]*Partition, len(waitable))
+		offsets := make([]int64, len(waitable))
+		for i, p := range waitable {
+			partitions[i], offsets[i] = p.partition, p.fetchOffset
+		}
+		s.broker.partitionManager.WaitForAny(ctx, partitions, offsets, maxWait)
+	}
+
+	w.PutInt32(0) // throttle_time_ms
+	if version >= 7 {
+		w.PutInt16(kafka.ErrNone)
+		w.PutInt32(0) // session_id
+	}
+
+	remaining := int(maxBytes)
+	w.PutArrayLen(len(topics))
+	for _, topic := range topics {
+		w.PutString(topic.name)
+		w.PutArrayLen(len(topic.partitions))
+		for _, p := range topic.partitions {
+			var batch []byte
+			highWatermark := int64(-1)
+			if p.partition != nil {
+				highWatermark = p.partition.logStorage.NextOffset()
+				if remaining > 0 {
+					events, err := s.broker.partitionManager.FetchEvents(p.partition, p.fetchOffset, min(int(p.maxBytes), remaining))
+					if err != nil {
+						p.errorCode = kafka.ErrKafkaStorageError
+					}
+					batch = encodeKafkaBatch(events)
+					remaining -= len(batch)
+				}
+			}
+
+			w.PutInt32(p.index)
+			w.PutInt16(p.errorCode)
+			w.PutInt64(highWatermark)
+			w.PutInt64(highWatermark) // last_stable_offset
+			if version >= 5 {
+				w.PutInt64(0) // log_start_offset
+			}
+			w.PutArrayLen(0) // aborted_transactions
+			if version >= 11 {
+				w.PutInt32(-1) // preferred_read_replica
+			}
+			w.PutBytes(batch)
+		}
+	}
+	return nil
+}
+
+// Encode events as a single record batch. Event timestamps are nanoseconds;
+// Kafka timestamps are milliseconds. Empty keys are sent as null.
+func encodeKafkaBatch(events []*StoredEvent) []byte {
+	if len(events) == 0 {
+		return []byte{}
+	}
+	records := make([]kafka.Record, len(events))
+	for i, event := range events {
+		records[i] = kafka.Record{
+			Offset:    event.Offset,
+			Timestamp: event.Timestamp / int64(time.Millisecond),
+			Value:     event.Payload,
+		}
+		if event.Key != "" {
+			records[i].Key = []byte(event.Key)
+		}
+	}
+	return kafka.AppendRecordBatch(nil, records)
+}
+
+// Resolve the earliest (-2) or latest (-1) offset, or the first offset
+// whose timestamp is at least the one requested.
+func (s *KafkaServer) listOffsets(version int16, r *kafka.Reader, w *kafka.Writer) error {
+	type listPartition struct {
+		index     int32
+		timestamp int64
+	}
+	type listTopic struct {
+		name       string
+		partitions []listPartition
+	}
+
+	r.ReadInt32() // replica_id
+	if version >= 2 {
+		r.ReadInt8() // isolation_level
+	}
+	var topics []listTopic
+	numTopics := r.ReadArrayLen()
+	for i := 0; i < numTopics; i++ {
+		topic := listTopic{name: r.ReadString()}
+		numPartitions := r.ReadArrayLen()
+		for j := 0; j < numPartitions; j++ {
+			p := listPartition{index: r.ReadInt32()}
+			if version >= 4 {
+				r.ReadInt32() // current_leader_epoch
+			}
+			p.timestamp = r.ReadInt64()
+			topic.partitions = append(topic.partitions, p)
+		}
+		topics = append(topics, topic)
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	if version >= 2 {
+		w.PutInt32(0) // throttle_time_ms
+	}
+	w.PutArrayLen(len(topics))
+	for _, topic := range topics {
+		w.PutString(topic.name)
+		w.PutArrayLen(len(topic.partitions))
+		for _, p := range topic.partitions {
+			errorCode := kafka.ErrNone
+			timestamp, offset := int64(-1), int64(-1)
+
+			partition, err := s.broker.GetPartition(topic.name, int(p.index))
+			switch {
+			case err != nil:
+				errorCode = kafka.ErrUnknownTopicOrPartition
+			case p.timestamp == kafka.TimestampLatest:
+				offset = partition.logStorage.NextOffset()
+			case p.timestamp == kafka.TimestampEarliest:
+				offset = 0
+			default:
+				offset, timestamp, err = s.offsetForTimestamp(partition, p.timestamp)
+				if err != nil {
+					errorCode = kafka.ErrKafkaStorageError
+				}
+			}
+
+			w.PutInt32(p.index)
+			w.PutInt16(errorCode)
+			w.PutInt64(timestamp)
+			w.PutInt64(offset)
+			if version >= 4 {
+				w.PutInt32(0) // leader_epoch
+			}
+		}
+	}
+	return nil
+}
+
+// Look up the first event at or after timestampMs in a partition's time index.
+// Returns -1 for both offset and timestamp when there is none.
+func (s *KafkaServer) offsetForTimestamp(partition *Partition, timestampMs int64) (int64, int64, error) {
+	offset, timestamp, err := partition.logStorage.OffsetForTimestamp(timestampMs * int64(time.Millisecond))
+	if err != nil || offset < 0 {
+		return -1, -1, err
+	}
+	return offset, timestamp / int64(time.Millisecond), nil
+}
+
+// Group generations and member IDs are not checked: Kafka clients that assign
+// partitions themselves commit with generation -1.
+func (s *KafkaServer) offsetCommit(version int16, r *kafka.Reader, w *kafka.Writer) error {
+	type commitPartition struct {
+		index  int32
+		offset int64
+	}
+	type commitTopic struct {
+		name       string
+		partitions []commitPartition
+	}
+
+	group := r.ReadString()
+	r.ReadInt32()  // generation_id
+	r.ReadString() // member_id
+	if version <= 4 {
+		r.ReadInt64() // retention_time_ms
+	}
+	if version >= 7 {
+		r.ReadNullableString() // group_instance_id
+	}
+	var topics []commitTopic
+	numTopics := r.ReadArrayLen()
+	for i := 0; i < numTopics; i++ {
+		topic := commitTopic{name: r.ReadString()}
+		numPartitions := r.ReadArrayLen()
+		for j := 0; j < numPartitions; j++ {
+			p := commitPartition{index: r.ReadInt32(), offset: r.ReadInt64()}
+			if version >= 6 {
+				r.ReadInt32() // committed_leader_epoch
+			}
+			r.ReadNullableString() // committed_metadata
+			topic.partitions = append(topic.partitions, p)
+		}
+		topics = append(topics, topic)
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	if version >= 3 {
+		w.PutInt32(0) // throttle_time_ms
+	}
+	w.PutArrayLen(len(topics))
+	for _, topic := range topics {
+		w.PutString(topic.name)
+		w.PutArrayLen(len(topic.partitions))
+		for _, p := range topic.partitions {
+			errorCode := kafka.ErrNone
+			if _, err := s.broker.GetPartition(topic.name, int(p.index)); err != nil {
+				errorCode = kafka.ErrUnknownTopicOrPartition
+			} else if err := s.broker.partitionManager.CommitOffset(group, topic.name, int(p.index), p.offset); err != nil {
+				errorCode = kafka.ErrKafkaStorageError
+			}
+			w.PutInt32(p.index)
+			w.PutInt16(errorCode)
+		}
+	}
+	return nil
+}
+
+// Partitions without a committed offset are reported with offset -1.
+// A null topic list (v2+) returns every committed offset of the group.
+func (s *KafkaServer) offsetFetch(version int16, r *kafka.Reader, w *kafka.Writer) error {
+	type fetchTopic struct {
+		name       string
+		partitions []int32
+	}
+
+	group := r.ReadString()
+	var topics []fetchTopic
+	numTopics := r.ReadArrayLen()
+	for i := 0; i < numTopics; i++ {
+		topic := fetchTopic{name: r.ReadString()}
+		numPartitions := r.ReadArrayLen()
+		for j := 0; j < numPartitions; j++ {
+			topic.partitions = append(topic.partitions, r.ReadInt32())
+		}
+		topics = append(topics, topic)
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	allTopics := numTopics < 0
+	if allTopics {
+		s.broker.mu.RLock()
+		for name, topic := range s.broker.topics {
+			t := fetchTopic{name: name}
+			for partitionID := 0; partitionID < topic.NumPartitions; partitionID++ {
+				if _, err := s.broker.offsetManager.GetOffset(group, name, partitionID); err == nil {
+					t.partitions = append(t.partitions, int32(partitionID))
+				}
+			}
+			if len(t.partitions) > 0 {
+				topics = append(topics, t)
+			}
+		}
+		s.broker.mu.RUnlock()
+		sort.Slice(topics, func(i, j int) bool { return topics[i].name < topics[j].name })
+	}
+
+	if version >= 3 {
+		w.PutInt32(0) // throttle_time_ms
+	}
+	w.PutArrayLen(len(topics))
+	for _, topic := range topics {
+		w.PutString(topic.name)
+		w.PutArrayLen(len(topic.partitions))
+		for _, partitionID := range topic.partitions {
+			errorCode := kafka.ErrNone
+			offset, err := s.broker.offsetManager.GetOffset(group, topic.name, int(partitionID))
+			if err != nil {
+				offset = -1
+				if _, err := s.broker.GetPartition(topic.name, int(partitionID)); err != nil {
+					errorCode = kafka.ErrUnknownTopicOrPartition
+				}
+			}
+
+			w.PutInt32(partitionID)
+			w.PutInt64(offset)
+			if version >= 5 {
+				w.PutInt32(-1) // committed_leader_epoch
+			}
+			metadata := ""
+			w.PutNullableString(&metadata)
+			w.PutInt16(errorCode)
+		}
+	}
+	if version >= 2 {
+		w.PutInt16(kafka.ErrNone)
+	}
+	return nil
+}
+
+// This broker coordinates every group.
+func (s *KafkaServer) findCoordinator(version int16, r *kafka.Reader, w *kafka.Writer, host string, port int32) error {
+	r.ReadString() // key
+	if version >= 1 {
+		r.ReadInt8() // key_type
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	if version >= 1 {
+		w.PutInt32(0) // throttle_time_ms
+	}
+	w.PutInt16(kafka.ErrNone)
+	if version >= 1 {
+		w.PutNullableString(nil) // error_message
+	}
+	w.PutInt32(kafkaNodeID)
+	w.PutString(host)
+	w.PutInt32(port)
+	return nil
+}
+
+// Hand out producer IDs so idempotent producers can start. Sequence numbers are
+// not checked, so retried batches may be appended twice. Transactions are not supported.
+func (s *KafkaServer) initProducerID(version int16, r *kafka.Reader, w *kafka.Writer) error {
+	transactionalID := r.ReadNullableString()
+	r.ReadInt32() // transaction_timeout_ms
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	w.PutInt32(0) // throttle_time_ms
+	if transactionalID != nil {
+		w.PutInt16(kafka.ErrInvalidRequest)
+		w.PutInt64(-1)
+		w.PutInt16(-1)
+		return nil
+	}
+	w.PutInt16(kafka.ErrNone)
+	w.PutInt64(s.producerID.Add(1))
+	w.PutInt16(0) // producer_epoch
+	return nil
+}
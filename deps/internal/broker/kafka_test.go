@@ -0,0 +1,439 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"example.com/deps/internal/protocol"
+	"example.com/deps/internal/protocol/kafka"
+)
+
+func TestKafkaApiVersions(t *testing.T) {
+	conn := setupTestKafkaConn(t)
+
+	resp := conn.request(t, kafka.APIApiVersions, 2, new(frame))
+	if code := resp.ReadInt16(); code != kafka.ErrNone {
+		t.Fatalf("Expected no error, got %d", code)
+	}
+	apis := map[int16][2]int16{}
+	for i, n := 0, resp.ReadArrayLen(); i < n; i++ {
+		key := resp.ReadInt16()
+		apis[key] = [2]int16{resp.ReadInt16(), resp.ReadInt16()}
+	}
+	for _, key := range []int16{kafka.APIProduce, kafka.APIFetch, kafka.APIListOffsets, kafka.APIMetadata, kafka.APIOffsetCommit, kafka.APIOffsetFetch} {
+		if _, ok := apis[key]; !ok {
+			t.Errorf("API %d not advertised", key)
+		}
+	}
+
+	// Newer clients open with a flexible version and expect a v0 downgrade hint
+	resp = conn.request(t, kafka.APIApiVersions, 3, new(frame))
+	if code := resp.ReadInt16(); code != kafka.ErrUnsupportedVersion {
+		t.Errorf("Expected UNSUPPORTED_VERSION, got %d", code)
+	}
+}
+
+func TestKafkaMetadata(t *testing.T) {
+	conn := setupTestKafkaConn(t)
+
+	// v1 with a null topic list: every topic
+	resp := conn.request(t, kafka.APIMetadata, 1, new(frame).i32(-1))
+	if n := resp.ReadArrayLen(); n != 1 {
+		t.Fatalf("Expected 1 broker, got %d", n)
+	}
+	resp.ReadInt32() // node_id
+	host, port := resp.ReadString(), resp.ReadInt32()
+	if addr := net.JoinHostPort(host, strconv.Itoa(int(port))); addr != conn.addr {
+		t.Errorf("Expected advertised address %s, got %s", conn.addr, addr)
+	}
+	resp.ReadNullableString() // rack
+	resp.ReadInt32()          // controller_id
+
+	if n := resp.ReadArrayLen(); n != 1 {
+		t.Fatalf("Expected 1 topic, got %d", n)
+	}
+	if code, name := resp.ReadInt16(), resp.ReadString(); code != kafka.ErrNone || name != "test-topic" {
+		t.Errorf("Unexpected topic %q (error %d)", name, code)
+	}
+	resp.ReadBool() // is_internal
+	if n := resp.ReadArrayLen(); n != 3 {
+		t.Errorf("Expected 3 partitions, got %d", n)
+	}
+
+	// Unknown topics are reported, not created
+	resp = conn.request(t, kafka.APIMetadata, 1, new(frame).i32(1).str("missing"))
+	resp.ReadArrayLen()
+	resp.ReadInt32()
+	resp.ReadString()
+	resp.ReadInt32()
+	resp.ReadNullableString()
+	resp.ReadInt32()
+	resp.ReadArrayLen()
+	if code := resp.ReadInt16(); code != kafka.ErrUnknownTopicOrPartition {
+		t.Errorf("Expected UNKNOWN_TOPIC_OR_PARTITION, got %d", code)
+	}
+}
+
+func TestKafkaProduceFetch(t *testing.T) {
+	conn := setupTestKafkaConn(t)
+
+	batch := recordBatch([]byte("k1"), []byte(`{"n":1}`), nil, []byte(`{"n":2}`))
+	resp := conn.request(t, kafka.APIProduce, 3, produceRequest("test-topic", 1, batch))
+	resp.ReadArrayLen()
+	resp.ReadString()
+	resp.ReadArrayLen()
+	if index, code, base := resp.ReadInt32(), resp.ReadInt16(), resp.ReadInt64(); index != 1 || code != kafka.ErrNone || base != 0 {
+		t.Fatalf("Unexpected produce result: partition %d error %d base offset %d", index, code, base)
+	}
+
+	// A second batch continues from the broker's offsets, not the producer's
+	resp = conn.request(t, kafka.APIProduce, 3, produceRequest("test-topic", 1, recordBatch(nil, []byte("3"))))
+	resp.ReadArrayLen()
+	resp.ReadString()
+	resp.ReadArrayLen()
+	resp.ReadInt32()
+	resp.ReadInt16()
+	if base := resp.ReadInt64(); base != 2 {
+		t.Errorf("Expected base offset 2, got %d", base)
+	}
+
+	resp = conn.request(t, kafka.APIFetch, 4, fetchRequest("test-topic", 1, 1, 0))
+	resp.ReadInt32() // throttle_time_ms
+	resp.ReadArrayLen()
+	resp.ReadString()
+	resp.ReadArrayLen()
+	resp.ReadInt32()
+	if code, hw := resp.ReadInt16(), resp.ReadInt64(); code != kafka.ErrNone || hw != 3 {
+		t.Fatalf("Unexpected fetch result: error %d high watermark %d", code, hw)
+	}
+	resp.ReadInt64()    // last_stable_offset
+	resp.ReadArrayLen() // aborted_transactions
+	records, err := kafka.ReadRecordBatches(resp.ReadBytes())
+	if err != nil {
+		t.Fatalf("Failed to decode fetched batch: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if records[0].Offset != 1 || records[0].Key != nil || string(records[0].Value) != `{"n":2}` {
+		t.Errorf("Unexpected record %+v", records[0])
+	}
+	if records[1].Offset != 2 || string(records[1].Value) != "3" {
+		t.Errorf("Unexpected record %+v", records[1])
+	}
+
+	// Past the end of the log
+	resp = conn.request(t, kafka.APIFetch, 4, fetchRequest("test-topic", 1, 10, 0))
+	resp.ReadInt32()
+	resp.ReadArrayLen()
+	resp.ReadString()
+	resp.ReadArrayLen()
+	resp.ReadInt32()
+	if code := resp.ReadInt16(); code != kafka.ErrOffsetOutOfRange {
+		t.Errorf("Expected OFFSET_OUT_OF_RANGE, got %d", code)
+	}
+}
+
+func TestKafkaProduceBatchWithConcurrentAppends(t *testing.T) {
+	conn := setupTestKafkaConn(t)
+	partition, _ := conn.broker.GetPartition("test-topic", 2)
+
+	// Another producer appends to the same partition throughout
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := conn.broker.partitionManager.AppendEvent(partition, "other", []byte("{}")); err != nil {
+				t.Errorf("Append failed: %v", err)
+				return
+			}
+		}
+	}()
+	defer func() { close(done); <-stopped }()
+
+	for n := 0; n < 20; n++ {
+		var keyValues [][]byte
+		for i := 0; i < 5; i++ {
+			keyValues = append(keyValues, []byte(fmt.Sprintf("b%d-%d", n, i)), []byte(strconv.Itoa(i)))
+		}
+		resp := conn.request(t, kafka.APIProduce, 3, produceRequest("test-topic", 2, recordBatch(keyValues...)))
+		resp.ReadArrayLen()
+		resp.ReadString()
+		resp.ReadArrayLen()
+		resp.ReadInt32()
+		code, base := resp.ReadInt16(), resp.ReadInt64()
+		if code != kafka.ErrNone {
+			t.Fatalf("Unexpected produce error %d", code)
+		}
+
+		// The batch's records are stored together from the offset reported
+		events, err := partition.logStorage.Read(base, 1<<20)
+		if err != nil || len(events) < 5 {
+			t.Fatalf("Failed to read batch at offset %d: %v", base, err)
+		}
+		for i, event := range events[:5] {
+			if expected := fmt.Sprintf("b%d-%d", n, i); event.Key != expected || event.Offset != base+int64(i) {
+				t.Fatalf("Expected %s at offset %d, got %s at %d", expected, base+int64(i), event.Key, event.Offset)
+			}
+		}
+	}
+}
+
+func TestKafkaProduceCorruptBatch(t *testing.T) {
+	conn := setupTestKafkaConn(t)
+
+	batch := recordBatch(nil, []byte("x"))
+	batch[len(batch)-1] ^= 0xff // breaks the CRC
+	resp := conn.request(t, kafka.APIProduce, 3, produceRequest("test-topic", 0, batch))
+	resp.ReadArrayLen()
+	resp.ReadString()
+	resp.ReadArrayLen()
+	resp.ReadInt32()
+	if code := resp.ReadInt16(); code != kafka.ErrCorruptMessage {
+		t.Errorf("Expected CORRUPT_MESSAGE, got %d", code)
+	}
+}
+
+func TestKafkaFetchLongPoll(t *testing.T) {
+	consumer := setupTestKafkaConn(t)
+	producer := consumer.dial(t)
+
+	done := make(chan int, 1)
+	go func() {
+		resp := consumer.request(t, kafka.APIFetch, 4, fetchRequest("test-topic", 2, 0, 5000))
+		resp.ReadInt32()
+		resp.ReadArrayLen()
+		resp.ReadString()
+		resp.ReadArrayLen()
+		resp.ReadInt32()
+		resp.ReadInt16()
+		resp.ReadInt64()
+		resp.ReadInt64()
+		resp.ReadArrayLen()
+		records, _ := kafka.ReadRecordBatches(resp.ReadBytes())
+		done <- len(records)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	producer.request(t, kafka.APIProduce, 3, produceRequest("test-topic", 2, recordBatch(nil, []byte("{}"))))
+
+	select {
+	case n := <-done:
+		if n != 1 {
+			t.Errorf("Expected 1 record, got %d", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Long poll not woken by produce")
+	}
+}
+
+func TestKafkaOffsets(t *testing.T) {
+	conn := setupTestKafkaConn(t)
+	conn.request(t, kafka.APIProduce, 3, produceRequest("test-topic", 0, recordBatch(nil, []byte("a"), nil, []byte("b"))))
+
+	// ListOffsets v1: latest then earliest
+	for _, tc := range []struct{ timestamp, offset int64 }{{kafka.TimestampLatest, 2}, {kafka.TimestampEarliest, 0}} {
+		req := new(frame).i32(-1).i32(1).str("test-topic").i32(1).i32(0).i64(tc.timestamp)
+		resp := conn.request(t, kafka.APIListOffsets, 1, req)
+		resp.ReadArrayLen()
+		resp.ReadString()
+		resp.ReadArrayLen()
+		resp.ReadInt32()
+		resp.ReadInt16()
+		resp.ReadInt64() // timestamp
+		if offset := resp.ReadInt64(); offset != tc.offset {
+			t.Errorf("ListOffsets(%d): expected %d, got %d", tc.timestamp, tc.offset, offset)
+		}
+	}
+
+	// FindCoordinator points at this broker
+	resp := conn.request(t, kafka.APIFindCoordinator, 0, new(frame).str("g"))
+	if code := resp.ReadInt16(); code != kafka.ErrNone {
+		t.Errorf("FindCoordinator failed with %d", code)
+	}
+
+	// OffsetCommit v2: group, generation, member, retention, topics
+	commit := new(frame).str("g").i32(-1).str("").i64(-1).i32(1).str("test-topic").i32(1).i32(0).i64(2).str("")
+	resp = conn.request(t, kafka.APIOffsetCommit, 2, commit)
+	resp.ReadArrayLen()
+	resp.ReadString()
+	resp.ReadArrayLen()
+	resp.ReadInt32()
+	if code := resp.ReadInt16(); code != kafka.ErrNone {
+		t.Fatalf("OffsetCommit failed with %d", code)
+	}
+	if offset, err := conn.broker.offsetManager.GetOffset("g", "test-topic", 0); err != nil || offset != 2 {
+		t.Errorf("Expected committed offset 2, got %d (%v)", offset, err)
+	}
+
+	// OffsetFetch v1: the committed partition and one without a commit
+	resp = conn.request(t, kafka.APIOffsetFetch, 1, new(frame).str("g").i32(1).str("test-topic").i32(2).i32(0).i32(1))
+	resp.ReadArrayLen()
+	resp.ReadString()
+	resp.ReadArrayLen()
+	for _, expected := range []int64{2, -1} {
+		resp.ReadInt32()
+		if offset := resp.ReadInt64(); offset != expected {
+			t.Errorf("Expected offset %d, got %d", expected, offset)
+		}
+		resp.ReadNullableString()
+		resp.ReadInt16()
+	}
+}
+
+func TestKafkaUnsupportedVersionClosesConnection(t *testing.T) {
+	conn := setupTestKafkaConn(t)
+
+	conn.send(t, kafka.APIFetch, 99, new(frame))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := protocol.ReadFrame(conn.reader); err == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+// A Kafka request body assembled field by field.
+type frame struct {
+	buf []byte
+}
+
+func (f *frame) i8(v int8) *frame { f.buf = append(f.buf, byte(v)); return f }
+func (f *frame) i16(v int16) *frame {
+	f.buf = binary.BigEndian.AppendUint16(f.buf, uint16(v))
+	return f
+}
+func (f *frame) i32(v int32) *frame {
+	f.buf = binary.BigEndian.AppendUint32(f.buf, uint32(v))
+	return f
+}
+func (f *frame) i64(v int64) *frame {
+	f.buf = binary.BigEndian.AppendUint64(f.buf, uint64(v))
+	return f
+}
+func (f *frame) str(s string) *frame {
+	f.i16(int16(len(s)))
+	f.buf = append(f.buf, s...)
+	return f
+}
+func (f *frame) bytes(b []byte) *frame {
+	f.i32(int32(len(b)))
+	f.buf = append(f.buf, b...)
+	return f
+}
+func (f *frame) varint(v int64) *frame { f.buf = binary.AppendVarint(f.buf, v); return f }
+func (f *frame) varbytes(b []byte) *frame {
+	if b == nil {
+		return f.varint(-1)
+	}
+	f.varint(int64(len(b)))
+	f.buf = append(f.buf, b...)
+	return f
+}
+
+// Build an uncompressed v2 record batch from alternating keys and values.
+func recordBatch(keyValues ...[]byte) []byte {
+	count := len(keyValues) / 2
+
+	body := new(frame).i16(0).i32(int32(count - 1)).i64(1700000000000).i64(1700000000000).i64(-1).i16(-1).i32(-1).i32(int32(count))
+	for i := 0; i < count; i++ {
+		record := new(frame).i8(0).varint(0).varint(int64(i)).varbytes(keyValues[2*i]).varbytes(keyValues[2*i+1]).varint(0)
+		body.varint(int64(len(record.buf)))
+		body.buf = append(body.buf, record.buf...)
+	}
+
+	batch := new(frame).i64(0).i32(int32(9 + len(body.buf))).i32(0).i8(2)
+	batch.buf = binary.BigEndian.AppendUint32(batch.buf, crc32.Checksum(body.buf, crc32.MakeTable(crc32.Castagnoli)))
+	batch.buf = append(batch.buf, body.buf...)
+	return batch.buf
+}
+
+// Produce v3 with acks=1 for a single partition.
+func produceRequest(topic string, partition int32, batch []byte) *frame {
+	return new(frame).i16(-1).i16(1).i32(5000).i32(1).str(topic).i32(1).i32(partition).bytes(batch)
+}
+
+// Fetch v4 for a single partition.
+func fetchRequest(topic string, partition int32, offset int64, maxWaitMs int32) *frame {
+	return new(frame).i32(-1).i32(maxWaitMs).i32(1).i32(1 << 20).i8(0).i32(1).str(topic).i32(1).i32(partition).i64(offset).i32(1 << 20)
+}
+
+type kafkaTestConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	addr          string
+	broker        *Broker
+	correlationID int32
+}
+
+// Send a request with a v1 header.
+func (c *kafkaTestConn) send(t *testing.T, apiKey, version int16, body *frame) int32 {
+	t.Helper()
+
+	c.correlationID++
+	clientID := "test"
+	req := new(frame).i16(apiKey).i16(version).i32(c.correlationID).str(clientID)
+	req.buf = append(req.buf, body.buf...)
+
+	sized := binary.BigEndian.AppendUint32(nil, uint32(len(req.buf)))
+	if _, err := c.Write(append(sized, req.buf...)); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	return c.correlationID
+}
+
+// Send a request and return a reader positioned at the response body.
+func (c *kafkaTestConn) request(t *testing.T, apiKey, version int16, body *frame) *kafka.Reader {
+	t.Helper()
+
+	correlationID := c.send(t, apiKey, version, body)
+	payload, err := protocol.ReadFrame(c.reader)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	resp := kafka.NewReader(payload)
+	if id := resp.ReadInt32(); id != correlationID {
+		t.Fatalf("Expected correlation ID %d, got %d", correlationID, id)
+	}
+	return resp
+}
+
+// Open another connection to the same listener.
+func (c *kafkaTestConn) dial(t *testing.T) *kafkaTestConn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", c.addr, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &kafkaTestConn{Conn: conn, reader: bufio.NewReader(conn), addr: c.addr, broker: c.broker}
+}
+
+// setupTestKafkaConn starts a Kafka listener on a random port over the test broker and connects to it.
+func setupTestKafkaConn(t *testing.T) *kafkaTestConn {
+	t.Helper()
+
+	s := setupTestServer()
+	server := NewKafkaServer(s.broker, 0)
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+
+	// Dial 127.0.0.1 so the advertised address matches what the client used
+	_, port, _ := net.SplitHostPort(server.Addr().String())
+	c := &kafkaTestConn{addr: net.JoinHostPort("127.0.0.1", port), broker: s.broker}
+	return c.dial(t)
+}
@@ -0,0 +1,206 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Where a topic's partitions store their events.
+type StorageType string
+
+const (
+	// Log files in the data directory; the default.
+	StorageFile StorageType = "file"
+
+	// In memory only: nothing is written to disk, and events are gone when the
+	// broker stops. For ephemeral topics and brokers in tests.
+	StorageMemory StorageType = "memory"
+)
+
+// The topic setting choosing its StorageType, overriding the broker's default.
+// It can only change while every partition of the topic is empty.
+const storageTypeConfig = "storage.type"
+
+func ParseStorageType(name string) (StorageType, error) {
+	switch StorageType(name) {
+	case StorageFile, StorageMemory:
+		return StorageType(name), nil
+	}
+	return "", fmt.Errorf("unknown storage type %q (use file or memory)", name)
+}
+
+// The topic's storage.type, or "" to use the broker's default.
+func (t *Topic) storageType() StorageType {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return StorageType(t.Config[storageTypeConfig])
+}
+
+// A PartitionLog kept in memory. Records are laid out as in a log file, without
+// the header, so Section serves the same bytes LogStorage would. Events are
+// stored one record each whatever codec they were appended with, and payloads
+// are never encrypted, since nothing is at rest.
+type MemoryLog struct {
+	// called with the events of each append, in offset order, while mu is held
+	onAppend func([]*StoredEvent)
+
+	// mu guards the fields below. data only grows in place, so readers may keep
+	// slices of it after unlocking; Truncate replaces it.
+	mu        sync.RWMutex
+	data      []byte
+	positions []int64 // of each event's record in data, by offset
+	newest    []int64 // newest timestamp up to each event, by offset
+
+	// closed and replaced on every append to wake long-polling fetches.
+	notifyMu sync.Mutex
+	notify   chan struct{}
+}
+
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{notify: make(chan struct{})}
+}
+
+func (m *MemoryLog) Append(event *StoredEvent) (int64, error) {
+	return m.AppendBatch([]*StoredEvent{event}, CodecNone)
+}
+
+func (m *MemoryLog) AppendBatch(events []*StoredEvent, codec Codec) (int64, error) {
+	records := make([][]byte, len(events))
+	for i, event := range events {
+		data, err := serializeEvent(event)
+		if err != nil {
+			return 0, fmt.Errorf("failed to serialize event: %w", err)
+		}
+		records[i] = data
+	}
+
+	m.mu.Lock()
+	first := int64(len(m.positions))
+	for i, data := range records {
+		offset := first + int64(i)
+		binary.BigEndian.PutUint64(data[0:8], uint64(offset))
+		events[i].Offset = offset
+		m.positions = append(m.positions, int64(len(m.data)))
+		m.data = append(m.data, data...)
+		newest := events[i].Timestamp
+		if offset > 0 {
+			newest = max(newest, m.newest[offset-1])
+		}
+		m.newest = append(m.newest, newest)
+	}
+	if m.onAppend != nil {
+		m.onAppend(events)
+	}
+	m.mu.Unlock()
+
+	m.notifyMu.Lock()
+	close(m.notify)
+	m.notify = make(chan struct{})
+	m.notifyMu.Unlock()
+	return first, nil
+}
+
+// The stored records from startOffset that fit in maxBytes, as LogStorage.Section
+// locates them, or nil at or past the end.
+func (m *MemoryLog) records(startOffset int64, maxBytes int) ([]byte, int64, int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if startOffset >= int64(len(m.positions)) {
+		return nil, startOffset, 0
+	}
+	first, start, end, count := span(m.positions, int64(len(m.data)), startOffset, maxBytes)
+	return m.data[start:end], first, count
+}
+
+func (m *MemoryLog) Read(startOffset int64, maxBytes int) ([]*StoredEvent, error) {
+	if startOffset < 0 {
+		return nil, fmt.Errorf("invalid offset %d", startOffset)
+	}
+	data, _, _ := m.records(startOffset, maxBytes)
+	if data == nil {
+		return make([]*StoredEvent, 0), nil
+	}
+	events, err := deserializeEvents(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize events: %w", err)
+	}
+	return events, nil
+}
+
+func (m *MemoryLog) Section(startOffset int64, maxBytes int) (*io.SectionReader, int64, int, error) {
+	if startOffset < 0 {
+		return nil, 0, 0, fmt.Errorf("invalid offset %d", startOffset)
+	}
+	data, first, count := m.records(startOffset, maxBytes)
+	return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), first, count, nil
+}
+
+func (m *MemoryLog) StartOffset() int64 {
+	return 0
+}
+
+func (m *MemoryLog) NextOffset() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.positions))
+}
+
+func (m *MemoryLog) BytesAfter(startOffset int64) int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if startOffset < 0 || startOffset >= int64(len(m.positions)) {
+		return 0
+	}
+	return int64(len(m.data)) - m.positions[startOffset]
+}
+
+// Every event is indexed by the newest timestamp up to it, so the first event
+// whose own is at or after timestamp is the first whose newest is.
+func (m *MemoryLog) OffsetForTimestamp(timestamp int64) (int64, int64, error) {
+	m.mu.RLock()
+	offset := int64(sort.Search(len(m.newest), func(i int) bool { return m.newest[i] >= timestamp }))
+	m.mu.RUnlock()
+	return scanForTimestamp(m, offset, timestamp)
+}
+
+func (m *MemoryLog) Changed() <-chan struct{} {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	return m.notify
+}
+
+func (m *MemoryLog) Encrypted() bool {
+	return false
+}
+
+func (m *MemoryLog) ReadOnly() *ReadOnlyError {
+	return nil
+}
+
+func (m *MemoryLog) Truncate(offset int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if offset < 0 || offset > int64(len(m.positions)) {
+		return fmt.Errorf("invalid offset %d", offset)
+	}
+	if offset == int64(len(m.positions)) {
+		return nil
+	}
+	// A copy, so appends don't overwrite what readers still hold
+	m.data = append([]byte(nil), m.data[:m.positions[offset]]...)
+	m.positions = append([]int64(nil), m.positions[:offset]...)
+	m.newest = append([]int64(nil), m.newest[:offset]...)
+	return nil
+}
+
+func (m *MemoryLog) Sync() error {
+	return nil
+}
+
+func (m *MemoryLog) Close() error {
+	return nil
+}
@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartitionLogImplementations(t *testing.T) {
+	for name, open := range map[string]func(t *testing.T) PartitionLog{
+		"file": func(t *testing.T) PartitionLog {
+			storage, err := NewLogStorage(filepath.Join(t.TempDir(), "partition-0.log"))
+			if err != nil {
+				t.Fatalf("Failed to create log storage: %v", err)
+			}
+			return storage
+		},
+		"memory": func(t *testing.T) PartitionLog { return NewMemoryLog() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			log := open(t)
+			defer log.Close()
+
+			changed := log.Changed()
+			for i := 0; i < 5; i++ {
+				if offset, err := log.Append(&StoredEvent{Key: fmt.Sprintf("k%d", i), Payload: []byte(`{"n":1}`)}); err != nil || offset != int64(i) {
+					t.Fatalf("Expected offset %d, got %d (%v)", i, offset, err)
+				}
+			}
+			select {
+			case <-changed:
+			default:
+				t.Errorf("Expected appends to signal Changed")
+			}
+			if log.StartOffset() != 0 || log.NextOffset() != 5 {
+				t.Errorf("Expected offsets 0 to 5, got %d to %d", log.StartOffset(), log.NextOffset())
+			}
+			readAll(t, log, 5)
+			if log.BytesAfter(0) <= log.BytesAfter(4) || log.BytesAfter(5) != 0 {
+				t.Errorf("Unexpected bytes after: %d, %d, %d", log.BytesAfter(0), log.BytesAfter(4), log.BytesAfter(5))
+			}
+
+			// Raw records decode to the same events
+			section, first, count, err := log.Section(2, 1<<20)
+			if err != nil || first != 2 || count != 3 {
+				t.Fatalf("Unexpected section: first %d, count %d (%v)", first, count, err)
+			}
+			data, _ := io.ReadAll(section)
+			if events, err := deserializeEvents(data, nil); err != nil || len(events) != 3 || events[0].Key != "k2" {
+				t.Errorf("Unexpected raw events %+v (%v)", events, err)
+			}
+
+			// Truncating drops the tail, and appends carry on from there
+			if err := log.Truncate(3); err != nil {
+				t.Fatalf("Truncate failed: %v", err)
+			}
+			if events, _ := log.Read(3, 1<<20); log.NextOffset() != 3 || len(events) != 0 {
+				t.Errorf("Expected the log to end at 3, got %d with %d events after it", log.NextOffset(), len(events))
+			}
+			if offset, err := log.Append(&StoredEvent{Key: "k3", Payload: []byte(`{}`)}); err != nil || offset != 3 {
+				t.Errorf("Expected the next append at 3, got %d (%v)", offset, err)
+			}
+			readAll(t, log, 4)
+			if err := log.Truncate(10); err == nil {
+				t.Errorf("Expected truncating past the end to fail")
+			}
+		})
+	}
+}
+
+func TestMemoryTopicOnFileBroker(t *testing.T) {
+	dataDir := t.TempDir()
+	b := NewBroker(0, dataDir)
+	if err := b.AddTopicWithConfig("scratch", 1, map[string]string{"storage.type": "memory"}); err != nil {
+		t.Fatalf("Failed to add topic: %v", err)
+	}
+	if err := b.AddTopicWithConfig("orders", 1, map[string]string{"storage.type": "tape"}); err == nil {
+		t.Errorf("Expected an unknown storage type to be refused")
+	}
+	if err := b.AddTopic("orders", 1); err != nil {
+		t.Fatalf("Failed to add topic: %v", err)
+	}
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+
+	partition, _ := b.GetPartition("scratch", 0)
+	if _, err := b.partitionManager.AppendEvent(partition, "k0", []byte(`{}`)); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if events, err := b.partitionManager.FetchEvents(partition, 0, 1<<20); err != nil || len(events) != 1 {
+		t.Errorf("Unexpected fetch %+v (%v)", events, err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "scratch")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing on disk for a memory topic")
+	}
+	if err := b.SetTopicConfig("scratch", "storage.type", "file"); err == nil {
+		t.Errorf("Expected changing the storage of a topic to be refused")
+	}
+
+	// Snapshots leave it out, and it comes back empty
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+	if _, err := b.Snapshot(snapshot); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if _, err := ValidateSnapshot(snapshot); err != nil {
+		t.Errorf("Expected a sound snapshot, got %v", err)
+	}
+	b.Close()
+
+	b = NewBroker(0, dataDir)
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Failed to restart broker: %v", err)
+	}
+	defer b.Close()
+	partition, err := b.GetPartition("scratch", 0)
+	if err != nil {
+		t.Fatalf("Expected the topic to be kept: %v", err)
+	}
+	if _, ok := partition.logStorage.(*MemoryLog); !ok || partition.logStorage.NextOffset() != 0 {
+		t.Errorf("Expected an empty memory log, got %T at %d", partition.logStorage, partition.logStorage.NextOffset())
+	}
+}
@@ -3,8 +3,10 @@ package broker
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 // track topics, partitions, and consumer groups
@@ -13,13 +15,19 @@ import (
 // It persists metadata to disk and loads it on startup.
 type MetadataManager struct {
 	mu     sync.RWMutex
+	fs     fileSystem
 	path   string
 	topics map[string]*Topic
+
+	// whether the file on disk is known to be ours to overwrite: loaded, saved, or
+	// checked by checkOverwrite. Topics can be added before Load.
+	writable atomic.Bool
 }
 
 // create a new MetadataManager.
 func NewMetadataManager(path string) *MetadataManager {
 	return &MetadataManager{
+		fs:     osFS{},
 		path:   path,
 		topics: make(map[string]*Topic),
 	}
@@ -30,16 +38,29 @@ func (m *MetadataManager) Save() error {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	file, err := os.Create(m.path)
-	if err != nil {
-		return fmt.Errorf("failed to create metadata file: %w", err)
+	// Kept in memory only when there is no path, for brokers without a data directory
+	if m.path == "" {
+		return nil
+	}
+	if !m.writable.Load() {
+		if err := checkOverwrite(m.fs, m.path); err != nil {
+			return err
+		}
+		m.writable.Store(true)
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(m.topics); err != nil {
+	data, err := json.Marshal(metadataFile{Version: FormatVersion, Topics: m.topics})
+	if err != nil {
 		return fmt.Errorf("failed to encode metadata: %w", err)
 	}
+	// Replaced whole, so a crash while saving leaves the previous metadata
+	err = writeFileAtomic(m.fs, m.path, func(out io.Writer) error {
+		_, err := out.Write(append(data, '\n'))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
 
 	return nil
 }
@@ -49,20 +70,31 @@ func (m *MetadataManager) Load() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	file, err := os.Open(m.path)
+	if m.path == "" {
+		return nil
+	}
+	data, err := m.fs.ReadFile(m.path)
 	if os.IsNotExist(err) {
 		// No metadata file exists; this is fine for a fresh start.
 		return nil
 	} else if err != nil {
 		return fmt.Errorf("failed to open metadata file: %w", err)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&m.topics); err != nil {
+	var loaded metadataFile
+	if err := decodeVersioned(m.path, data, &loaded); err != nil {
 		return fmt.Errorf("failed to decode metadata: %w", err)
 	}
 
+	m.writable.Store(true)
+
+	// Topics added before loading are the ones in use; saving must see their changes
+	for name, topic := range loaded.Topics {
+		if _, exists := m.topics[name]; !exists {
+			m.topics[name] = topic
+		}
+	}
+
 	return nil
 }
 
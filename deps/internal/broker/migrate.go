@@ -0,0 +1,460 @@
+package broker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A data file that Migrate rewrote or copied, relative to the data directory.
+type MigratedFile struct {
+	Path string
+
+	// format version it was in; files already in FormatVersion are copied as is,
+	// or left alone when migrating in place.
+	Version int
+
+	// records rewritten, for a log
+	Records int64
+}
+
+// Rewrite the data directory src in the current format version. With dst empty or
+// equal to src, the files are replaced in place; otherwise the converted data is
+// written to dst, which must not exist or be empty, and src is left untouched. The
+// broker must not be running on src.
+//
+// Logs get a current header, and the offset stored in each record is rewritten
+// with its position in the log, since version 1 logs may have been written
+// without offsets. Offsets committed in a version 1 offsets.json are byte positions
+// in the logs, as brokers then used, and are converted to record offsets. Sealed
+// segments exist only in the current version; they are copied with their log.
+// Encrypted records are copied without being opened. A log with a corrupt record
+// fails the migration; repair it first.
+//
+// Every file is written to a temporary file and renamed into place, and logs come
+// before metadata.json, so a migration that is interrupted can be run again.
+func Migrate(src, dst string) ([]MigratedFile, error) {
+	inPlace := dst == "" || filepath.Clean(dst) == filepath.Clean(src)
+	if inPlace {
+		dst = src
+	} else {
+		entries, err := os.ReadDir(dst)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			return nil, fmt.Errorf("%s is not empty", dst)
+		}
+	}
+
+	metadataPath := filepath.Join(src, "metadata.json")
+	offsetsPath := filepath.Join(src, "offsets.json")
+	if _, err := os.Stat(metadataPath); err != nil {
+		return nil, fmt.Errorf("%s is not a data directory: %w", src, err)
+	}
+	logs, err := dataDirLogs(metadataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse anything newer before touching a file
+	for _, path := range []string{metadataPath, offsetsPath} {
+		if version, err := jsonFileVersion(path); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		} else if version > FormatVersion {
+			return nil, &FormatVersionError{Path: path, Version: version}
+		}
+	}
+	for _, log := range logs {
+		path := filepath.Join(src, log)
+		if version, err := logFileVersion(path); err != nil {
+			return nil, err
+		} else if version > FormatVersion {
+			return nil, &FormatVersionError{Path: path, Version: version}
+		}
+	}
+
+	// Version 1 offsets are byte positions in the logs, so read where the records
+	// start before the logs are rewritten
+	var starts map[string][]recordStart
+	if version, _ := jsonFileVersion(offsetsPath); version == 1 {
+		if starts, err = logRecordStarts(src, logs); err != nil {
+			return nil, err
+		}
+	}
+
+	var migrated []MigratedFile
+	for _, log := range logs {
+		file, err := migrateLog(filepath.Join(src, log), filepath.Join(dst, log), inPlace)
+		if err != nil {
+			return migrated, err
+		}
+		if file != nil {
+			file.Path = log
+			migrated = append(migrated, *file)
+		}
+		if inPlace {
+			continue
+		}
+
+		segments, err := localSegmentFiles(filepath.Join(src, log))
+		if err != nil {
+			return migrated, err
+		}
+		for _, path := range segments {
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return migrated, err
+			}
+			if err := copyFile(path, filepath.Join(dst, rel)); err != nil {
+				return migrated, err
+			}
+			migrated = append(migrated, MigratedFile{Path: rel, Version: FormatVersion})
+		}
+	}
+
+	// metadata.json last: until it is rewritten the broker refuses the directory
+	version, err := migrateJSON(offsetsPath, filepath.Join(dst, "offsets.json"), inPlace,
+		func(offsets map[string]int64) any {
+			return offsetsFile{Version: FormatVersion, Offsets: indexOffsets(offsets, starts)}
+		})
+	if err != nil {
+		return migrated, err
+	}
+	if version != 0 {
+		migrated = append(migrated, MigratedFile{Path: "offsets.json", Version: version})
+	}
+
+	// Topics are kept as they are, so nothing in them is lost in the round trip
+	version, err = migrateJSON(metadataPath, filepath.Join(dst, "metadata.json"), inPlace,
+		func(topics map[string]json.RawMessage) any {
+			return struct {
+				Version int                        `json:"version"`
+				Topics  map[string]json.RawMessage `json:"topics"`
+			}{FormatVersion, topics}
+		})
+	if err != nil {
+		return migrated, err
+	}
+	if version != 0 {
+		migrated = append(migrated, MigratedFile{Path: "metadata.json", Version: version})
+	}
+
+	return migrated, nil
+}
+
+// The partition logs of the topics in metadata.json, relative to the data
+// directory, in any version.
+func dataDirLogs(metadataPath string) ([]string, error) {
+	data, err := os.ReadFile(metadataPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	topics := make(map[string]*Topic)
+	version, err := jsonVersion(data)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("%s: %w", metadataPath, err)
+	case version == 1:
+		err = json.Unmarshal(data, &topics)
+	case version <= FormatVersion:
+		var file metadataFile
+		err = json.Unmarshal(data, &file)
+		topics = file.Topics
+	default:
+		return nil, &FormatVersionError{Path: metadataPath, Version: version}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", metadataPath, err)
+	}
+
+	var logs []string
+	for name, topic := range topics {
+		for id := range topic.Partitions {
+			logs = append(logs, filepath.Join(name, fmt.Sprintf("partition-%d.log", id)))
+		}
+	}
+	sort.Strings(logs)
+	return logs, nil
+}
+
+// Where a record starts, counted from the first record, and how many events it holds.
+type recordStart struct {
+	position int64
+	count    int
+}
+
+// The records of each log, by "topic-partition". Positions are counted from the
+// first record, as in a version 1 log, whatever the log's version: migration
+// leaves the records the same size, so this also holds for a log already
+// rewritten by an interrupted migration.
+func logRecordStarts(src string, logs []string) (map[string][]recordStart, error) {
+	starts := make(map[string][]recordStart, len(logs))
+	for _, log := range logs {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(log), "partition-%d.log", &id); err != nil {
+			return nil, fmt.Errorf("%s: %w", log, err)
+		}
+		key := fmt.Sprintf("%s-%d", filepath.Dir(log), id)
+
+		file, err := os.Open(filepath.Join(src, log))
+		if os.IsNotExist(err) {
+			starts[key] = nil
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		version, err := logFileVersion(file.Name())
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		var first int64
+		if version > 1 {
+			first = logHeaderSize
+		}
+		_, err = ReadLog(file, nil, func(record LogRecord) error {
+			starts[key] = append(starts[key], recordStart{position: record.Position - first, count: record.Count})
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", log, err)
+		}
+	}
+	return starts, nil
+}
+
+// Convert version 1 committed offsets, the byte position of the next record to
+// read, to the offset of that record. Keys are "consumerGroup-topic-partition";
+// the longest topic-partition that ends a key is taken as its own. Offsets of
+// partitions with no log in metadata.json can't be converted and are dropped. With
+// starts nil the offsets are already record offsets and are kept as they are.
+func indexOffsets(offsets map[string]int64, starts map[string][]recordStart) map[string]int64 {
+	if starts == nil {
+		return offsets
+	}
+
+	converted := make(map[string]int64, len(offsets))
+	for key, position := range offsets {
+		partition := ""
+		for candidate := range starts {
+			if strings.HasSuffix(key, "-"+candidate) && len(candidate) > len(partition) {
+				partition = candidate
+			}
+		}
+		if partition == "" {
+			continue
+		}
+
+		// Events in the records that start before the position
+		var offset int64
+		for _, record := range starts[partition] {
+			if record.position >= position {
+				break
+			}
+			offset += int64(record.count)
+		}
+		converted[key] = offset
+	}
+	return converted
+}
+
+func jsonFileVersion(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return jsonVersion(data)
+}
+
+// Version of the log at path; a missing log is created by the broker, in the
+// current version.
+func logFileVersion(path string) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return FormatVersion, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, logHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	return logVersion(header[:n]), nil
+}
+
+// Rewrite an older log at dst with a current header and positional offsets, or
+// copy a current one. Returns nil for a missing log, or one already current in place.
+func migrateLog(src, dst string, inPlace bool) (*MigratedFile, error) {
+	version, err := logFileVersion(src)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(src); os.IsNotExist(err) || (inPlace && version == FormatVersion) {
+		return nil, nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	migrated := &MigratedFile{Version: version}
+	err = writeFileAtomic(osFS{}, dst, func(out io.Writer) error {
+		if version == FormatVersion {
+			_, err := io.Copy(out, in)
+			return err
+		}
+
+		if _, err := out.Write(logHeader()); err != nil {
+			return err
+		}
+		var next int64
+		_, err := ReadLog(in, nil, func(record LogRecord) error {
+			data := make([]byte, record.Size)
+			if _, err := in.ReadAt(data, record.Position); err != nil {
+				return err
+			}
+			binary.BigEndian.PutUint64(data[0:8], uint64(next))
+			if _, err := out.Write(data); err != nil {
+				return err
+			}
+			next += int64(record.Count)
+			migrated.Records++
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		var corrupt *CorruptRecordError
+		if errors.As(err, &corrupt) {
+			return nil, fmt.Errorf("%s: %w; run depslog repair on it first", src, err)
+		}
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	return migrated, nil
+}
+
+// Wrap a version 1 metadata.json or offsets.json, a bare map, with wrap, set the
+// version of a later one, or copy a current one. Returns the version it was in, or 0 if it is missing or already
+// current in place.
+func migrateJSON[T any](src, dst string, inPlace bool, wrap func(T) any) (int, error) {
+	data, err := os.ReadFile(src)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	version, err := jsonVersion(data)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", src, err)
+	}
+	if inPlace && version == FormatVersion {
+		return 0, nil
+	}
+
+	switch {
+	case version == 1:
+		var legacy T
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return 0, fmt.Errorf("%s: %w", src, err)
+		}
+		if data, err = json.Marshal(wrap(legacy)); err != nil {
+			return 0, err
+		}
+		data = append(data, '\n')
+	case version < FormatVersion:
+		// The envelope is unchanged since version 2
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return 0, fmt.Errorf("%s: %w", src, err)
+		}
+		delete(fields, "version")
+		rest, err := json.Marshal(fields)
+		if err != nil {
+			return 0, err
+		}
+		// "version" first, as the broker writes it
+		data = []byte(`{"version":` + strconv.Itoa(FormatVersion))
+		if len(rest) > 2 {
+			data = append(data, ',')
+		}
+		data = append(append(data, rest[1:]...), '\n')
+	}
+
+	err = writeFileAtomic(osFS{}, dst, func(out io.Writer) error {
+		_, err := out.Write(data)
+		return err
+	})
+	return version, err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFileAtomic(osFS{}, dst, func(out io.Writer) error {
+		_, err := io.Copy(out, in)
+		return err
+	})
+}
+
+// Write a file through fn into a temporary file next to path, then sync it and
+// rename it over path, so path is either untouched or complete.
+func writeFileAtomic(fsys fileSystem, path string, fn func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := fsys.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := fsys.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer fsys.Remove(file.Name())
+
+	if err := fn(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := fsys.Rename(file.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename durable
+	d, err := fsys.OpenFile(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
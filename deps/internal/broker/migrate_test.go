@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateVersion1DataDir(t *testing.T) {
+	src := t.TempDir()
+	writeVersion1DataDir(t, src)
+
+	// The broker refuses it, pointing at the migration
+	b := NewBroker(0, src)
+	var versionErr *FormatVersionError
+	if err := b.Listen(); !errors.As(err, &versionErr) || versionErr.Version != 1 {
+		t.Fatalf("Expected a version 1 error, got %v", err)
+	}
+	b.Close()
+
+	// Nor does it overwrite what it couldn't load, even with a topic added first
+	b = NewBroker(0, src)
+	if err := b.AddTopic("audit", 1); !errors.As(err, &versionErr) {
+		t.Errorf("Expected adding a topic over version 1 metadata to fail, got %v", err)
+	}
+	b.Close()
+
+	// Into a new directory, leaving the original alone
+	original, _ := os.ReadFile(filepath.Join(src, "orders", "partition-0.log"))
+	dst := filepath.Join(t.TempDir(), "migrated")
+	migrated, err := Migrate(src, dst)
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if len(migrated) != 3 || migrated[0].Path != filepath.Join("orders", "partition-0.log") || migrated[0].Records != 3 {
+		t.Errorf("Unexpected migrated files %+v", migrated)
+	}
+	if data, _ := os.ReadFile(filepath.Join(src, "orders", "partition-0.log")); !bytes.Equal(data, original) {
+		t.Errorf("Expected the source log to be untouched")
+	}
+
+	// Stored offsets are rewritten with their positions
+	data, _ := os.ReadFile(filepath.Join(dst, "orders", "partition-0.log"))
+	var offsets []int64
+	ReadLog(bytes.NewReader(data), nil, func(record LogRecord) error {
+		offsets = append(offsets, record.Offset)
+		return nil
+	})
+	if len(offsets) != 3 || offsets[2] != 2 {
+		t.Errorf("Expected stored offsets 0-2, got %v", offsets)
+	}
+
+	b = NewBroker(0, dst)
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Failed to start on the migrated directory: %v", err)
+	}
+	partition, err := b.GetPartition("orders", 0)
+	if err != nil {
+		t.Fatalf("Expected the migrated topic: %v", err)
+	}
+	events, err := partition.logStorage.Read(1, 1<<20)
+	if err != nil || len(events) != 2 || events[0].Key != "k1" || events[0].Offset != 1 {
+		t.Errorf("Unexpected events after migration: %+v (%v)", events, err)
+	}
+	// Committed byte positions become the offsets of the records there
+	if offset, err := b.offsetManager.GetOffset("billing", "orders", 0); err != nil || offset != 2 {
+		t.Errorf("Expected committed offset 2, got %d (%v)", offset, err)
+	}
+	if offset, err := b.offsetManager.GetOffset("audit", "orders", 0); err != nil || offset != 3 {
+		t.Errorf("Expected committed offset 3 at the end of the log, got %d (%v)", offset, err)
+	}
+	if _, err := b.offsetManager.GetOffset("billing", "refunds", 0); err == nil {
+		t.Errorf("Expected the offset of a topic without a log to be dropped")
+	}
+	b.Close()
+
+	// In place, and again, which finds nothing left to do
+	if _, err := Migrate(src, ""); err != nil {
+		t.Fatalf("Migrate in place failed: %v", err)
+	}
+	if migrated, err := Migrate(src, src); err != nil || len(migrated) != 0 {
+		t.Errorf("Expected a second migration to do nothing, got %+v (%v)", migrated, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(src, "orders", "partition-0.log")); !bytes.HasPrefix(data, logHeader()) {
+		t.Errorf("Expected the log to be migrated in place")
+	}
+}
+
+func TestMigrateVersion2DataDir(t *testing.T) {
+	dir := t.TempDir()
+	writeVersion1DataDir(t, dir)
+	if _, err := Migrate(dir, ""); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	// Version 2 differs only in its version markers
+	path := filepath.Join(dir, "orders", "partition-0.log")
+	file, _ := os.OpenFile(path, os.O_WRONLY, 0644)
+	file.WriteAt([]byte{0, 0, 0, 2}, 4)
+	file.Close()
+	for _, name := range []string{"metadata.json", "offsets.json"} {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		os.WriteFile(filepath.Join(dir, name), bytes.Replace(data, []byte(`"version":3`), []byte(`"version":2`), 1), 0644)
+	}
+
+	migrated, err := Migrate(dir, "")
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if len(migrated) != 3 || migrated[0].Version != 2 || migrated[0].Records != 3 {
+		t.Errorf("Unexpected migrated files %+v", migrated)
+	}
+	b := NewBroker(0, dir)
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Failed to start on the migrated directory: %v", err)
+	}
+	defer b.Close()
+	// Committed byte positions become the offsets of the records there
+	if offset, err := b.offsetManager.GetOffset("billing", "orders", 0); err != nil || offset != 2 {
+		t.Errorf("Expected committed offset 2, got %d (%v)", offset, err)
+	}
+	if offset, err := b.offsetManager.GetOffset("audit", "orders", 0); err != nil || offset != 3 {
+		t.Errorf("Expected committed offset 3 at the end of the log, got %d (%v)", offset, err)
+	}
+	if _, err := b.offsetManager.GetOffset("billing", "refunds", 0); err == nil {
+		t.Errorf("Expected the offset of a topic without a log to be dropped")
+	}
+}
+
+func TestNewerFormatVersionRejected(t *testing.T) {
+	dir := t.TempDir()
+	writeVersion1DataDir(t, dir)
+	if _, err := Migrate(dir, ""); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	// A log written by a later broker
+	path := filepath.Join(dir, "orders", "partition-0.log")
+	file, _ := os.OpenFile(path, os.O_WRONLY, 0644)
+	version := make([]byte, 4)
+	binary.BigEndian.PutUint32(version, FormatVersion+1)
+	file.WriteAt(version, 4)
+	file.Close()
+
+	var versionErr *FormatVersionError
+	if _, err := NewLogStorage(path); !errors.As(err, &versionErr) || versionErr.Version != FormatVersion+1 {
+		t.Errorf("Expected opening a newer log to fail, got %v", err)
+	}
+	if _, err := Migrate(dir, ""); !errors.As(err, &versionErr) {
+		t.Errorf("Expected migrating a newer log to fail, got %v", err)
+	}
+}
+
+// writeVersion1DataDir writes a data directory as brokers did before the format
+// was versioned: topic "orders" with three events in partition 0, all stored with
+// offset 0, and offsets committed as byte positions: by group "billing" at the
+// third event, by "audit" at the end of the log, and by "billing" for a deleted
+// topic "refunds".
+func writeVersion1DataDir(t *testing.T, dir string) {
+	t.Helper()
+
+	metadata := `{"orders":{"Name":"orders","NumPartitions":1,"Partitions":{"0":{"Topic":"orders","ID":0}}}}`
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), []byte(metadata+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var log []byte
+	var third int
+	for _, key := range []string{"k0", "k1", "k2"} {
+		record, err := serializeEvent(&StoredEvent{Key: key, Payload: []byte(`{}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key == "k2" {
+			third = len(log)
+		}
+		log = append(log, record...)
+	}
+	offsets := fmt.Sprintf(`{"billing-orders-0":%d,"audit-orders-0":%d,"billing-refunds-0":40}`, third, len(log))
+	if err := os.WriteFile(filepath.Join(dir, "offsets.json"), []byte(offsets+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "orders"), 0755)
+	if err := os.WriteFile(filepath.Join(dir, "orders", "partition-0.log"), log, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
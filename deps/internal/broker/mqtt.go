@@ -0,0 +1,683 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"example.com/deps/internal/protocol/mqtt"
+)
+
+// Packets queued for one connection, and QoS 1 messages held for an offline
+// persistent session, before the client is treated as too slow.
+const mqttSessionQueue = 1000
+
+// How long routing waits after a partition fails to read before trying again,
+// doubling while it keeps failing.
+const (
+	mqttRouteRetry    = 1 * time.Second
+	mqttRouteMaxRetry = 30 * time.Second
+)
+
+// Serve MQTT 3.1.1 so devices can publish into and subscribe to DEPS topics.
+//
+// The first level of an MQTT topic name selects the DEPS topic and the rest of the
+// path becomes the event key: "telemetry/device42/temp" is appended to topic
+// "telemetry" with key "device42/temp", so one device's messages stay in one
+// partition. Payloads are stored as-is.
+//
+// Subscriptions are fed by tailing the partitions of every DEPS topic a filter can
+// match, so subscribers also see events published over HTTP or the other protocols,
+// under the topic name "<topic>/<key>". QoS 0 and 1 are supported; QoS 2
+// subscriptions are granted QoS 1. Sessions and retained messages are kept in memory,
+// with retained messages also saved to disk.
+type MQTTServer struct {
+	broker       *Broker
+	port         int
+	listener     net.Listener
+	conns        connSet
+	retainedPath string
+
+	// stops the partition routers
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	sessions map[string]*mqttSession
+	retained map[string]*mqtt.Message // topic name → message
+	routers  map[string]bool          // DEPS topics being tailed
+
+	// generates client IDs for clients that connect without one
+	anonymous atomic.Int64
+}
+
+// State kept for a client ID, across connections when CleanSession is false.
+type mqttSession struct {
+	clientID string
+	clean    bool
+
+	mu            sync.Mutex
+	conn          *mqttConn // nil while offline
+	subscriptions map[string]byte
+	inflight      map[uint16]*mqtt.Publish // QoS 1 sent, awaiting PUBACK
+	queue         []*mqtt.Message          // QoS 1 messages that arrived while offline
+	nextPacketID  uint16
+}
+
+// An open client connection. Packets are written by a dedicated goroutine so a
+// slow client never blocks the routers delivering to it.
+type mqttConn struct {
+	conn      net.Conn
+	out       chan mqtt.Packet
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type mqttRetained struct {
+	Payload []byte `json:"payload"`
+	QoS     byte   `json:"qos"`
+}
+
+// New MQTT server for the broker. Retained messages are saved to retainedPath
+// unless it is empty.
+func NewMQTTServer(broker *Broker, port int, retainedPath string) *MQTTServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MQTTServer{
+		broker:       broker,
+		port:         port,
+		retainedPath: retainedPath,
+		ctx:          ctx,
+		cancel:       cancel,
+		sessions:     make(map[string]*mqttSession),
+		retained:     make(map[string]*mqtt.Message),
+		routers:      make(map[string]bool),
+	}
+}
+
+// Load retained messages and bind the listening socket. Separate from Serve so
+// startup errors surface before the broker blocks.
+func (s *MQTTServer) Listen() error {
+	if err := s.loadRetained(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", s.port, err)
+	}
+	s.listener = listener
+	fmt.Printf("Broker MQTT listener on %s\n", listener.Addr())
+	return nil
+}
+
+// Accept connections until the listener is closed.
+func (s *MQTTServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !s.conns.add(conn) {
+			conn.Close()
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Return the address the server is listening on.
+func (s *MQTTServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop accepting connections and stop the partition routers.
+func (s *MQTTServer) Close() error {
+	s.cancel()
+	return s.listener.Close()
+}
+
+// Stop accepting connections and the partition routers, then wait for open
+// connections to finish the packet in progress. Wills are not published: the
+// clients did not go away. Connections still open when ctx expires are closed.
+func (s *MQTTServer) Shutdown(ctx context.Context) error {
+	s.cancel()
+	return errors.Join(s.listener.Close(), s.conns.shutdown(ctx))
+}
+
+// The connection is closed by its writer goroutine once c.close is called,
+// after flushing anything still queued.
+func (s *MQTTServer) handleConn(netConn net.Conn) {
+	defer s.conns.done(netConn)
+
+	c := &mqttConn{
+		conn: netConn,
+		out:  make(chan mqtt.Packet, mqttSessionQueue),
+		done: make(chan struct{}),
+	}
+	go c.writeLoop()
+	defer c.close()
+
+	reader := bufio.NewReader(netConn)
+
+	// The first packet must be CONNECT, within a reasonable time
+	netConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	packet, err := mqtt.ReadPacket(reader)
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*mqtt.Connect)
+	if !ok {
+		return
+	}
+	session, will := s.connect(c, connect)
+	if session == nil {
+		return
+	}
+
+	cleanExit := false
+	defer func() {
+		s.disconnect(session, c)
+		if !cleanExit && will != nil && s.ctx.Err() == nil {
+			if err := s.publish(will); err != nil {
+				fmt.Printf("MQTT: failed to publish will of %q: %v\n", session.clientID, err)
+			}
+		}
+	}()
+
+	for {
+		// Allow one and a half keep-alive periods between packets
+		if connect.KeepAlive > 0 {
+			netConn.SetReadDeadline(time.Now().Add(time.Duration(connect.KeepAlive) * 1500 * time.Millisecond))
+		} else {
+			netConn.SetReadDeadline(time.Time{})
+		}
+		// Checked after setting the deadline, which would undo one set by Shutdown
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		packet, err := mqtt.ReadPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch p := packet.(type) {
+		case *mqtt.Publish:
+			if err := s.handlePublish(c, p); err != nil {
+				fmt.Printf("MQTT: closing connection of %q: %v\n", session.clientID, err)
+				return
+			}
+		case *mqtt.PubAck:
+			session.mu.Lock()
+			delete(session.inflight, p.PacketID)
+			session.mu.Unlock()
+		case *mqtt.Subscribe:
+			if !s.subscribe(c, session, p) {
+				return
+			}
+		case *mqtt.Unsubscribe:
+			session.mu.Lock()
+			for _, filter := range p.Filters {
+				delete(session.subscriptions, filter)
+			}
+			session.mu.Unlock()
+			c.send(&mqtt.UnsubAck{PacketID: p.PacketID})
+		case *mqtt.PingReq:
+			c.send(&mqtt.PingResp{})
+		case *mqtt.Disconnect:
+			cleanExit = true
+			return
+		default:
+			return // a second CONNECT or a packet only servers send
+		}
+	}
+}
+
+// Validate CONNECT, attach the connection to its session and acknowledge.
+// Returns a nil session when the connection was refused.
+func (s *MQTTServer) connect(c *mqttConn, connect *mqtt.Connect) (*mqttSession, *mqtt.Message) {
+	if connect.ProtocolName != "MQTT" || connect.ProtocolLevel != 4 {
+		c.send(&mqtt.ConnAck{ReturnCode: mqtt.ConnRefusedProtocolVersion})
+		return nil, nil
+	}
+
+	clientID := connect.ClientID
+	if clientID == "" {
+		if !connect.CleanSession {
+			c.send(&mqtt.ConnAck{ReturnCode: mqtt.ConnRefusedIdentifier})
+			return nil, nil
+		}
+		clientID = fmt.Sprintf("deps-anonymous-%d", s.anonymous.Add(1))
+	}
+	if connect.Will != nil && (!mqtt.ValidTopicName(connect.Will.Topic) || connect.Will.QoS > 1) {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	session, present := s.sessions[clientID]
+	if present && (connect.CleanSession || session.clean) {
+		present = false
+	}
+	if !present {
+		session = &mqttSession{
+			clientID:      clientID,
+			clean:         connect.CleanSession,
+			subscriptions: make(map[string]byte),
+			inflight:      make(map[uint16]*mqtt.Publish),
+		}
+	}
+	previous := s.sessions[clientID]
+	s.sessions[clientID] = session
+	s.mu.Unlock()
+
+	// Take over from a connection still open under this client ID
+	if previous != nil {
+		previous.mu.Lock()
+		if previous.conn != nil {
+			previous.conn.close()
+			previous.conn = nil
+		}
+		previous.mu.Unlock()
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.conn = c
+	c.send(&mqtt.ConnAck{SessionPresent: present, ReturnCode: mqtt.ConnAccepted})
+
+	// Redeliver unacknowledged messages, then those that arrived while offline
+	ids := make([]int, 0, len(session.inflight))
+	for id := range session.inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		resend := *session.inflight[uint16(id)]
+		resend.Dup = true
+		c.send(&resend)
+	}
+	queued := session.queue
+	session.queue = nil
+	for _, msg := range queued {
+		session.deliverLocked(msg)
+	}
+
+	return session, connect.Will
+}
+
+// Detach a closed connection from its session, discarding clean sessions.
+func (s *MQTTServer) disconnect(session *mqttSession, c *mqttConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.conn != c {
+		return // taken over by a newer connection
+	}
+	session.conn = nil
+	if session.clean && s.sessions[session.clientID] == session {
+		delete(s.sessions, session.clientID)
+	}
+}
+
+func (s *MQTTServer) handlePublish(c *mqttConn, p *mqtt.Publish) error {
+	if !mqtt.ValidTopicName(p.Topic) {
+		return fmt.Errorf("invalid topic name %q", p.Topic)
+	}
+	if p.QoS > 1 {
+		return errors.New("QoS 2 is not supported")
+	}
+
+	if err := s.publish(&p.Message); err != nil {
+		return err
+	}
+	if p.QoS == 1 {
+		c.send(&mqtt.PubAck{PacketID: p.PacketID})
+	}
+	return nil
+}
+
+// Append a message to its DEPS topic and update the retained message.
+// Subscribers receive it from the partition routers.
+func (s *MQTTServer) publish(msg *mqtt.Message) error {
+	topic, key := splitMQTTTopic(msg.Topic)
+
+	partition, err := s.broker.partitionManager.RouteEvent(topic, key)
+	if err != nil {
+		return err
+	}
+	if _, err := s.broker.partitionManager.AppendEvent(partition, key, msg.Payload); err != nil {
+		return err
+	}
+
+	if msg.Retain {
+		return s.retain(msg)
+	}
+	return nil
+}
+
+// Store a retained message, or remove it when the payload is empty.
+func (s *MQTTServer) retain(msg *mqtt.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(msg.Payload) == 0 {
+		delete(s.retained, msg.Topic)
+	} else {
+		s.retained[msg.Topic] = &mqtt.Message{Topic: msg.Topic, Payload: msg.Payload, QoS: msg.QoS, Retain: true}
+	}
+	return s.saveRetained()
+}
+
+// Add subscriptions, start routing the topics they cover and send matching
+// retained messages. Returns false if the packet was invalid.
+func (s *MQTTServer) subscribe(c *mqttConn, session *mqttSession, p *mqtt.Subscribe) bool {
+	codes := make([]byte, len(p.Subscriptions))
+	var granted []mqtt.Subscription
+	for i, sub := range p.Subscriptions {
+		if sub.QoS > 2 {
+			return false
+		}
+		if !mqtt.ValidTopicFilter(sub.Filter) {
+			codes[i] = mqtt.SubAckFailure
+			continue
+		}
+		codes[i] = min(sub.QoS, 1)
+		granted = append(granted, mqtt.Subscription{Filter: sub.Filter, QoS: codes[i]})
+	}
+
+	session.mu.Lock()
+	for _, sub := range granted {
+		session.subscriptions[sub.Filter] = sub.QoS
+	}
+	session.mu.Unlock()
+
+	for _, sub := range granted {
+		s.ensureRouters(sub.Filter)
+	}
+
+	c.send(&mqtt.SubAck{PacketID: p.PacketID, ReturnCodes: codes})
+
+	// Retained messages for the new filters, flagged as retained
+	s.mu.Lock()
+	var retained []*mqtt.Message
+	for _, msg := range s.retained {
+		retained = append(retained, msg)
+	}
+	s.mu.Unlock()
+	sort.Slice(retained, func(i, j int) bool { return retained[i].Topic < retained[j].Topic })
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	for _, msg := range retained {
+		qos, ok := matchSubscriptions(granted, msg.Topic)
+		if !ok {
+			continue
+		}
+		session.deliverLocked(&mqtt.Message{Topic: msg.Topic, Payload: msg.Payload, QoS: min(qos, msg.QoS), Retain: true})
+	}
+	return true
+}
+
+// Start tailing every DEPS topic a filter can match: the topic named by its
+// first level, or all topics when that level is a wildcard.
+func (s *MQTTServer) ensureRouters(filter string) {
+	first, _, _ := strings.Cut(filter, "/")
+
+	var topics []*Topic
+	if first == "+" || first == "#" {
+		s.broker.mu.RLock()
+		for _, topic := range s.broker.topics {
+			topics = append(topics, topic)
+		}
+		s.broker.mu.RUnlock()
+	} else if topic := s.broker.GetTopic(first); topic != nil {
+		topics = append(topics, topic)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, topic := range topics {
+		if s.routers[topic.Name] {
+			continue
+		}
+		s.routers[topic.Name] = true
+
+		topic.mu.RLock()
+		for _, partition := range topic.Partitions {
+			go s.routePartition(partition, partition.logStorage.NextOffset())
+		}
+		topic.mu.RUnlock()
+	}
+}
+
+// Deliver every event appended to a partition from startOffset on to the
+// sessions subscribed to its topic name. A partition that fails to read, say
+// while its cold store is down, is retried with backoff.
+func (s *MQTTServer) routePartition(partition *Partition, startOffset int64) {
+	offset := startOffset
+	var retry time.Duration
+	for s.ctx.Err() == nil {
+		s.broker.partitionManager.WaitForEvents(s.ctx, partition, offset, 1, maxFetchWait)
+
+		events, err := s.broker.partitionManager.FetchEvents(partition, offset, streamFetchBytes)
+		if err != nil {
+			retry = min(max(2*retry, mqttRouteRetry), mqttRouteMaxRetry)
+			fmt.Printf("MQTT: failed to read %s partition %d at offset %d, retrying in %s: %v\n", partition.Topic, partition.ID, offset, retry, err)
+			select {
+			case <-s.ctx.Done():
+			case <-time.After(retry):
+			}
+			continue
+		}
+		retry = 0
+		if len(events) == 0 {
+			continue
+		}
+		for _, event := range events {
+			s.route(mqttTopicName(partition.Topic, event.Key), event.Payload)
+		}
+		offset = events[len(events)-1].Offset + 1
+	}
+}
+
+func (s *MQTTServer) route(name string, payload []byte) {
+	s.mu.Lock()
+	sessions := make([]*mqttSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.Unlock()
+
+	for _, session := range sessions {
+		session.mu.Lock()
+		if qos, ok := session.match(name); ok {
+			session.deliverLocked(&mqtt.Message{Topic: name, Payload: payload, QoS: qos})
+		}
+		session.mu.Unlock()
+	}
+}
+
+// The highest QoS of the session's subscriptions matching a topic name.
+// Caller holds session.mu.
+func (session *mqttSession) match(name string) (byte, bool) {
+	qos, matched := byte(0), false
+	for filter, granted := range session.subscriptions {
+		if mqtt.MatchTopic(filter, name) {
+			qos, matched = max(qos, granted), true
+		}
+	}
+	return qos, matched
+}
+
+func matchSubscriptions(subs []mqtt.Subscription, name string) (byte, bool) {
+	qos, matched := byte(0), false
+	for _, sub := range subs {
+		if mqtt.MatchTopic(sub.Filter, name) {
+			qos, matched = max(qos, sub.QoS), true
+		}
+	}
+	return qos, matched
+}
+
+// Send a message to the session's client. While offline, QoS 1 messages for
+// persistent sessions are queued and everything else is dropped. A client that
+// falls too far behind is disconnected. Caller holds session.mu.
+func (session *mqttSession) deliverLocked(msg *mqtt.Message) {
+	if session.conn == nil {
+		if msg.QoS > 0 && !session.clean && len(session.queue) < mqttSessionQueue {
+			session.queue = append(session.queue, msg)
+		}
+		return
+	}
+
+	publish := &mqtt.Publish{Message: *msg}
+	if msg.QoS > 0 {
+		if len(session.inflight) >= mqttSessionQueue {
+			session.conn.close()
+			return
+		}
+		publish.PacketID = session.allocatePacketID()
+		session.inflight[publish.PacketID] = publish
+	}
+	session.conn.send(publish)
+}
+
+// Next packet ID not in flight. Caller holds session.mu.
+func (session *mqttSession) allocatePacketID() uint16 {
+	for {
+		session.nextPacketID++
+		if session.nextPacketID == 0 {
+			continue
+		}
+		if _, used := session.inflight[session.nextPacketID]; !used {
+			return session.nextPacketID
+		}
+	}
+}
+
+// Queue a packet for the writer, closing the connection if the queue is full.
+func (c *mqttConn) send(packet mqtt.Packet) {
+	select {
+	case c.out <- packet:
+	case <-c.done:
+	default:
+		c.close()
+	}
+}
+
+func (c *mqttConn) writeLoop() {
+	writer := bufio.NewWriter(c.conn)
+	for {
+		select {
+		case packet := <-c.out:
+			if err := mqtt.WritePacket(writer, packet); err != nil {
+				c.close()
+				return
+			}
+			// Flush once the queue is drained
+			if len(c.out) == 0 {
+				if err := writer.Flush(); err != nil {
+					c.close()
+					return
+				}
+			}
+		case <-c.done:
+			// Flush what was queued before closing, such as a refusing CONNACK
+			for len(c.out) > 0 {
+				mqtt.WritePacket(writer, <-c.out)
+			}
+			writer.Flush()
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// Stop the writer. A write already blocked on a slow client fails within a second.
+func (c *mqttConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	})
+}
+
+// Split an MQTT topic name into the DEPS topic (first level) and event key (the rest).
+func splitMQTTTopic(name string) (string, string) {
+	topic, key, _ := strings.Cut(name, "/")
+	return topic, key
+}
+
+// The MQTT topic name of an event: the DEPS topic, then the key as the rest of the path.
+func mqttTopicName(topic, key string) string {
+	if key == "" {
+		return topic
+	}
+	return topic + "/" + key
+}
+
+// Persist retained messages. Caller holds s.mu.
+func (s *MQTTServer) saveRetained() error {
+	// Skip saving if path is empty (used in testing)
+	if s.retainedPath == "" {
+		return nil
+	}
+
+	retained := make(map[string]mqttRetained, len(s.retained))
+	for topic, msg := range s.retained {
+		retained[topic] = mqttRetained{Payload: msg.Payload, QoS: msg.QoS}
+	}
+
+	file, err := os.Create(s.retainedPath)
+	if err != nil {
+		return fmt.Errorf("failed to create retained messages file: %w", err)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(retained); err != nil {
+		return fmt.Errorf("failed to encode retained messages: %w", err)
+	}
+	return nil
+}
+
+func (s *MQTTServer) loadRetained() error {
+	if s.retainedPath == "" {
+		return nil
+	}
+
+	file, err := os.Open(s.retainedPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open retained messages file: %w", err)
+	}
+	defer file.Close()
+
+	var retained map[string]mqttRetained
+	if err := json.NewDecoder(file).Decode(&retained); err != nil {
+		return fmt.Errorf("failed to decode retained messages: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for topic, msg := range retained {
+		s.retained[topic] = &mqtt.Message{Topic: topic, Payload: msg.Payload, QoS: msg.QoS, Retain: true}
+	}
+	return nil
+}
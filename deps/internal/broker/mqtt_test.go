@@ -0,0 +1,262 @@
+package broker
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"example.com/deps/internal/protocol/mqtt"
+)
+
+func TestMQTTPublishQoS1(t *testing.T) {
+	server := setupTestMQTTServer(t)
+	conn := server.connect(t, &mqtt.Connect{ClientID: "sensor", CleanSession: true})
+
+	conn.send(t, &mqtt.Publish{Message: mqtt.Message{Topic: "test-topic/device42/temp", Payload: []byte("21.5"), QoS: 1}, PacketID: 7})
+	ack, ok := conn.read(t).(*mqtt.PubAck)
+	if !ok || ack.PacketID != 7 {
+		t.Fatalf("Expected PUBACK 7, got %#v", ack)
+	}
+
+	// The message is a DEPS event keyed by the rest of the topic path
+	partition, err := server.broker.partitionManager.RouteEvent("test-topic", "device42/temp")
+	if err != nil {
+		t.Fatalf("Failed to route: %v", err)
+	}
+	events, err := server.broker.partitionManager.FetchEvents(partition, 0, streamFetchBytes)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d (%v)", len(events), err)
+	}
+	if events[0].Key != "device42/temp" || string(events[0].Payload) != "21.5" {
+		t.Errorf("Unexpected event %+v", events[0])
+	}
+}
+
+func TestMQTTWildcardSubscription(t *testing.T) {
+	server := setupTestMQTTServer(t)
+	subscriber := server.connect(t, &mqtt.Connect{ClientID: "dashboard", CleanSession: true})
+	publisher := server.connect(t, &mqtt.Connect{ClientID: "sensor", CleanSession: true})
+
+	subscriber.send(t, &mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{
+		{Filter: "test-topic/+/temp", QoS: 1},
+		{Filter: "bad/#/filter", QoS: 0},
+	}})
+	suback, ok := subscriber.read(t).(*mqtt.SubAck)
+	if !ok || len(suback.ReturnCodes) != 2 || suback.ReturnCodes[0] != 1 || suback.ReturnCodes[1] != mqtt.SubAckFailure {
+		t.Fatalf("Unexpected SUBACK %#v", suback)
+	}
+
+	publisher.send(t, &mqtt.Publish{Message: mqtt.Message{Topic: "test-topic/d1/humidity", Payload: []byte("40")}})
+	publisher.send(t, &mqtt.Publish{Message: mqtt.Message{Topic: "test-topic/d1/temp", Payload: []byte("20")}})
+
+	// Events appended by other protocols are routed too
+	partition, _ := server.broker.partitionManager.RouteEvent("test-topic", "d2/temp")
+	if _, err := server.broker.partitionManager.AppendEvent(partition, "d2/temp", []byte("22")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	received := map[string]string{}
+	for len(received) < 2 {
+		publish, ok := subscriber.read(t).(*mqtt.Publish)
+		if !ok {
+			t.Fatalf("Expected PUBLISH")
+		}
+		if publish.QoS != 1 || publish.PacketID == 0 {
+			t.Errorf("Expected QoS 1 delivery, got %#v", publish)
+		}
+		subscriber.send(t, &mqtt.PubAck{PacketID: publish.PacketID})
+		received[publish.Topic] = string(publish.Payload)
+	}
+	if received["test-topic/d1/temp"] != "20" || received["test-topic/d2/temp"] != "22" {
+		t.Errorf("Unexpected messages %v", received)
+	}
+
+	// Nothing else matches
+	subscriber.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if packet, err := mqtt.ReadPacket(subscriber.reader); err == nil {
+		t.Errorf("Unexpected packet %#v", packet)
+	}
+}
+
+func TestMQTTRetainedMessages(t *testing.T) {
+	server := setupTestMQTTServer(t)
+	publisher := server.connect(t, &mqtt.Connect{ClientID: "sensor", CleanSession: true})
+
+	publisher.send(t, &mqtt.Publish{Message: mqtt.Message{Topic: "test-topic/d1/status", Payload: []byte("online"), QoS: 1, Retain: true}, PacketID: 1})
+	publisher.read(t)
+
+	subscriber := server.connect(t, &mqtt.Connect{ClientID: "late", CleanSession: true})
+	subscriber.send(t, &mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{{Filter: "test-topic/#", QoS: 0}}})
+	subscriber.read(t) // SUBACK
+
+	publish, ok := subscriber.read(t).(*mqtt.Publish)
+	if !ok || !publish.Retain || publish.Topic != "test-topic/d1/status" || string(publish.Payload) != "online" {
+		t.Fatalf("Expected retained message, got %#v", publish)
+	}
+
+	// An empty retained payload clears it
+	publisher.send(t, &mqtt.Publish{Message: mqtt.Message{Topic: "test-topic/d1/status", QoS: 1, Retain: true}, PacketID: 2})
+	publisher.read(t)
+
+	another := server.connect(t, &mqtt.Connect{ClientID: "later", CleanSession: true})
+	another.send(t, &mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{{Filter: "test-topic/#", QoS: 0}}})
+	another.read(t) // SUBACK
+	another.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if packet, err := mqtt.ReadPacket(another.reader); err == nil {
+		t.Errorf("Expected no retained message, got %#v", packet)
+	}
+}
+
+func TestMQTTPersistentSession(t *testing.T) {
+	server := setupTestMQTTServer(t)
+
+	subscriber := server.connect(t, &mqtt.Connect{ClientID: "collector", CleanSession: false})
+	subscriber.send(t, &mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{{Filter: "test-topic/#", QoS: 1}}})
+	subscriber.read(t) // SUBACK
+	subscriber.send(t, &mqtt.Disconnect{})
+	subscriber.Close()
+
+	// Wait for the server to notice the disconnect
+	time.Sleep(100 * time.Millisecond)
+
+	publisher := server.connect(t, &mqtt.Connect{ClientID: "sensor", CleanSession: true})
+	publisher.send(t, &mqtt.Publish{Message: mqtt.Message{Topic: "test-topic/d1", Payload: []byte("queued"), QoS: 1}, PacketID: 1})
+	publisher.read(t) // PUBACK
+
+	// Give the router time to queue the message for the offline session
+	time.Sleep(100 * time.Millisecond)
+
+	conn := server.dial(t)
+	conn.send(t, &mqtt.Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "collector"})
+	connack, ok := conn.read(t).(*mqtt.ConnAck)
+	if !ok || connack.ReturnCode != mqtt.ConnAccepted || !connack.SessionPresent {
+		t.Fatalf("Expected CONNACK with session present, got %#v", connack)
+	}
+	publish, ok := conn.read(t).(*mqtt.Publish)
+	if !ok || publish.Topic != "test-topic/d1" || string(publish.Payload) != "queued" || publish.QoS != 1 {
+		t.Errorf("Expected queued message, got %#v", publish)
+	}
+}
+
+func TestMQTTWillMessage(t *testing.T) {
+	server := setupTestMQTTServer(t)
+
+	watcher := server.connect(t, &mqtt.Connect{ClientID: "watcher", CleanSession: true})
+	watcher.send(t, &mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{{Filter: "test-topic/+/status", QoS: 0}}})
+	watcher.read(t) // SUBACK
+
+	device := server.connect(t, &mqtt.Connect{
+		ClientID:     "device",
+		CleanSession: true,
+		Will:         &mqtt.Message{Topic: "test-topic/device/status", Payload: []byte("offline")},
+	})
+	device.Close() // without DISCONNECT
+
+	publish, ok := watcher.read(t).(*mqtt.Publish)
+	if !ok || publish.Topic != "test-topic/device/status" || string(publish.Payload) != "offline" {
+		t.Errorf("Expected will message, got %#v", publish)
+	}
+}
+
+func TestMQTTRejectsProtocolLevel(t *testing.T) {
+	server := setupTestMQTTServer(t)
+
+	conn := server.dial(t)
+	conn.send(t, &mqtt.Connect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "v5", CleanSession: true})
+	connack, ok := conn.read(t).(*mqtt.ConnAck)
+	if !ok || connack.ReturnCode != mqtt.ConnRefusedProtocolVersion {
+		t.Fatalf("Expected CONNACK refusing the protocol version, got %#v", connack)
+	}
+
+	// Then the connection is closed
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := mqtt.ReadPacket(conn.reader); err == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+type mqttTestServer struct {
+	*MQTTServer
+}
+
+type mqttTestConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Open a connection without sending CONNECT.
+func (s *mqttTestServer) dial(t *testing.T) *mqttTestConn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", s.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &mqttTestConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Open a connection and complete the MQTT 3.1.1 handshake.
+func (s *mqttTestServer) connect(t *testing.T, connect *mqtt.Connect) *mqttTestConn {
+	t.Helper()
+
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolLevel = 4
+	conn := s.dial(t)
+	conn.send(t, connect)
+	if connack, ok := conn.read(t).(*mqtt.ConnAck); !ok || connack.ReturnCode != mqtt.ConnAccepted {
+		t.Fatalf("Connection refused: %#v", connack)
+	}
+	return conn
+}
+
+func (c *mqttTestConn) send(t *testing.T, packet mqtt.Packet) {
+	t.Helper()
+
+	if err := mqtt.WritePacket(c, packet); err != nil {
+		t.Fatalf("Failed to send packet: %v", err)
+	}
+}
+
+func (c *mqttTestConn) read(t *testing.T) mqtt.Packet {
+	t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	packet, err := mqtt.ReadPacket(c.reader)
+	if err != nil {
+		t.Fatalf("Failed to read packet: %v", err)
+	}
+	return packet
+}
+
+// setupTestMQTTServer starts an MQTT listener on a random port over the test broker.
+func TestMQTTRoutingBacksOffOnReadErrors(t *testing.T) {
+	server := setupTestMQTTServer(t)
+
+	log := &unreadableLog{MemoryLog: NewMemoryLog()}
+	log.Append(&StoredEvent{Key: "d1/temp", Payload: []byte("20")})
+	partition, _ := server.broker.GetPartition("test-topic", 0)
+	partition.logStorage = log
+	go server.routePartition(partition, 0)
+
+	// A read that fails is retried after a second, not at once
+	time.Sleep(500 * time.Millisecond)
+	if reads := log.reads.Load(); reads != 1 {
+		t.Errorf("Expected 1 read within the first retry interval, got %d", reads)
+	}
+}
+
+func setupTestMQTTServer(t *testing.T) *mqttTestServer {
+	t.Helper()
+
+	s := setupTestServer()
+	server := NewMQTTServer(s.broker, 0, "")
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+
+	return &mqttTestServer{server}
+}
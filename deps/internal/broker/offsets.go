@@ -3,19 +3,26 @@ package broker
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 // Handle tracking and committing consumer offsets.
 type OffsetManager struct {
 	mu      sync.RWMutex
+	fs      fileSystem
 	path    string
 	offsets map[string]int64 // Key: "consumerGroup-topic-partition", Value: offset
+
+	// whether the file on disk is known to be ours to overwrite; see MetadataManager.
+	writable atomic.Bool
 }
 
 func NewOffsetManager(path string) *OffsetManager {
 	return &OffsetManager{
+		fs:      osFS{},
 		path:    path,
 		offsets: make(map[string]int64),
 	}
@@ -42,42 +49,75 @@ func (o *OffsetManager) GetOffset(consumerGroup, topic string, partitionID int)
 	return offset, nil
 }
 
+// Return a copy of every committed offset.
+func (o *OffsetManager) snapshot() map[string]int64 {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	offsets := make(map[string]int64, len(o.offsets))
+	for key, offset := range o.offsets {
+		offsets[key] = offset
+	}
+	return offsets
+}
+
+// Write the committed offsets to disk. Commits already save them; this is for shutdown.
+func (o *OffsetManager) Save() error {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.save()
+}
+
 // Persists the offsets to disk.
 func (o *OffsetManager) save() error {
 	// Skip saving if path is empty (used in testing)
 	if o.path == "" {
 		return nil
 	}
-
-	file, err := os.Create(o.path)
-	if err != nil {
-		return fmt.Errorf("failed to create offsets file: %w", err)
+	if !o.writable.Load() {
+		if err := checkOverwrite(o.fs, o.path); err != nil {
+			return err
+		}
+		o.writable.Store(true)
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(o.offsets); err != nil {
+	data, err := json.Marshal(offsetsFile{Version: FormatVersion, Offsets: o.offsets})
+	if err != nil {
 		return fmt.Errorf("failed to encode offsets: %w", err)
 	}
+	// Replaced whole, so a crash while saving leaves the previous offsets
+	err = writeFileAtomic(o.fs, o.path, func(out io.Writer) error {
+		_, err := out.Write(append(data, '\n'))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write offsets file: %w", err)
+	}
 
 	return nil
 }
 
 // Load the offsets from disk.
 func (o *OffsetManager) load() error {
-	file, err := os.Open(o.path)
+	if o.path == "" {
+		return nil
+	}
+	data, err := o.fs.ReadFile(o.path)
 	if os.IsNotExist(err) {
 		// No offsets file exists; fresh start.
 		return nil
 	} else if err != nil {
 		return fmt.Errorf("failed to open offsets file: %w", err)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&o.offsets); err != nil {
+	loaded := offsetsFile{Offsets: o.offsets}
+	if err := decodeVersioned(o.path, data, &loaded); err != nil {
 		return fmt.Errorf("failed to decode offsets: %w", err)
 	}
+	if loaded.Offsets != nil {
+		o.offsets = loaded.Offsets
+	}
+	o.writable.Store(true)
 
 	return nil
 }
@@ -0,0 +1,816 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/deps/internal/protocol/resp"
+)
+
+// Bytes read from the log per batch when serving stream reads.
+const redisReadBytes = 1048576
+
+// Serve a Redis Streams compatible subset of RESP so services written against
+// Redis Streams can use DEPS without new client libraries.
+//
+// A stream key names a partition: "orders:2" is partition 2 of topic orders, and a
+// bare topic name is its partition 0. Entry IDs are "<offset+1>-0", so IDs increase
+// with offsets and every entry sorts after "0-0". Entry fields are stored as a JSON
+// object payload with string values, readable over HTTP like any other event.
+//
+// Consumer groups track delivered and pending entries in memory; XACK commits the
+// offset below the oldest pending entry through the OffsetManager, which is where
+// a group resumes after a restart.
+type RedisServer struct {
+	broker   *Broker
+	port     int
+	listener net.Listener
+	conns    connSet
+
+	mu     sync.Mutex
+	groups map[redisGroupKey]*redisGroup
+}
+
+type redisGroupKey struct {
+	group     string
+	topic     string
+	partition int
+}
+
+// Delivery state of one consumer group on one stream.
+type redisGroup struct {
+	// next offset to deliver to a ">" read
+	lastDelivered int64
+
+	// delivered but unacknowledged offsets, and the consumer each went to
+	pending map[int64]string
+}
+
+// A stream ID; entries have ms = offset+1 and seq = 0.
+type streamID struct {
+	ms, seq int64
+}
+
+func NewRedisServer(broker *Broker, port int) *RedisServer {
+	return &RedisServer{
+		broker: broker,
+		port:   port,
+		groups: make(map[redisGroupKey]*redisGroup),
+	}
+}
+
+// Bind the listening socket. Separate from Serve so startup errors surface before the broker blocks.
+func (s *RedisServer) Listen() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", s.port, err)
+	}
+	s.listener = listener
+	fmt.Printf("Broker Redis listener on %s\n", listener.Addr())
+	return nil
+}
+
+// Accept connections until the listener is closed.
+func (s *RedisServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !s.conns.add(conn) {
+			conn.Close()
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Return the address the server is listening on.
+func (s *RedisServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop accepting connections.
+func (s *RedisServer) Close() error {
+	return s.listener.Close()
+}
+
+// Stop accepting connections and wait for open ones to finish the request in
+// progress. Connections still open when ctx expires are closed.
+func (s *RedisServer) Shutdown(ctx context.Context) error {
+	return errors.Join(s.listener.Close(), s.conns.shutdown(ctx))
+}
+
+// Execute commands on one connection in order. Replies are flushed once no
+// further pipelined commands are waiting.
+func (s *RedisServer) handleConn(conn net.Conn) {
+	defer s.conns.done(conn)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reader := bufio.NewReader(conn)
+	w := resp.NewWriter(bufio.NewWriter(conn))
+
+	for {
+		args, err := resp.ReadCommand(reader)
+		if errors.Is(err, resp.ErrProtocol) {
+			w.Error("ERR Protocol error: " + err.Error())
+			w.Flush()
+			return
+		} else if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if strings.EqualFold(args[0], "QUIT") {
+			w.SimpleString("OK")
+			w.Flush()
+			return
+		}
+		s.execute(ctx, w, args)
+
+		if reader.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *RedisServer) execute(ctx context.Context, w *resp.Writer, args []string) {
+	switch cmd := strings.ToUpper(args[0]); cmd {
+	case "PING":
+		if len(args) > 1 {
+			w.BulkString(args[1])
+		} else {
+			w.SimpleString("PONG")
+		}
+	case "ECHO":
+		if len(args) != 2 {
+			wrongArgs(w, cmd)
+			return
+		}
+		w.BulkString(args[1])
+	case "SELECT":
+		if len(args) != 2 || args[1] != "0" {
+			w.Error("ERR DB index is out of range")
+			return
+		}
+		w.SimpleString("OK")
+	case "XADD":
+		s.xadd(w, args)
+	case "XRANGE":
+		s.xrange(w, args)
+	case "XREAD":
+		s.xread(ctx, w, args)
+	case "XGROUP":
+		s.xgroup(w, args)
+	case "XREADGROUP":
+		s.xreadgroup(ctx, w, args)
+	case "XACK":
+		s.xack(w, args)
+	default:
+		w.Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+// XADD key [NOMKSTREAM] * field value [field value ...]
+func (s *RedisServer) xadd(w *resp.Writer, args []string) {
+	if len(args) < 5 {
+		wrongArgs(w, "xadd")
+		return
+	}
+
+	i := 2
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		if option == "NOMKSTREAM" {
+			continue // streams are never created implicitly
+		}
+		if option == "MAXLEN" || option == "MINID" {
+			w.Error("ERR stream trimming is not supported")
+			return
+		}
+		break
+	}
+	if i >= len(args) || args[i] != "*" {
+		w.Error("ERR only auto-generated IDs (*) are supported")
+		return
+	}
+	fields := args[i+1:]
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		wrongArgs(w, "xadd")
+		return
+	}
+
+	partition, err := s.resolveStream(args[1])
+	if err != nil {
+		w.Error("ERR " + err.Error())
+		return
+	}
+
+	offset, err := s.broker.partitionManager.AppendEvent(partition, "", fieldsPayload(fields))
+	if err != nil {
+		w.Error("ERR " + err.Error())
+		return
+	}
+	w.BulkString(formatStreamID(offset))
+}
+
+// XRANGE key start end [COUNT count]
+func (s *RedisServer) xrange(w *resp.Writer, args []string) {
+	if len(args) != 4 && len(args) != 6 {
+		wrongArgs(w, "xrange")
+		return
+	}
+	count := 0
+	if len(args) == 6 {
+		if !strings.EqualFold(args[4], "COUNT") {
+			w.Error("ERR syntax error")
+			return
+		}
+		n, err := strconv.Atoi(args[5])
+		if err != nil {
+			w.Error("ERR value is not an integer or out of range")
+			return
+		}
+		if n <= 0 {
+			w.ArrayLen(0)
+			return
+		}
+		count = n
+	}
+
+	partition, err := s.resolveStream(args[1])
+	if err != nil {
+		w.Error("ERR " + err.Error())
+		return
+	}
+	start, err := parseRangeStart(args[2])
+	if err != nil {
+		w.Error("ERR Invalid stream ID specified as stream command argument")
+		return
+	}
+	end, err := parseRangeEnd(args[3])
+	if err != nil {
+		w.Error("ERR Invalid stream ID specified as stream command argument")
+		return
+	}
+
+	events, err := s.readStream(partition, start, end, count)
+	if err != nil {
+		w.Error("ERR " + err.Error())
+		return
+	}
+	writeStreamEntries(w, events)
+}
+
+// Options shared by XREAD and XREADGROUP.
+type streamReadArgs struct {
+	count int
+	block time.Duration // negative when not blocking
+	noAck bool
+	keys  []string
+	ids   []string
+}
+
+// Parse [COUNT n] [BLOCK ms] [NOACK] STREAMS key... id... starting at args[i].
+func parseStreamReadArgs(args []string, i int, allowNoAck bool) (*streamReadArgs, error) {
+	read := &streamReadArgs{block: -1}
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT", "BLOCK":
+			if i+1 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			if strings.EqualFold(args[i], "COUNT") {
+				read.count = int(n)
+			} else {
+				read.block = time.Duration(n) * time.Millisecond
+			}
+			i++
+		case "NOACK":
+			if !allowNoAck {
+				return nil, errors.New("ERR syntax error")
+			}
+			read.noAck = true
+		case "STREAMS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return nil, errors.New("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+			}
+			read.keys, read.ids = rest[:len(rest)/2], rest[len(rest)/2:]
+			return read, nil
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+	return nil, errors.New("ERR syntax error")
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func (s *RedisServer) xread(ctx context.Context, w *resp.Writer, args []string) {
+	read, err := parseStreamReadArgs(args, 1, false)
+	if err != nil {
+		w.Error(err.Error())
+		return
+	}
+
+	partitions := make([]*Partition, len(read.keys))
+	starts := make([]int64, len(read.keys))
+	for i, key := range read.keys {
+		partition, err := s.resolveStream(key)
+		if err != nil {
+			w.Error("ERR " + err.Error())
+			return
+		}
+		partitions[i] = partition
+
+		if read.ids[i] == "$" {
+			starts[i] = partition.logStorage.NextOffset()
+			continue
+		}
+		id, err := parseStreamID(read.ids[i])
+		if err != nil {
+			w.Error("ERR Invalid stream ID specified as stream command argument")
+			return
+		}
+		starts[i] = id.ms // first entry after id
+	}
+
+	results, err := s.readStreams(partitions, starts, read.count)
+	if err == nil && results == nil && read.block >= 0 {
+		s.broker.partitionManager.WaitForAny(ctx, partitions, starts, blockDuration(read.block))
+		results, err = s.readStreams(partitions, starts, read.count)
+	}
+	if err != nil {
+		w.Error("ERR " + err.Error())
+		return
+	}
+	writeStreamResults(w, read.keys, results)
+}
+
+// Read each stream from its start offset; nil when none has entries.
+func (s *RedisServer) readStreams(partitions []*Partition, starts []int64, count int) ([][]*StoredEvent, error) {
+	results := make([][]*StoredEvent, len(partitions))
+	found := false
+	for i, partition := range partitions {
+		events, err := s.readStream(partition, starts[i], math.MaxInt64, count)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = events
+		found = found || len(events) > 0
+	}
+	if !found {
+		return nil, nil
+	}
+	return results, nil
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM]
+func (s *RedisServer) xgroup(w *resp.Writer, args []string) {
+	if len(args) < 2 || !strings.EqualFold(args[1], "CREATE") {
+		w.Error("ERR only XGROUP CREATE is supported")
+		return
+	}
+	if len(args) < 5 {
+		wrongArgs(w, "xgroup|create")
+		return
+	}
+	key, groupName := args[2], args[3]
+
+	partition, err := s.resolveStream(key)
+	if err != nil {
+		w.Error("ERR " + err.Error())
+		return
+	}
+
+	start := partition.logStorage.NextOffset()
+	if args[4] != "$" {
+		id, err := parseStreamID(args[4])
+		if err != nil {
+			w.Error("ERR Invalid stream ID specified as stream command argument")
+			return
+		}
+		start = id.ms
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groupKey := redisGroupKey{group: groupName, topic: partition.Topic, partition: partition.ID}
+	if s.group(groupKey) != nil {
+		w.Error("BUSYGROUP Consumer Group name already exists")
+		return
+	}
+	if err := s.broker.partitionManager.CommitOffset(groupName, partition.Topic, partition.ID, start); err != nil {
+		w.Error("ERR " + err.Error())
+		return
+	}
+	s.groups[groupKey] = &redisGroup{lastDelivered: start, pending: make(map[int64]string)}
+	w.SimpleString("OK")
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+//
+// The ID ">" delivers entries no consumer in the group has seen; any other ID
+// re-reads this consumer's pending entries after it.
+func (s *RedisServer) xreadgroup(ctx context.Context, w *resp.Writer, args []string) {
+	if len(args) < 4 || !strings.EqualFold(args[1], "GROUP") {
+		w.Error("ERR syntax error")
+		return
+	}
+	groupName, consumer := args[2], args[3]
+	read, err := parseStreamReadArgs(args, 4, true)
+	if err != nil {
+		w.Error(err.Error())
+		return
+	}
+
+	partitions := make([]*Partition, len(read.keys))
+	for i, key := range read.keys {
+		partition, err := s.resolveStream(key)
+		if err != nil {
+			w.Error("ERR " + err.Error())
+			return
+		}
+		partitions[i] = partition
+	}
+
+	results, starts, err := s.deliver(groupName, consumer, partitions, read)
+	if err == nil && results == nil && read.block >= 0 {
+		s.broker.partitionManager.WaitForAny(ctx, partitions, starts, blockDuration(read.block))
+		results, _, err = s.deliver(groupName, consumer, partitions, read)
+	}
+	if err != nil {
+		w.Error(err.Error())
+		return
+	}
+	writeStreamResults(w, read.keys, results)
+}
+
+// Read entries for a group member and record ">" deliveries as pending.
+// Returns nil results when only ">" reads were requested and none had entries,
+// along with the offsets a blocking read should wait on.
+func (s *RedisServer) deliver(groupName, consumer string, partitions []*Partition, read *streamReadArgs) ([][]*StoredEvent, []int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([][]*StoredEvent, len(partitions))
+	starts := make([]int64, len(partitions))
+	found := false
+	for i, partition := range partitions {
+		groupKey := redisGroupKey{group: groupName, topic: partition.Topic, partition: partition.ID}
+		group := s.group(groupKey)
+		if group == nil {
+			return nil, nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", read.keys[i], groupName)
+		}
+
+		if read.ids[i] != ">" {
+			id, err := parseStreamID(read.ids[i])
+			if err != nil {
+				return nil, nil, errors.New("ERR Invalid stream ID specified as stream command argument")
+			}
+			events, err := s.readPending(partition, group, consumer, id.ms, read.count)
+			if err != nil {
+				return nil, nil, fmt.Errorf("ERR %v", err)
+			}
+			results[i] = events // non-nil: history reads always reply, even when empty
+			found = true
+			continue
+		}
+
+		starts[i] = group.lastDelivered
+		events, err := s.readStream(partition, group.lastDelivered, math.MaxInt64, read.count)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ERR %v", err)
+		}
+		for _, event := range events {
+			if !read.noAck {
+				group.pending[event.Offset] = consumer
+			}
+			group.lastDelivered = event.Offset + 1
+		}
+		results[i] = events
+		found = found || len(events) > 0
+	}
+
+	if !found {
+		return nil, starts, nil
+	}
+	if read.noAck {
+		for _, partition := range partitions {
+			s.commitGroup(redisGroupKey{group: groupName, topic: partition.Topic, partition: partition.ID})
+		}
+	}
+	return results, starts, nil
+}
+
+// The consumer's pending entries at or after startOffset, oldest first.
+func (s *RedisServer) readPending(partition *Partition, group *redisGroup, consumer string, startOffset int64, count int) ([]*StoredEvent, error) {
+	var offsets []int64
+	for offset, owner := range group.pending {
+		if owner == consumer && offset >= startOffset {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	if count > 0 && len(offsets) > count {
+		offsets = offsets[:count]
+	}
+
+	events := make([]*StoredEvent, 0, len(offsets))
+	for _, offset := range offsets {
+		entry, err := s.readStream(partition, offset, offset, 1)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, entry...)
+	}
+	return events, nil
+}
+
+// XACK key group id [id ...]
+func (s *RedisServer) xack(w *resp.Writer, args []string) {
+	if len(args) < 4 {
+		wrongArgs(w, "xack")
+		return
+	}
+
+	partition, err := s.resolveStream(args[1])
+	if err != nil {
+		w.Error("ERR " + err.Error())
+		return
+	}
+
+	var offsets []int64
+	for _, arg := range args[3:] {
+		id, err := parseStreamID(arg)
+		if err != nil {
+			w.Error("ERR Invalid stream ID specified as stream command argument")
+			return
+		}
+		if id.seq == 0 && id.ms > 0 {
+			offsets = append(offsets, id.ms-1)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groupKey := redisGroupKey{group: args[2], topic: partition.Topic, partition: partition.ID}
+	group := s.group(groupKey)
+	if group == nil {
+		w.Integer(0)
+		return
+	}
+
+	acked := 0
+	for _, offset := range offsets {
+		if _, ok := group.pending[offset]; ok {
+			delete(group.pending, offset)
+			acked++
+		}
+	}
+	if acked > 0 {
+		if err := s.commitGroup(groupKey); err != nil {
+			w.Error("ERR " + err.Error())
+			return
+		}
+	}
+	w.Integer(int64(acked))
+}
+
+// Look up a group's delivery state, restoring it from its committed offset
+// after a restart. Returns nil if the group was never created. Caller holds s.mu.
+func (s *RedisServer) group(key redisGroupKey) *redisGroup {
+	if group, ok := s.groups[key]; ok {
+		return group
+	}
+	offset, err := s.broker.offsetManager.GetOffset(key.group, key.topic, key.partition)
+	if err != nil {
+		return nil
+	}
+	group := &redisGroup{lastDelivered: offset, pending: make(map[int64]string)}
+	s.groups[key] = group
+	return group
+}
+
+// Commit the offset below the oldest pending entry, or everything delivered
+// when nothing is pending. Caller holds s.mu.
+func (s *RedisServer) commitGroup(key redisGroupKey) error {
+	group := s.groups[key]
+	offset := group.lastDelivered
+	for pending := range group.pending {
+		offset = min(offset, pending)
+	}
+	return s.broker.partitionManager.CommitOffset(key.group, key.topic, key.partition, offset)
+}
+
+// Map a stream key onto a partition: an existing topic name is its partition 0,
+// otherwise the key must be "<topic>:<partition>".
+func (s *RedisServer) resolveStream(key string) (*Partition, error) {
+	if s.broker.GetTopic(key) != nil {
+		return s.broker.GetPartition(key, 0)
+	}
+	if i := strings.LastIndexByte(key, ':'); i > 0 {
+		if partitionID, err := strconv.Atoi(key[i+1:]); err == nil {
+			return s.broker.GetPartition(key[:i], partitionID)
+		}
+	}
+	return nil, fmt.Errorf("no such stream '%s'", key)
+}
+
+// Read up to count entries (all when count is 0) with offsets in [start, end].
+func (s *RedisServer) readStream(partition *Partition, start, end int64, count int) ([]*StoredEvent, error) {
+	var events []*StoredEvent
+	for start <= end {
+		batch, err := s.broker.partitionManager.FetchEvents(partition, start, redisReadBytes)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, event := range batch {
+			if event.Offset > end || (count > 0 && len(events) >= count) {
+				return events, nil
+			}
+			events = append(events, event)
+		}
+		start = batch[len(batch)-1].Offset + 1
+	}
+	return events, nil
+}
+
+func formatStreamID(offset int64) string {
+	return strconv.FormatInt(offset+1, 10) + "-0"
+}
+
+// Parse "<ms>-<seq>" or "<ms>".
+func parseStreamID(s string) (streamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseInt(msPart, 10, 64)
+	if err != nil || ms < 0 {
+		return streamID{}, fmt.Errorf("invalid stream ID %q", s)
+	}
+	id := streamID{ms: ms}
+	if hasSeq {
+		if id.seq, err = strconv.ParseInt(seqPart, 10, 64); err != nil || id.seq < 0 {
+			return streamID{}, fmt.Errorf("invalid stream ID %q", s)
+		}
+	}
+	return id, nil
+}
+
+// First offset of an XRANGE: "-", an inclusive ID, or "(" and an exclusive ID.
+func parseRangeStart(s string) (int64, error) {
+	if s == "-" {
+		return 0, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	id, err := parseStreamID(strings.TrimPrefix(s, "("))
+	if err != nil {
+		return 0, err
+	}
+	if !exclusive && id.seq == 0 {
+		return max(id.ms-1, 0), nil // the entry with this ID is included
+	}
+	return id.ms, nil
+}
+
+// Last offset of an XRANGE: "+", an inclusive ID, or "(" and an exclusive ID.
+func parseRangeEnd(s string) (int64, error) {
+	if s == "+" {
+		return math.MaxInt64, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	id, err := parseStreamID(strings.TrimPrefix(s, "("))
+	if err != nil {
+		return 0, err
+	}
+	if exclusive && id.seq == 0 {
+		return id.ms - 2, nil // the entry with this ID is excluded
+	}
+	return id.ms - 1, nil
+}
+
+// BLOCK 0 waits indefinitely.
+func blockDuration(block time.Duration) time.Duration {
+	if block == 0 {
+		return math.MaxInt64
+	}
+	return block
+}
+
+// Encode XADD fields as a JSON object with string values, keeping their order.
+func fieldsPayload(fields []string) []byte {
+	buf := []byte{'{'}
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		name, _ := json.Marshal(fields[i])
+		value, _ := json.Marshal(fields[i+1])
+		buf = append(buf, name...)
+		buf = append(buf, ':')
+		buf = append(buf, value...)
+	}
+	return append(buf, '}')
+}
+
+// Decode a payload into entry fields. JSON object members become fields in order,
+// with string values unquoted and other values left as JSON. Anything else is
+// returned as a single "payload" field.
+func payloadFields(payload []byte) []string {
+	fallback := []string{"payload", string(payload)}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return fallback
+	}
+
+	var fields []string
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return fallback
+		}
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return fallback
+		}
+
+		value := string(raw)
+		var str string
+		if json.Unmarshal(raw, &str) == nil {
+			value = str
+		}
+		fields = append(fields, token.(string), value)
+	}
+	return fields
+}
+
+func writeStreamEntries(w *resp.Writer, events []*StoredEvent) {
+	w.ArrayLen(len(events))
+	for _, event := range events {
+		w.ArrayLen(2)
+		w.BulkString(formatStreamID(event.Offset))
+		fields := payloadFields(event.Payload)
+		w.ArrayLen(len(fields))
+		for _, field := range fields {
+			w.BulkString(field)
+		}
+	}
+}
+
+// Reply to XREAD/XREADGROUP: one [key, entries] pair per stream with results,
+// or a nil array when there are none. Streams with nil results are left out.
+func writeStreamResults(w *resp.Writer, keys []string, results [][]*StoredEvent) {
+	if results == nil {
+		w.NullArray()
+		return
+	}
+	n := 0
+	for _, events := range results {
+		if events != nil {
+			n++
+		}
+	}
+	w.ArrayLen(n)
+	for i, key := range keys {
+		if results[i] == nil {
+			continue
+		}
+		w.ArrayLen(2)
+		w.BulkString(key)
+		writeStreamEntries(w, results[i])
+	}
+}
+
+func wrongArgs(w *resp.Writer, cmd string) {
+	w.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
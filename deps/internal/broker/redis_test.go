@@ -0,0 +1,264 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedisXAddXRange(t *testing.T) {
+	conn := setupTestRedisConn(t)
+
+	for i := 1; i <= 3; i++ {
+		id := conn.do(t, "XADD", "test-topic:1", "*", "n", strconv.Itoa(i), "kind", "order")
+		if id != fmt.Sprintf("%d-0", i) {
+			t.Fatalf("Expected ID %d-0, got %v", i, id)
+		}
+	}
+
+	entries := conn.do(t, "XRANGE", "test-topic:1", "-", "+").([]interface{})
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	first := entries[0].([]interface{})
+	if first[0] != "1-0" || !reflect.DeepEqual(first[1], []interface{}{"n", "1", "kind", "order"}) {
+		t.Errorf("Unexpected entry %v", first)
+	}
+
+	// Exclusive start and COUNT
+	entries = conn.do(t, "XRANGE", "test-topic:1", "(1-0", "+", "COUNT", "1").([]interface{})
+	if len(entries) != 1 || entries[0].([]interface{})[0] != "2-0" {
+		t.Errorf("Expected only entry 2-0, got %v", entries)
+	}
+
+	// Inclusive end
+	entries = conn.do(t, "XRANGE", "test-topic:1", "-", "2").([]interface{})
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries, got %v", entries)
+	}
+
+	// A bare topic name is partition 0, which is empty
+	if entries := conn.do(t, "XRANGE", "test-topic", "-", "+").([]interface{}); len(entries) != 0 {
+		t.Errorf("Expected partition 0 to be empty, got %v", entries)
+	}
+
+	if reply := conn.do(t, "XADD", "missing", "*", "a", "b"); !isRedisError(reply, "ERR") {
+		t.Errorf("Expected error for unknown stream, got %v", reply)
+	}
+}
+
+func TestRedisXReadBlock(t *testing.T) {
+	conn := setupTestRedisConn(t)
+	producer := conn.dial(t)
+
+	// Nothing new after $ within the timeout
+	if reply := conn.do(t, "XREAD", "BLOCK", "50", "STREAMS", "test-topic:2", "$"); reply != nil {
+		t.Fatalf("Expected nil reply, got %v", reply)
+	}
+
+	done := make(chan interface{}, 1)
+	go func() {
+		done <- conn.do(t, "XREAD", "COUNT", "10", "BLOCK", "5000", "STREAMS", "test-topic:2", "$")
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	producer.do(t, "XADD", "test-topic:2", "*", "temp", "21")
+
+	select {
+	case reply := <-done:
+		streams, ok := reply.([]interface{})
+		if !ok || len(streams) != 1 {
+			t.Fatalf("Unexpected reply %v", reply)
+		}
+		stream := streams[0].([]interface{})
+		entries := stream[1].([]interface{})
+		if stream[0] != "test-topic:2" || len(entries) != 1 {
+			t.Errorf("Unexpected stream reply %v", stream)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Blocking XREAD not woken by XADD")
+	}
+
+	// Reading from 0 returns the whole stream without blocking
+	streams := conn.do(t, "XREAD", "STREAMS", "test-topic:2", "0").([]interface{})
+	if entries := streams[0].([]interface{})[1].([]interface{}); len(entries) != 1 {
+		t.Errorf("Expected 1 entry, got %v", entries)
+	}
+}
+
+func TestRedisConsumerGroup(t *testing.T) {
+	conn := setupTestRedisConn(t)
+
+	for i := 0; i < 3; i++ {
+		conn.do(t, "XADD", "test-topic", "*", "n", strconv.Itoa(i))
+	}
+
+	if reply := conn.do(t, "XREADGROUP", "GROUP", "g", "c1", "STREAMS", "test-topic", ">"); !isRedisError(reply, "NOGROUP") {
+		t.Fatalf("Expected NOGROUP, got %v", reply)
+	}
+	if reply := conn.do(t, "XGROUP", "CREATE", "test-topic", "g", "0"); reply != "OK" {
+		t.Fatalf("XGROUP CREATE failed: %v", reply)
+	}
+	if reply := conn.do(t, "XGROUP", "CREATE", "test-topic", "g", "0"); !isRedisError(reply, "BUSYGROUP") {
+		t.Errorf("Expected BUSYGROUP, got %v", reply)
+	}
+
+	// Two consumers share the stream: each ">" read gets entries nobody else has seen
+	c1 := streamEntryIDs(conn.do(t, "XREADGROUP", "GROUP", "g", "c1", "COUNT", "2", "STREAMS", "test-topic", ">"))
+	c2 := streamEntryIDs(conn.do(t, "XREADGROUP", "GROUP", "g", "c2", "COUNT", "2", "STREAMS", "test-topic", ">"))
+	if !reflect.DeepEqual(c1, []string{"1-0", "2-0"}) || !reflect.DeepEqual(c2, []string{"3-0"}) {
+		t.Fatalf("Unexpected deliveries c1=%v c2=%v", c1, c2)
+	}
+	if reply := conn.do(t, "XREADGROUP", "GROUP", "g", "c1", "STREAMS", "test-topic", ">"); reply != nil {
+		t.Errorf("Expected nil reply with nothing new, got %v", reply)
+	}
+
+	// Pending history for c1
+	if pending := streamEntryIDs(conn.do(t, "XREADGROUP", "GROUP", "g", "c1", "STREAMS", "test-topic", "0")); len(pending) != 2 {
+		t.Errorf("Expected 2 pending entries, got %v", pending)
+	}
+
+	// Acking 1-0 commits offset 1; 2-0 is still pending
+	if n := conn.do(t, "XACK", "test-topic", "g", "1-0", "3-0"); n != int64(2) {
+		t.Errorf("Expected 2 acked, got %v", n)
+	}
+	if offset, err := conn.broker.offsetManager.GetOffset("g", "test-topic", 0); err != nil || offset != 1 {
+		t.Errorf("Expected committed offset 1, got %d (%v)", offset, err)
+	}
+	conn.do(t, "XACK", "test-topic", "g", "2-0")
+	if offset, _ := conn.broker.offsetManager.GetOffset("g", "test-topic", 0); offset != 3 {
+		t.Errorf("Expected committed offset 3, got %d", offset)
+	}
+}
+
+func TestRedisInlineAndUnknownCommands(t *testing.T) {
+	conn := setupTestRedisConn(t)
+
+	if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if reply := readRESP(t, conn.reader); reply != "PONG" {
+		t.Errorf("Expected PONG, got %v", reply)
+	}
+	if reply := conn.do(t, "FLUSHALL"); !isRedisError(reply, "ERR") {
+		t.Errorf("Expected unknown command error, got %v", reply)
+	}
+}
+
+type redisError string
+
+type redisTestConn struct {
+	net.Conn
+	reader *bufio.Reader
+	addr   string
+	broker *Broker
+}
+
+// Send a command as an array of bulk strings and read its reply.
+func (c *redisTestConn) do(t *testing.T, args ...string) interface{} {
+	t.Helper()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	return readRESP(t, c.reader)
+}
+
+// Open another connection to the same listener.
+func (c *redisTestConn) dial(t *testing.T) *redisTestConn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", c.addr, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &redisTestConn{Conn: conn, reader: bufio.NewReader(conn), addr: c.addr, broker: c.broker}
+}
+
+// Parse one reply: strings, redisError, int64, nil, or []interface{}.
+func readRESP(t *testing.T, r *bufio.Reader) interface{} {
+	t.Helper()
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return redisError(line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("Failed to read bulk string: %v", err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = readRESP(t, r)
+		}
+		return items
+	}
+	t.Fatalf("Unexpected reply %q", line)
+	return nil
+}
+
+func isRedisError(reply interface{}, code string) bool {
+	err, ok := reply.(redisError)
+	return ok && strings.HasPrefix(string(err), code+" ")
+}
+
+// The entry IDs of a single-stream XREAD/XREADGROUP reply.
+func streamEntryIDs(reply interface{}) []string {
+	streams, _ := reply.([]interface{})
+	if len(streams) != 1 {
+		return nil
+	}
+	var ids []string
+	for _, entry := range streams[0].([]interface{})[1].([]interface{}) {
+		ids = append(ids, entry.([]interface{})[0].(string))
+	}
+	return ids
+}
+
+// setupTestRedisConn starts a Redis listener on a random port over the test broker and connects to it.
+func setupTestRedisConn(t *testing.T) *redisTestConn {
+	t.Helper()
+
+	s := setupTestServer()
+	server := NewRedisServer(s.broker, 0)
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+
+	c := &redisTestConn{addr: server.Addr().String(), broker: s.broker}
+	return c.dial(t)
+}
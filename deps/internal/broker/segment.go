@@ -0,0 +1,303 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A sealed segment of a partition log: a log file, header and records, that
+// holds offsets Base up to Next and is never written again. It is stored next to
+// the active file as partition-{id}-{base}.log until tiering offloads it to the
+// cold store, after which it is read back through the tier's cache.
+//
+// The exported fields are persisted in partition-{id}.segments.json and guarded
+// by the LogStorage's mu; Cold is changed with mu held as well, so readers may
+// check it holding only mu.
+type segment struct {
+	Base         int64 `json:"base"`
+	Next         int64 `json:"next"`
+	Size         int64 `json:"size"`
+	MaxTimestamp int64 `json:"maxTimestamp"`
+	Encrypted    bool  `json:"encrypted,omitempty"`
+	Cold         bool  `json:"cold,omitempty"`
+
+	// mu guards file and the indexes, which are loaded on first read.
+	mu        sync.Mutex
+	file      file // local file, while the segment is local
+	positions []int64
+	timeIndex []timeIndexEntry
+}
+
+// partition-{id}.segments.json: the sealed segments of a partition, in order.
+type segmentsFile struct {
+	Version  int        `json:"version"`
+	Segments []*segment `json:"segments"`
+}
+
+// Name of the sealed segment starting at base, next to the active file at path.
+func segmentPath(logPath string, base int64) string {
+	return fmt.Sprintf("%s-%020d.log", strings.TrimSuffix(logPath, ".log"), base)
+}
+
+func segmentsPath(logPath string) string {
+	return strings.TrimSuffix(logPath, ".log") + ".segments.json"
+}
+
+// Name of a segment in the cold store: "{topic}/partition-{id}-{base}.log".
+func segmentObject(logPath string, base int64) string {
+	return path.Join(filepath.Base(filepath.Dir(logPath)), filepath.Base(segmentPath(logPath, base)))
+}
+
+// Load the sealed segments of the log at logPath. A segment renamed into place by
+// a roll that crashed before recording it is adopted, so no offsets are lost.
+func loadSegments(fsys fileSystem, logPath string) ([]*segment, error) {
+	var segments []*segment
+	data, err := fsys.ReadFile(segmentsPath(logPath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var file segmentsFile
+		if err := decodeVersioned(segmentsPath(logPath), data, &file); err != nil {
+			return nil, err
+		}
+		segments = file.Segments
+	}
+
+	// A new active file left by a roll that crashed before renaming it
+	fsys.Remove(logPath + ".next")
+
+	var next int64
+	if len(segments) > 0 {
+		next = segments[len(segments)-1].Next
+	}
+	stray := segmentPath(logPath, next)
+	if _, err := fsys.Stat(stray); err != nil {
+		return segments, nil
+	}
+	adopted, err := sealedSegment(fsys, stray, next)
+	if err != nil {
+		return nil, fmt.Errorf("failed to adopt %s: %w", stray, err)
+	}
+	segments = append(segments, adopted)
+	if err := saveSegments(fsys, logPath, segments); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+// Describe the sealed segment file at path, which starts at base, by scanning it.
+func sealedSegment(fsys fileSystem, path string, base int64) (*segment, error) {
+	file, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, logHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if version := logVersion(header[:n]); version != FormatVersion {
+		return nil, &FormatVersionError{Path: path, Version: version}
+	}
+
+	scan, err := scanPositions(file)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &segment{
+		Base:         base,
+		Next:         base + int64(len(scan.positions)),
+		Size:         info.Size(),
+		MaxTimestamp: scan.maxTimestamp,
+		Encrypted:    scan.encrypted,
+	}, nil
+}
+
+func saveSegments(fsys fileSystem, logPath string, segments []*segment) error {
+	data, err := json.Marshal(segmentsFile{Version: FormatVersion, Segments: segments})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fsys, segmentsPath(logPath), func(out io.Writer) error {
+		_, err := out.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// Local sealed segments of the log at logPath and its segments file, if any, for
+// copying a partition's log whole.
+func localSegmentFiles(logPath string) ([]string, error) {
+	data, err := os.ReadFile(segmentsPath(logPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var file segmentsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", segmentsPath(logPath), err)
+	}
+
+	files := []string{segmentsPath(logPath)}
+	for _, segment := range file.Segments {
+		if !segment.Cold {
+			files = append(files, segmentPath(logPath, segment.Base))
+		}
+	}
+	return files, nil
+}
+
+// Seal the active file as a segment and start a new, empty one. The sealed file
+// stays open for reads in progress. mu must be held.
+func (l *LogStorage) roll() error {
+	if len(l.positions) == 0 {
+		return nil
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	// Prepare the new active file first, so a failure leaves everything as it was
+	next := l.path + ".next"
+	l.fs.Remove(next)
+	file, err := l.fs.OpenFile(next, os.O_RDWR|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := prepareLogHeader(file, next); err != nil {
+		file.Close()
+		l.fs.Remove(next)
+		return err
+	}
+
+	sealed := &segment{
+		Base:         l.base,
+		Next:         l.base + int64(len(l.positions)),
+		Size:         l.offset,
+		MaxTimestamp: l.maxTimestamp,
+		Encrypted:    l.encrypted,
+		file:         l.file,
+		positions:    l.positions,
+		timeIndex:    l.timeIndex,
+	}
+	if err := l.fs.Rename(l.path, segmentPath(l.path, sealed.Base)); err != nil {
+		file.Close()
+		l.fs.Remove(next)
+		return err
+	}
+	if err := l.fs.Rename(next, l.path); err != nil {
+		l.fs.Rename(segmentPath(l.path, sealed.Base), l.path)
+		file.Close()
+		l.fs.Remove(next)
+		return err
+	}
+
+	// From here on the segment is sealed; on a crash before this is saved, the
+	// next open adopts it
+	l.segments = append(l.segments, sealed)
+	l.file = file
+	l.offset = logHeaderSize
+	l.base = sealed.Next
+	l.positions = make([]int64, 0)
+	l.timeIndex = nil
+	l.encrypted = false
+	l.maxTimestamp = 0
+	return saveSegments(l.fs, l.path, l.segments)
+}
+
+// The sealed segment holding offset, which must be before base. mu must be held.
+func (l *LogStorage) segmentFor(offset int64) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].Next > offset })
+	return l.segments[i]
+}
+
+// Read the whole records of a sealed segment from startOffset that fit in
+// maxBytes, as span does. Returns them with the offset of their first event and
+// how many events they hold.
+func (l *LogStorage) readSegment(segment *segment, startOffset int64, maxBytes int) ([]byte, int64, int, error) {
+	for attempt := 0; ; attempt++ {
+		buffer, first, count, err := l.readSegmentOnce(segment, startOffset, maxBytes)
+		// Offloaded while it was being read: read it back from the cold store
+		if attempt == 0 && (errors.Is(err, os.ErrClosed) || errors.Is(err, os.ErrNotExist)) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to read segment at offset %d: %w", segment.Base, err)
+		}
+		return buffer, first, count, nil
+	}
+}
+
+func (l *LogStorage) readSegmentOnce(segment *segment, startOffset int64, maxBytes int) ([]byte, int64, int, error) {
+	segment.mu.Lock()
+	cold := segment.Cold
+	file := segment.file
+	if file == nil {
+		var err error
+		if cold {
+			if l.tier == nil {
+				segment.mu.Unlock()
+				return nil, 0, 0, errors.New("segment is in the cold tier, which is not configured")
+			}
+			file, err = l.tier.open(segmentObject(l.path, segment.Base))
+		} else {
+			file, err = l.fs.OpenFile(segmentPath(l.path, segment.Base), os.O_RDONLY, 0)
+		}
+		if err != nil {
+			segment.mu.Unlock()
+			return nil, 0, 0, err
+		}
+		if cold {
+			// The cache may evict the file; open it for each read
+			defer file.Close()
+		} else {
+			segment.file = file
+		}
+	}
+	if segment.positions == nil {
+		scan, err := scanPositions(file)
+		if err != nil {
+			segment.mu.Unlock()
+			return nil, 0, 0, err
+		}
+		segment.positions = scan.positions
+		segment.timeIndex = scan.timeIndex
+	}
+	positions := segment.positions
+	segment.mu.Unlock()
+
+	if int64(len(positions)) != segment.Next-segment.Base {
+		return nil, 0, 0, fmt.Errorf("segment holds %d events, expected %d", len(positions), segment.Next-segment.Base)
+	}
+	index, start, end, count := span(positions, segment.Size, startOffset-segment.Base, maxBytes)
+	buffer := make([]byte, end-start)
+	if _, err := file.ReadAt(buffer, start); err != nil {
+		return nil, 0, 0, err
+	}
+	return buffer, segment.Base + index, count, nil
+}
+
+// Close the segment's local file, if open.
+func (s *segment) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"example.com/deps/internal/protocol"
+	"example.com/deps/pkg/client"
+)
+
+func TestBrokerShutdownReleasesLongPolls(t *testing.T) {
+	dataDir := t.TempDir()
+	b, addr := startTestBroker(t, dataDir)
+
+	// Serve the binary protocol too, on a random port
+	tcpServer := NewTCPServer(b, 0)
+	if err := tcpServer.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	b.tcpServer = tcpServer
+	go tcpServer.Serve()
+
+	ctx := context.Background()
+	cl := client.New(addr)
+	if _, err := cl.Publish(ctx, "orders", "k", map[string]int{"n": 1}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if err := cl.CommitOffset(ctx, "g", "orders", 0, 1); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	// Long polls over HTTP and TCP, waiting for a record that never comes
+	httpDone := make(chan error, 1)
+	go func() {
+		_, err := cl.Fetch(ctx, "orders", 0, 1, client.FetchOptions{MinBytes: 1, MaxWait: 20 * time.Second})
+		httpDone <- err
+	}()
+	tcpClient, err := protocol.Dial(tcpServer.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer tcpClient.Close()
+	tcpDone := make(chan error, 1)
+	go func() {
+		req := &protocol.FetchRequest{Topic: "orders", Partition: 0, Offset: 1, MinBytes: 1, MaxWaitMs: 20000}
+		tcpDone <- tcpClient.Do(protocol.APIFetch, req, &protocol.FetchResponse{})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := b.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %s; long polls were not released", elapsed)
+	}
+
+	// Both long polls were answered rather than cut off
+	for name, done := range map[string]chan error{"HTTP": httpDone, "TCP": tcpDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%s long poll failed: %v", name, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s long poll still waiting after shutdown", name)
+		}
+	}
+
+	// The logs are closed, and everything is there after a restart
+	partition, _ := b.GetPartition("orders", 0)
+	if _, err := b.partitionManager.AppendEvent(partition, "k", []byte("{}")); err == nil {
+		t.Errorf("Expected appends to fail after shutdown")
+	}
+
+	restarted, _ := startTestBroker(t, dataDir)
+	if offset, err := restarted.offsetManager.GetOffset("g", "orders", 0); err != nil || offset != 1 {
+		t.Errorf("Expected committed offset 1 after restart, got %d (%v)", offset, err)
+	}
+	partition, err = restarted.GetPartition("orders", 0)
+	if err != nil || partition.logStorage.NextOffset() != 1 {
+		t.Errorf("Expected 1 record after restart (%v)", err)
+	}
+}
+
+func TestBrokerShutdownDeadline(t *testing.T) {
+	b, addr := startTestBroker(t, t.TempDir())
+
+	// A publish whose body never finishes arriving keeps its handler busy
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /topics/events HTTP/1.1\r\nHost: %s\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{", addr)
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline to expire, got %v", err)
+	}
+
+	// The stuck connection was dropped and the logs closed regardless
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+	partition, _ := b.GetPartition("orders", 0)
+	if _, err := b.partitionManager.AppendEvent(partition, "k", []byte("{}")); err == nil {
+		t.Errorf("Expected appends to fail after shutdown")
+	}
+}
+
+func TestBrokerListenFailureReleasesResources(t *testing.T) {
+	dataDir := t.TempDir()
+	b, _ := startTestBroker(t, dataDir)
+	partition, _ := b.GetPartition("orders", 0)
+	if _, err := b.partitionManager.AppendEvent(partition, "k", []byte("{}")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The HTTP port is taken, so Listen fails after loading the logs and starting TCP
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer busy.Close()
+	free, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	tcpPort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	b = NewBroker(busy.Addr().(*net.TCPAddr).Port, dataDir)
+	b.EnableTCP(tcpPort)
+	if err := b.Listen(); err == nil {
+		b.Close()
+		t.Fatalf("Expected Listen to fail on a port in use")
+	}
+
+	// Nothing it started is left running
+	if b.tcpServer != nil || b.GetTopic("orders") != nil {
+		t.Errorf("Expected the TCP listener and loaded topics to be released")
+	}
+	if l, err := net.Listen("tcp", fmt.Sprintf(":%d", tcpPort)); err != nil {
+		t.Errorf("Expected the TCP port to be released: %v", err)
+	} else {
+		l.Close()
+	}
+
+	// Once the port is free, retrying succeeds with the same state
+	b.port = 0
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Failed to listen on retry: %v", err)
+	}
+	defer b.Close()
+	partition, err = b.GetPartition("orders", 0)
+	if err != nil || partition.logStorage.NextOffset() != 1 {
+		t.Errorf("Expected 1 record after retrying (%v)", err)
+	}
+}
+
+// startTestBroker starts a broker with an "orders" topic in dataDir, serving HTTP on
+// a random port, and returns it with its address. It is closed when the test ends
+// unless the test shuts it down first.
+func startTestBroker(t *testing.T, dataDir string) (*Broker, string) {
+	t.Helper()
+
+	b := NewBroker(0, dataDir)
+	if err := b.AddTopic("orders", 1); err != nil {
+		t.Fatalf("Failed to add topic: %v", err)
+	}
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	go b.Serve()
+	t.Cleanup(func() { b.Close() })
+
+	return b, fmt.Sprintf("127.0.0.1:%d", b.Addr().(*net.TCPAddr).Port)
+}
@@ -0,0 +1,438 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Manifest of a snapshot, written to snapshot.json once everything else is in
+// place. A snapshot directory is otherwise laid out like a data directory.
+type SnapshotManifest struct {
+	Version   int           `json:"version"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Logs      []SnapshotLog `json:"logs"`
+}
+
+// A partition log in a snapshot: its active file, copied up to the end it had
+// when the snapshot was taken, and its sealed segments.
+type SnapshotLog struct {
+	Topic      string            `json:"topic"`
+	Partition  int               `json:"partition"`
+	Path       string            `json:"path"` // relative to the snapshot directory
+	Size       int64             `json:"size"`
+	NextOffset int64             `json:"nextOffset"`
+	SHA256     string            `json:"sha256"`
+	Segments   []SnapshotSegment `json:"segments,omitempty"`
+}
+
+// A sealed segment of a partition log in a snapshot, holding offsets Base up to
+// Next. A cold segment is only recorded: it stays in the cold store.
+type SnapshotSegment struct {
+	Path   string `json:"path"` // relative to the snapshot directory
+	Base   int64  `json:"base"`
+	Next   int64  `json:"next"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Cold   bool   `json:"cold,omitempty"`
+}
+
+const snapshotManifest = "snapshot.json"
+
+// Take a point-in-time snapshot of every topic's log, the topic metadata and the
+// committed offsets into dir, which must not exist, while the broker keeps
+// serving. Writes are held off only while the end of every log is recorded; the
+// logs are then copied up to those ends, which appends don't change.
+//
+// The active file of each log stays open for appends, so it is copied; sealed
+// segments are never written again and are hard-linked where the file system
+// allows. Segments offloaded to the cold tier are recorded but not copied, so a
+// broker restored from the snapshot needs the same cold store. Encrypted records
+// are copied as they are stored; the keyfile is not part of the snapshot.
+func (b *Broker) Snapshot(dir string) (*SnapshotManifest, error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	manifest, err := b.snapshot(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func (b *Broker) snapshot(dir string) (*SnapshotManifest, error) {
+	type logCopy struct {
+		storage *LogStorage
+		log     SnapshotLog
+		file    file  // the active file as of the snapshot, which a roll may seal
+		base    int64 // of the active file
+	}
+
+	// Hold off topic changes and every log's writes together, so the logs, offsets
+	// and metadata agree: no committed offset is past the end of its copied log
+	b.mu.RLock()
+	var logs []logCopy
+	for name, topic := range b.topics {
+		for id, partition := range topic.Partitions {
+			// Topics kept in memory are in the metadata, but start out empty
+			storage, ok := partition.logStorage.(*LogStorage)
+			if !ok {
+				continue
+			}
+			logs = append(logs, logCopy{storage: storage, log: SnapshotLog{
+				Topic:     name,
+				Partition: id,
+				Path:      filepath.Join(name, fmt.Sprintf("partition-%d.log", id)),
+			}})
+		}
+	}
+	for i := range logs {
+		storage := logs[i].storage
+		storage.mu.RLock()
+		logs[i].log.Size = storage.offset
+		logs[i].log.NextOffset = storage.base + int64(len(storage.positions))
+		logs[i].file = storage.file
+		logs[i].base = storage.base
+		for _, segment := range storage.segments {
+			logs[i].log.Segments = append(logs[i].log.Segments, SnapshotSegment{
+				Path: segmentPath(logs[i].log.Path, segment.Base),
+				Base: segment.Base,
+				Next: segment.Next,
+				Size: segment.Size,
+				Cold: segment.Cold,
+			})
+		}
+	}
+	offsets, offsetsErr := json.Marshal(offsetsFile{Version: FormatVersion, Offsets: b.offsetManager.snapshot()})
+	metadata, metadataErr := json.Marshal(metadataFile{Version: FormatVersion, Topics: b.metadata.GetTopics()})
+	for i := range logs {
+		logs[i].storage.mu.RUnlock()
+	}
+	b.mu.RUnlock()
+	if err := errors.Join(offsetsErr, metadataErr); err != nil {
+		return nil, err
+	}
+
+	manifest := &SnapshotManifest{Version: FormatVersion, CreatedAt: time.Now().UTC()}
+	for _, l := range logs {
+		sum, err := l.storage.snapshotActive(filepath.Join(dir, l.log.Path), l.file, l.base, l.log.Size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy log of %s partition %d: %w", l.log.Topic, l.log.Partition, err)
+		}
+		l.log.SHA256 = sum
+
+		if err := l.storage.snapshotSegments(dir, &l.log); err != nil {
+			return nil, fmt.Errorf("failed to copy segments of %s partition %d: %w", l.log.Topic, l.log.Partition, err)
+		}
+		manifest.Logs = append(manifest.Logs, l.log)
+	}
+	sort.Slice(manifest.Logs, func(i, j int) bool { return manifest.Logs[i].Path < manifest.Logs[j].Path })
+
+	for name, data := range map[string][]byte{"offsets.json": offsets, "metadata.json": metadata} {
+		if err := writeSnapshotFile(filepath.Join(dir, name), data); err != nil {
+			return nil, err
+		}
+	}
+
+	// Last, so a snapshot with a manifest is complete
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSnapshotFile(filepath.Join(dir, snapshotManifest), data); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Copy the first size bytes of the active file as of the snapshot, active, to path
+// and return their checksum. Should a roll have sealed the file since and
+// offloading closed it, the copy is made from the segment it became instead.
+func (l *LogStorage) snapshotActive(path string, active file, base, size int64) (string, error) {
+	copyFrom := func(from io.ReaderAt) (string, error) {
+		hash := sha256.New()
+		err := writeFileAtomic(osFS{}, path, func(out io.Writer) error {
+			_, err := io.Copy(io.MultiWriter(out, hash), io.NewSectionReader(from, 0, size))
+			return err
+		})
+		return hex.EncodeToString(hash.Sum(nil)), err
+	}
+
+	sum, err := copyFrom(active)
+	if !errors.Is(err, os.ErrClosed) {
+		return sum, err
+	}
+	var sealed *os.File
+	if sealed, err = os.Open(segmentPath(l.path, base)); errors.Is(err, os.ErrNotExist) && l.tier != nil {
+		sealed, err = l.tier.open(segmentObject(l.path, base))
+	}
+	if err != nil {
+		return "", err
+	}
+	defer sealed.Close()
+	return copyFrom(sealed)
+}
+
+// Link the local sealed segments of a log into the snapshot in dir, filling in
+// their checksums, and write its segments file. A segment offloaded since the
+// snapshot started is marked cold.
+func (l *LogStorage) snapshotSegments(dir string, log *SnapshotLog) error {
+	segments := log.Segments
+	if len(segments) == 0 {
+		return nil
+	}
+
+	listed := make([]*segment, len(segments))
+	for i := range segments {
+		s := &segments[i]
+		if !s.Cold {
+			err := linkOrCopy(segmentPath(l.path, s.Base), filepath.Join(dir, s.Path))
+			if errors.Is(err, os.ErrNotExist) {
+				s.Cold = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if !s.Cold {
+			sum, err := fileSHA256(filepath.Join(dir, s.Path))
+			if err != nil {
+				return err
+			}
+			s.SHA256 = sum
+		}
+		listed[i] = &segment{Base: s.Base, Next: s.Next, Size: s.Size, Cold: s.Cold}
+	}
+
+	// Sealed segments were scanned when written or loaded; keep what is known
+	l.mu.RLock()
+	for i, segment := range l.segments[:len(listed)] {
+		listed[i].MaxTimestamp = segment.MaxTimestamp
+		listed[i].Encrypted = segment.Encrypted
+	}
+	l.mu.RUnlock()
+	return saveSegments(osFS{}, filepath.Join(dir, log.Path), listed)
+}
+
+// Hard-link src to dst, or copy it where links aren't possible, such as across
+// file systems.
+func linkOrCopy(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil || errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return copyFile(src, dst)
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func writeSnapshotFile(path string, data []byte) error {
+	return writeFileAtomic(osFS{}, path, func(out io.Writer) error {
+		_, err := out.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// Check that dir holds a complete snapshot in the current format version: every
+// log and local segment in its manifest has the recorded size and checksum and
+// holds sound records up to its recorded next offset, and the metadata and
+// offsets load. Cold segments are not checked, being out of the snapshot. Encrypted
+// records are checked for structure only.
+func ValidateSnapshot(dir string) (*SnapshotManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotManifest))
+	if err != nil {
+		return nil, fmt.Errorf("not a complete snapshot: %w", err)
+	}
+	var manifest SnapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", snapshotManifest, err)
+	}
+	if manifest.Version != FormatVersion {
+		return nil, &FormatVersionError{Path: filepath.Join(dir, snapshotManifest), Version: manifest.Version}
+	}
+
+	metadata := NewMetadataManager(filepath.Join(dir, "metadata.json"))
+	if err := metadata.Load(); err != nil {
+		return nil, err
+	}
+	if err := NewOffsetManager(filepath.Join(dir, "offsets.json")).load(); err != nil {
+		return nil, err
+	}
+
+	// Every partition in the metadata must have its log in the manifest
+	listed := make(map[string]bool)
+	for _, log := range manifest.Logs {
+		listed[log.Path] = true
+	}
+	for name, topic := range metadata.GetTopics() {
+		if topic.storageType() == StorageMemory {
+			continue
+		}
+		for id := range topic.Partitions {
+			if path := filepath.Join(name, fmt.Sprintf("partition-%d.log", id)); !listed[path] {
+				return nil, fmt.Errorf("%s is in the metadata but not in the snapshot", path)
+			}
+		}
+	}
+
+	for _, log := range manifest.Logs {
+		if err := validateSnapshotLog(dir, log); err != nil {
+			return nil, fmt.Errorf("%s: %w", log.Path, err)
+		}
+	}
+	return &manifest, nil
+}
+
+func validateSnapshotLog(dir string, log SnapshotLog) error {
+	// Restoring writes to the path, so it must be the partition's own
+	if path := filepath.Join(log.Topic, fmt.Sprintf("partition-%d.log", log.Partition)); log.Path != path || !filepath.IsLocal(path) {
+		return fmt.Errorf("unexpected path for %s partition %d", log.Topic, log.Partition)
+	}
+
+	// Segments follow each other from offset 0 up to the active file
+	var base int64
+	for _, segment := range log.Segments {
+		if segment.Base != base || segment.Next < segment.Base || segment.Path != segmentPath(log.Path, segment.Base) {
+			return fmt.Errorf("unexpected segment at offset %d", segment.Base)
+		}
+		if !segment.Cold {
+			if err := validateSnapshotFile(dir, segment.Path, segment.Size, segment.SHA256, segment.Next-segment.Base); err != nil {
+				return fmt.Errorf("%s: %w", segment.Path, err)
+			}
+		}
+		base = segment.Next
+	}
+	if err := validateSnapshotSegmentsFile(dir, log); err != nil {
+		return err
+	}
+
+	return validateSnapshotFile(dir, log.Path, log.Size, log.SHA256, log.NextOffset-base)
+}
+
+// Check that the segments file of a log in a snapshot lists what its manifest
+// entry does.
+func validateSnapshotSegmentsFile(dir string, log SnapshotLog) error {
+	path := segmentsPath(filepath.Join(dir, log.Path))
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && len(log.Segments) == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var file segmentsFile
+	if err := decodeVersioned(path, data, &file); err != nil {
+		return err
+	}
+	if len(file.Segments) != len(log.Segments) {
+		return fmt.Errorf("segments file lists %d segments, expected %d", len(file.Segments), len(log.Segments))
+	}
+	for i, s := range file.Segments {
+		expected := log.Segments[i]
+		if s.Base != expected.Base || s.Next != expected.Next || s.Size != expected.Size || s.Cold != expected.Cold {
+			return fmt.Errorf("segments file disagrees about the segment at offset %d", expected.Base)
+		}
+	}
+	return nil
+}
+
+// Check a log file in a snapshot against its recorded size and checksum, and
+// that it holds sound records for the given number of events.
+func validateSnapshotFile(dir, path string, size int64, sum string, events int64) error {
+	data, err := os.ReadFile(filepath.Join(dir, path))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("size %d, expected %d", len(data), size)
+	}
+	if actual := sha256.Sum256(data); hex.EncodeToString(actual[:]) != sum {
+		return errors.New("checksum mismatch")
+	}
+	if version := logVersion(data); version != FormatVersion {
+		return &FormatVersionError{Path: path, Version: version}
+	}
+
+	var read int64
+	if _, err := ReadLog(bytes.NewReader(data), nil, func(record LogRecord) error {
+		read += int64(record.Count)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if read != events {
+		return fmt.Errorf("holds %d events, expected %d", read, events)
+	}
+	return nil
+}
+
+// Validate the snapshot in dir and copy it into dataDir, which must not exist or
+// be empty, for a broker to start from. Sealed segments are hard-linked where
+// possible, since neither side writes them again. The snapshot is left as it is,
+// so it can be restored again.
+func RestoreSnapshot(dir, dataDir string) (*SnapshotManifest, error) {
+	manifest, err := ValidateSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", dataDir)
+	}
+
+	// Sealed segments first, linked like when the snapshot was taken; a log's
+	// segments file and active file then make them part of it
+	files := []string{"metadata.json", "offsets.json"}
+	for _, log := range manifest.Logs {
+		for _, segment := range log.Segments {
+			if segment.Cold {
+				continue
+			}
+			if err := linkOrCopy(filepath.Join(dir, segment.Path), filepath.Join(dataDir, segment.Path)); err != nil {
+				return nil, fmt.Errorf("failed to restore %s: %w", segment.Path, err)
+			}
+		}
+		if len(log.Segments) > 0 {
+			rel, err := filepath.Rel(dir, segmentsPath(filepath.Join(dir, log.Path)))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, rel)
+		}
+		files = append(files, log.Path)
+	}
+	for _, name := range files {
+		if err := copyFile(filepath.Join(dir, name), filepath.Join(dataDir, name)); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,138 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"example.com/deps/pkg/client"
+)
+
+func TestSnapshotWhilePublishing(t *testing.T) {
+	ctx := context.Background()
+	snapshotDir := t.TempDir()
+
+	b := NewBroker(0, t.TempDir())
+	b.SetSnapshotDir(snapshotDir)
+	for _, topic := range []string{"orders", "payments"} {
+		if err := b.AddTopic(topic, 2); err != nil {
+			t.Fatalf("Failed to add topic: %v", err)
+		}
+	}
+	if err := b.Listen(); err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	go b.Serve()
+	t.Cleanup(func() { b.Close() })
+	cl := client.New(fmt.Sprintf("127.0.0.1:%d", b.Addr().(*net.TCPAddr).Port))
+
+	// Keep publishing and committing while the snapshot is taken
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, topic := range []string{"orders", "payments"} {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				result, err := cl.Publish(ctx, topic, fmt.Sprintf("k%d", i), json.RawMessage(`{"n":1}`))
+				if err != nil {
+					t.Errorf("Publish failed: %v", err)
+					return
+				}
+				cl.CommitOffset(ctx, "billing", topic, result.Partition, result.Offset+1)
+			}
+		}(topic)
+	}
+	for {
+		if offsets, _ := cl.PartitionOffsets(ctx, "orders", 0); offsets != nil && offsets.EndOffset >= 20 {
+			break
+		}
+	}
+	snapshot, err := cl.Snapshot(ctx, "nightly")
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if len(snapshot.Logs) != 4 || snapshot.Path != filepath.Join(snapshotDir, "nightly") {
+		t.Errorf("Unexpected snapshot %+v", snapshot)
+	}
+
+	// Names can't escape the snapshot directory or be reused
+	for name, status := range map[string]int{"../escape": http.StatusBadRequest, "nightly": http.StatusConflict} {
+		if _, err := cl.Snapshot(ctx, name); !client.IsStatus(err, status) {
+			t.Errorf("Expected status %d for snapshot %q, got %v", status, name, err)
+		}
+	}
+
+	// A broker started from the restored snapshot has exactly what it recorded
+	dataDir := filepath.Join(t.TempDir(), "restored")
+	manifest, err := RestoreSnapshot(snapshot.Path, dataDir)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restored := NewBroker(0, dataDir)
+	if err := restored.Listen(); err != nil {
+		t.Fatalf("Failed to start the restored broker: %v", err)
+	}
+	defer restored.Close()
+	for _, log := range manifest.Logs {
+		partition, err := restored.GetPartition(log.Topic, log.Partition)
+		if err != nil {
+			t.Fatalf("Restored broker is missing %s: %v", log.Path, err)
+		}
+		if next := partition.logStorage.NextOffset(); next != log.NextOffset {
+			t.Errorf("%s: expected next offset %d, got %d", log.Path, log.NextOffset, next)
+		}
+		// Offsets were taken at the same moment as the logs
+		if committed, err := restored.offsetManager.GetOffset("billing", log.Topic, log.Partition); err == nil && committed > log.NextOffset {
+			t.Errorf("%s: committed offset %d is past the end %d", log.Path, committed, log.NextOffset)
+		}
+	}
+
+	// Restoring needs an empty data directory
+	if _, err := RestoreSnapshot(snapshot.Path, dataDir); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("Expected restoring over data to fail, got %v", err)
+	}
+}
+
+func TestValidateSnapshotDetectsDamage(t *testing.T) {
+	b, _ := startTestBroker(t, t.TempDir())
+	partition, _ := b.GetPartition("orders", 0)
+	partition.logStorage.Append(&StoredEvent{Key: "k", Payload: []byte(`{}`)})
+
+	dir := filepath.Join(t.TempDir(), "snapshot")
+	if _, err := b.Snapshot(dir); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if _, err := ValidateSnapshot(dir); err != nil {
+		t.Fatalf("Expected a sound snapshot, got %v", err)
+	}
+
+	// A flipped byte in a log
+	path := filepath.Join(dir, "orders", "partition-0.log")
+	data, _ := os.ReadFile(path)
+	data[len(data)-2] ^= 0xff
+	os.WriteFile(path, data, 0644)
+	if _, err := ValidateSnapshot(dir); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+
+	// A snapshot that never finished has no manifest
+	os.Remove(filepath.Join(dir, snapshotManifest))
+	if _, err := ValidateSnapshot(dir); err == nil {
+		t.Errorf("Expected a snapshot without a manifest to be rejected")
+	}
+}
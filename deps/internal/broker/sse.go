@@ -0,0 +1,313 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How often a streaming subscription commits its position for a consumer group.
+	streamCommitInterval = 1 * time.Second
+
+	// How often an idle stream sends a comment line so proxies keep the connection open.
+	streamKeepaliveInterval = 15 * time.Second
+
+	// Upper bound on bytes read from a partition per fetch while streaming.
+	streamFetchBytes = 1048576
+)
+
+// A record as sent over a streaming subscription.
+// The stored event is flattened into the same object as its topic and partition.
+type streamEvent struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	*StoredEvent
+}
+
+// Events fetched from one partition, handed from its reader to the response writer,
+// or the error that stopped the reader.
+type streamBatch struct {
+	topic     string
+	partition int
+	events    []*StoredEvent
+	err       error
+}
+
+// handleStream serves a Server-Sent Events feed of records from one partition of a topic,
+// or from all of its partitions when no partition is given.
+//
+// With a single partition each event's id is its offset. With all partitions the id is a
+// cursor of the last offset delivered per partition ("0:41,1:17"), so Last-Event-ID resumes
+// every partition. If a group is given, delivered offsets are committed for that group.
+func (s *HTTPServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		http.Error(w, "Missing topic", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	t := s.broker.GetTopic(topic)
+	if t == nil {
+		http.Error(w, "Topic not found", http.StatusNotFound)
+		return
+	}
+
+	// Select the partitions to stream
+	partitions := make(map[int]*Partition)
+	single := false
+	if partitionStr := r.URL.Query().Get("partition"); partitionStr != "" {
+		var partitionID int
+		if _, err := fmt.Sscanf(partitionStr, "%d", &partitionID); err != nil {
+			http.Error(w, "Invalid partition ID", http.StatusBadRequest)
+			return
+		}
+		partition, err := s.broker.GetPartition(topic, partitionID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		partitions[partitionID] = partition
+		single = true
+	} else {
+		for partitionID := 0; partitionID < t.NumPartitions; partitionID++ {
+			partition, err := s.broker.GetPartition(topic, partitionID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			partitions[partitionID] = partition
+		}
+	}
+
+	group := r.URL.Query().Get("group")
+	positions, err := s.streamStartOffsets(r, topic, partitions, group)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// One reader per partition; this goroutine is the only writer to the response.
+	// The stream ends when the broker shuts down; clients resume with Last-Event-ID.
+	ctx, cancel := s.broker.shutdownContext(r.Context())
+	defer cancel()
+	batches := make(chan streamBatch)
+	for partitionID, partition := range partitions {
+		go s.streamPartition(ctx, partitionID, partition, positions[partitionID], batches)
+	}
+
+	// Last offset delivered per partition (-1 before the first event)
+	delivered := make(map[int]int64, len(positions))
+	committed := make(map[int]int64, len(positions))
+	for partitionID, offset := range positions {
+		delivered[partitionID] = offset - 1
+		committed[partitionID] = offset - 1
+	}
+
+	commit := func() {
+		for partitionID, offset := range delivered {
+			if offset == committed[partitionID] {
+				continue
+			}
+			if err := s.broker.partitionManager.CommitOffset(group, topic, partitionID, offset+1); err != nil {
+				return
+			}
+			committed[partitionID] = offset
+		}
+	}
+
+	commitTicker := time.NewTicker(streamCommitInterval)
+	defer commitTicker.Stop()
+	keepalive := time.NewTicker(streamKeepaliveInterval)
+	defer keepalive.Stop()
+
+	if group != "" {
+		defer commit()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case batch := <-batches:
+			if batch.err != nil {
+				// Resuming would fail the same way; tell the client and end the stream
+				log.Printf("Stream of %s partition %d failed: %v", topic, batch.partition, batch.err)
+				data, _ := json.Marshal(map[string]interface{}{"partition": batch.partition, "error": batch.err.Error()})
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+				flusher.Flush()
+				return
+			}
+			for _, event := range batch.events {
+				data, err := json.Marshal(streamEvent{Topic: topic, Partition: batch.partition, StoredEvent: event})
+				if err != nil {
+					return
+				}
+				delivered[batch.partition] = event.Offset
+
+				id := strconv.FormatInt(event.Offset, 10)
+				if !single {
+					id = formatStreamCursor(delivered)
+				}
+				if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", id, data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-commitTicker.C:
+			if group != "" {
+				commit()
+			}
+		}
+	}
+}
+
+// Tail one partition from startOffset, sending each non-empty fetch to batches until ctx is
+// done or a fetch fails, which is sent as the last batch.
+func (s *HTTPServer) streamPartition(ctx context.Context, partitionID int, partition *Partition, startOffset int64, batches chan<- streamBatch) {
+	offset := startOffset
+	for ctx.Err() == nil {
+		s.broker.partitionManager.WaitForEvents(ctx, partition, offset, 1, maxFetchWait)
+
+		events, err := s.broker.partitionManager.FetchEvents(partition, offset, streamFetchBytes)
+		if err != nil {
+			select {
+			case batches <- streamBatch{topic: partition.Topic, partition: partitionID, err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		if len(events) == 0 {
+			continue
+		}
+
+		select {
+		case batches <- streamBatch{topic: partition.Topic, partition: partitionID, events: events}:
+			offset = events[len(events)-1].Offset + 1
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Work out where each partition starts. In order of precedence: the Last-Event-ID
+// header (or lastEventId query parameter, for clients that cannot set headers),
+// the offset parameter, the group's committed offset, and finally the start of the log.
+func (s *HTTPServer) streamStartOffsets(r *http.Request, topic string, partitions map[int]*Partition, group string) (map[int]int64, error) {
+	positions := make(map[int]int64, len(partitions))
+
+	var explicit *int64
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		var offset int64
+		if _, err := fmt.Sscanf(offsetStr, "%d", &offset); err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset")
+		}
+		explicit = &offset
+	}
+
+	for partitionID := range partitions {
+		positions[partitionID] = 0
+		switch {
+		case explicit != nil:
+			positions[partitionID] = *explicit
+		case group != "":
+			if offset, err := s.broker.offsetManager.GetOffset(group, topic, partitionID); err == nil {
+				positions[partitionID] = offset
+			}
+		}
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	if lastEventID == "" {
+		return positions, nil
+	}
+
+	// A bare offset applies to a single-partition stream
+	if !strings.Contains(lastEventID, ":") {
+		offset, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || len(partitions) != 1 {
+			return nil, fmt.Errorf("invalid Last-Event-ID %q", lastEventID)
+		}
+		for partitionID := range partitions {
+			positions[partitionID] = offset + 1
+		}
+		return positions, nil
+	}
+
+	cursor, err := parseStreamCursor(lastEventID)
+	if err != nil {
+		return nil, err
+	}
+	for partitionID, offset := range cursor {
+		if _, ok := partitions[partitionID]; ok {
+			positions[partitionID] = offset + 1
+		}
+	}
+	return positions, nil
+}
+
+// Render the last delivered offset of each partition as "0:41,1:17".
+// Partitions that have not delivered anything are left out.
+func formatStreamCursor(delivered map[int]int64) string {
+	partitionIDs := make([]int, 0, len(delivered))
+	for partitionID, offset := range delivered {
+		if offset >= 0 {
+			partitionIDs = append(partitionIDs, partitionID)
+		}
+	}
+	sort.Ints(partitionIDs)
+
+	parts := make([]string, 0, len(partitionIDs))
+	for _, partitionID := range partitionIDs {
+		parts = append(parts, fmt.Sprintf("%d:%d", partitionID, delivered[partitionID]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Parse a cursor produced by formatStreamCursor.
+func parseStreamCursor(cursor string) (map[int]int64, error) {
+	offsets := make(map[int]int64)
+	for _, part := range strings.Split(cursor, ",") {
+		var partitionID int
+		var offset int64
+		if _, err := fmt.Sscanf(part, "%d:%d", &partitionID, &offset); err != nil {
+			return nil, fmt.Errorf("invalid Last-Event-ID %q", cursor)
+		}
+		offsets[partitionID] = offset
+	}
+	return offsets, nil
+}
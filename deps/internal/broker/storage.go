@@ -1,94 +1,819 @@
 package broker
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// The storage of one partition: events at consecutive offsets from StartOffset,
+// appended at NextOffset. LogStorage keeps them in log files, MemoryLog in memory;
+// the broker picks one per topic, see StorageType.
+type PartitionLog interface {
+	// Append events at consecutive offsets and return the first, once stored.
+	// Offsets set on the events are overwritten.
+	Append(event *StoredEvent) (int64, error)
+	AppendBatch(events []*StoredEvent, codec Codec) (int64, error)
+
+	// Events from startOffset whose stored records fit in maxBytes, and at least
+	// one; empty at or past NextOffset.
+	Read(startOffset int64, maxBytes int) ([]*StoredEvent, error)
+
+	// The stored records from startOffset that fit in maxBytes, in the log file
+	// format, with the offset of the first event in them and how many they hold.
+	Section(startOffset int64, maxBytes int) (*io.SectionReader, int64, int, error)
+
+	StartOffset() int64
+	NextOffset() int64
+
+	// Bytes of records stored at or after offset.
+	BytesAfter(offset int64) int64
+
+	// The offset of the first event stamped at or after timestamp, in Unix
+	// nanoseconds, and its timestamp; -1 for both if every event is older.
+	OffsetForTimestamp(timestamp int64) (int64, int64, error)
+
+	// Closed the next time events are appended.
+	Changed() <-chan struct{}
+
+	// Whether any record is stored encrypted, so stored bytes must not be served.
+	Encrypted() bool
+
+	// The failed write that made the log read-only, or nil while it takes appends.
+	ReadOnly() *ReadOnlyError
+
+	// Drop the events at and after offset, so it is the next one appended. The
+	// partition's tail cache is not told; callers must drop what it holds.
+	Truncate(offset int64) error
+
+	Sync() error
+	Close() error
+}
+
+// How appended records reach the disk.
+type WriteOptions struct {
+	// Wait this long before each write so more concurrent appends join the batch.
+	// With zero, appends that arrive while a batch is being written still form the next one.
+	CommitWindow time.Duration
+
+	// Fsync every batch before acknowledging its appends.
+	Sync bool
+
+	// Seal the active segment and start a new one once it holds this many bytes.
+	// With zero, a partition's log is one file unless tiering seals it by age.
+	SegmentBytes int64
+
+	// How often a partition made read-only by a failed write checks whether the
+	// disk takes writes again; 5 seconds if zero. See ReadOnlyError.
+	RecoveryInterval time.Duration
+}
+
 // Handle reading and writing events to partition log files.
 // Each partition has its own LogStorage instance.
+//
+// Appends are group committed: concurrent appends queue up, and one of them, the
+// leader, writes the whole queue with a single write (and fsync, if enabled) before
+// completing every append in it. Appends that arrive in the meantime form the next
+// batch, led by the first of them.
+//
+// Writes are serialized by mu, which also guards the index. Readers take a
+// snapshot of the index under the read lock and then read the file with ReadAt,
+// so they never wait on a write in progress and never share a file position.
+//
+// Appends go to the active segment, the file at path. Once sealed, a segment is
+// renamed after its first offset and never written again; see segment.
 type LogStorage struct {
-	file   *os.File
-	path   string
+	fs      fileSystem
+	file    file
+	path    string
+	options WriteOptions
+
+	// called with the events of each written batch, in offset order, while mu is
+	// held; used to fill the partition's tail cache
+	onAppend func([]*StoredEvent)
+
+	// keys to open encrypted records with, and whether to seal appended payloads
+	// with the active one.
+	keys    *Keyring
+	encrypt atomic.Bool
+
+	// appends waiting for the next batch, and whether a leader is committing.
+	queueMu    sync.Mutex
+	queue      []*pendingAppend
+	committing bool
+
+	// where sealed segments are offloaded and read back from; nil keeps them local.
+	tier *tier
+
+	// mu guards the fields below, and is held while a batch is written.
+	mu sync.RWMutex
+
+	// size of the active file, where the next record will be written.
 	offset int64
+
+	// offset of the first event in the active file; earlier ones are in segments.
+	base int64
+
+	// byte position of each record in the active file, indexed by offset from
+	// base; every event of a compressed batch maps to the batch. Rebuilt by
+	// scanning the file on open.
+	positions []int64
+
+	// whether any record in the active file is encrypted, and its latest event
+	// timestamp.
+	encrypted    bool
+	maxTimestamp int64
+
+	// time index of the active file; see timeIndexEntry.
+	timeIndex []timeIndexEntry
+
+	// sealed segments, in offset order.
+	segments []*segment
+
+	// set when a write fails, after which appends are refused until recover
+	// clears it.
+	failure *ReadOnlyError
+
+	// closed and replaced on every append to wake long-polling fetches.
+	notifyMu sync.Mutex
+	notify   chan struct{}
 }
 
 // Create a new LogStorage instance for a partition.
 func NewLogStorage(path string) (*LogStorage, error) {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	return openLogStorage(osFS{}, path)
+}
+
+// Open the log at path through fsys. A record cut short at the end of the active
+// file, by a crash or a failed write that couldn't be undone, is truncated away so
+// appends continue from the last whole record.
+func openLogStorage(fsys fileSystem, path string) (*LogStorage, error) {
+	// Sealed segments, and the offset the active file starts at
+	segments, err := loadSegments(fsys, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load segments: %w", err)
+	}
+	var base int64
+	if len(segments) > 0 {
+		base = segments[len(segments)-1].Next
+	}
+
+	// O_APPEND keeps every write at the end of the file
+	file, err := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open log file: %w", err)
 	}
 
+	// New logs get a format header; existing ones must be in the current version
+	if err := prepareLogHeader(file, path); err != nil {
+		file.Close()
+		return nil, err
+	}
+
 	// Get the current file size to determine the starting offset
 	info, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return nil, fmt.Errorf("failed to stat log file: %w", err)
 	}
 
+	// Scan the existing records to recover the offset index
+	scan, err := scanPositions(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to scan log file: %w", err)
+	}
+	if info.Size() > scan.size {
+		log.Printf("Truncating %d bytes of a partial record at the end of %s", info.Size()-scan.size, path)
+		if err := file.Truncate(scan.size); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to truncate log file: %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to sync log file: %w", err)
+		}
+	}
+
 	return &LogStorage{
-		file:   file,
-		path:   path,
-		offset: info.Size(),
+		fs:           fsys,
+		file:         file,
+		path:         path,
+		offset:       scan.size,
+		base:         base,
+		positions:    scan.positions,
+		timeIndex:    scan.timeIndex,
+		encrypted:    scan.encrypted,
+		maxTimestamp: scan.maxTimestamp,
+		segments:     segments,
+		notify:       make(chan struct{}),
 	}, nil
 }
 
-// Write an event to the log file and returns its offset.
+// An append waiting to be written by a batch leader.
+type pendingAppend struct {
+	events  []*StoredEvent
+	records [][]byte // serialized events; offsets are filled in when written
+	codec   Codec
+	offset  int64 // of the first event
+	err     error
+
+	// closed once the append is written, or once it is promoted to lead the next
+	// batch (lead is set first)
+	ready chan struct{}
+	lead  bool
+}
+
+// Write an event to the log file and returns its offset once the batch holding it
+// has been written. The broker assigns offsets sequentially; any offset set on the
+// event is overwritten.
 func (l *LogStorage) Append(event *StoredEvent) (int64, error) {
-	// Serialize the event
-	data, err := serializeEvent(event)
+	return l.AppendBatch([]*StoredEvent{event}, CodecNone)
+}
+
+// Write events to the log file at consecutive offsets and return the first one.
+// With a codec other than CodecNone the events are stored compressed, in one record
+// together with any concurrent appends using the same codec.
+func (l *LogStorage) AppendBatch(events []*StoredEvent, codec Codec) (int64, error) {
+	// Serialize outside any lock; offsets are filled in when the batch is written
+	records := make([][]byte, len(events))
+	for i, event := range events {
+		data, err := serializeEvent(event)
+		if err != nil {
+			return 0, fmt.Errorf("failed to serialize event: %w", err)
+		}
+		records[i] = data
+	}
+	pending := &pendingAppend{events: events, records: records, codec: codec, ready: make(chan struct{})}
+
+	l.queueMu.Lock()
+	l.queue = append(l.queue, pending)
+	if !l.committing {
+		l.committing = true
+		pending.lead = true
+	}
+	lead := pending.lead
+	l.queueMu.Unlock()
+
+	// commit sets lead on a queued append before closing ready, so it may only be
+	// read again once ready is closed
+	if !lead {
+		<-pending.ready
+		lead = pending.lead
+	}
+	if lead {
+		l.commit()
+	}
+
+	return pending.offset, pending.err
+}
+
+// Write the queued appends as one batch, then hand leadership to the first append
+// queued during the write, if any.
+func (l *LogStorage) commit() {
+	if l.options.CommitWindow > 0 {
+		time.Sleep(l.options.CommitWindow)
+	}
+
+	l.queueMu.Lock()
+	batch := l.queue
+	l.queue = nil
+	l.queueMu.Unlock()
+
+	l.writeBatch(batch)
+
+	l.queueMu.Lock()
+	if len(l.queue) > 0 {
+		next := l.queue[0]
+		next.lead = true
+		close(next.ready)
+	} else {
+		l.committing = false
+	}
+	l.queueMu.Unlock()
+}
+
+// A record ready to be written: one event, or a compressed batch of count events.
+type encodedRecord struct {
+	data  []byte
+	count int
+}
+
+// Lay out the appends of a batch as records, compressing each run of appends that
+// share a codec into one record and sealing payloads if encryption is on. Offsets
+// are relative to the batch: compressed records hold their events' offsets
+// relative to the record, and the first offset of each record is filled in when
+// it is written. Also reports whether it sealed them.
+func (l *LogStorage) encodeRecords(batch []*pendingAppend) ([]encodedRecord, bool, error) {
+	var keys *Keyring
+	if l.encrypt.Load() {
+		keys = l.keys
+	}
+
+	var records []encodedRecord
+	for i := 0; i < len(batch); {
+		codec := batch[i].codec
+		j := i + 1
+		for j < len(batch) && batch[j].codec == codec {
+			j++
+		}
+		run := batch[i:j]
+		i = j
+
+		if codec == CodecNone {
+			for _, pending := range run {
+				for _, data := range pending.records {
+					if keys != nil {
+						var err error
+						if data, err = sealRecord(keys, data); err != nil {
+							return nil, false, err
+						}
+					}
+					records = append(records, encodedRecord{data: data, count: 1})
+				}
+			}
+			continue
+		}
+
+		var inner []byte
+		var count int
+		var timestamp int64
+		for _, pending := range run {
+			for k, data := range pending.records {
+				binary.BigEndian.PutUint64(data[0:8], uint64(count))
+				inner = append(inner, data...)
+				timestamp = max(timestamp, pending.events[k].Timestamp)
+				count++
+			}
+		}
+		data, err := serializeBatch(codec, timestamp, count, inner, keys)
+		if err != nil {
+			return nil, false, err
+		}
+		records = append(records, encodedRecord{data: data, count: count})
+	}
+	return records, keys != nil, nil
+}
+
+// Assign offsets to a batch, write it with one syscall and complete its appends.
+// A failed write is truncated away so the log ends at a record boundary, and makes
+// the log read-only.
+func (l *LogStorage) writeBatch(batch []*pendingAppend) {
+	// Compress and encrypt before taking the lock so readers aren't held up
+	records, sealed, err := l.encodeRecords(batch)
 	if err != nil {
-		return 0, fmt.Errorf("failed to serialize event: %w", err)
+		err = fmt.Errorf("failed to encode batch: %w", err)
 	}
 
-	// Write the serialized data to the file
-	n, err := l.file.Write(data)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err == nil && l.failure != nil {
+		err = l.failure
+	}
+
+	var buffer []byte
+	var positions []int64
+	if err == nil {
+		size := 0
+		for _, record := range records {
+			size += len(record.data)
+		}
+		buffer = make([]byte, 0, size)
+		next := l.base + int64(len(l.positions))
+		for _, record := range records {
+			binary.BigEndian.PutUint64(record.data[0:8], uint64(next))
+			for i := 0; i < record.count; i++ {
+				positions = append(positions, l.offset+int64(len(buffer)))
+			}
+			buffer = append(buffer, record.data...)
+			next += int64(record.count)
+		}
+
+		if _, err = l.file.Write(buffer); err != nil {
+			err = fmt.Errorf("failed to write to log file: %w", err)
+		} else if l.options.Sync {
+			if err = l.file.Sync(); err != nil {
+				err = fmt.Errorf("failed to sync log file: %w", err)
+			}
+		}
+		if err != nil {
+			// Even if this fails, nothing is appended after the partial batch
+			// until recover has cut it off
+			l.file.Truncate(l.offset)
+			l.failure = &ReadOnlyError{Err: err, Since: time.Now()}
+			err = l.failure
+		}
+	}
 	if err != nil {
-		return 0, fmt.Errorf("failed to write to log file: %w", err)
+		for _, pending := range batch {
+			pending.err = err
+			if !pending.lead {
+				close(pending.ready)
+			}
+		}
+		return
+	}
+
+	// Index the records by time, with the newest timestamp up to each
+	first := int64(len(l.positions))
+	index, newest := first, l.maxTimestamp
+	l.positions = append(l.positions, positions...)
+	for _, record := range records {
+		newest = max(newest, int64(binary.BigEndian.Uint64(record.data[8:16])))
+		l.timeIndex = addTimeIndexEntry(l.timeIndex, l.positions, index, newest)
+		index += int64(record.count)
+	}
+
+	// Record where each event is stored and advance the write position
+	var events []*StoredEvent
+	next := l.base + first
+	for _, pending := range batch {
+		pending.offset = next
+		for _, event := range pending.events {
+			event.Offset = next
+			l.maxTimestamp = max(l.maxTimestamp, event.Timestamp)
+			next++
+		}
+		events = append(events, pending.events...)
+	}
+	l.offset += int64(len(buffer))
+	l.encrypted = l.encrypted || sealed
+	if l.onAppend != nil {
+		l.onAppend(events)
+	}
+	for _, pending := range batch {
+		if !pending.lead {
+			close(pending.ready)
+		}
+	}
+
+	// The batch is written either way; a failed roll leaves the active file as it is
+	if l.options.SegmentBytes > 0 && l.offset >= l.options.SegmentBytes {
+		if err := l.roll(); err != nil {
+			log.Printf("Failed to seal segment of %s: %v", l.path, err)
+		}
+	}
+
+	// Wake everyone waiting for new data
+	l.notifyMu.Lock()
+	close(l.notify)
+	l.notify = make(chan struct{})
+	l.notifyMu.Unlock()
+}
+
+// Return a channel that is closed the next time an event is appended.
+// Callers should grab the channel before checking for data so no append is missed.
+func (l *LogStorage) Changed() <-chan struct{} {
+	l.notifyMu.Lock()
+	defer l.notifyMu.Unlock()
+	return l.notify
+}
+
+// Return how many bytes of records are stored at or after the given offset.
+// Before the active segment this counts every sealed segment from the one
+// holding the offset.
+func (l *LogStorage) BytesAfter(startOffset int64) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if startOffset < 0 || startOffset >= l.base+int64(len(l.positions)) {
+		return 0
+	}
+	if startOffset >= l.base {
+		return l.offset - l.positions[startOffset-l.base]
+	}
+
+	total := l.offset - logHeaderSize
+	for _, segment := range l.segments {
+		if segment.Next > startOffset {
+			total += segment.Size - logHeaderSize
+		}
 	}
+	return total
+}
 
-	// Update the offset
-	currentOffset := l.offset
-	l.offset += int64(n)
+// Return the offset of the first stored event. Logs are never trimmed from the
+// front, so this is always 0.
+func (l *LogStorage) StartOffset() int64 {
+	return 0
+}
 
-	return currentOffset, nil
+// Return the offset that will be assigned to the next appended event.
+func (l *LogStorage) NextOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.base + int64(len(l.positions))
 }
 
-// Read reads events from the log file starting at the given offset.
+// Read reads events from the log file starting at the given offset. Events in
+// sealed segments are read from their segment, so a read never spans two.
 func (l *LogStorage) Read(startOffset int64, maxBytes int) ([]*StoredEvent, error) {
-	if _, err := l.file.Seek(startOffset, 0); err != nil {
-		return nil, fmt.Errorf("failed to seek log file: %w", err)
+	if startOffset < 0 {
+		return nil, fmt.Errorf("invalid offset %d", startOffset)
 	}
 
-	buffer := make([]byte, maxBytes)
-	n, err := l.file.Read(buffer)
-	if n == 0 {
-		// Return empty slice for empty reads (EOF)
+	// Everything up to end is complete on disk; later appends don't affect it
+	l.mu.RLock()
+	if startOffset >= l.base+int64(len(l.positions)) {
+		l.mu.RUnlock()
+		// Nothing written at or after this offset yet
 		return make([]*StoredEvent, 0), nil
 	}
-	if err != nil && err.Error() != "EOF" {
-		return nil, fmt.Errorf("failed to read from log file: %w", err)
+
+	var buffer []byte
+	var first int64
+	if startOffset < l.base {
+		segment := l.segmentFor(startOffset)
+		l.mu.RUnlock()
+
+		var err error
+		if buffer, first, _, err = l.readSegment(segment, startOffset, maxBytes); err != nil {
+			return nil, err
+		}
+	} else {
+		// The file the positions are of: a roll may replace the active file once the
+		// lock is released, and the sealed segment keeps this one
+		index, start, end, _ := span(l.positions, l.offset, startOffset-l.base, maxBytes)
+		first = l.base + index
+		file := l.file
+		l.mu.RUnlock()
+
+		buffer = make([]byte, end-start)
+		n, err := file.ReadAt(buffer, start)
+		if errors.Is(err, os.ErrClosed) && l.rolledPast(startOffset) {
+			// Sealed and offloaded meanwhile: read it from its segment
+			return l.Read(startOffset, maxBytes)
+		}
+		if err != nil {
+			// The positions show whole records here, so even a short read at EOF
+			// means the file lost them
+			return nil, fmt.Errorf("failed to read from log file (%d of %d bytes at %d): %w", n, len(buffer), start, err)
+		}
 	}
 
-	events, err := deserializeEvents(buffer[:n])
+	events, err := deserializeEvents(buffer, l.keys)
 	if err != nil {
 		return nil, fmt.Errorf("failed to deserialize events: %w", err)
 	}
 
+	// Offsets are positional; older logs were written without them
+	for i, event := range events {
+		event.Offset = first + int64(i)
+	}
+	// A compressed batch may hold events before startOffset
+	if skip := int(startOffset - first); skip < len(events) {
+		events = events[skip:]
+	} else {
+		events = make([]*StoredEvent, 0)
+	}
+
 	return events, nil
 }
 
-// Close closes the log file.
+// Whether offset is in a sealed segment by now.
+func (l *LogStorage) rolledPast(offset int64) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return offset < l.base
+}
+
+// Return a reader over the stored bytes of the whole records from startOffset that
+// fit in maxBytes, the offset of the first event in them and how many events they
+// hold. The first record may be a compressed batch holding events before
+// startOffset. For the active segment nothing is read or copied until the reader
+// is used, so callers can stream records without decoding them; records of sealed
+// segments are read into memory first, since the segment may be offloaded meanwhile.
+func (l *LogStorage) Section(startOffset int64, maxBytes int) (*io.SectionReader, int64, int, error) {
+	if startOffset < 0 {
+		return nil, 0, 0, fmt.Errorf("invalid offset %d", startOffset)
+	}
+
+	l.mu.RLock()
+	if startOffset >= l.base+int64(len(l.positions)) {
+		defer l.mu.RUnlock()
+		return io.NewSectionReader(l.file, 0, 0), startOffset, 0, nil
+	}
+	if startOffset < l.base {
+		segment := l.segmentFor(startOffset)
+		l.mu.RUnlock()
+
+		buffer, first, count, err := l.readSegment(segment, startOffset, maxBytes)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		return io.NewSectionReader(bytes.NewReader(buffer), 0, int64(len(buffer))), first, count, nil
+	}
+	defer l.mu.RUnlock()
+
+	index, start, end, count := span(l.positions, l.offset, startOffset-l.base, maxBytes)
+	return io.NewSectionReader(l.file, start, end-start), l.base + index, count, nil
+}
+
+// Locate the whole records, starting with the one that holds the event at index,
+// that fit in maxBytes, in a segment of size bytes with the given positions; the
+// first record is included even if it alone is larger, so a big compressed batch
+// can't stall a reader. Returns the index of the first event in those records,
+// their byte range, and how many events they hold. index must be in positions.
+func span(positions []int64, size int64, index int64, maxBytes int) (first, start, end int64, count int) {
+	start = positions[index]
+
+	// Every event in a compressed batch is indexed at the batch's position
+	first = int64(sort.Search(int(index), func(i int) bool { return positions[i] >= start }))
+	// number of events from first stored in records starting before position
+	before := func(position int64) int {
+		return sort.Search(len(positions)-int(first), func(i int) bool { return positions[int(first)+i] >= position })
+	}
+
+	end = size
+	if n := before(start + 1); int(first)+n < len(positions) {
+		end = positions[int(first)+n]
+	}
+	limit := max(start+int64(maxBytes), end)
+	if size <= limit {
+		return first, start, size, len(positions) - int(first)
+	}
+
+	// The last record starting within limit ends past it; stop where it starts
+	end = positions[int(first)+before(limit+1)-1]
+	return first, start, end, before(end)
+}
+
+// Whether any record is stored encrypted, in which case the stored bytes must not
+// leave the broker.
+func (l *LogStorage) Encrypted() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	encrypted := l.encrypted
+	for _, segment := range l.segments {
+		encrypted = encrypted || segment.Encrypted
+	}
+	return encrypted
+}
+
+// Drop the events at and after offset from the end of the log. Only the active
+// file can be truncated, and only at a record boundary: not inside a compressed
+// batch.
+func (l *LogStorage) Truncate(offset int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := l.base + int64(len(l.positions))
+	switch {
+	case offset < 0 || offset > next:
+		return fmt.Errorf("invalid offset %d", offset)
+	case offset == next:
+		return nil
+	case offset < l.base:
+		return fmt.Errorf("offset %d is in a sealed segment", offset)
+	}
+
+	index := offset - l.base
+	position := l.positions[index]
+	if index > 0 && l.positions[index-1] == position {
+		return fmt.Errorf("offset %d is inside a compressed batch", offset)
+	}
+	if err := l.file.Truncate(position); err != nil {
+		return fmt.Errorf("failed to truncate log file: %w", err)
+	}
+	if l.options.Sync {
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync log file: %w", err)
+		}
+	}
+	l.positions = l.positions[:index]
+	l.timeIndex = truncateTimeIndex(l.timeIndex, index)
+	l.offset = position
+	return nil
+}
+
+// Flush written records to stable storage.
+func (l *LogStorage) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.file.Sync()
+}
+
+// Close closes the log file and any open segments, after any append in progress.
 func (l *LogStorage) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, segment := range l.segments {
+		segment.close()
+	}
 	return l.file.Close()
 }
 
+// The offset index of a log file, as rebuilt by scanPositions.
+type logScan struct {
+	// byte position of each event; the events of a compressed batch all map to
+	// the batch's record.
+	positions []int64
+
+	// whether any record is encrypted, and the latest record timestamp.
+	encrypted    bool
+	maxTimestamp int64
+
+	// the newest timestamp up to records spread through the file.
+	timeIndex []timeIndexEntry
+
+	// where the last whole record ends.
+	size int64
+}
+
+// Walk the records in a log file, after its header, and index them. A partially
+// written record at the tail is not indexed.
+func scanPositions(file file) (logScan, error) {
+	if _, err := file.Seek(logHeaderSize, io.SeekStart); err != nil {
+		return logScan{}, err
+	}
+	reader := bufio.NewReader(file)
+
+	scan := logScan{positions: make([]int64, 0)}
+	position := int64(logHeaderSize)
+	header := make([]byte, 20)
+	length := make([]byte, 4)
+	for {
+		// [offset(8)][timestamp(8)][attributes(1)][keyLength(3)]
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		codec, sealed, keyLength := recordAttributes(header[16:20])
+		timestamp := int64(binary.BigEndian.Uint64(header[8:16]))
+		if _, err := reader.Discard(keyLength); err != nil {
+			break
+		}
+
+		// [payloadLength(4)][payload]
+		if _, err := io.ReadFull(reader, length); err != nil {
+			break
+		}
+		payloadLength := int(binary.BigEndian.Uint32(length))
+		remaining, count := payloadLength, 1
+		if codec != CodecNone {
+			// A compressed batch's payload starts with its event count
+			if payloadLength < 4 {
+				break
+			}
+			if _, err := io.ReadFull(reader, length); err != nil {
+				break
+			}
+			remaining, count = payloadLength-4, int(binary.BigEndian.Uint32(length))
+		}
+		if _, err := reader.Discard(remaining); err != nil {
+			break
+		}
+
+		index := int64(len(scan.positions))
+		for i := 0; i < count; i++ {
+			scan.positions = append(scan.positions, position)
+		}
+		scan.encrypted = scan.encrypted || sealed
+		scan.maxTimestamp = max(scan.maxTimestamp, timestamp)
+		scan.timeIndex = addTimeIndexEntry(scan.timeIndex, scan.positions, index, scan.maxTimestamp)
+		position += int64(24 + keyLength + payloadLength)
+	}
+	scan.size = position
+	// Leave the file positioned at the end for appends
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return logScan{}, err
+	}
+
+	return scan, nil
+}
+
+// The top byte of a record's key length field holds its attributes: the codec its
+// payload is compressed with and whether it is encrypted. Logs written before
+// either have none, and keys are limited to the low 24 bits.
+const maxKeyLength = 1<<24 - 1
+
+// Split a record's key length field into its codec, encryption flag and key length.
+func recordAttributes(field []byte) (Codec, bool, int) {
+	value := binary.BigEndian.Uint32(field)
+	attributes := byte(value >> 24)
+	return Codec(attributes & attributeCodecMask), attributes&attributeEncrypted != 0, int(value & maxKeyLength)
+}
+
 // Convert a StoredEvent to binary format.
-// Format: [offset(8)][timestamp(8)][keyLength(4)][key][payloadLength(4)][payload]
+// Format: [offset(8)][timestamp(8)][attributes(1)][keyLength(3)][key][payloadLength(4)][payload]
+// An encrypted payload is [keyID(4)][nonce(12)][ciphertext and tag]; see Keyring.
 func serializeEvent(event *StoredEvent) ([]byte, error) {
 	keyBytes := []byte(event.Key)
 	keyLength := len(keyBytes)
+	if keyLength > maxKeyLength {
+		return nil, fmt.Errorf("key of %d bytes exceeds the %d byte limit", keyLength, maxKeyLength)
+	}
 	payloadLength := len(event.Payload)
 	totalSize := 8 + 8 + 4 + keyLength + 4 + payloadLength
 	buffer := make([]byte, totalSize)
@@ -103,13 +828,38 @@ func serializeEvent(event *StoredEvent) ([]byte, error) {
 	return buffer, nil
 }
 
-// Convert binary data to a slice of StoredEvent.
-func deserializeEvents(data []byte) ([]*StoredEvent, error) {
+// Compress serialized events into one record, sealing them if keys is non-nil.
+// The offset is filled in when it is written.
+// Format: [offset(8)][maxTimestamp(8)][attributes(1)][0(3)][payloadLength(4)][count(4)][compressed events]
+// The events inside hold their offsets relative to the record's.
+func serializeBatch(codec Codec, timestamp int64, count int, records []byte, keys *Keyring) ([]byte, error) {
+	compressed, err := compress(codec, records)
+	if err != nil {
+		return nil, err
+	}
+	attributes := byte(codec)
+	if keys != nil {
+		if compressed, err = keys.seal(compressed); err != nil {
+			return nil, err
+		}
+		attributes |= attributeEncrypted
+	}
+	buffer := make([]byte, 28, 28+len(compressed))
+	binary.BigEndian.PutUint64(buffer[8:16], uint64(timestamp))
+	binary.BigEndian.PutUint32(buffer[16:20], uint32(attributes)<<24)
+	binary.BigEndian.PutUint32(buffer[20:24], uint32(4+len(compressed)))
+	binary.BigEndian.PutUint32(buffer[24:28], uint32(count))
+	return append(buffer, compressed...), nil
+}
+
+// Convert binary data to a slice of StoredEvent, expanding compressed batches and
+// opening encrypted payloads with keys.
+func deserializeEvents(data []byte, keys *Keyring) ([]*StoredEvent, error) {
 	var events []*StoredEvent
 	for len(data) >= 24 { // minimum: 8+8+4+0+4
 		offset := int64(binary.BigEndian.Uint64(data[0:8]))
 		timestamp := int64(binary.BigEndian.Uint64(data[8:16]))
-		keyLength := int(binary.BigEndian.Uint32(data[16:20]))
+		codec, encrypted, keyLength := recordAttributes(data[16:20])
 
 		// Check if we have enough data for the key
 		if len(data) < 24+keyLength {
@@ -125,6 +875,22 @@ func deserializeEvents(data []byte) ([]*StoredEvent, error) {
 		}
 
 		payload := data[24+keyLength : 24+keyLength+payloadLength]
+		data = data[24+keyLength+payloadLength:]
+
+		if codec != CodecNone {
+			batch, err := deserializeBatch(codec, encrypted, offset, payload, keys)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, batch...)
+			continue
+		}
+		if encrypted {
+			var err error
+			if payload, err = keys.open(payload); err != nil {
+				return nil, fmt.Errorf("offset %d: %w", offset, err)
+			}
+		}
 
 		events = append(events, &StoredEvent{
 			Offset:    offset,
@@ -132,9 +898,38 @@ func deserializeEvents(data []byte) ([]*StoredEvent, error) {
 			Key:       key,
 			Payload:   payload,
 		})
+	}
 
-		data = data[24+keyLength+payloadLength:]
+	return events, nil
+}
+
+// Decrypt and decompress the events of a batch record stored at offset.
+func deserializeBatch(codec Codec, encrypted bool, offset int64, payload []byte, keys *Keyring) ([]*StoredEvent, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("batch at offset %d is truncated", offset)
+	}
+	count := int(binary.BigEndian.Uint32(payload[0:4]))
+	compressed := payload[4:]
+	if encrypted {
+		var err error
+		if compressed, err = keys.open(compressed); err != nil {
+			return nil, fmt.Errorf("batch at offset %d: %w", offset, err)
+		}
+	}
+	records, err := decompress(codec, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s batch at offset %d: %w", codec, offset, err)
 	}
 
+	events, err := deserializeEvents(records, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) != count {
+		return nil, fmt.Errorf("batch at offset %d holds %d events, expected %d", offset, len(events), count)
+	}
+	for _, event := range events {
+		event.Offset += offset
+	}
 	return events, nil
 }
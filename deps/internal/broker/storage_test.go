@@ -0,0 +1,331 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/deps/pkg/client"
+)
+
+// Run with -race: appends and reads share one LogStorage.
+func TestLogStorageConcurrentAppendRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partition-0.log")
+	storage, err := NewLogStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer storage.Close()
+
+	const producers, perProducer = 8, 200
+	type record struct{ P, N int }
+
+	var producing sync.WaitGroup
+	offsets := make(chan int64, producers*perProducer)
+	for p := 0; p < producers; p++ {
+		producing.Add(1)
+		go func(p int) {
+			defer producing.Done()
+			for n := 0; n < perProducer; n++ {
+				payload, _ := json.Marshal(record{p, n})
+				offset, err := storage.Append(&StoredEvent{Key: fmt.Sprint(p), Payload: payload})
+				if err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+				offsets <- offset
+			}
+		}(p)
+	}
+
+	// Readers tail the log while it grows; every read must be a run of whole records
+	done := make(chan struct{})
+	var reading sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		reading.Add(1)
+		go func() {
+			defer reading.Done()
+			var next int64
+			for {
+				changed := storage.Changed()
+				if storage.BytesAfter(next) == 0 {
+					select {
+					case <-changed:
+					case <-done:
+						return
+					}
+				}
+				events, err := storage.Read(next, 4096)
+				if err != nil {
+					t.Errorf("Read failed: %v", err)
+					return
+				}
+				for i, event := range events {
+					var rec record
+					if event.Offset != next+int64(i) || json.Unmarshal(event.Payload, &rec) != nil || event.Key != fmt.Sprint(rec.P) {
+						t.Errorf("Torn read at offset %d: %+v", next+int64(i), event)
+						return
+					}
+				}
+				next += int64(len(events))
+			}
+		}()
+	}
+
+	producing.Wait()
+	close(done)
+	reading.Wait()
+	close(offsets)
+
+	// Every append got its own offset, with none skipped
+	seen := make(map[int64]bool)
+	for offset := range offsets {
+		if seen[offset] {
+			t.Fatalf("Offset %d assigned twice", offset)
+		}
+		seen[offset] = true
+	}
+	if total := int64(producers * perProducer); storage.NextOffset() != total || int64(len(seen)) != total {
+		t.Fatalf("Expected %d records, got next offset %d", total, storage.NextOffset())
+	}
+
+	// Each producer's records are stored in the order it appended them
+	events, err := storage.Read(0, 1<<20)
+	if err != nil || len(events) != producers*perProducer {
+		t.Fatalf("Expected all records, got %d (%v)", len(events), err)
+	}
+	last := make(map[int]int)
+	for _, event := range events {
+		var rec record
+		json.Unmarshal(event.Payload, &rec)
+		if n, ok := last[rec.P]; ok && rec.N != n+1 {
+			t.Fatalf("Producer %d: record %d follows %d", rec.P, rec.N, n)
+		}
+		last[rec.P] = rec.N
+	}
+
+	// The index rebuilt from disk matches
+	storage.Close()
+	reopened, err := NewLogStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen log: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.NextOffset() != int64(producers*perProducer) {
+		t.Errorf("Expected %d records after reopening, got %d", producers*perProducer, reopened.NextOffset())
+	}
+}
+
+func TestLogStorageReadDuringRoll(t *testing.T) {
+	storage, err := NewLogStorage(filepath.Join(t.TempDir(), "partition-0.log"))
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer storage.Close()
+	storage.options.SegmentBytes = 1024
+
+	// Readers tail the active file while appends keep sealing it
+	const total = 600
+	done := make(chan struct{})
+	var reading sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		reading.Add(1)
+		go func() {
+			defer reading.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				next := max(storage.NextOffset()-1, 0)
+				events, err := storage.Read(next, 4096)
+				if err != nil {
+					t.Errorf("Read at offset %d failed: %v", next, err)
+					return
+				}
+				if len(events) > 0 && (events[0].Offset != next || events[0].Key != fmt.Sprintf("k%d", next)) {
+					t.Errorf("Expected k%d at offset %d, got %s at %d", next, next, events[0].Key, events[0].Offset)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < total; i++ {
+		if _, err := storage.Append(&StoredEvent{Key: fmt.Sprintf("k%d", i), Payload: []byte(`{"n":1}`)}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	close(done)
+	reading.Wait()
+	if len(storage.segments) < 10 {
+		t.Errorf("Expected the appends to roll many segments, got %d", len(storage.segments))
+	}
+	readAll(t, storage, total)
+}
+
+func TestLogStorageReadLostRecords(t *testing.T) {
+	storage, err := NewLogStorage(filepath.Join(t.TempDir(), "partition-0.log"))
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer storage.Close()
+	for i := 0; i < 5; i++ {
+		if _, err := storage.Append(&StoredEvent{Key: fmt.Sprintf("k%d", i), Payload: []byte(`{"n":1}`)}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	// The records are cut from the file behind the log's back, as by a failing disk
+	if err := os.Truncate(storage.file.Name(), storage.positions[2]); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	for _, offset := range []int64{0, 3} {
+		if events, err := storage.Read(offset, 1<<20); err == nil {
+			t.Errorf("Expected a read error at offset %d, got %d events", offset, len(events))
+		}
+	}
+}
+
+func TestLogStorageGroupCommit(t *testing.T) {
+	storage, err := NewLogStorage(filepath.Join(t.TempDir(), "partition-0.log"))
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer storage.Close()
+	storage.options = WriteOptions{CommitWindow: 20 * time.Millisecond, Sync: true}
+
+	// Appended one at a time these would take a second; coalesced, a few windows
+	const appends = 50
+	start := time.Now()
+	var wg sync.WaitGroup
+	offsets := make([]int64, appends)
+	for i := 0; i < appends; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			event := &StoredEvent{Key: "k", Payload: []byte(fmt.Sprintf(`{"i":%d}`, i))}
+			offset, err := storage.Append(event)
+			if err != nil || event.Offset != offset {
+				t.Errorf("Append failed: %v", err)
+			}
+			offsets[i] = offset
+		}(i)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Appends took %s; expected them to share commits", elapsed)
+	}
+
+	// Each append's offset holds its own record
+	events, err := storage.Read(0, 1<<20)
+	if err != nil || len(events) != appends {
+		t.Fatalf("Expected %d records, got %d (%v)", appends, len(events), err)
+	}
+	for i, offset := range offsets {
+		if want := fmt.Sprintf(`{"i":%d}`, i); string(events[offset].Payload) != want {
+			t.Errorf("Offset %d holds %s, expected %s", offset, events[offset].Payload, want)
+		}
+	}
+}
+
+func BenchmarkLogStorageAppend(b *testing.B) {
+	for _, options := range []WriteOptions{{}, {Sync: true}} {
+		b.Run(fmt.Sprintf("sync=%t", options.Sync), func(b *testing.B) {
+			storage, err := NewLogStorage(filepath.Join(b.TempDir(), "partition-0.log"))
+			if err != nil {
+				b.Fatalf("Failed to open log: %v", err)
+			}
+			defer storage.Close()
+			storage.options = options
+
+			payload := []byte(`{"amount":100,"currency":"EUR","customer":"c-1234"}`)
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := storage.Append(&StoredEvent{Key: "k", Payload: payload}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Run with -race: concurrent publishes and fetches through the HTTP handlers.
+func TestConcurrentPublishAndFetch(t *testing.T) {
+	cl, s := setupTestClient(t, nil)
+	ctx := context.Background()
+
+	const producers, perProducer = 6, 30
+	var producing sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		producing.Add(1)
+		go func(p int) {
+			defer producing.Done()
+			for n := 0; n < perProducer; n++ {
+				if _, err := cl.Publish(ctx, "test-topic", fmt.Sprintf("key-%d", p), map[string]int{"n": n}); err != nil {
+					t.Errorf("Publish failed: %v", err)
+					return
+				}
+			}
+		}(p)
+	}
+	published := make(chan struct{})
+	go func() {
+		producing.Wait()
+		close(published)
+	}()
+
+	// Consumers long-poll every partition from the start until publishing is over
+	// and they have caught up
+	fetched := make([]int64, 3)
+	var consuming sync.WaitGroup
+	for partition := range fetched {
+		consuming.Add(1)
+		go func(partition int) {
+			defer consuming.Done()
+			storage := s.broker.GetTopic("test-topic").Partitions[partition].logStorage
+			var offset int64
+			for {
+				select {
+				case <-published:
+					if offset == storage.NextOffset() {
+						fetched[partition] = offset
+						return
+					}
+				default:
+				}
+
+				result, err := cl.Fetch(ctx, "test-topic", partition, offset, client.FetchOptions{MinBytes: 1, MaxWait: 50 * time.Millisecond})
+				if err != nil {
+					t.Errorf("Fetch failed: %v", err)
+					return
+				}
+				for i, m := range result.Messages {
+					if m.Offset != offset+int64(i) {
+						t.Errorf("Partition %d: expected offset %d, got %d", partition, offset+int64(i), m.Offset)
+						return
+					}
+				}
+				offset += int64(len(result.Messages))
+			}
+		}(partition)
+	}
+	consuming.Wait()
+
+	var total int64
+	for _, count := range fetched {
+		total += count
+	}
+	if total != producers*perProducer {
+		t.Errorf("Expected %d records fetched, got %d", producers*perProducer, total)
+	}
+}
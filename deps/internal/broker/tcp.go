@@ -0,0 +1,374 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"example.com/deps/internal/protocol"
+)
+
+// Serve the binary protocol (see internal/protocol) over persistent TCP connections.
+// Runs alongside HTTPServer on its own port and shares the same broker.
+type TCPServer struct {
+	broker   *Broker
+	port     int
+	listener net.Listener
+	conns    connSet
+}
+
+// New TCP server for the broker.
+func NewTCPServer(broker *Broker, port int) *TCPServer {
+	return &TCPServer{
+		broker: broker,
+		port:   port,
+	}
+}
+
+// Bind the listening socket. Separate from Serve so startup errors surface before the broker blocks.
+func (s *TCPServer) Listen() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", s.port, err)
+	}
+	s.listener = listener
+	fmt.Printf("Broker TCP server listening on %s\n", listener.Addr())
+	return nil
+}
+
+// Accept connections until the listener is closed.
+func (s *TCPServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !s.conns.add(conn) {
+			conn.Close()
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Return the address the server is listening on.
+func (s *TCPServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop accepting connections.
+func (s *TCPServer) Close() error {
+	return s.listener.Close()
+}
+
+// Stop accepting connections and wait for open ones to finish the request in
+// progress. Connections still open when ctx expires are closed.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	return errors.Join(s.listener.Close(), s.conns.shutdown(ctx))
+}
+
+// Answer requests on one connection in the order they arrive. Long-polling fetches
+// are answered from their own goroutine when they complete, so they don't hold up the
+// requests behind them. Responses are flushed once no further pipelined requests are waiting.
+func (s *TCPServer) handleConn(conn net.Conn) {
+	defer s.conns.done(conn)
+	defer conn.Close()
+
+	// Cancelled when the connection ends so long-polling fetches are released;
+	// they still answer before the connection closes
+	ctx, cancel := context.WithCancel(context.Background())
+	var fetches sync.WaitGroup
+	defer func() {
+		cancel()
+		fetches.Wait()
+	}()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	var writeMu sync.Mutex
+
+	respond := func(correlationID uint32, resp protocol.Message, respErr *protocol.Error, flush bool) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		if err := protocol.WriteFrame(writer, protocol.EncodeResponse(correlationID, resp, respErr)); err != nil {
+			return err
+		}
+		if flush {
+			return writer.Flush()
+		}
+		return nil
+	}
+
+	for {
+		payload, err := protocol.ReadFrame(reader)
+		if err != nil {
+			return
+		}
+
+		apiKey, correlationID, body, err := protocol.DecodeRequest(payload)
+		if err != nil {
+			return
+		}
+
+		if apiKey == protocol.APIFetch {
+			var req protocol.FetchRequest
+			if err := req.Decode(body); err != nil {
+				if respond(correlationID, nil, invalidRequest(err), reader.Buffered() == 0) != nil {
+					return
+				}
+				continue
+			}
+			if req.MaxWaitMs > 0 {
+				fetches.Add(1)
+				go func() {
+					defer fetches.Done()
+					resp, respErr := s.fetch(ctx, &req)
+					if respond(correlationID, resp, respErr, true) != nil {
+						cancel()
+					}
+				}()
+				continue
+			}
+			resp, respErr := s.fetch(ctx, &req)
+			if respond(correlationID, resp, respErr, reader.Buffered() == 0) != nil {
+				return
+			}
+			continue
+		}
+
+		resp, respErr := s.dispatch(apiKey, body)
+		if respond(correlationID, resp, respErr, reader.Buffered() == 0) != nil {
+			return
+		}
+	}
+}
+
+// Decode a request body, run it against the broker and return the response or error.
+// Fetches are handled by handleConn.
+func (s *TCPServer) dispatch(apiKey protocol.APIKey, body *protocol.Reader) (protocol.Message, *protocol.Error) {
+	switch apiKey {
+	case protocol.APIProduce:
+		var req protocol.ProduceRequest
+		if err := req.Decode(body); err != nil {
+			return nil, invalidRequest(err)
+		}
+		return s.produce(&req)
+
+	case protocol.APIMetadata:
+		return s.metadata(), nil
+
+	case protocol.APIPartitionOffsets:
+		var req protocol.PartitionOffsetsRequest
+		if err := req.Decode(body); err != nil {
+			return nil, invalidRequest(err)
+		}
+		partition, err := s.broker.GetPartition(req.Topic, int(req.Partition))
+		if err != nil {
+			return nil, &protocol.Error{Code: protocol.ErrPartitionNotFound, Message: err.Error()}
+		}
+		return &protocol.PartitionOffsetsResponse{StartOffset: 0, EndOffset: partition.logStorage.NextOffset()}, nil
+
+	case protocol.APIOffsetCommit:
+		var req protocol.OffsetCommitRequest
+		if err := req.Decode(body); err != nil {
+			return nil, invalidRequest(err)
+		}
+		if err := s.broker.partitionManager.CommitOffset(req.Group, req.Topic, int(req.Partition), req.Offset); err != nil {
+			return nil, &protocol.Error{Code: protocol.ErrStorage, Message: err.Error()}
+		}
+		return &protocol.Empty{}, nil
+
+	case protocol.APIOffsetFetch:
+		var req protocol.OffsetFetchRequest
+		if err := req.Decode(body); err != nil {
+			return nil, invalidRequest(err)
+		}
+		offset, err := s.broker.offsetManager.GetOffset(req.Group, req.Topic, int(req.Partition))
+		if err != nil {
+			return nil, &protocol.Error{Code: protocol.ErrOffsetNotFound, Message: err.Error()}
+		}
+		return &protocol.OffsetFetchResponse{Offset: offset}, nil
+
+	case protocol.APIJoinGroup:
+		var req protocol.JoinGroupRequest
+		if err := req.Decode(body); err != nil {
+			return nil, invalidRequest(err)
+		}
+		assignment, err := s.broker.coordinator.Join(req.Group, req.ConsumerID, req.Topics)
+		if err != nil {
+			return nil, &protocol.Error{Code: protocol.ErrInvalidRequest, Message: err.Error()}
+		}
+		return encodeAssignment(assignment), nil
+
+	case protocol.APIHeartbeat:
+		var req protocol.GroupMemberRequest
+		if err := req.Decode(body); err != nil {
+			return nil, invalidRequest(err)
+		}
+		assignment, err := s.broker.coordinator.Heartbeat(req.Group, req.ConsumerID)
+		if err != nil {
+			return nil, &protocol.Error{Code: protocol.ErrUnknownMember, Message: err.Error()}
+		}
+		return encodeAssignment(assignment), nil
+
+	case protocol.APILeaveGroup:
+		var req protocol.GroupMemberRequest
+		if err := req.Decode(body); err != nil {
+			return nil, invalidRequest(err)
+		}
+		if err := s.broker.coordinator.Leave(req.Group, req.ConsumerID); err != nil {
+			return nil, &protocol.Error{Code: protocol.ErrUnknownMember, Message: err.Error()}
+		}
+		return &protocol.Empty{}, nil
+	}
+
+	return nil, &protocol.Error{Code: protocol.ErrUnsupportedAPI, Message: fmt.Sprintf("unsupported api %s", apiKey)}
+}
+
+// Append every record in the request, routing by key unless a partition is given.
+// The records for each partition are appended together. When only some partitions
+// fail, their records are reported with an error and the rest with their offsets.
+func (s *TCPServer) produce(req *protocol.ProduceRequest) (protocol.Message, *protocol.Error) {
+	// Group the records by partition, keeping their order within each
+	type partitionBatch struct {
+		partition *Partition
+		events    []*StoredEvent
+		indexes   []int
+	}
+	var batches []*partitionBatch
+	byPartition := make(map[*Partition]*partitionBatch)
+	for i, record := range req.Records {
+		var partition *Partition
+		var err error
+		if req.Partition >= 0 {
+			partition, err = s.broker.GetPartition(req.Topic, int(req.Partition))
+			if err != nil {
+				return nil, &protocol.Error{Code: protocol.ErrPartitionNotFound, Message: err.Error()}
+			}
+		} else {
+			partition, err = s.broker.partitionManager.RouteEvent(req.Topic, record.Key)
+			if err != nil {
+				return nil, &protocol.Error{Code: protocol.ErrTopicNotFound, Message: err.Error()}
+			}
+		}
+
+		batch, ok := byPartition[partition]
+		if !ok {
+			batch = &partitionBatch{partition: partition}
+			byPartition[partition] = batch
+			batches = append(batches, batch)
+		}
+		batch.events = append(batch.events, &StoredEvent{Key: record.Key, Payload: record.Payload})
+		batch.indexes = append(batch.indexes, i)
+	}
+
+	resp := &protocol.ProduceResponse{Results: make([]protocol.ProduceResult, len(req.Records))}
+	var stored int
+	var failure error
+	for _, batch := range batches {
+		offset, err := s.broker.partitionManager.AppendEvents(batch.partition, batch.events, CodecNone)
+		if err != nil {
+			failure = err
+			for _, index := range batch.indexes {
+				resp.Results[index] = protocol.ProduceResult{
+					Partition:    int32(batch.partition.ID),
+					Offset:       -1,
+					ErrorCode:    protocol.ErrStorage,
+					ErrorMessage: err.Error(),
+				}
+			}
+			continue
+		}
+		stored++
+		for i, index := range batch.indexes {
+			resp.Results[index] = protocol.ProduceResult{Partition: int32(batch.partition.ID), Offset: offset + int64(i)}
+		}
+	}
+	if stored == 0 && failure != nil {
+		// Nothing was stored, so the whole request can be sent again
+		return nil, &protocol.Error{Code: protocol.ErrStorage, Message: failure.Error()}
+	}
+
+	return resp, nil
+}
+
+func (s *TCPServer) fetch(ctx context.Context, req *protocol.FetchRequest) (protocol.Message, *protocol.Error) {
+	partition, err := s.broker.GetPartition(req.Topic, int(req.Partition))
+	if err != nil {
+		return nil, &protocol.Error{Code: protocol.ErrPartitionNotFound, Message: err.Error()}
+	}
+
+	maxBytes := int(req.MaxBytes)
+	if maxBytes <= 0 {
+		maxBytes = 1048576 // Default 1MB, as over HTTP
+	}
+
+	maxWait := time.Duration(req.MaxWaitMs) * time.Millisecond
+	if maxWait > maxFetchWait {
+		maxWait = maxFetchWait
+	}
+	if maxWait > 0 {
+		s.broker.partitionManager.WaitForEvents(ctx, partition, req.Offset, int(req.MinBytes), maxWait)
+	}
+
+	events, err := s.broker.partitionManager.FetchEvents(partition, req.Offset, maxBytes)
+	if err != nil {
+		return nil, &protocol.Error{Code: protocol.ErrStorage, Message: err.Error()}
+	}
+
+	resp := &protocol.FetchResponse{
+		HighWatermark: partition.logStorage.NextOffset(),
+		Records:       make([]protocol.Record, 0, len(events)),
+	}
+	for _, event := range events {
+		resp.Records = append(resp.Records, protocol.Record{
+			Offset:    event.Offset,
+			Timestamp: event.Timestamp,
+			Key:       event.Key,
+			Payload:   event.Payload,
+		})
+	}
+	return resp, nil
+}
+
+func (s *TCPServer) metadata() protocol.Message {
+	s.broker.mu.RLock()
+	defer s.broker.mu.RUnlock()
+
+	resp := &protocol.MetadataResponse{Topics: make([]protocol.TopicMetadata, 0, len(s.broker.topics))}
+	for _, topic := range s.broker.topics {
+		resp.Topics = append(resp.Topics, protocol.TopicMetadata{
+			Name:       topic.Name,
+			Partitions: int32(topic.NumPartitions),
+		})
+	}
+	sort.Slice(resp.Topics, func(i, j int) bool { return resp.Topics[i].Name < resp.Topics[j].Name })
+	return resp
+}
+
+// Convert the coordinator's assignment into its wire form, with topics sorted by name.
+func encodeAssignment(assignment *GroupAssignment) *protocol.GroupAssignment {
+	resp := &protocol.GroupAssignment{Generation: int32(assignment.Generation)}
+	for topic, partitionIDs := range assignment.Partitions {
+		topicAssignment := protocol.TopicAssignment{Topic: topic}
+		for _, partitionID := range partitionIDs {
+			topicAssignment.Partitions = append(topicAssignment.Partitions, int32(partitionID))
+		}
+		resp.Topics = append(resp.Topics, topicAssignment)
+	}
+	sort.Slice(resp.Topics, func(i, j int) bool { return resp.Topics[i].Topic < resp.Topics[j].Topic })
+	return resp
+}
+
+func invalidRequest(err error) *protocol.Error {
+	return &protocol.Error{Code: protocol.ErrInvalidRequest, Message: err.Error()}
+}
@@ -0,0 +1,226 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/deps/internal/protocol"
+)
+
+func TestTCPProduceFetchPipelined(t *testing.T) {
+	client, _ := setupTestTCPClient(t)
+
+	// Issue many produce requests concurrently over the one connection
+	const producers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, producers)
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &protocol.ProduceRequest{
+				Topic:     "test-topic",
+				Partition: 1,
+				Records:   []protocol.ProduceRecord{{Key: "k", Payload: []byte(`{"n":1}`)}},
+			}
+			var resp protocol.ProduceResponse
+			if err := client.Do(protocol.APIProduce, req, &resp); err != nil {
+				errs <- err
+				return
+			}
+			if len(resp.Results) != 1 || resp.Results[0].Partition != 1 {
+				errs <- errors.New("unexpected produce result")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Produce failed: %v", err)
+	}
+
+	var fetched protocol.FetchResponse
+	req := &protocol.FetchRequest{Topic: "test-topic", Partition: 1, Offset: 0, MaxBytes: 1 << 20}
+	if err := client.Do(protocol.APIFetch, req, &fetched); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	if len(fetched.Records) != producers {
+		t.Fatalf("Expected %d records, got %d", producers, len(fetched.Records))
+	}
+	if fetched.HighWatermark != producers {
+		t.Errorf("Expected high watermark %d, got %d", producers, fetched.HighWatermark)
+	}
+	for i, record := range fetched.Records {
+		if record.Offset != int64(i) || string(record.Payload) != `{"n":1}` {
+			t.Errorf("Unexpected record %d: %+v", i, record)
+		}
+	}
+}
+
+func TestTCPProducePartialFailure(t *testing.T) {
+	client, broker := setupTestTCPClient(t)
+
+	// Partition 0 is out of space for its first two appends
+	full := &fullDiskLog{MemoryLog: NewMemoryLog()}
+	full.failures.Store(2)
+	partition, _ := broker.GetPartition("test-topic", 0)
+	partition.logStorage = full
+
+	var records, onFull []protocol.ProduceRecord
+	isFull := make(map[int]bool)
+	for i := 0; i < 12; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		routed, _ := broker.partitionManager.RouteEvent("test-topic", key)
+		record := protocol.ProduceRecord{Key: key, Payload: []byte(strconv.Itoa(i))}
+		records = append(records, record)
+		if routed.ID == 0 {
+			onFull = append(onFull, record)
+			isFull[i] = true
+		}
+	}
+
+	// Only partition 0: nothing is stored, so the request fails as a whole
+	var resp protocol.ProduceResponse
+	err := client.Do(protocol.APIProduce, &protocol.ProduceRequest{Topic: "test-topic", Partition: -1, Records: onFull}, &resp)
+	var protoErr *protocol.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != protocol.ErrStorage {
+		t.Fatalf("Expected ErrStorage when nothing is stored, got %v", err)
+	}
+
+	// Every partition: the others' records are stored, and partition 0's reported failed
+	if err := client.Do(protocol.APIProduce, &protocol.ProduceRequest{Topic: "test-topic", Partition: -1, Records: records}, &resp); err != nil {
+		t.Fatalf("Produce failed: %v", err)
+	}
+	if len(resp.Results) != len(records) {
+		t.Fatalf("Expected %d results, got %d", len(records), len(resp.Results))
+	}
+	next := make(map[int32]int64)
+	for i, result := range resp.Results {
+		switch {
+		case isFull[i] && (result.Offset != -1 || result.ErrorCode != protocol.ErrStorage || result.ErrorMessage == ""):
+			t.Errorf("Record %d: expected a storage error, got %+v", i, result)
+		case !isFull[i] && (result.ErrorCode != protocol.ErrNone || result.Offset != next[result.Partition]):
+			t.Errorf("Record %d: expected offset %d, got %+v", i, next[result.Partition], result)
+		}
+		if !isFull[i] {
+			next[result.Partition]++
+		}
+	}
+
+	// Once the disk has room the whole request goes through
+	if err := client.Do(protocol.APIProduce, &protocol.ProduceRequest{Topic: "test-topic", Partition: -1, Records: records}, &resp); err != nil {
+		t.Fatalf("Produce failed: %v", err)
+	}
+	for i, result := range resp.Results {
+		if result.ErrorCode != protocol.ErrNone || result.Offset < 0 {
+			t.Errorf("Record %d: expected an offset, got %+v", i, result)
+		}
+	}
+}
+
+func TestTCPFetchLongPoll(t *testing.T) {
+	client, _ := setupTestTCPClient(t)
+
+	done := make(chan protocol.FetchResponse, 1)
+	go func() {
+		var resp protocol.FetchResponse
+		req := &protocol.FetchRequest{Topic: "test-topic", Partition: 2, MinBytes: 1, MaxWaitMs: 5000}
+		client.Do(protocol.APIFetch, req, &resp)
+		done <- resp
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	produce := &protocol.ProduceRequest{Topic: "test-topic", Partition: 2, Records: []protocol.ProduceRecord{{Payload: []byte("{}")}}}
+	if err := client.Do(protocol.APIProduce, produce, &protocol.ProduceResponse{}); err != nil {
+		t.Fatalf("Produce failed: %v", err)
+	}
+
+	select {
+	case resp := <-done:
+		if len(resp.Records) != 1 {
+			t.Errorf("Expected 1 record, got %d", len(resp.Records))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Long poll not woken by produce")
+	}
+}
+
+func TestTCPOffsetsAndGroups(t *testing.T) {
+	client, _ := setupTestTCPClient(t)
+
+	// Nothing committed yet
+	err := client.Do(protocol.APIOffsetFetch, &protocol.OffsetFetchRequest{Group: "g", Topic: "test-topic", Partition: 0}, nil)
+	var protoErr *protocol.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != protocol.ErrOffsetNotFound {
+		t.Fatalf("Expected ErrOffsetNotFound, got %v", err)
+	}
+
+	commit := &protocol.OffsetCommitRequest{Group: "g", Topic: "test-topic", Partition: 0, Offset: 12}
+	if err := client.Do(protocol.APIOffsetCommit, commit, nil); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	var fetched protocol.OffsetFetchResponse
+	if err := client.Do(protocol.APIOffsetFetch, &protocol.OffsetFetchRequest{Group: "g", Topic: "test-topic", Partition: 0}, &fetched); err != nil {
+		t.Fatalf("Offset fetch failed: %v", err)
+	}
+	if fetched.Offset != 12 {
+		t.Errorf("Expected offset 12, got %d", fetched.Offset)
+	}
+
+	var assignment protocol.GroupAssignment
+	join := &protocol.JoinGroupRequest{Group: "g", ConsumerID: "c1", Topics: []string{"test-topic"}}
+	if err := client.Do(protocol.APIJoinGroup, join, &assignment); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	if len(assignment.Topics) != 1 || len(assignment.Topics[0].Partitions) != 3 {
+		t.Errorf("Expected all 3 partitions, got %+v", assignment)
+	}
+
+	if err := client.Do(protocol.APILeaveGroup, &protocol.GroupMemberRequest{Group: "g", ConsumerID: "c1"}, nil); err != nil {
+		t.Fatalf("Leave failed: %v", err)
+	}
+	err = client.Do(protocol.APIHeartbeat, &protocol.GroupMemberRequest{Group: "g", ConsumerID: "c1"}, &assignment)
+	if !errors.As(err, &protoErr) || protoErr.Code != protocol.ErrUnknownMember {
+		t.Errorf("Expected ErrUnknownMember after leaving, got %v", err)
+	}
+
+	var metadata protocol.MetadataResponse
+	if err := client.Do(protocol.APIMetadata, &protocol.MetadataRequest{}, &metadata); err != nil {
+		t.Fatalf("Metadata failed: %v", err)
+	}
+	if len(metadata.Topics) != 1 || metadata.Topics[0].Partitions != 3 {
+		t.Errorf("Unexpected metadata %+v", metadata)
+	}
+
+	err = client.Do(protocol.APIKey(999), nil, nil)
+	if !errors.As(err, &protoErr) || protoErr.Code != protocol.ErrUnsupportedAPI {
+		t.Errorf("Expected ErrUnsupportedAPI, got %v", err)
+	}
+}
+
+// setupTestTCPClient starts a TCP server on a random port over the test broker and connects to it.
+func setupTestTCPClient(t *testing.T) (*protocol.Client, *Broker) {
+	t.Helper()
+
+	s := setupTestServer()
+	server := NewTCPServer(s.broker, 0)
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+
+	client, err := protocol.Dial(server.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client, s.broker
+}
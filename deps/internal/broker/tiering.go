@@ -0,0 +1,299 @@
+package broker
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where sealed segments are offloaded: a second directory, or an object store.
+// Names are slash-separated, "{topic}/partition-{id}-{base}.log". Get returns an
+// error wrapping fs.ErrNotExist for a name that was never put.
+type ColdStore interface {
+	Put(ctx context.Context, name string, r io.ReadSeeker, size int64) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+// A ColdStore in a local directory, such as a mount of slower or cheaper disks.
+type DirStore struct {
+	root string
+}
+
+func NewDirStore(root string) *DirStore {
+	return &DirStore{root: root}
+}
+
+func (s *DirStore) path(name string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("invalid segment name %q", name)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(name)), nil
+}
+
+// Write the segment to a temporary file and rename it into place, so a name is
+// either missing or complete.
+func (s *DirStore) Put(ctx context.Context, name string, r io.ReadSeeker, size int64) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(osFS{}, path, func(out io.Writer) error {
+		n, err := io.Copy(out, r)
+		if err == nil && n != size {
+			err = fmt.Errorf("copied %d bytes of %d", n, size)
+		}
+		return err
+	})
+}
+
+func (s *DirStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Move sealed segments whose newest event is older than After to Store, and read
+// them back through a local cache of at most CacheBytes when consumers replay them.
+type TieringOptions struct {
+	Store ColdStore
+	After time.Duration
+
+	// With zero, only the segment being read is kept.
+	CacheBytes int64
+
+	// How often partitions are checked for segments to offload; a minute if zero.
+	Interval time.Duration
+}
+
+// A cold store and the local cache segments are read back through.
+type tier struct {
+	store ColdStore
+	cache *tierCache
+}
+
+// Open a segment stored in the cold tier, fetching it into the cache first if it
+// isn't there. The file stays readable until closed, even if evicted meanwhile.
+func (t *tier) open(name string) (*os.File, error) {
+	return t.cache.open(t.store, name)
+}
+
+// A read-through cache of cold segments in a local directory, evicting the least
+// recently read once over maxBytes. A segment is fetched once however many
+// readers want it.
+type tierCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *cachedSegment, most recent first
+	lru     *list.List
+	size    int64
+	loading map[string]chan struct{} // closed once the fetch is done
+}
+
+type cachedSegment struct {
+	name string
+	size int64
+}
+
+func newTierCache(dir string, maxBytes int64) *tierCache {
+	return &tierCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		loading:  make(map[string]chan struct{}),
+	}
+}
+
+func (c *tierCache) path(name string) string {
+	return filepath.Join(c.dir, strings.ReplaceAll(name, "/", "__"))
+}
+
+func (c *tierCache) open(store ColdStore, name string) (*os.File, error) {
+	c.mu.Lock()
+	for {
+		if element, ok := c.entries[name]; ok {
+			c.lru.MoveToFront(element)
+			// Opened under the lock, so it can't be evicted in between
+			file, err := os.Open(c.path(name))
+			c.mu.Unlock()
+			return file, err
+		}
+		done, ok := c.loading[name]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+	}
+	done := make(chan struct{})
+	c.loading[name] = done
+	c.mu.Unlock()
+
+	size, err := c.fetch(store, name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.loading, name)
+	close(done)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s from the cold tier: %w", name, err)
+	}
+	c.entries[name] = c.lru.PushFront(&cachedSegment{name: name, size: size})
+	c.size += size
+	c.evict()
+	return os.Open(c.path(name))
+}
+
+// Download a segment into the cache directory, returning its size.
+func (c *tierCache) fetch(store ColdStore, name string) (int64, error) {
+	in, err := store.Get(context.Background(), name)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	var size int64
+	err = writeFileAtomic(osFS{}, c.path(name), func(out io.Writer) error {
+		size, err = io.Copy(out, in)
+		return err
+	})
+	return size, err
+}
+
+// Remove the least recently read segments until the cache fits, keeping the most
+// recent one. Readers holding an evicted file open can still read it. mu must be
+// held.
+func (c *tierCache) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 1 {
+		entry := c.lru.Remove(c.lru.Back()).(*cachedSegment)
+		delete(c.entries, entry.name)
+		c.size -= entry.size
+		os.Remove(c.path(entry.name))
+	}
+}
+
+// Offload partition log data older than options.After to options.Store, reading
+// it back through a cache in the data directory. Must be called before topics are
+// added or the broker starts.
+func (b *Broker) SetTiering(options TieringOptions) {
+	if options.Interval <= 0 {
+		options.Interval = time.Minute
+	}
+	b.tiering = options
+	b.tier = &tier{
+		store: options.Store,
+		cache: newTierCache(filepath.Join(b.dataDir, ".tier-cache"), options.CacheBytes),
+	}
+}
+
+// Check every partition for cold segments each interval until the broker stops.
+func (b *Broker) runTiering() {
+	defer b.background.Done()
+
+	ticker := time.NewTicker(b.tiering.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+			b.offloadCold(b.ctx, time.Now().Add(-b.tiering.After))
+		}
+	}
+}
+
+// Offload the segments of every partition whose newest event is older than
+// cutoff, logging failures, which are retried on the next pass.
+func (b *Broker) offloadCold(ctx context.Context, cutoff time.Time) {
+	b.mu.RLock()
+	var logs []*LogStorage
+	for _, topic := range b.topics {
+		for _, partition := range topic.Partitions {
+			if storage, ok := partition.logStorage.(*LogStorage); ok {
+				logs = append(logs, storage)
+			}
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, l := range logs {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := l.offload(ctx, cutoff.UnixNano()); err != nil {
+			log.Printf("Failed to offload segments of %s: %v", l.path, err)
+		}
+	}
+}
+
+// Seal the active file if its newest event is older than cutoff, then move every
+// local sealed segment that is older to the cold tier. A segment is uploaded
+// before it is marked cold, and its local file removed only once that is saved.
+func (l *LogStorage) offload(ctx context.Context, cutoff int64) error {
+	l.mu.Lock()
+	if len(l.positions) > 0 && l.maxTimestamp < cutoff {
+		if err := l.roll(); err != nil {
+			l.mu.Unlock()
+			return err
+		}
+	}
+	var cold []*segment
+	for _, segment := range l.segments {
+		if !segment.Cold && segment.MaxTimestamp < cutoff {
+			cold = append(cold, segment)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, segment := range cold {
+		if err := l.offloadSegment(ctx, segment); err != nil {
+			return fmt.Errorf("segment at offset %d: %w", segment.Base, err)
+		}
+	}
+	return nil
+}
+
+func (l *LogStorage) offloadSegment(ctx context.Context, segment *segment) error {
+	path := segmentPath(l.path, segment.Base)
+	file, err := l.fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = l.tier.store.Put(ctx, segmentObject(l.path, segment.Base), file, segment.Size)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	segment.mu.Lock()
+	segment.Cold = true
+	segment.mu.Unlock()
+	if err := saveSegments(l.fs, l.path, l.segments); err != nil {
+		segment.mu.Lock()
+		segment.Cold = false
+		segment.mu.Unlock()
+		l.mu.Unlock()
+		return err
+	}
+	l.mu.Unlock()
+
+	segment.close()
+	if err := l.fs.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogStorageSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partition-0.log")
+	storage, err := NewLogStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to create log storage: %v", err)
+	}
+	storage.options.SegmentBytes = 200
+	for i := 0; i < 40; i++ {
+		if _, err := storage.Append(&StoredEvent{Key: fmt.Sprintf("k%d", i), Payload: []byte(`{"n":1}`)}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if len(storage.segments) < 2 {
+		t.Fatalf("Expected the log to be split into segments, got %d", len(storage.segments))
+	}
+	if storage.BytesAfter(0) <= storage.BytesAfter(storage.base) {
+		t.Errorf("Expected the sealed segments to count towards the bytes after offset 0")
+	}
+	readAll(t, storage, 40)
+	storage.Close()
+
+	// A roll that crashed before recording its segment: the segment is adopted
+	var file segmentsFile
+	data, _ := os.ReadFile(segmentsPath(path))
+	json.Unmarshal(data, &file)
+	file.Segments = file.Segments[:len(file.Segments)-1]
+	data, _ = json.Marshal(file)
+	os.WriteFile(segmentsPath(path), data, 0644)
+
+	storage, err = NewLogStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen log storage: %v", err)
+	}
+	defer storage.Close()
+	if next := storage.NextOffset(); next != 40 {
+		t.Errorf("Expected next offset 40 after reopening, got %d", next)
+	}
+	readAll(t, storage, 40)
+	if offset, err := storage.Append(&StoredEvent{Key: "k40", Payload: []byte(`{}`)}); err != nil || offset != 40 {
+		t.Errorf("Expected the next append at offset 40, got %d (%v)", offset, err)
+	}
+}
+
+func TestTieringOffloadsAndReadsBack(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+	coldDir := t.TempDir()
+	start := func() (*Broker, *Partition) {
+		b := NewBroker(0, dataDir)
+		b.SetWriteOptions(WriteOptions{SegmentBytes: 300})
+		b.SetCacheOptions(CacheOptions{})
+		b.SetTiering(TieringOptions{Store: NewDirStore(coldDir), After: time.Hour, Interval: time.Hour})
+		if b.GetTopic("orders") == nil {
+			if err := b.AddTopic("orders", 1); err != nil {
+				t.Fatalf("Failed to add topic: %v", err)
+			}
+		}
+		if err := b.Listen(); err != nil {
+			t.Fatalf("Failed to start broker: %v", err)
+		}
+		partition, _ := b.GetPartition("orders", 0)
+		return b, partition
+	}
+	publish := func(b *Broker, partition *Partition, from, to int) {
+		for i := from; i < to; i++ {
+			if _, err := b.partitionManager.AppendEvent(partition, fmt.Sprintf("k%d", i), []byte(`{"n":1}`)); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+		}
+	}
+
+	b, partition := start()
+	publish(b, partition, 0, 30)
+
+	// With a cutoff in the future every segment is old, and the active file is sealed
+	b.offloadCold(ctx, time.Now().Add(time.Hour))
+	storage := partition.logStorage.(*LogStorage)
+	if len(storage.segments) == 0 || storage.base != 30 {
+		t.Fatalf("Expected everything to be sealed, active file at %d", storage.base)
+	}
+	for _, segment := range storage.segments {
+		if !segment.Cold {
+			t.Errorf("Expected segment at offset %d to be offloaded", segment.Base)
+		}
+		if _, err := os.Stat(segmentPath(storage.path, segment.Base)); !os.IsNotExist(err) {
+			t.Errorf("Expected the local file of segment %d to be removed", segment.Base)
+		}
+		if _, err := os.Stat(filepath.Join(coldDir, filepath.FromSlash(segmentObject(storage.path, segment.Base)))); err != nil {
+			t.Errorf("Expected segment %d in the cold store: %v", segment.Base, err)
+		}
+	}
+
+	// Replaying reads them back through the cache, concurrently too
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readAll(t, storage, 30)
+		}()
+	}
+	wg.Wait()
+	if offset, _, err := storage.OffsetForTimestamp(0); err != nil || offset != 0 {
+		t.Errorf("Expected a lookup by time to find offset 0 in the cold tier, got %d (%v)", offset, err)
+	}
+	events, err := b.partitionManager.FetchEvents(partition, 5, 1<<20)
+	if err != nil || len(events) == 0 || events[0].Offset != 5 || events[0].Key != "k5" {
+		t.Errorf("Unexpected fetch from the cold tier: %+v (%v)", events, err)
+	}
+	if section, first, count, err := b.partitionManager.FetchRaw(partition, 0, 1<<20); err != nil || first != 0 || count == 0 || section.Size() == 0 {
+		t.Errorf("Unexpected raw fetch from the cold tier: first %d, count %d (%v)", first, count, err)
+	}
+	// With no cache budget only the segment read last is kept
+	if entries, _ := os.ReadDir(b.tier.cache.dir); len(entries) != 1 {
+		t.Errorf("Expected one cached segment, got %d", len(entries))
+	}
+
+	// Newer data stays local: a snapshot records the cold segments and links the rest
+	publish(b, partition, 30, 50)
+	snapshotDir := filepath.Join(t.TempDir(), "snapshot")
+	manifest, err := b.Snapshot(snapshotDir)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	var cold, local int
+	for _, segment := range manifest.Logs[0].Segments {
+		if segment.Cold {
+			cold++
+		} else {
+			local++
+		}
+	}
+	if cold == 0 || local == 0 || manifest.Logs[0].NextOffset != 50 {
+		t.Errorf("Expected cold and local segments up to offset 50, got %+v", manifest.Logs[0])
+	}
+	b.Close()
+
+	// After a restart, and from the restored snapshot, everything reads back
+	b, partition = start()
+	readAll(t, partition.logStorage, 50)
+	publish(b, partition, 50, 51)
+	b.Close()
+
+	dataDir = filepath.Join(t.TempDir(), "restored")
+	if _, err := RestoreSnapshot(snapshotDir, dataDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	b, partition = start()
+	defer b.Close()
+	readAll(t, partition.logStorage, 50)
+}
+
+func TestS3Store(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") {
+			http.Error(w, "unsigned", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			if sum := sha256.Sum256(body); r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+				http.Error(w, "bad payload hash", http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = body
+		case http.MethodGet:
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			w.Write(body)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store, err := NewS3Store(server.URL+"/segments", "eu-west-1", "AKID", "secret")
+	if err != nil {
+		t.Fatalf("Failed to create S3 store: %v", err)
+	}
+	data := []byte("segment bytes")
+	if err := store.Put(ctx, "orders/partition-0-00000000000000000000.log", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, ok := objects["/segments/orders/partition-0-00000000000000000000.log"]; !ok {
+		t.Errorf("Expected the object under the bucket, got %v", objects)
+	}
+	body, err := store.Get(ctx, "orders/partition-0-00000000000000000000.log")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expected %q back, got %q", data, got)
+	}
+	if _, err := store.Get(ctx, "orders/missing.log"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing object to be not found, got %v", err)
+	}
+
+	// Without credentials the request goes out unsigned
+	unsigned, _ := NewS3Store(server.URL+"/segments", "", "", "")
+	if _, err := unsigned.Get(ctx, "orders/partition-0-00000000000000000000.log"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected an unsigned request to be refused, got %v", err)
+	}
+}
+
+// readAll reads a log from offset 0 to its end in small reads and checks that
+// it holds events k0 up to k{count-1} in order.
+func readAll(t *testing.T, storage PartitionLog, count int64) {
+	t.Helper()
+	var next int64
+	for next < count {
+		events, err := storage.Read(next, 64)
+		if err != nil {
+			t.Errorf("Read at offset %d failed: %v", next, err)
+			return
+		}
+		if len(events) == 0 {
+			t.Errorf("Read at offset %d returned nothing", next)
+			return
+		}
+		for _, event := range events {
+			if event.Offset != next || event.Key != fmt.Sprintf("k%d", next) {
+				t.Errorf("Expected k%d at offset %d, got %s at %d", next, next, event.Key, event.Offset)
+				return
+			}
+			next++
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Bytes of records between entries of a time index.
+const timeIndexBytes = 4096
+
+// An entry of the time index of a log file: the newest event timestamp in the
+// file up to and including the record that holds the event at index, counted
+// from the file's first offset. Since that only grows, the first event at or
+// after a time is after the last entry older than it, and entries every
+// timeIndexBytes of records bound how far a lookup reads. Like positions, the
+// index is kept in memory and rebuilt by scanning the file.
+type timeIndexEntry struct {
+	timestamp int64
+	index     int64
+}
+
+// Add the record holding the events from index to a time index, given the newest
+// timestamp up to and including it, if it starts timeIndexBytes past the last
+// entry. positions must include the record.
+func addTimeIndexEntry(entries []timeIndexEntry, positions []int64, index, newest int64) []timeIndexEntry {
+	if n := len(entries); n > 0 && positions[index] < positions[entries[n-1].index]+timeIndexBytes {
+		return entries
+	}
+	return append(entries, timeIndexEntry{timestamp: newest, index: index})
+}
+
+// Drop the entries of records at or after the event at index.
+func truncateTimeIndex(entries []timeIndexEntry, index int64) []timeIndexEntry {
+	n := sort.Search(len(entries), func(i int) bool { return entries[i].index >= index })
+	return entries[:n]
+}
+
+// Where the first event at or after timestamp may be: the index of the last entry
+// older than it, or 0.
+func timeIndexStart(entries []timeIndexEntry, timestamp int64) int64 {
+	n := sort.Search(len(entries), func(i int) bool { return entries[i].timestamp >= timestamp })
+	if n == 0 {
+		return 0
+	}
+	return entries[n-1].index
+}
+
+// Return the offset of the first event stamped at or after timestamp and its
+// timestamp. The first segment whose newest event is recent enough holds it,
+// and its time index narrows down where to read from.
+func (l *LogStorage) OffsetForTimestamp(timestamp int64) (int64, int64, error) {
+	l.mu.RLock()
+	var found *segment
+	for _, segment := range l.segments {
+		if segment.MaxTimestamp >= timestamp {
+			found = segment
+			break
+		}
+	}
+	var start int64
+	switch {
+	case found != nil:
+	case len(l.positions) > 0 && l.maxTimestamp >= timestamp:
+		start = l.base + timeIndexStart(l.timeIndex, timestamp)
+	default:
+		l.mu.RUnlock()
+		return -1, -1, nil
+	}
+	l.mu.RUnlock()
+
+	if found != nil {
+		// Reading its first record loads the segment's indexes, from the cold
+		// tier if need be
+		if _, _, _, err := l.readSegment(found, found.Base, 0); err != nil {
+			return -1, -1, err
+		}
+		found.mu.Lock()
+		start = found.Base + timeIndexStart(found.timeIndex, timestamp)
+		found.mu.Unlock()
+	}
+	return scanForTimestamp(l, start, timestamp)
+}
+
+// Read a log from offset start up to the first event stamped at or after
+// timestamp, returning its offset and timestamp, or -1 for both if there is none.
+func scanForTimestamp(log PartitionLog, start, timestamp int64) (int64, int64, error) {
+	for offset := start; ; {
+		events, err := log.Read(offset, timeIndexBytes)
+		if err != nil {
+			return -1, -1, err
+		}
+		if len(events) == 0 {
+			return -1, -1, nil
+		}
+		for _, event := range events {
+			if event.Timestamp >= timestamp {
+				return event.Offset, event.Timestamp, nil
+			}
+		}
+		offset = events[len(events)-1].Offset + 1
+	}
+}
+
+// Where to start replaying a partition from a point in time.
+type TimeOffset struct {
+	Partition int `json:"partition"`
+	// the first event stamped at or after the time, or the next offset if there is
+	// none yet
+	Offset    int64      `json:"offset"`
+	Timestamp *time.Time `json:"timestamp,omitempty"` // of the event at offset, if any
+}
+
+// Look up the first offset at or after a point in time in every partition of a
+// topic, by partition ID.
+func (b *Broker) OffsetsForTime(topic string, at time.Time) ([]TimeOffset, error) {
+	t := b.GetTopic(topic)
+	if t == nil {
+		return nil, fmt.Errorf("topic %q not found", topic)
+	}
+
+	offsets := make([]TimeOffset, 0, t.NumPartitions)
+	for partitionID := 0; partitionID < t.NumPartitions; partitionID++ {
+		partition, err := b.GetPartition(topic, partitionID)
+		if err != nil {
+			return nil, err
+		}
+		offset, timestamp, err := partition.logStorage.OffsetForTimestamp(at.UnixNano())
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %w", partitionID, err)
+		}
+		result := TimeOffset{Partition: partitionID, Offset: offset}
+		if offset < 0 {
+			result.Offset = partition.logStorage.NextOffset()
+		} else {
+			stamp := time.Unix(0, timestamp).UTC()
+			result.Timestamp = &stamp
+		}
+		offsets = append(offsets, result)
+	}
+	return offsets, nil
+}
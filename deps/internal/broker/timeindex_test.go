@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The timestamp of the event appended at offset i: rising by a second per event,
+// except every seventh, which is stamped half a minute early as if its producer's
+// clock were behind.
+func timeIndexTimestamp(i int64) int64 {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	if i%7 == 6 {
+		return start + (i-30)*int64(time.Second)
+	}
+	return start + i*int64(time.Second)
+}
+
+// Append count events with timeIndexTimestamp, some in compressed batches.
+func appendTimed(t *testing.T, log PartitionLog, from, count int64) {
+	t.Helper()
+	for i := from; i < from+count; {
+		n, codec := int64(1), CodecNone
+		if i%20 >= 10 {
+			n, codec = min(5, from+count-i), CodecGzip
+		}
+		events := make([]*StoredEvent, n)
+		for k := range events {
+			offset := i + int64(k)
+			events[k] = &StoredEvent{
+				Key:       fmt.Sprintf("k%d", offset),
+				Payload:   []byte(fmt.Sprintf(`{"n":%d,"pad":"%s"}`, offset, strings.Repeat("x", 100))),
+				Timestamp: timeIndexTimestamp(offset),
+			}
+		}
+		if _, err := log.AppendBatch(events, codec); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		i += n
+	}
+}
+
+// Check OffsetForTimestamp against a linear search over the first count events,
+// for times before, between, at and after them.
+func checkOffsetsForTimestamps(t *testing.T, log PartitionLog, count int64) {
+	t.Helper()
+	for i := int64(-40); i <= count; i++ {
+		for _, delta := range []int64{0, 1} {
+			target := timeIndexTimestamp(0) + i*int64(time.Second) + delta
+			expected := int64(-1)
+			for k := int64(0); k < count; k++ {
+				if timeIndexTimestamp(k) >= target {
+					expected = k
+					break
+				}
+			}
+			offset, timestamp, err := log.OffsetForTimestamp(target)
+			if err != nil {
+				t.Fatalf("Lookup of %d failed: %v", target, err)
+			}
+			switch {
+			case offset != expected:
+				t.Fatalf("Expected offset %d for time %d, got %d", expected, target, offset)
+			case expected >= 0 && timestamp != timeIndexTimestamp(expected):
+				t.Fatalf("Expected timestamp %d at offset %d, got %d", timeIndexTimestamp(expected), expected, timestamp)
+			case expected < 0 && timestamp != -1:
+				t.Fatalf("Expected no timestamp for time %d, got %d", target, timestamp)
+			}
+		}
+	}
+}
+
+func TestOffsetForTimestamp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partition-0.log")
+	storage, err := NewLogStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to create log storage: %v", err)
+	}
+	storage.options.SegmentBytes = 16 << 10
+	appendTimed(t, storage, 0, 400)
+	if len(storage.segments) < 2 || len(storage.segments[0].timeIndex) < 2 {
+		t.Fatalf("Expected several segments with several index entries, got %d segments", len(storage.segments))
+	}
+	checkOffsetsForTimestamps(t, storage, 400)
+
+	// Truncating drops the index entries of the dropped records
+	if err := storage.Truncate(390); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	for _, entry := range storage.timeIndex {
+		if storage.base+entry.index >= 390 {
+			t.Errorf("Expected no index entry at or after offset 390, got one at %d", storage.base+entry.index)
+		}
+	}
+	checkOffsetsForTimestamps(t, storage, 390)
+	storage.Close()
+
+	// Reopening rebuilds the indexes from the files
+	storage, err = NewLogStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen log storage: %v", err)
+	}
+	defer storage.Close()
+	checkOffsetsForTimestamps(t, storage, 390)
+
+	// So does the in-memory log
+	memory := NewMemoryLog()
+	appendTimed(t, memory, 0, 200)
+	checkOffsetsForTimestamps(t, memory, 200)
+	if err := memory.Truncate(150); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	checkOffsetsForTimestamps(t, memory, 150)
+}
+
+func TestHandleOffsetsForTime(t *testing.T) {
+	s := setupTestServer()
+
+	// Partition 0 has events, the others none
+	partition, _ := s.broker.GetPartition("test-topic", 0)
+	appendTimed(t, partition.logStorage, 0, 50)
+
+	at := time.Unix(0, timeIndexTimestamp(22)).UTC()
+	req := httptest.NewRequest(http.MethodGet, "/topics/offsets/by-time?topic=test-topic&time="+at.Format(time.RFC3339), nil)
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", rec.Code, rec.Body)
+	}
+
+	var response struct {
+		Partitions []TimeOffset `json:"partitions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(response.Partitions) != 3 {
+		t.Fatalf("Expected 3 partitions, got %+v", response.Partitions)
+	}
+	if first := response.Partitions[0]; first.Offset != 22 || first.Timestamp == nil || !first.Timestamp.Equal(at) {
+		t.Errorf("Expected partition 0 to start at offset 22, got %+v", first)
+	}
+	if empty := response.Partitions[1]; empty.Partition != 1 || empty.Offset != 0 || empty.Timestamp != nil {
+		t.Errorf("Expected an empty partition to start at its end, got %+v", empty)
+	}
+
+	for query, status := range map[string]int{
+		"topic=test-topic&time=yesterday":            http.StatusBadRequest,
+		"topic=test-topic":                           http.StatusBadRequest,
+		"topic=missing&time=2026-10-01T00:00:00Z":    http.StatusNotFound,
+		"topic=test-topic&time=2026-10-01T00:00:00Z": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/topics/offsets/by-time?"+query, nil))
+		if rec.Code != status {
+			t.Errorf("Expected status %d for %q, got %d", status, query, rec.Code)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package broker
 
 import (
+	"context"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,12 +44,18 @@ type Partition struct {
 	// Starts at 0 and increments monotonically.
 	currentOffset int64
 
-	// hold all events in memory (loaded from disk on startup).
-	// In a production system, this would be limited (e.g., keep last N events).
-	events []*StoredEvent
+	// the most recently written events, bounded by the broker's CacheOptions.
+	// Filled as batches are written; empty after a restart until new appends.
+	events     []*StoredEvent
+	eventBytes int64
 
-	// LogStorage handles event storage for this partition.
-	logStorage *LogStorage
+	// fetches answered from events, and fetches that had to read the log file.
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+
+	// stores the partition's events: a *LogStorage, or a *MemoryLog for topics
+	// kept in memory.
+	logStorage PartitionLog
 }
 
 type Topic struct {
@@ -60,7 +69,10 @@ type Topic struct {
 	// Partitions is a map of partition ID to Partition.
 	Partitions map[int]*Partition
 
-	// mu protects Partitions map access.
+	// settings overriding the broker's defaults, such as "compression.type".
+	Config map[string]string `json:",omitempty"`
+
+	// mu protects Partitions map and Config access.
 	mu sync.RWMutex
 }
 
@@ -77,7 +89,7 @@ type ConsumerGroup struct {
 	// Name uniquely identifies the consumer group.
 	Name string
 
-	// In a real system, this would have heartbeat/session tracking.
+	// mu protects all fields below.
 	mu              sync.RWMutex
 	ActiveConsumers map[string]bool // consumerID → is active
 
@@ -86,6 +98,16 @@ type ConsumerGroup struct {
 
 	// LastRebalance tracks when the group last rebalanced.
 	LastRebalance time.Time
+
+	// Generation increments on every rebalance.
+	// Members compare it to notice that their assignment changed.
+	Generation int
+
+	// topics each member subscribed to when it joined.
+	subscriptions map[string][]string // consumerID → topics
+
+	// time of each member's last join or heartbeat.
+	lastHeartbeat map[string]time.Time // consumerID → time
 }
 
 // Routing and operations for partitions.
@@ -120,11 +142,95 @@ func (p *PartitionManager) RouteEvent(topic string, key string) (*Partition, err
 	return t.Partitions[partitionID], nil
 }
 
-// Fetch events from a partition starting at a given offset.
+// Append an event to a partition, stamping it with the current time.
+// Returns the offset assigned to the event.
+func (p *PartitionManager) AppendEvent(partition *Partition, key string, payload []byte) (int64, error) {
+	storedEvent := &StoredEvent{
+		Key:     key,
+		Payload: payload,
+	}
+	return p.AppendEvents(partition, []*StoredEvent{storedEvent}, CodecNone)
+}
+
+// Append events to a partition at consecutive offsets, stamping them with the
+// current time, and return the first offset. The events are stored compressed with
+// the producer's codec unless the topic's compression.type says otherwise.
+func (p *PartitionManager) AppendEvents(partition *Partition, events []*StoredEvent, producer Codec) (int64, error) {
+	now := time.Now().UnixNano()
+	for _, event := range events {
+		event.Timestamp = now
+	}
+
+	codec := producer
+	if t := p.broker.GetTopic(partition.Topic); t != nil {
+		codec = t.codec(producer)
+	}
+	return partition.logStorage.AppendBatch(events, codec)
+}
+
+// Fetch events from a partition starting at a given offset, from the tail cache
+// when it holds them and from the log file otherwise.
 func (p *PartitionManager) FetchEvents(partition *Partition, startOffset int64, maxBytes int) ([]*StoredEvent, error) {
+	if p.broker.cacheOptions.enabled() {
+		if events, ok := partition.cachedEvents(startOffset, maxBytes); ok {
+			partition.cacheHits.Add(1)
+			return events, nil
+		}
+		partition.cacheMisses.Add(1)
+	}
 	return partition.logStorage.Read(startOffset, maxBytes)
 }
 
+// Fetch the stored bytes of events from a partition without decoding them.
+// Returns a reader over at most maxBytes of whole records, the offset of the first
+// event in them and the number of events.
+func (p *PartitionManager) FetchRaw(partition *Partition, startOffset int64, maxBytes int) (*io.SectionReader, int64, int, error) {
+	return partition.logStorage.Section(startOffset, maxBytes)
+}
+
+// Block until at least minBytes of events are available at startOffset,
+// the wait expires, ctx is cancelled or the broker starts shutting down.
+// Appends to the partition wake every waiter.
+func (p *PartitionManager) WaitForEvents(ctx context.Context, partition *Partition, startOffset int64, minBytes int, maxWait time.Duration) {
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	for {
+		changed := partition.logStorage.Changed()
+		if partition.logStorage.BytesAfter(startOffset) >= int64(minBytes) {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		case <-p.broker.stopping():
+			return
+		}
+	}
+}
+
+// Block until any of the partitions has events past its start offset,
+// the wait expires, or ctx is cancelled.
+func (p *PartitionManager) WaitForAny(ctx context.Context, partitions []*Partition, startOffsets []int64, maxWait time.Duration) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i, partition := range partitions {
+		wg.Add(1)
+		go func(partition *Partition, startOffset int64) {
+			defer wg.Done()
+			p.WaitForEvents(ctx, partition, startOffset, 1, maxWait)
+			cancel()
+		}(partition, startOffsets[i])
+	}
+	wg.Wait()
+}
+
 // Commit the offset for a consumer group, topic, and partition.
 func (p *PartitionManager) CommitOffset(consumerGroup, topic string, partitionID int, offset int64) error {
 	// Update PartitionManager.CommitOffset to use OffsetManager
@@ -0,0 +1,519 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WebSocket opcodes (RFC 6455 section 5.2).
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// Appended to the client's key to compute Sec-WebSocket-Accept.
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Largest message (after reassembling fragments) accepted from a peer.
+const wsMaxMessageSize = 4 << 20
+
+var errWebSocketClosed = errors.New("websocket closed")
+
+// Close frame payload with status 1001 (going away), sent when the broker shuts down.
+var wsCloseGoingAway = []byte{0x03, 0xE9}
+
+// A WebSocket connection on top of a hijacked net.Conn.
+// Reads must come from a single goroutine; writes may come from any.
+type wsConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	isServer bool
+
+	writeMu sync.Mutex
+}
+
+// Complete the WebSocket handshake and take over the underlying connection.
+// Handshake errors are written to w before returning.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("websocket handshake requires GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Missing websocket upgrade headers", http.StatusBadRequest)
+		return nil, fmt.Errorf("missing websocket upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Websocket unsupported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hijack connection: %w", err)
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write handshake: %w", err)
+	}
+
+	return &wsConn{conn: conn, reader: rw.Reader, isServer: true}, nil
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Report whether a comma-separated header contains token (case-insensitive).
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read the next data message, reassembling fragments and answering control frames.
+// Returns errWebSocketClosed once the peer sends a close frame.
+func (c *wsConn) ReadMessage() (opcode byte, data []byte, err error) {
+	var message []byte
+	messageOpcode := byte(0)
+
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch frameOpcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the close frame to finish the closing handshake
+			c.writeFrame(wsOpClose, payload)
+			return 0, nil, errWebSocketClosed
+		case wsOpContinuation:
+			if messageOpcode == 0 {
+				return 0, nil, fmt.Errorf("unexpected continuation frame")
+			}
+		case wsOpText, wsOpBinary:
+			if messageOpcode != 0 {
+				return 0, nil, fmt.Errorf("expected continuation frame")
+			}
+			messageOpcode = frameOpcode
+		default:
+			return 0, nil, fmt.Errorf("unknown opcode %#x", frameOpcode)
+		}
+
+		if len(message)+len(payload) > wsMaxMessageSize {
+			return 0, nil, fmt.Errorf("message exceeds %d bytes", wsMaxMessageSize)
+		}
+		message = append(message, payload...)
+
+		if fin {
+			return messageOpcode, message, nil
+		}
+	}
+}
+
+// Read a single frame off the wire and unmask its payload.
+// Frame: [FIN|RSV|opcode(1)][MASK|len(1)][extended len(0/2/8)][mask key(0/4)][payload]
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	// Clients must mask every frame; servers must not
+	if masked != c.isServer {
+		return false, 0, nil, fmt.Errorf("invalid frame masking")
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > wsMaxMessageSize {
+		return false, 0, nil, fmt.Errorf("frame exceeds %d bytes", wsMaxMessageSize)
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, maskKey[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Send a complete message as a single frame.
+func (c *wsConn) WriteMessage(opcode byte, data []byte) error {
+	return c.writeFrame(opcode, data)
+}
+
+// Send a JSON value as a text message.
+func (c *wsConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsOpText, data)
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := byte(0)
+	if !c.isServer {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if c.isServer {
+		frame = append(frame, payload...)
+	} else {
+		var maskKey [4]byte
+		if _, err := rand.Read(maskKey[:]); err != nil {
+			return err
+		}
+		frame = append(frame, maskKey[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^maskKey[i%4])
+		}
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// A JSON frame sent by a WebSocket client.
+//
+//	publish:   {"type":"publish","id":"1","topic":"orders","key":"k","payload":{...}}
+//	subscribe: {"type":"subscribe","id":"2","topic":"orders","partition":0,"offset":0,"group":"g"}
+//	ack:       {"type":"ack","topic":"orders","partition":0,"offset":41}
+//	commit:    {"type":"commit","id":"3","group":"g","topic":"orders","partition":0,"offset":42}
+type wsRequest struct {
+	Type      string                 `json:"type"`
+	ID        string                 `json:"id,omitempty"`
+	Topic     string                 `json:"topic"`
+	Partition *int                   `json:"partition,omitempty"`
+	Offset    *int64                 `json:"offset,omitempty"`
+	Group     string                 `json:"group,omitempty"`
+	Key       string                 `json:"key,omitempty"`
+	Payload   map[string]interface{} `json:"payload,omitempty"`
+}
+
+// A JSON frame sent to a WebSocket client in reply to a request.
+type wsResponse struct {
+	Type       string `json:"type"`
+	ID         string `json:"id,omitempty"`
+	Topic      string `json:"topic,omitempty"`
+	Partition  *int   `json:"partition,omitempty"`
+	Partitions []int  `json:"partitions,omitempty"`
+	Offset     *int64 `json:"offset,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// A record pushed to a subscribed WebSocket client.
+type wsRecord struct {
+	Type string `json:"type"`
+	streamEvent
+}
+
+// An active subscription on a WebSocket connection. At most one per topic.
+type wsSubscription struct {
+	group  string
+	cancel context.CancelFunc
+}
+
+// handleWebSocket upgrades the connection and serves the JSON publish/subscribe protocol.
+// Subscribed records are pushed as {"type":"message",...}. Acks from a subscriber with a
+// group commit the acknowledged position for that group.
+func (s *HTTPServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Hijacked connections are invisible to http.Server.Shutdown, so track them here
+	if !s.websockets.add(conn.conn) {
+		return
+	}
+	defer s.websockets.done(conn.conn)
+
+	// The request context ends when the handler returns; subscriptions live until then,
+	// or until the broker starts shutting down
+	ctx, cancel := s.broker.shutdownContext(context.Background())
+	defer cancel()
+
+	subscriptions := make(map[string]*wsSubscription)
+
+	for {
+		opcode, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				conn.WriteMessage(wsOpClose, wsCloseGoingAway)
+			}
+			return
+		}
+		if opcode != wsOpText {
+			conn.WriteJSON(wsResponse{Type: "error", Error: "expected text frame"})
+			continue
+		}
+
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			conn.WriteJSON(wsResponse{Type: "error", Error: "invalid message"})
+			continue
+		}
+
+		var reply *wsResponse
+		switch req.Type {
+		case "publish":
+			reply, err = s.wsPublish(&req)
+		case "subscribe":
+			reply, err = s.wsSubscribe(ctx, conn, &req, subscriptions)
+		case "ack":
+			err = s.wsAck(&req, subscriptions)
+		case "commit":
+			reply, err = s.wsCommit(&req)
+		default:
+			err = fmt.Errorf("unknown message type %q", req.Type)
+		}
+
+		if err != nil {
+			reply = &wsResponse{Type: "error", ID: req.ID, Error: err.Error()}
+		}
+		if reply != nil {
+			if err := conn.WriteJSON(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *HTTPServer) wsPublish(req *wsRequest) (*wsResponse, error) {
+	if req.Topic == "" {
+		return nil, fmt.Errorf("missing topic")
+	}
+
+	partition, err := s.broker.partitionManager.RouteEvent(req.Topic, req.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadBytes, err := json.Marshal(req.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize payload")
+	}
+
+	offset, err := s.broker.partitionManager.AppendEvent(partition, req.Key, payloadBytes)
+	var readOnly *ReadOnlyError
+	if errors.As(err, &readOnly) {
+		return nil, readOnly
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to append event")
+	}
+
+	partitionID := partition.ID
+	return &wsResponse{Type: "published", ID: req.ID, Topic: req.Topic, Partition: &partitionID, Offset: &offset}, nil
+}
+
+// Start pushing records from one partition (or all partitions) of a topic.
+// Subscribing to a topic again replaces the earlier subscription.
+func (s *HTTPServer) wsSubscribe(ctx context.Context, conn *wsConn, req *wsRequest, subscriptions map[string]*wsSubscription) (*wsResponse, error) {
+	t := s.broker.GetTopic(req.Topic)
+	if t == nil {
+		return nil, fmt.Errorf("topic %q not found", req.Topic)
+	}
+
+	partitionIDs := make([]int, 0, t.NumPartitions)
+	if req.Partition != nil {
+		partitionIDs = append(partitionIDs, *req.Partition)
+	} else {
+		for partitionID := 0; partitionID < t.NumPartitions; partitionID++ {
+			partitionIDs = append(partitionIDs, partitionID)
+		}
+	}
+
+	// Resolve partitions and starting offsets before starting anything
+	partitions := make(map[int]*Partition, len(partitionIDs))
+	positions := make(map[int]int64, len(partitionIDs))
+	for _, partitionID := range partitionIDs {
+		partition, err := s.broker.GetPartition(req.Topic, partitionID)
+		if err != nil {
+			return nil, err
+		}
+		partitions[partitionID] = partition
+
+		switch {
+		case req.Offset != nil:
+			positions[partitionID] = *req.Offset
+		case req.Group != "":
+			if offset, err := s.broker.offsetManager.GetOffset(req.Group, req.Topic, partitionID); err == nil {
+				positions[partitionID] = offset
+			}
+		}
+	}
+
+	if existing, ok := subscriptions[req.Topic]; ok {
+		existing.cancel()
+	}
+	subCtx, cancel := context.WithCancel(ctx)
+	subscriptions[req.Topic] = &wsSubscription{group: req.Group, cancel: cancel}
+
+	// Reply before the first record is pushed
+	if err := conn.WriteJSON(wsResponse{Type: "subscribed", ID: req.ID, Topic: req.Topic, Partitions: partitionIDs}); err != nil {
+		cancel()
+		return nil, nil
+	}
+
+	batches := make(chan streamBatch)
+	for partitionID, partition := range partitions {
+		go s.streamPartition(subCtx, partitionID, partition, positions[partitionID], batches)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-subCtx.Done():
+				return
+			case batch := <-batches:
+				if batch.err != nil {
+					// Resuming would fail the same way; tell the client and end the subscription
+					log.Printf("WebSocket subscription to %s partition %d failed: %v", batch.topic, batch.partition, batch.err)
+					partitionID := batch.partition
+					conn.WriteJSON(wsResponse{Type: "error", Topic: batch.topic, Partition: &partitionID, Error: batch.err.Error()})
+					cancel()
+					return
+				}
+				for _, event := range batch.events {
+					record := wsRecord{Type: "message", streamEvent: streamEvent{Topic: batch.topic, Partition: batch.partition, StoredEvent: event}}
+					if err := conn.WriteJSON(record); err != nil {
+						cancel()
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return nil, nil
+}
+
+// Record that a subscriber has processed a topic-partition through offset.
+// For subscriptions with a group this commits offset+1 for the group.
+func (s *HTTPServer) wsAck(req *wsRequest, subscriptions map[string]*wsSubscription) error {
+	sub, ok := subscriptions[req.Topic]
+	if !ok {
+		return fmt.Errorf("not subscribed to topic %q", req.Topic)
+	}
+	if req.Partition == nil || req.Offset == nil {
+		return fmt.Errorf("ack requires partition and offset")
+	}
+	if sub.group == "" {
+		return nil
+	}
+
+	return s.broker.partitionManager.CommitOffset(sub.group, req.Topic, *req.Partition, *req.Offset+1)
+}
+
+func (s *HTTPServer) wsCommit(req *wsRequest) (*wsResponse, error) {
+	if req.Group == "" || req.Topic == "" || req.Partition == nil || req.Offset == nil {
+		return nil, fmt.Errorf("commit requires group, topic, partition and offset")
+	}
+
+	if err := s.broker.partitionManager.CommitOffset(req.Group, req.Topic, *req.Partition, *req.Offset); err != nil {
+		return nil, err
+	}
+
+	return &wsResponse{Type: "committed", ID: req.ID, Topic: req.Topic, Partition: req.Partition, Offset: req.Offset}, nil
+}
@@ -0,0 +1,186 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketPublishSubscribe(t *testing.T) {
+	s := setupTestServer()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	conn := dialWebSocket(t, server.URL+"/ws")
+	defer conn.Close()
+
+	// Publish with a key so the partition is deterministic
+	send(t, conn, map[string]interface{}{
+		"type":    "publish",
+		"id":      "p1",
+		"topic":   "test-topic",
+		"key":     "user-1",
+		"payload": map[string]interface{}{"amount": 10},
+	})
+	published := receive(t, conn)
+	if published["type"] != "published" || published["id"] != "p1" {
+		t.Fatalf("Expected published reply, got %v", published)
+	}
+	partition := int(published["partition"].(float64))
+
+	// Subscribe to that partition with a group and expect the record back
+	send(t, conn, map[string]interface{}{
+		"type":      "subscribe",
+		"id":        "s1",
+		"topic":     "test-topic",
+		"partition": partition,
+		"group":     "ws-group",
+	})
+	if reply := receive(t, conn); reply["type"] != "subscribed" {
+		t.Fatalf("Expected subscribed reply, got %v", reply)
+	}
+
+	record := receive(t, conn)
+	if record["type"] != "message" || record["key"] != "user-1" || record["offset"] != float64(0) {
+		t.Fatalf("Expected message for offset 0, got %v", record)
+	}
+
+	// Acking commits the next offset for the group
+	send(t, conn, map[string]interface{}{
+		"type":      "ack",
+		"topic":     "test-topic",
+		"partition": partition,
+		"offset":    0,
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		offset, err := s.broker.offsetManager.GetOffset("ws-group", "test-topic", partition)
+		if err == nil && offset == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected committed offset 1, got %d (%v)", offset, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Unknown message types are reported, not fatal
+	send(t, conn, map[string]interface{}{"type": "bogus", "id": "x"})
+	if reply := receive(t, conn); reply["type"] != "error" || reply["id"] != "x" {
+		t.Fatalf("Expected error reply, got %v", reply)
+	}
+}
+
+func TestWebSocketSubscribeReadError(t *testing.T) {
+	s := setupTestServer()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	partition, _ := s.broker.GetPartition("test-topic", 0)
+	unreadable := &unreadableLog{MemoryLog: NewMemoryLog()}
+	partition.logStorage = unreadable
+	partition.logStorage.Append(&StoredEvent{Key: "k", Payload: []byte("{}")})
+
+	conn := dialWebSocket(t, server.URL+"/ws")
+	defer conn.Close()
+
+	send(t, conn, map[string]interface{}{"type": "subscribe", "id": "s1", "topic": "test-topic", "partition": 0})
+	if reply := receive(t, conn); reply["type"] != "subscribed" {
+		t.Fatalf("Expected subscribed reply, got %v", reply)
+	}
+
+	// The failure is reported once, then the subscription ends rather than retrying
+	reply := receive(t, conn)
+	if reply["type"] != "error" || reply["topic"] != "test-topic" || reply["partition"] != float64(0) ||
+		!strings.Contains(reply["error"].(string), "cold store unavailable") {
+		t.Fatalf("Expected a read error for partition 0, got %v", reply)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if reads := unreadable.reads.Load(); reads != 1 {
+		t.Errorf("Expected 1 read, got %d", reads)
+	}
+
+	// The connection is still usable
+	send(t, conn, map[string]interface{}{"type": "bogus", "id": "x"})
+	if reply := receive(t, conn); reply["type"] != "error" || reply["id"] != "x" {
+		t.Fatalf("Expected error reply, got %v", reply)
+	}
+}
+
+func TestWebSocketRejectsPlainRequest(t *testing.T) {
+	s := setupTestServer()
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status BadRequest, got %v", rec.Code)
+	}
+}
+
+// dialWebSocket performs a client handshake against url and returns a client-side connection.
+func dialWebSocket(t *testing.T, url string) *wsConn {
+	t.Helper()
+
+	addr := strings.TrimPrefix(url, "http://")
+	host, path, _ := strings.Cut(addr, "/")
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	handshake := "GET /" + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		t.Fatalf("Failed to write handshake: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %v", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		t.Fatalf("Unexpected Sec-WebSocket-Accept %q", resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	return &wsConn{conn: conn, reader: reader}
+}
+
+func send(t *testing.T, conn *wsConn, v interface{}) {
+	t.Helper()
+	if err := conn.WriteJSON(v); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+}
+
+func receive(t *testing.T, conn *wsConn) map[string]interface{} {
+	t.Helper()
+	conn.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to receive: %v", err)
+	}
+
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("Failed to unmarshal %q: %v", data, err)
+	}
+	return msg
+}
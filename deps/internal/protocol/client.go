@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrClientClosed = errors.New("protocol client closed")
+
+// A connection to a broker's binary protocol listener.
+// Safe for concurrent use: requests issued from several goroutines are pipelined
+// over the one connection and matched to their responses by correlation ID.
+type Client struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan []byte
+	err     error
+}
+
+// Connect to a broker's binary protocol listener.
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:    conn,
+		writer:  bufio.NewWriter(conn),
+		pending: make(map[uint32]chan []byte),
+	}
+	go c.readLoop()
+
+	return c, nil
+}
+
+// Send a request and wait for its response, decoding the body into resp (if non-nil).
+// A non-zero error code from the broker is returned as *Error.
+func (c *Client) Do(apiKey APIKey, req Message, resp Message) error {
+	done := make(chan []byte, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	correlationID := c.nextID
+	c.pending[correlationID] = done
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	err := WriteFrame(c.writer, EncodeRequest(apiKey, correlationID, req))
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return err
+	}
+
+	payload, ok := <-done
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.err
+	}
+
+	_, body, respErr, err := DecodeResponse(payload)
+	if err != nil {
+		return err
+	}
+	if respErr != nil {
+		return respErr
+	}
+	if resp != nil {
+		if err := resp.Decode(body); err != nil {
+			return fmt.Errorf("failed to decode %s response: %w", apiKey, err)
+		}
+	}
+	return nil
+}
+
+// Close the connection. Requests still waiting fail with ErrClientClosed.
+func (c *Client) Close() error {
+	c.fail(ErrClientClosed)
+	return c.conn.Close()
+}
+
+// Route each response frame to the request waiting for it.
+func (c *Client) readLoop() {
+	reader := bufio.NewReader(c.conn)
+	for {
+		payload, err := ReadFrame(reader)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		correlationID, _, _, err := DecodeResponse(payload)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		c.mu.Lock()
+		done, ok := c.pending[correlationID]
+		delete(c.pending, correlationID)
+		c.mu.Unlock()
+
+		if ok {
+			done <- payload
+		}
+	}
+}
+
+// Record the first connection error and release every waiting request.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	for correlationID, done := range c.pending {
+		close(done)
+		delete(c.pending, correlationID)
+	}
+}
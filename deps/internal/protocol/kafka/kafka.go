@@ -0,0 +1,254 @@
+// Package kafka implements the subset of the Apache Kafka wire protocol that DEPS
+// speaks for compatibility with existing Kafka clients: request and response headers,
+// primitive types, and v2 record batches.
+//
+// Only non-flexible API versions are supported, so compact strings, compact arrays and
+// tagged fields never appear. Frames share the DEPS framing: a 4-byte big-endian size
+// followed by the payload (see protocol.ReadFrame and protocol.WriteFrame).
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// API keys used by the compatibility listener.
+const (
+	APIProduce         int16 = 0
+	APIFetch           int16 = 1
+	APIListOffsets     int16 = 2
+	APIMetadata        int16 = 3
+	APIOffsetCommit    int16 = 8
+	APIOffsetFetch     int16 = 9
+	APIFindCoordinator int16 = 10
+	APIApiVersions     int16 = 18
+	APIInitProducerID  int16 = 22
+)
+
+// Kafka error codes returned by the compatibility listener.
+const (
+	ErrNone                       int16 = 0
+	ErrUnknownServerError         int16 = -1
+	ErrOffsetOutOfRange           int16 = 1
+	ErrCorruptMessage             int16 = 2
+	ErrUnknownTopicOrPartition    int16 = 3
+	ErrUnsupportedVersion         int16 = 35
+	ErrInvalidRequest             int16 = 42
+	ErrKafkaStorageError          int16 = 56
+	ErrUnsupportedCompressionType int16 = 76
+)
+
+// Special timestamps accepted by ListOffsets.
+const (
+	TimestampLatest   int64 = -1
+	TimestampEarliest int64 = -2
+)
+
+// The fixed part of every non-flexible request (header v1).
+type RequestHeader struct {
+	APIKey        int16
+	APIVersion    int16
+	CorrelationID int32
+	ClientID      *string
+}
+
+// Parse the request header. The returned reader is positioned at the request body.
+//
+// Flexible request headers (v2) append tagged fields after the client ID; callers
+// that only answer with UNSUPPORTED_VERSION can ignore them.
+func ReadRequestHeader(payload []byte) (RequestHeader, *Reader, error) {
+	r := NewReader(payload)
+	header := RequestHeader{
+		APIKey:        r.ReadInt16(),
+		APIVersion:    r.ReadInt16(),
+		CorrelationID: r.ReadInt32(),
+		ClientID:      r.ReadNullableString(),
+	}
+	return header, r, r.Err()
+}
+
+// Start a response with the v0 response header.
+func NewResponse(correlationID int32) *Writer {
+	w := NewWriter()
+	w.PutInt32(correlationID)
+	return w
+}
+
+// Append Kafka primitives (big-endian) to a buffer.
+type Writer struct {
+	buf []byte
+}
+
+func NewWriter() *Writer {
+	return &Writer{buf: make([]byte, 0, 256)}
+}
+
+func (w *Writer) Bytes() []byte { return w.buf }
+
+func (w *Writer) PutInt8(v int8)   { w.buf = append(w.buf, byte(v)) }
+func (w *Writer) PutInt16(v int16) { w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(v)) }
+func (w *Writer) PutInt32(v int32) { w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v)) }
+func (w *Writer) PutInt64(v int64) { w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(v)) }
+func (w *Writer) PutUint32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *Writer) PutBool(v bool) {
+	if v {
+		w.PutInt8(1)
+	} else {
+		w.PutInt8(0)
+	}
+}
+
+// STRING: int16 length then bytes.
+func (w *Writer) PutString(s string) {
+	w.PutInt16(int16(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// NULLABLE_STRING: length -1 for null.
+func (w *Writer) PutNullableString(s *string) {
+	if s == nil {
+		w.PutInt16(-1)
+		return
+	}
+	w.PutString(*s)
+}
+
+// NULLABLE_BYTES: int32 length (-1 for nil) then bytes.
+func (w *Writer) PutBytes(b []byte) {
+	if b == nil {
+		w.PutInt32(-1)
+		return
+	}
+	w.PutInt32(int32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// ARRAY: int32 count, followed by the elements.
+func (w *Writer) PutArrayLen(n int) { w.PutInt32(int32(n)) }
+
+// Zig-zag encoded variable-length integer, as used inside record batches.
+func (w *Writer) PutVarint(v int64) { w.buf = binary.AppendVarint(w.buf, v) }
+
+// Read Kafka primitives from a buffer.
+// The first error is sticky: later reads return zero values and Err reports it.
+type Reader struct {
+	buf []byte
+	err error
+}
+
+var errTruncated = errors.New("kafka: message truncated")
+
+func NewReader(buf []byte) *Reader {
+	return &Reader{buf: buf}
+}
+
+func (r *Reader) Err() error { return r.err }
+
+// Bytes not yet consumed.
+func (r *Reader) Remaining() int { return len(r.buf) }
+
+func (r *Reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf) < n {
+		r.err = errTruncated
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *Reader) ReadInt8() int8 {
+	if b := r.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *Reader) ReadInt16() int16 {
+	if b := r.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *Reader) ReadInt32() int32 {
+	if b := r.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *Reader) ReadInt64() int64 {
+	if b := r.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *Reader) ReadUint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *Reader) ReadBool() bool { return r.ReadInt8() != 0 }
+
+func (r *Reader) ReadString() string {
+	n := r.ReadInt16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+
+func (r *Reader) ReadNullableString() *string {
+	n := r.ReadInt16()
+	if n < 0 || r.err != nil {
+		return nil
+	}
+	s := string(r.take(int(n)))
+	return &s
+}
+
+// NULLABLE_BYTES. Returns a slice of the underlying buffer, or nil for null.
+func (r *Reader) ReadBytes() []byte {
+	n := r.ReadInt32()
+	if n < 0 {
+		return nil
+	}
+	return r.take(int(n))
+}
+
+// ARRAY count; -1 means a null array.
+// Counts that could not fit in the remaining bytes are rejected.
+func (r *Reader) ReadArrayLen() int {
+	n := int(r.ReadInt32())
+	if r.err == nil && n > len(r.buf) {
+		r.err = errTruncated
+		return 0
+	}
+	return n
+}
+
+func (r *Reader) ReadVarint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// Raw bytes of a known length.
+func (r *Reader) ReadRaw(n int) []byte { return r.take(n) }
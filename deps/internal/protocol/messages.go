@@ -0,0 +1,340 @@
+package protocol
+
+// Produce: append records to a topic.
+// Partition -1 routes each record by its key, as the HTTP API does.
+type ProduceRequest struct {
+	Topic     string
+	Partition int32
+	Records   []ProduceRecord
+}
+
+type ProduceRecord struct {
+	Key     string
+	Payload []byte
+}
+
+func (m *ProduceRequest) Encode(w *Writer) {
+	w.PutString(m.Topic)
+	w.PutInt32(m.Partition)
+	w.PutArrayLen(len(m.Records))
+	for _, record := range m.Records {
+		w.PutString(record.Key)
+		w.PutBytes(record.Payload)
+	}
+}
+
+func (m *ProduceRequest) Decode(r *Reader) error {
+	m.Topic = r.ReadString()
+	m.Partition = r.ReadInt32()
+	m.Records = make([]ProduceRecord, r.ReadArrayLen())
+	for i := range m.Records {
+		m.Records[i].Key = r.ReadString()
+		m.Records[i].Payload = r.ReadBytes()
+	}
+	return r.Err()
+}
+
+// One result per produced record, in request order. A record that was not stored
+// has offset -1 and a non-zero ErrorCode; the others in the request may still have been.
+type ProduceResponse struct {
+	Results []ProduceResult
+}
+
+type ProduceResult struct {
+	Partition    int32
+	Offset       int64
+	ErrorCode    ErrorCode
+	ErrorMessage string
+}
+
+func (m *ProduceResponse) Encode(w *Writer) {
+	w.PutArrayLen(len(m.Results))
+	for _, result := range m.Results {
+		w.PutInt32(result.Partition)
+		w.PutInt64(result.Offset)
+		w.PutUint16(uint16(result.ErrorCode))
+		w.PutString(result.ErrorMessage)
+	}
+}
+
+func (m *ProduceResponse) Decode(r *Reader) error {
+	m.Results = make([]ProduceResult, r.ReadArrayLen())
+	for i := range m.Results {
+		m.Results[i].Partition = r.ReadInt32()
+		m.Results[i].Offset = r.ReadInt64()
+		m.Results[i].ErrorCode = ErrorCode(r.ReadUint16())
+		m.Results[i].ErrorMessage = r.ReadString()
+	}
+	return r.Err()
+}
+
+// Fetch: read records from a partition, optionally long polling
+// until MinBytes are available or MaxWaitMs expires.
+type FetchRequest struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	MaxBytes  int32
+	MinBytes  int32
+	MaxWaitMs int32
+}
+
+func (m *FetchRequest) Encode(w *Writer) {
+	w.PutString(m.Topic)
+	w.PutInt32(m.Partition)
+	w.PutInt64(m.Offset)
+	w.PutInt32(m.MaxBytes)
+	w.PutInt32(m.MinBytes)
+	w.PutInt32(m.MaxWaitMs)
+}
+
+func (m *FetchRequest) Decode(r *Reader) error {
+	m.Topic = r.ReadString()
+	m.Partition = r.ReadInt32()
+	m.Offset = r.ReadInt64()
+	m.MaxBytes = r.ReadInt32()
+	m.MinBytes = r.ReadInt32()
+	m.MaxWaitMs = r.ReadInt32()
+	return r.Err()
+}
+
+// HighWatermark is the offset the next appended record will receive.
+type FetchResponse struct {
+	HighWatermark int64
+	Records       []Record
+}
+
+type Record struct {
+	Offset    int64
+	Timestamp int64
+	Key       string
+	Payload   []byte
+}
+
+func (m *FetchResponse) Encode(w *Writer) {
+	w.PutInt64(m.HighWatermark)
+	w.PutArrayLen(len(m.Records))
+	for _, record := range m.Records {
+		w.PutInt64(record.Offset)
+		w.PutInt64(record.Timestamp)
+		w.PutString(record.Key)
+		w.PutBytes(record.Payload)
+	}
+}
+
+func (m *FetchResponse) Decode(r *Reader) error {
+	m.HighWatermark = r.ReadInt64()
+	m.Records = make([]Record, r.ReadArrayLen())
+	for i := range m.Records {
+		m.Records[i].Offset = r.ReadInt64()
+		m.Records[i].Timestamp = r.ReadInt64()
+		m.Records[i].Key = r.ReadString()
+		m.Records[i].Payload = r.ReadBytes()
+	}
+	return r.Err()
+}
+
+// Metadata: list topics and their partition counts. The request has no body.
+type MetadataRequest struct{}
+
+func (m *MetadataRequest) Encode(w *Writer)       {}
+func (m *MetadataRequest) Decode(r *Reader) error { return r.Err() }
+
+type MetadataResponse struct {
+	Topics []TopicMetadata
+}
+
+type TopicMetadata struct {
+	Name       string
+	Partitions int32
+}
+
+func (m *MetadataResponse) Encode(w *Writer) {
+	w.PutArrayLen(len(m.Topics))
+	for _, topic := range m.Topics {
+		w.PutString(topic.Name)
+		w.PutInt32(topic.Partitions)
+	}
+}
+
+func (m *MetadataResponse) Decode(r *Reader) error {
+	m.Topics = make([]TopicMetadata, r.ReadArrayLen())
+	for i := range m.Topics {
+		m.Topics[i].Name = r.ReadString()
+		m.Topics[i].Partitions = r.ReadInt32()
+	}
+	return r.Err()
+}
+
+// PartitionOffsets: the earliest offset and the next offset to be written.
+type PartitionOffsetsRequest struct {
+	Topic     string
+	Partition int32
+}
+
+func (m *PartitionOffsetsRequest) Encode(w *Writer) {
+	w.PutString(m.Topic)
+	w.PutInt32(m.Partition)
+}
+
+func (m *PartitionOffsetsRequest) Decode(r *Reader) error {
+	m.Topic = r.ReadString()
+	m.Partition = r.ReadInt32()
+	return r.Err()
+}
+
+type PartitionOffsetsResponse struct {
+	StartOffset int64
+	EndOffset   int64
+}
+
+func (m *PartitionOffsetsResponse) Encode(w *Writer) {
+	w.PutInt64(m.StartOffset)
+	w.PutInt64(m.EndOffset)
+}
+
+func (m *PartitionOffsetsResponse) Decode(r *Reader) error {
+	m.StartOffset = r.ReadInt64()
+	m.EndOffset = r.ReadInt64()
+	return r.Err()
+}
+
+// OffsetCommit: store the next offset a group should consume. The response has no body.
+type OffsetCommitRequest struct {
+	Group     string
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+func (m *OffsetCommitRequest) Encode(w *Writer) {
+	w.PutString(m.Group)
+	w.PutString(m.Topic)
+	w.PutInt32(m.Partition)
+	w.PutInt64(m.Offset)
+}
+
+func (m *OffsetCommitRequest) Decode(r *Reader) error {
+	m.Group = r.ReadString()
+	m.Topic = r.ReadString()
+	m.Partition = r.ReadInt32()
+	m.Offset = r.ReadInt64()
+	return r.Err()
+}
+
+// OffsetFetch: look up a group's committed offset. Fails with ErrOffsetNotFound if none.
+type OffsetFetchRequest struct {
+	Group     string
+	Topic     string
+	Partition int32
+}
+
+func (m *OffsetFetchRequest) Encode(w *Writer) {
+	w.PutString(m.Group)
+	w.PutString(m.Topic)
+	w.PutInt32(m.Partition)
+}
+
+func (m *OffsetFetchRequest) Decode(r *Reader) error {
+	m.Group = r.ReadString()
+	m.Topic = r.ReadString()
+	m.Partition = r.ReadInt32()
+	return r.Err()
+}
+
+type OffsetFetchResponse struct {
+	Offset int64
+}
+
+func (m *OffsetFetchResponse) Encode(w *Writer) { w.PutInt64(m.Offset) }
+
+func (m *OffsetFetchResponse) Decode(r *Reader) error {
+	m.Offset = r.ReadInt64()
+	return r.Err()
+}
+
+// JoinGroup: add a member to a consumer group. Answered with a GroupAssignment.
+type JoinGroupRequest struct {
+	Group      string
+	ConsumerID string
+	Topics     []string
+}
+
+func (m *JoinGroupRequest) Encode(w *Writer) {
+	w.PutString(m.Group)
+	w.PutString(m.ConsumerID)
+	w.PutArrayLen(len(m.Topics))
+	for _, topic := range m.Topics {
+		w.PutString(topic)
+	}
+}
+
+func (m *JoinGroupRequest) Decode(r *Reader) error {
+	m.Group = r.ReadString()
+	m.ConsumerID = r.ReadString()
+	m.Topics = make([]string, r.ReadArrayLen())
+	for i := range m.Topics {
+		m.Topics[i] = r.ReadString()
+	}
+	return r.Err()
+}
+
+// Heartbeat and LeaveGroup identify a member of a group.
+// Heartbeat is answered with a GroupAssignment; LeaveGroup has no response body.
+type GroupMemberRequest struct {
+	Group      string
+	ConsumerID string
+}
+
+func (m *GroupMemberRequest) Encode(w *Writer) {
+	w.PutString(m.Group)
+	w.PutString(m.ConsumerID)
+}
+
+func (m *GroupMemberRequest) Decode(r *Reader) error {
+	m.Group = r.ReadString()
+	m.ConsumerID = r.ReadString()
+	return r.Err()
+}
+
+// The partitions assigned to a member in the current generation.
+type GroupAssignment struct {
+	Generation int32
+	Topics     []TopicAssignment
+}
+
+type TopicAssignment struct {
+	Topic      string
+	Partitions []int32
+}
+
+func (m *GroupAssignment) Encode(w *Writer) {
+	w.PutInt32(m.Generation)
+	w.PutArrayLen(len(m.Topics))
+	for _, topic := range m.Topics {
+		w.PutString(topic.Topic)
+		w.PutArrayLen(len(topic.Partitions))
+		for _, partition := range topic.Partitions {
+			w.PutInt32(partition)
+		}
+	}
+}
+
+func (m *GroupAssignment) Decode(r *Reader) error {
+	m.Generation = r.ReadInt32()
+	m.Topics = make([]TopicAssignment, r.ReadArrayLen())
+	for i := range m.Topics {
+		m.Topics[i].Topic = r.ReadString()
+		m.Topics[i].Partitions = make([]int32, r.ReadArrayLen())
+		for j := range m.Topics[i].Partitions {
+			m.Topics[i].Partitions[j] = r.ReadInt32()
+		}
+	}
+	return r.Err()
+}
+
+// A response with no body.
+type Empty struct{}
+
+func (m *Empty) Encode(w *Writer)       {}
+func (m *Empty) Decode(r *Reader) error { return r.Err() }
@@ -0,0 +1,495 @@
+// Package mqtt implements the MQTT 3.1.1 control packets used by the broker's
+// MQTT listener, along with topic name and filter validation and matching.
+//
+// Every packet starts with a fixed header: one byte holding the packet type and
+// flags, then the remaining length as a variable-length integer of up to four bytes.
+// Strings are a 2-byte big-endian length followed by UTF-8 bytes.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Control packet types.
+const (
+	TypeConnect     byte = 1
+	TypeConnAck     byte = 2
+	TypePublish     byte = 3
+	TypePubAck      byte = 4
+	TypePubRec      byte = 5
+	TypePubRel      byte = 6
+	TypePubComp     byte = 7
+	TypeSubscribe   byte = 8
+	TypeSubAck      byte = 9
+	TypeUnsubscribe byte = 10
+	TypeUnsubAck    byte = 11
+	TypePingReq     byte = 12
+	TypePingResp    byte = 13
+	TypeDisconnect  byte = 14
+)
+
+// CONNACK return codes.
+const (
+	ConnAccepted                 byte = 0
+	ConnRefusedProtocolVersion   byte = 1
+	ConnRefusedIdentifier        byte = 2
+	ConnRefusedServerUnavailable byte = 3
+)
+
+// SUBACK return code for a rejected subscription.
+const SubAckFailure byte = 0x80
+
+// Largest remaining length a four-byte variable-length integer can hold.
+const MaxRemainingLength = 268435455
+
+// Largest packet ReadPacket accepts, to bound memory per connection.
+const MaxPacketSize = 64 * 1024 * 1024
+
+var ErrMalformed = errors.New("mqtt: malformed packet")
+
+// A control packet. Use a type switch on the concrete types below.
+type Packet interface {
+	Type() byte
+}
+
+// An application message, as carried by PUBLISH and as a will.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+type Connect struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	CleanSession  bool
+	KeepAlive     uint16 // seconds
+	ClientID      string
+	Will          *Message
+	Username      *string
+	Password      []byte
+}
+
+type ConnAck struct {
+	SessionPresent bool
+	ReturnCode     byte
+}
+
+type Publish struct {
+	Message
+	Dup      bool
+	PacketID uint16 // only for QoS > 0
+}
+
+type PubAck struct {
+	PacketID uint16
+}
+
+type Subscription struct {
+	Filter string
+	QoS    byte
+}
+
+type Subscribe struct {
+	PacketID      uint16
+	Subscriptions []Subscription
+}
+
+type SubAck struct {
+	PacketID    uint16
+	ReturnCodes []byte
+}
+
+type Unsubscribe struct {
+	PacketID uint16
+	Filters  []string
+}
+
+type UnsubAck struct {
+	PacketID uint16
+}
+
+type PingReq struct{}
+type PingResp struct{}
+type Disconnect struct{}
+
+func (*Connect) Type() byte     { return TypeConnect }
+func (*ConnAck) Type() byte     { return TypeConnAck }
+func (*Publish) Type() byte     { return TypePublish }
+func (*PubAck) Type() byte      { return TypePubAck }
+func (*Subscribe) Type() byte   { return TypeSubscribe }
+func (*SubAck) Type() byte      { return TypeSubAck }
+func (*Unsubscribe) Type() byte { return TypeUnsubscribe }
+func (*UnsubAck) Type() byte    { return TypeUnsubAck }
+func (*PingReq) Type() byte     { return TypePingReq }
+func (*PingResp) Type() byte    { return TypePingResp }
+func (*Disconnect) Type() byte  { return TypeDisconnect }
+
+// Read one control packet. QoS 2 flow packets (PUBREC, PUBREL, PUBCOMP) are not
+// supported and are reported as ErrMalformed.
+func ReadPacket(r *bufio.Reader) (Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readRemainingLength(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > MaxPacketSize {
+		return nil, fmt.Errorf("%w: packet of %d bytes exceeds limit", ErrMalformed, length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	packetType, flags := header>>4, header&0x0f
+	d := &decoder{buf: body}
+	var packet Packet
+
+	switch packetType {
+	case TypeConnect:
+		packet = decodeConnect(d)
+	case TypePublish:
+		p := &Publish{Dup: flags&0x08 != 0, Message: Message{QoS: (flags >> 1) & 0x03, Retain: flags&0x01 != 0}}
+		p.Topic = d.string()
+		if p.QoS > 0 {
+			p.PacketID = d.uint16()
+		}
+		p.Payload = d.rest()
+		if p.QoS > 2 {
+			return nil, fmt.Errorf("%w: invalid QoS %d", ErrMalformed, p.QoS)
+		}
+		packet = p
+	case TypeConnAck:
+		packet = &ConnAck{SessionPresent: d.byte()&0x01 != 0, ReturnCode: d.byte()}
+	case TypePubAck:
+		packet = &PubAck{PacketID: d.uint16()}
+	case TypeSubAck:
+		packet = &SubAck{PacketID: d.uint16(), ReturnCodes: d.rest()}
+	case TypeUnsubAck:
+		packet = &UnsubAck{PacketID: d.uint16()}
+	case TypeSubscribe:
+		if flags != 0x02 {
+			return nil, fmt.Errorf("%w: invalid SUBSCRIBE flags", ErrMalformed)
+		}
+		p := &Subscribe{PacketID: d.uint16()}
+		for d.err == nil && len(d.buf) > 0 {
+			p.Subscriptions = append(p.Subscriptions, Subscription{Filter: d.string(), QoS: d.byte()})
+		}
+		if len(p.Subscriptions) == 0 {
+			return nil, fmt.Errorf("%w: SUBSCRIBE without topic filters", ErrMalformed)
+		}
+		packet = p
+	case TypeUnsubscribe:
+		if flags != 0x02 {
+			return nil, fmt.Errorf("%w: invalid UNSUBSCRIBE flags", ErrMalformed)
+		}
+		p := &Unsubscribe{PacketID: d.uint16()}
+		for d.err == nil && len(d.buf) > 0 {
+			p.Filters = append(p.Filters, d.string())
+		}
+		if len(p.Filters) == 0 {
+			return nil, fmt.Errorf("%w: UNSUBSCRIBE without topic filters", ErrMalformed)
+		}
+		packet = p
+	case TypePingReq:
+		packet = &PingReq{}
+	case TypePingResp:
+		packet = &PingResp{}
+	case TypeDisconnect:
+		packet = &Disconnect{}
+	default:
+		return nil, fmt.Errorf("%w: unexpected packet type %d", ErrMalformed, packetType)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return packet, nil
+}
+
+func decodeConnect(d *decoder) *Connect {
+	p := &Connect{
+		ProtocolName:  d.string(),
+		ProtocolLevel: d.byte(),
+	}
+	flags := d.byte()
+	p.KeepAlive = d.uint16()
+	p.CleanSession = flags&0x02 != 0
+	if flags&0x01 != 0 {
+		d.fail("reserved connect flag set")
+	}
+
+	p.ClientID = d.string()
+	if flags&0x04 != 0 {
+		p.Will = &Message{
+			Topic:  d.string(),
+			QoS:    (flags >> 3) & 0x03,
+			Retain: flags&0x20 != 0,
+		}
+		p.Will.Payload = d.bytes()
+	}
+	if flags&0x80 != 0 {
+		username := d.string()
+		p.Username = &username
+	}
+	if flags&0x40 != 0 {
+		p.Password = d.bytes()
+	}
+	return p
+}
+
+// Write one control packet.
+func WritePacket(w io.Writer, packet Packet) error {
+	e := &encoder{}
+	var flags byte
+
+	switch p := packet.(type) {
+	case *ConnAck:
+		if p.SessionPresent {
+			e.byte(1)
+		} else {
+			e.byte(0)
+		}
+		e.byte(p.ReturnCode)
+	case *Publish:
+		flags = p.QoS << 1
+		if p.Dup {
+			flags |= 0x08
+		}
+		if p.Retain {
+			flags |= 0x01
+		}
+		e.string(p.Topic)
+		if p.QoS > 0 {
+			e.uint16(p.PacketID)
+		}
+		e.buf = append(e.buf, p.Payload...)
+	case *PubAck:
+		e.uint16(p.PacketID)
+	case *Subscribe:
+		flags = 0x02
+		e.uint16(p.PacketID)
+		for _, sub := range p.Subscriptions {
+			e.string(sub.Filter)
+			e.byte(sub.QoS)
+		}
+	case *SubAck:
+		e.uint16(p.PacketID)
+		e.buf = append(e.buf, p.ReturnCodes...)
+	case *Unsubscribe:
+		flags = 0x02
+		e.uint16(p.PacketID)
+		for _, filter := range p.Filters {
+			e.string(filter)
+		}
+	case *UnsubAck:
+		e.uint16(p.PacketID)
+	case *Connect:
+		encodeConnect(e, p)
+	case *PingReq, *PingResp, *Disconnect:
+	default:
+		return fmt.Errorf("mqtt: cannot encode packet type %d", packet.Type())
+	}
+
+	if len(e.buf) > MaxRemainingLength {
+		return fmt.Errorf("mqtt: packet too large (%d bytes)", len(e.buf))
+	}
+	header := []byte{packet.Type()<<4 | flags}
+	header = appendRemainingLength(header, len(e.buf))
+	if _, err := w.Write(append(header, e.buf...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func encodeConnect(e *encoder, p *Connect) {
+	e.string(p.ProtocolName)
+	e.byte(p.ProtocolLevel)
+
+	var flags byte
+	if p.CleanSession {
+		flags |= 0x02
+	}
+	if p.Will != nil {
+		flags |= 0x04 | p.Will.QoS<<3
+		if p.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if p.Username != nil {
+		flags |= 0x80
+	}
+	if p.Password != nil {
+		flags |= 0x40
+	}
+	e.byte(flags)
+	e.uint16(p.KeepAlive)
+
+	e.string(p.ClientID)
+	if p.Will != nil {
+		e.string(p.Will.Topic)
+		e.bytes(p.Will.Payload)
+	}
+	if p.Username != nil {
+		e.string(*p.Username)
+	}
+	if p.Password != nil {
+		e.bytes(p.Password)
+	}
+}
+
+func readRemainingLength(r *bufio.Reader) (int, error) {
+	length, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return length, nil
+		}
+		multiplier *= 128
+	}
+	return 0, fmt.Errorf("%w: remaining length exceeds four bytes", ErrMalformed)
+}
+
+func appendRemainingLength(buf []byte, length int) []byte {
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			return buf
+		}
+	}
+}
+
+// Valid topic name for PUBLISH: non-empty, no wildcards.
+func ValidTopicName(name string) bool {
+	return name != "" && len(name) <= 65535 && utf8.ValidString(name) &&
+		!strings.ContainsAny(name, "+#\x00")
+}
+
+// Valid topic filter for SUBSCRIBE: "+" must occupy a whole level and "#" must be
+// the whole last level.
+func ValidTopicFilter(filter string) bool {
+	if filter == "" || len(filter) > 65535 || !utf8.ValidString(filter) || strings.ContainsRune(filter, 0) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// Report whether a topic name matches a filter. Wildcards in the first level
+// do not match names starting with "$".
+func MatchTopic(filter, name string) bool {
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	nameLevels := strings.Split(name, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true // also matches the parent level ("a/#" matches "a")
+		}
+		if i >= len(nameLevels) {
+			return false
+		}
+		if level != "+" && level != nameLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(nameLevels)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(msg string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrMalformed, msg)
+	}
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.fail("truncated")
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	return d.take(int(d.uint16()))
+}
+
+func (d *decoder) string() string {
+	s := d.bytes()
+	if d.err == nil && !utf8.Valid(s) {
+		d.fail("invalid UTF-8 string")
+	}
+	return string(s)
+}
+
+func (d *decoder) rest() []byte {
+	return d.take(len(d.buf))
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) byte(b byte) { e.buf = append(e.buf, b) }
+
+func (e *encoder) uint16(v uint16) { e.buf = binary.BigEndian.AppendUint16(e.buf, v) }
+
+func (e *encoder) bytes(b []byte) {
+	e.uint16(uint16(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(s string) { e.bytes([]byte(s)) }
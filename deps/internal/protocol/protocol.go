@@ -0,0 +1,281 @@
+// Package protocol defines the DEPS binary protocol: length-prefixed request and
+// response frames exchanged over persistent TCP connections.
+//
+// Request frame:  [size(4)][apiKey(2)][correlationID(4)][body]
+// Response frame: [size(4)][correlationID(4)][errorCode(2)][body]
+//
+// size counts the bytes that follow it. All integers are big-endian. Clients may
+// pipeline requests; the broker answers each connection's requests in the order
+// they were sent, echoing the correlation ID, except that a long-polling fetch is
+// answered whenever it completes. On a non-zero error code the body holds a single
+// string describing the error.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Largest frame either side will accept.
+const MaxFrameSize = 64 << 20
+
+// Identifies the operation a request performs.
+type APIKey uint16
+
+const (
+	APIProduce APIKey = iota + 1
+	APIFetch
+	APIMetadata
+	APIPartitionOffsets
+	APIOffsetCommit
+	APIOffsetFetch
+	APIJoinGroup
+	APIHeartbeat
+	APILeaveGroup
+)
+
+func (k APIKey) String() string {
+	switch k {
+	case APIProduce:
+		return "Produce"
+	case APIFetch:
+		return "Fetch"
+	case APIMetadata:
+		return "Metadata"
+	case APIPartitionOffsets:
+		return "PartitionOffsets"
+	case APIOffsetCommit:
+		return "OffsetCommit"
+	case APIOffsetFetch:
+		return "OffsetFetch"
+	case APIJoinGroup:
+		return "JoinGroup"
+	case APIHeartbeat:
+		return "Heartbeat"
+	case APILeaveGroup:
+		return "LeaveGroup"
+	}
+	return fmt.Sprintf("APIKey(%d)", uint16(k))
+}
+
+// Result of a request, carried in every response frame.
+type ErrorCode uint16
+
+const (
+	ErrNone ErrorCode = iota
+	ErrUnknown
+	ErrInvalidRequest
+	ErrUnsupportedAPI
+	ErrTopicNotFound
+	ErrPartitionNotFound
+	ErrOffsetNotFound
+	ErrUnknownMember
+	ErrStorage
+)
+
+// A non-zero error code returned by the broker.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("broker error %d: %s", e.Code, e.Message)
+}
+
+// A request or response body.
+type Message interface {
+	Encode(w *Writer)
+	Decode(r *Reader) error
+}
+
+// Write one frame: a 4-byte size followed by payload.
+func WriteFrame(w io.Writer, payload []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Read one frame and return its payload.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit of %d", n, MaxFrameSize)
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Build a request frame payload.
+func EncodeRequest(apiKey APIKey, correlationID uint32, body Message) []byte {
+	w := NewWriter()
+	w.PutUint16(uint16(apiKey))
+	w.PutUint32(correlationID)
+	if body != nil {
+		body.Encode(w)
+	}
+	return w.Bytes()
+}
+
+// Split a request frame payload into its header and a reader over the body.
+func DecodeRequest(payload []byte) (apiKey APIKey, correlationID uint32, body *Reader, err error) {
+	r := NewReader(payload)
+	apiKey = APIKey(r.ReadUint16())
+	correlationID = r.ReadUint32()
+	if err := r.Err(); err != nil {
+		return 0, 0, nil, fmt.Errorf("truncated request header: %w", err)
+	}
+	return apiKey, correlationID, r, nil
+}
+
+// Build a response frame payload. A non-nil respErr replaces the body.
+func EncodeResponse(correlationID uint32, body Message, respErr *Error) []byte {
+	w := NewWriter()
+	w.PutUint32(correlationID)
+	if respErr != nil {
+		w.PutUint16(uint16(respErr.Code))
+		w.PutString(respErr.Message)
+		return w.Bytes()
+	}
+	w.PutUint16(uint16(ErrNone))
+	if body != nil {
+		body.Encode(w)
+	}
+	return w.Bytes()
+}
+
+// Split a response frame payload into its correlation ID and either a body reader or the broker's error.
+func DecodeResponse(payload []byte) (correlationID uint32, body *Reader, respErr *Error, err error) {
+	r := NewReader(payload)
+	correlationID = r.ReadUint32()
+	code := ErrorCode(r.ReadUint16())
+	if err := r.Err(); err != nil {
+		return 0, nil, nil, fmt.Errorf("truncated response header: %w", err)
+	}
+
+	if code != ErrNone {
+		message := r.ReadString()
+		return correlationID, nil, &Error{Code: code, Message: message}, r.Err()
+	}
+	return correlationID, r, nil, nil
+}
+
+// Append big-endian primitives to a buffer.
+type Writer struct {
+	buf []byte
+}
+
+func NewWriter() *Writer {
+	return &Writer{buf: make([]byte, 0, 64)}
+}
+
+func (w *Writer) Bytes() []byte { return w.buf }
+
+func (w *Writer) PutUint16(v uint16) { w.buf = binary.BigEndian.AppendUint16(w.buf, v) }
+func (w *Writer) PutUint32(v uint32) { w.buf = binary.BigEndian.AppendUint32(w.buf, v) }
+func (w *Writer) PutInt32(v int32)   { w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v)) }
+func (w *Writer) PutInt64(v int64)   { w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(v)) }
+
+// String: [length(2)][bytes]
+func (w *Writer) PutString(s string) {
+	w.PutUint16(uint16(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// Bytes: [length(4)][bytes]
+func (w *Writer) PutBytes(b []byte) {
+	w.PutUint32(uint32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// Array header: [count(4)], followed by the elements.
+func (w *Writer) PutArrayLen(n int) { w.PutUint32(uint32(n)) }
+
+// Read big-endian primitives from a buffer.
+// The first error is sticky: later reads return zero values and Err reports it.
+type Reader struct {
+	buf []byte
+	err error
+}
+
+var errTruncated = errors.New("message truncated")
+
+func NewReader(buf []byte) *Reader {
+	return &Reader{buf: buf}
+}
+
+func (r *Reader) Err() error { return r.err }
+
+func (r *Reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf) < n {
+		r.err = errTruncated
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *Reader) ReadUint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *Reader) ReadUint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *Reader) ReadInt32() int32 { return int32(r.ReadUint32()) }
+
+func (r *Reader) ReadInt64() int64 {
+	if b := r.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *Reader) ReadString() string {
+	return string(r.take(int(r.ReadUint16())))
+}
+
+// Returns a copy so the frame buffer can be released.
+func (r *Reader) ReadBytes() []byte {
+	b := r.take(int(r.ReadUint32()))
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// Read an array header, rejecting counts that could not fit in the remaining bytes.
+func (r *Reader) ReadArrayLen() int {
+	n := int(r.ReadUint32())
+	if r.err == nil && n > len(r.buf) {
+		r.err = errTruncated
+		return 0
+	}
+	return n
+}
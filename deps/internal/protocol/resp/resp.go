@@ -0,0 +1,130 @@
+// Package resp implements the Redis serialization protocol (RESP2) as used by
+// Redis clients: commands arrive as arrays of bulk strings (or inline, space-separated
+// lines from tools like telnet) and replies are simple strings, errors, integers,
+// bulk strings and arrays.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits that protect the server from oversized or malicious input.
+const (
+	MaxBulkLength = 512 * 1024 * 1024 // same limit as Redis
+	MaxArgs       = 1024 * 1024
+)
+
+var ErrProtocol = errors.New("resp: protocol error")
+
+// Read one command and return its arguments.
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	// Inline command
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > MaxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
+
+	args := make([]string, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got %q", ErrProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > MaxBulkLength {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// Read a CRLF-terminated line, without the terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Write RESP replies to a buffered connection.
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter(w *bufio.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Flush buffered replies to the connection.
+func (w *Writer) Flush() error { return w.w.Flush() }
+
+// +OK style status reply.
+func (w *Writer) SimpleString(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+// Error reply. The message should start with an error code such as ERR or NOGROUP.
+func (w *Writer) Error(msg string) {
+	w.w.WriteString("-" + strings.ReplaceAll(msg, "\r\n", " ") + "\r\n")
+}
+
+func (w *Writer) Integer(n int64) {
+	w.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *Writer) BulkString(s string) {
+	w.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) BulkBytes(b []byte) {
+	w.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+// Nil bulk string.
+func (w *Writer) Null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+// Array header; the n elements follow.
+func (w *Writer) ArrayLen(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// Nil array, as returned by blocking reads that time out.
+func (w *Writer) NullArray() {
+	w.w.WriteString("*-1\r\n")
+}
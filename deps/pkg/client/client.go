@@ -0,0 +1,553 @@
+// Package client is a Go client for the broker's HTTP API.
+//
+// Client makes single requests (publish, fetch, offsets, group membership) and
+// decodes the responses into typed structs. Producer batches records and publishes
+// them asynchronously with retries; Consumer polls assigned partitions, either
+// chosen by hand or assigned by a consumer group, and commits its positions.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A connection to a broker's HTTP API. Safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// Error returned when the broker answers with a non-200 status.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Message)
+}
+
+// Error returned by PublishBatch when the broker stored some of the events but
+// not others: Failed holds why each event that was not stored failed, by its
+// index in the batch. The results of the other events are valid.
+type PartialBatchError struct {
+	Failed map[int]*APIError
+}
+
+func (e *PartialBatchError) Error() string {
+	first := -1
+	for index := range e.Failed {
+		if first < 0 || index < first {
+			first = index
+		}
+	}
+	return fmt.Sprintf("%d events of the batch were not stored, the first (%d) with %v", len(e.Failed), first, e.Failed[first])
+}
+
+// Whether err is an APIError with the given status code.
+func IsStatus(err error, statusCode int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == statusCode
+}
+
+// Where a published event was stored.
+type PublishResult struct {
+	Partition int   `json:"partition"`
+	Offset    int64 `json:"offset"`
+}
+
+// An event read from a partition.
+type Message struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Timestamp int64  `json:"timestamp"` // Unix nanoseconds
+	Key       string `json:"key"`
+	Payload   []byte `json:"payload"` // the published payload, as JSON
+}
+
+// The time the broker stored the message.
+func (m *Message) Time() time.Time {
+	return time.Unix(0, m.Timestamp)
+}
+
+type FetchResult struct {
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Messages  []Message `json:"messages"`
+}
+
+// Limits for a fetch. Zero values use the broker's defaults (1MB, no long polling).
+type FetchOptions struct {
+	MaxBytes int
+	// Bytes that must be available before the broker responds, when MaxWait is set.
+	MinBytes int
+	// How long the broker may hold the request waiting for MinBytes; capped at 30s.
+	MaxWait time.Duration
+	// Transfer records in the broker's log format rather than JSON, which the
+	// broker copies straight from disk and which carries payloads without base64.
+	Raw bool
+}
+
+type PartitionOffsets struct {
+	Topic       string `json:"topic"`
+	Partition   int    `json:"partition"`
+	StartOffset int64  `json:"startOffset"` // earliest offset still stored
+	EndOffset   int64  `json:"endOffset"`   // offset the next event will get
+}
+
+// Where to start replaying a partition from a point in time.
+type TimeOffset struct {
+	Partition int `json:"partition"`
+	// first event stamped at or after the time, or the end offset if there is none yet
+	Offset    int64      `json:"offset"`
+	Timestamp *time.Time `json:"timestamp"` // of the event at Offset, nil if none
+}
+
+type TopicMetadata struct {
+	Name       string `json:"name"`
+	Partitions int    `json:"partitions"`
+
+	// partitions refusing publishes after a failed write, until the disk recovers
+	ReadOnlyPartitions []int `json:"readOnlyPartitions,omitempty"`
+}
+
+type Metadata struct {
+	Topics []TopicMetadata `json:"topics"`
+}
+
+// A member's view of its consumer group after join and heartbeat.
+type GroupAssignment struct {
+	Generation int              `json:"generation"`
+	Partitions map[string][]int `json:"partitions"` // topic → partition IDs
+}
+
+// A snapshot the broker took of its logs, topic metadata and committed offsets.
+type Snapshot struct {
+	Name      string        `json:"name"`
+	Path      string        `json:"path"` // on the broker's host
+	CreatedAt time.Time     `json:"createdAt"`
+	Logs      []SnapshotLog `json:"logs"`
+}
+
+// A partition log in a snapshot, with its size and next offset when it was taken.
+type SnapshotLog struct {
+	Topic      string `json:"topic"`
+	Partition  int    `json:"partition"`
+	Size       int64  `json:"size"`
+	NextOffset int64  `json:"nextOffset"`
+}
+
+type TopicPartition struct {
+	Topic     string
+	Partition int
+}
+
+func (tp TopicPartition) String() string {
+	return fmt.Sprintf("%s/%d", tp.Topic, tp.Partition)
+}
+
+// New client for the broker at addr, either "host:port" or an http:// URL.
+func New(addr string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &Client{
+		baseURL: strings.TrimSuffix(addr, "/"),
+		// No overall timeout: fetches long-poll. Use contexts to bound requests.
+		httpClient: &http.Client{},
+	}
+}
+
+// Check that the broker is up.
+func (c *Client) Health(ctx context.Context) error {
+	return c.get(ctx, "/health", nil, nil)
+}
+
+// List topics and their partition counts.
+func (c *Client) Metadata(ctx context.Context) (*Metadata, error) {
+	var metadata Metadata
+	if err := c.get(ctx, "/metadata", nil, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// Publish one event. The payload must marshal to a JSON object; a
+// json.RawMessage is sent as-is.
+func (c *Client) Publish(ctx context.Context, topic, key string, payload interface{}) (*PublishResult, error) {
+	event := struct {
+		Key     string      `json:"key"`
+		Payload interface{} `json:"payload"`
+	}{key, payload}
+
+	var result PublishResult
+	if err := c.post(ctx, "/topics/events", url.Values{"topic": {topic}}, event, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// An event in a batch published with PublishBatch.
+type BatchEvent struct {
+	Key string `json:"key"`
+	// Must marshal to a JSON object; a json.RawMessage is sent as-is.
+	Payload interface{} `json:"payload"`
+}
+
+// Publish events to a topic in one request, compressed with gzip, zlib or flate,
+// or uncompressed if compression is empty. The broker stores each partition's
+// events together and in order, in the same compression unless the topic's
+// compression.type says otherwise. Returns where each event was stored; if only
+// some were, the error is a *PartialBatchError saying which were not.
+func (c *Client) PublishBatch(ctx context.Context, topic string, events []BatchEvent, compression string) ([]PublishResult, error) {
+	data, err := json.Marshal(events)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	if compression != "" {
+		if data, err = compressBody(compression, data); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("/topics/events/batch", url.Values{"topic": {topic}}), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if compression != "" {
+		req.Header.Set("Content-Encoding", contentEncodings[compression])
+	}
+
+	var response struct {
+		Results []struct {
+			PublishResult
+			Status int    `json:"status"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+	if err := c.do(req, &response); err != nil {
+		return nil, err
+	}
+	results := make([]PublishResult, len(response.Results))
+	var partial *PartialBatchError
+	for i, result := range response.Results {
+		results[i] = result.PublishResult
+		if result.Status != 0 {
+			if partial == nil {
+				partial = &PartialBatchError{Failed: make(map[int]*APIError)}
+			}
+			partial.Failed[i] = &APIError{StatusCode: result.Status, Message: result.Error}
+		}
+	}
+	if partial != nil {
+		return results, partial
+	}
+	return results, nil
+}
+
+// A topic's settings, such as compression.type.
+func (c *Client) TopicConfig(ctx context.Context, topic string) (map[string]string, error) {
+	var response struct {
+		Config map[string]string `json:"config"`
+	}
+	if err := c.get(ctx, "/topics/config", url.Values{"topic": {topic}}, &response); err != nil {
+		return nil, err
+	}
+	return response.Config, nil
+}
+
+// Change topic settings and return them all.
+func (c *Client) SetTopicConfig(ctx context.Context, topic string, settings map[string]string) (map[string]string, error) {
+	var response struct {
+		Config map[string]string `json:"config"`
+	}
+	if err := c.post(ctx, "/topics/config", url.Values{"topic": {topic}}, settings, &response); err != nil {
+		return nil, err
+	}
+	return response.Config, nil
+}
+
+// Fetch events from a partition starting at offset.
+func (c *Client) Fetch(ctx context.Context, topic string, partition int, offset int64, opts FetchOptions) (*FetchResult, error) {
+	query := url.Values{
+		"topic":     {topic},
+		"partition": {strconv.Itoa(partition)},
+		"offset":    {strconv.FormatInt(offset, 10)},
+	}
+	if opts.MaxBytes > 0 {
+		query.Set("maxBytes", strconv.Itoa(opts.MaxBytes))
+	}
+	if opts.MaxWait > 0 {
+		query.Set("minBytes", strconv.Itoa(max(opts.MinBytes, 1)))
+		query.Set("maxWait", strconv.FormatInt(opts.MaxWait.Milliseconds(), 10))
+	}
+
+	var result FetchResult
+	if opts.Raw {
+		query.Set("format", "raw")
+		var raw rawResponse
+		if err := c.get(ctx, "/messages", query, &raw); err != nil {
+			return nil, err
+		}
+		messages, err := decodeRecords(raw, offset)
+		if err != nil {
+			return nil, err
+		}
+		result = FetchResult{Topic: topic, Partition: partition, Messages: messages}
+	} else if err := c.get(ctx, "/messages", query, &result); err != nil {
+		return nil, err
+	}
+	for i := range result.Messages {
+		result.Messages[i].Topic = result.Topic
+		result.Messages[i].Partition = result.Partition
+	}
+	return &result, nil
+}
+
+// The earliest and next offsets of a partition.
+func (c *Client) PartitionOffsets(ctx context.Context, topic string, partition int) (*PartitionOffsets, error) {
+	query := url.Values{"topic": {topic}, "partition": {strconv.Itoa(partition)}}
+
+	var result PartitionOffsets
+	if err := c.get(ctx, "/topics/offsets", query, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// The first offset at or after t in each partition of a topic, by partition ID.
+func (c *Client) OffsetsForTime(ctx context.Context, topic string, t time.Time) ([]TimeOffset, error) {
+	query := url.Values{"topic": {topic}, "time": {t.Format(time.RFC3339Nano)}}
+
+	var result struct {
+		Partitions []TimeOffset `json:"partitions"`
+	}
+	if err := c.get(ctx, "/topics/offsets/by-time", query, &result); err != nil {
+		return nil, err
+	}
+	return result.Partitions, nil
+}
+
+// Commit the next offset the group should read from a partition.
+func (c *Client) CommitOffset(ctx context.Context, group, topic string, partition int, offset int64) error {
+	body := struct {
+		Topic     string `json:"topic"`
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+	}{topic, partition, offset}
+	return c.post(ctx, "/consumer-groups/offsets/commit", url.Values{"group": {group}}, body, nil)
+}
+
+// The group's committed offset for a partition. ok is false if nothing has been committed.
+func (c *Client) CommittedOffset(ctx context.Context, group, topic string, partition int) (offset int64, ok bool, err error) {
+	query := url.Values{"group": {group}, "topic": {topic}, "partition": {strconv.Itoa(partition)}}
+
+	var result struct {
+		Offset int64 `json:"offset"`
+	}
+	if err := c.get(ctx, "/consumer-groups/offsets", query, &result); err != nil {
+		if IsStatus(err, http.StatusNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return result.Offset, true, nil
+}
+
+// Join a consumer group (or change the member's topics) and return its assignment.
+func (c *Client) JoinGroup(ctx context.Context, group, consumerID string, topics []string) (*GroupAssignment, error) {
+	body := struct {
+		ConsumerID string   `json:"consumerId"`
+		Topics     []string `json:"topics"`
+	}{consumerID, topics}
+
+	var assignment GroupAssignment
+	if err := c.post(ctx, "/consumer-groups/join", url.Values{"group": {group}}, body, &assignment); err != nil {
+		return nil, err
+	}
+	return &assignment, nil
+}
+
+// Keep a member's session alive. Fails with status 409 once the member must rejoin.
+func (c *Client) Heartbeat(ctx context.Context, group, consumerID string) (*GroupAssignment, error) {
+	body := struct {
+		ConsumerID string `json:"consumerId"`
+	}{consumerID}
+
+	var assignment GroupAssignment
+	if err := c.post(ctx, "/consumer-groups/heartbeat", url.Values{"group": {group}}, body, &assignment); err != nil {
+		return nil, err
+	}
+	return &assignment, nil
+}
+
+// Leave a consumer group so its partitions are reassigned.
+func (c *Client) LeaveGroup(ctx context.Context, group, consumerID string) error {
+	body := struct {
+		ConsumerID string `json:"consumerId"`
+	}{consumerID}
+	return c.post(ctx, "/consumer-groups/leave", url.Values{"group": {group}}, body, nil)
+}
+
+// Take a snapshot into the named subdirectory of the broker's snapshot directory.
+// Fails with status 404 if the broker has none, and 409 if the name is taken.
+func (c *Client) Snapshot(ctx context.Context, name string) (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := c.post(ctx, "/admin/snapshot", url.Values{"name": {name}}, nil, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(path, query), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, out)
+}
+
+func (c *Client) post(ctx context.Context, path string, query url.Values, body interface{}, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(path, query), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, out)
+}
+
+func (c *Client) url(path string, query url.Values) string {
+	if len(query) == 0 {
+		return c.baseURL + path
+	}
+	return c.baseURL + path + "?" + query.Encode()
+}
+
+// Send a request and decode a JSON response into out (if non-nil).
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	// 207 Multi-Status answers a batch only partly stored, with per-event results
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultiStatus {
+		return &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+
+	if out == nil {
+		return nil
+	}
+	if raw, ok := out.(*rawResponse); ok {
+		raw.header, raw.body = resp.Header, body
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
+
+// A response body that is not JSON, with its headers.
+type rawResponse struct {
+	header http.Header
+	body   []byte
+}
+
+// Decode a raw fetch: records in the log format
+// [offset(8)][timestamp(8)][attributes(1)][keyLength(3)][key][payloadLength(4)][payload],
+// numbered from X-Deps-First-Offset, keeping those from offset on. Records with a
+// codec in their attributes are compressed batches: [count(4)][compressed records].
+// Uncompressed payloads share the response buffer.
+func decodeRecords(raw rawResponse, offset int64) ([]Message, error) {
+	first, err := strconv.ParseInt(raw.header.Get("X-Deps-First-Offset"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw fetch response: missing first offset")
+	}
+
+	messages, err := appendRecords(make([]Message, 0), raw.body, first)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw fetch response: %w", err)
+	}
+	// A compressed batch may start before the requested offset
+	if skip := offset - first; skip > 0 {
+		messages = messages[min(int(skip), len(messages)):]
+	}
+	return messages, nil
+}
+
+// Decode the records in data, numbering them from offset.
+func appendRecords(messages []Message, data []byte, offset int64) ([]Message, error) {
+	for len(data) > 0 {
+		if len(data) < 24 {
+			return nil, errors.New("truncated record")
+		}
+		field := binary.BigEndian.Uint32(data[16:20])
+		attributes, keyLength := byte(field>>24), int(field&(1<<24-1))
+		if attributes&attributeEncrypted != 0 {
+			return nil, errors.New("record is encrypted")
+		}
+		codec := attributes & attributeCodecMask
+		if len(data) < 24+keyLength {
+			return nil, errors.New("truncated record")
+		}
+		payloadLength := int(binary.BigEndian.Uint32(data[20+keyLength : 24+keyLength]))
+		size := 24 + keyLength + payloadLength
+		if len(data) < size {
+			return nil, errors.New("truncated record")
+		}
+		record, payload := data[:size], data[24+keyLength:size]
+		data = data[size:]
+
+		if codec != 0 {
+			if len(payload) < 4 {
+				return nil, errors.New("truncated batch")
+			}
+			records, err := decompress(codec, payload[4:])
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress batch: %w", err)
+			}
+			count := len(messages)
+			if messages, err = appendRecords(messages, records, offset); err != nil {
+				return nil, err
+			}
+			if len(messages)-count != int(binary.BigEndian.Uint32(payload[0:4])) {
+				return nil, errors.New("batch record count mismatch")
+			}
+			offset += int64(len(messages) - count)
+			continue
+		}
+
+		messages = append(messages, Message{
+			Offset:    offset,
+			Timestamp: int64(binary.BigEndian.Uint64(record[8:16])),
+			Key:       string(record[20 : 20+keyLength]),
+			Payload:   payload,
+		})
+		offset++
+	}
+	return messages, nil
+}
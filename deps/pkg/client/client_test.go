@@ -0,0 +1,446 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"example.com/deps/pkg/client"
+	"example.com/deps/pkg/depstest"
+)
+
+func TestProducerBatchesAndCallbacks(t *testing.T) {
+	var requests atomic.Int64
+	cl := setupTestClient(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			next.ServeHTTP(w, r)
+		})
+	})
+	producer := cl.NewProducer(client.ProducerConfig{BatchSize: 10, Linger: 20 * time.Millisecond})
+
+	var mu sync.Mutex
+	offsets := make(map[string][]int64) // key → offsets in delivery order
+	var failures atomic.Int64
+
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("key-%d", i%3)
+		err := producer.Send(client.Record{Topic: "test-topic", Key: key, Payload: map[string]int{"n": i}},
+			func(result *client.PublishResult, err error) {
+				if err != nil {
+					failures.Add(1)
+					return
+				}
+				mu.Lock()
+				offsets[key] = append(offsets[key], result.Offset)
+				mu.Unlock()
+			})
+		if err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := producer.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if failures.Load() != 0 {
+		t.Fatalf("Expected no failures, got %d", failures.Load())
+	}
+
+	// Every record was delivered, and each key's records kept their order
+	total := 0
+	for key, delivered := range offsets {
+		total += len(delivered)
+		for i := 1; i < len(delivered); i++ {
+			if delivered[i] <= delivered[i-1] {
+				t.Errorf("Records for %s stored out of order: %v", key, delivered)
+			}
+		}
+	}
+	if total != 25 {
+		t.Errorf("Expected 25 deliveries, got %d", total)
+	}
+	// One request per batch: two full ones and the rest after Linger
+	if requests.Load() != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests.Load())
+	}
+
+	producer.Close()
+	if err := producer.Send(client.Record{Topic: "test-topic"}, nil); err != client.ErrProducerClosed {
+		t.Errorf("Expected ErrProducerClosed, got %v", err)
+	}
+}
+
+func TestProducerRetries(t *testing.T) {
+	// Fail the first two publishes with a server error
+	var attempts atomic.Int64
+	cl := setupTestClient(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/topics/events/batch" && attempts.Add(1) <= 2 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	producer := cl.NewProducer(client.ProducerConfig{RetryBackoff: time.Millisecond})
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := producer.Publish(ctx, client.Record{Topic: "test-topic", Key: "k", Payload: map[string]string{"a": "b"}})
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if attempts.Load() != 3 || result.Offset != 0 {
+		t.Errorf("Expected success on the third attempt, got %d attempts and %+v", attempts.Load(), result)
+	}
+
+	// Client errors are not retried
+	before := attempts.Load()
+	_, err = producer.Publish(ctx, client.Record{Topic: "missing", Payload: map[string]string{}})
+	if !client.IsStatus(err, http.StatusNotFound) {
+		t.Errorf("Expected 404, got %v", err)
+	}
+	if attempts.Load() != before+1 {
+		t.Errorf("Expected one attempt for a rejected publish, got %d", attempts.Load()-before)
+	}
+}
+
+func TestProducerRetriesOnlyFailedRecords(t *testing.T) {
+	// The first batch is only partly stored, as when one partition's disk is full
+	var requests atomic.Int64
+	cl := setupTestClient(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/topics/events/batch" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if requests.Add(1) == 1 {
+				storeEvenEvents(t, next, w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	ctx := context.Background()
+
+	var events []client.BatchEvent
+	for i := 0; i < 12; i++ {
+		events = append(events, client.BatchEvent{Key: fmt.Sprintf("key-%d", i), Payload: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i))})
+	}
+	results, err := cl.PublishBatch(ctx, "test-topic", events, "")
+	var partial *client.PartialBatchError
+	if !errors.As(err, &partial) || len(partial.Failed) != 6 {
+		t.Fatalf("Expected half the events to fail, got %v", err)
+	}
+	for i := range events {
+		failure, failed := partial.Failed[i]
+		switch {
+		case failed != (i%2 == 1):
+			t.Errorf("Event %d: unexpected failure %v", i, failure)
+		case failed && failure.StatusCode != http.StatusInsufficientStorage:
+			t.Errorf("Event %d: expected status 507, got %d", i, failure.StatusCode)
+		case !failed && results[i].Offset < 0:
+			t.Errorf("Event %d: expected an offset, got %+v", i, results[i])
+		}
+	}
+
+	// The producer sends only the failed records again, storing none twice
+	requests.Store(0)
+	producer := cl.NewProducer(client.ProducerConfig{BatchSize: len(events), Linger: time.Hour, RetryBackoff: time.Millisecond})
+	defer producer.Close()
+	var failures atomic.Int64
+	for _, event := range events {
+		producer.Send(client.Record{Topic: "test-topic", Key: event.Key, Payload: event.Payload}, func(_ *client.PublishResult, err error) {
+			if err != nil {
+				failures.Add(1)
+			}
+		})
+	}
+	flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := producer.Flush(flushCtx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if failures.Load() != 0 || requests.Load() != 2 {
+		t.Errorf("Expected every record delivered in two requests, got %d failures in %d", failures.Load(), requests.Load())
+	}
+
+	stored := make(map[string]int)
+	for partition := 0; partition < 3; partition++ {
+		fetched, err := cl.Fetch(ctx, "test-topic", partition, 0, client.FetchOptions{})
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		for _, m := range fetched.Messages {
+			stored[string(m.Payload)]++
+		}
+	}
+	for i := range events {
+		// The even events were stored by the direct publish and again by the producer
+		want := 1
+		if i%2 == 0 {
+			want = 2
+		}
+		if n := stored[string(events[i].Payload.(json.RawMessage))]; n != want {
+			t.Errorf("Event %d stored %d times, expected %d", i, n, want)
+		}
+	}
+}
+
+// Pass only the even-numbered events of a batch on to the broker and answer 207,
+// with the odd-numbered ones failed as on a full disk.
+func storeEvenEvents(t *testing.T, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	var events []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		t.Errorf("Failed to decode batch: %v", err)
+		return
+	}
+	var even []json.RawMessage
+	for i := 0; i < len(events); i += 2 {
+		even = append(even, events[i])
+	}
+	body, _ := json.Marshal(even)
+	r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+
+	stored := httptest.NewRecorder()
+	next.ServeHTTP(stored, r)
+	var response struct {
+		Results []json.RawMessage `json:"results"`
+	}
+	if err := json.Unmarshal(stored.Body.Bytes(), &response); err != nil || len(response.Results) != len(even) {
+		t.Errorf("Unexpected response to the even events: %s", stored.Body)
+		return
+	}
+
+	results := make([]interface{}, len(events))
+	for i := range events {
+		if i%2 == 0 {
+			results[i] = response.Results[i/2]
+		} else {
+			results[i] = map[string]interface{}{"partition": 0, "offset": -1, "status": http.StatusInsufficientStorage, "error": "no space left on device"}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultiStatus)
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+func TestConsumerAssignSeekCommit(t *testing.T) {
+	cl := setupTestClient(t, nil)
+	ctx := context.Background()
+
+	// One key, so every event lands in the same partition
+	var tp client.TopicPartition
+	for i := 0; i < 5; i++ {
+		result, err := cl.Publish(ctx, "test-topic", "k", map[string]int{"n": i})
+		if err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+		tp = client.TopicPartition{Topic: "test-topic", Partition: result.Partition}
+	}
+
+	consumer := cl.NewConsumer(client.ConsumerConfig{Group: "g", MaxWait: 100 * time.Millisecond})
+	defer consumer.Close()
+
+	if err := consumer.Assign(tp); err != nil {
+		t.Fatalf("Assign failed: %v", err)
+	}
+	if err := consumer.Subscribe("test-topic"); err == nil {
+		t.Errorf("Expected Subscribe to fail after Assign")
+	}
+
+	messages, err := consumer.Poll(ctx)
+	if err != nil || len(messages) != 5 {
+		t.Fatalf("Expected 5 messages, got %d (%v)", len(messages), err)
+	}
+	if m := messages[4]; m.Topic != "test-topic" || m.Partition != tp.Partition || m.Offset != 4 || string(m.Payload) != `{"n":4}` {
+		t.Errorf("Unexpected message %+v", m)
+	}
+	if offset, _ := consumer.Position(tp); offset != 5 {
+		t.Errorf("Expected position 5, got %d", offset)
+	}
+
+	if err := consumer.Commit(ctx); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if offset, ok, err := cl.CommittedOffset(ctx, "g", "test-topic", tp.Partition); err != nil || !ok || offset != 5 {
+		t.Errorf("Expected committed offset 5, got %d %v (%v)", offset, ok, err)
+	}
+
+	// Seek back and re-read
+	consumer.Seek(tp, 3)
+	messages, err = consumer.Poll(ctx)
+	if err != nil || len(messages) != 2 || messages[0].Offset != 3 {
+		t.Errorf("Expected offsets 3-4 after seek, got %+v (%v)", messages, err)
+	}
+
+	// Nothing new: the poll waits MaxWait and returns empty
+	messages, err = consumer.Poll(ctx)
+	if err != nil || len(messages) != 0 {
+		t.Errorf("Expected an empty poll, got %+v (%v)", messages, err)
+	}
+
+	// A new consumer in the same group resumes from the committed offset
+	resumed := cl.NewConsumer(client.ConsumerConfig{Group: "g", MaxWait: 100 * time.Millisecond})
+	defer resumed.Close()
+	resumed.Assign(tp)
+	if _, err := cl.Publish(ctx, "test-topic", "k", map[string]int{"n": 5}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	messages, err = resumed.Poll(ctx)
+	if err != nil || len(messages) != 1 || messages[0].Offset != 5 {
+		t.Errorf("Expected to resume at offset 5, got %+v (%v)", messages, err)
+	}
+}
+
+func TestFetchRaw(t *testing.T) {
+	cl := setupTestClient(t, nil)
+	ctx := context.Background()
+
+	var partition int
+	for i := 0; i < 3; i++ {
+		result, err := cl.Publish(ctx, "test-topic", "k", map[string]int{"n": i})
+		if err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+		partition = result.Partition
+	}
+
+	// Raw and JSON fetches decode to the same messages
+	viaJSON, err := cl.Fetch(ctx, "test-topic", partition, 1, client.FetchOptions{})
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	raw, err := cl.Fetch(ctx, "test-topic", partition, 1, client.FetchOptions{Raw: true})
+	if err != nil {
+		t.Fatalf("Raw fetch failed: %v", err)
+	}
+	if len(raw.Messages) != 2 || len(viaJSON.Messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d raw and %d JSON", len(raw.Messages), len(viaJSON.Messages))
+	}
+	for i, m := range raw.Messages {
+		j := viaJSON.Messages[i]
+		if m.Topic != j.Topic || m.Partition != j.Partition || m.Offset != j.Offset || m.Timestamp != j.Timestamp || m.Key != j.Key || string(m.Payload) != string(j.Payload) {
+			t.Errorf("Raw message %+v differs from JSON %+v", m, j)
+		}
+	}
+}
+
+func TestOffsetsForTime(t *testing.T) {
+	cl := setupTestClient(t, nil)
+	ctx := context.Background()
+
+	before := time.Now()
+	result, err := cl.Publish(ctx, "test-topic", "k", map[string]int{"n": 0})
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	offsets, err := cl.OffsetsForTime(ctx, "test-topic", before)
+	if err != nil || len(offsets) != 3 {
+		t.Fatalf("Expected offsets of 3 partitions, got %+v (%v)", offsets, err)
+	}
+	for _, offset := range offsets {
+		if offset.Partition == result.Partition {
+			if offset.Offset != 0 || offset.Timestamp == nil || offset.Timestamp.Before(before) {
+				t.Errorf("Expected the published event at offset 0, got %+v", offset)
+			}
+		} else if offset.Offset != 0 || offset.Timestamp != nil {
+			t.Errorf("Expected an empty partition to start at 0, got %+v", offset)
+		}
+	}
+
+	// After the last event every partition starts at its end
+	offsets, err = cl.OffsetsForTime(ctx, "test-topic", time.Now().Add(time.Hour))
+	if err != nil || offsets[result.Partition].Offset != 1 || offsets[result.Partition].Timestamp != nil {
+		t.Errorf("Expected partition %d to start at its end, got %+v (%v)", result.Partition, offsets, err)
+	}
+}
+
+func TestConsumerGroupRebalance(t *testing.T) {
+	cl := setupTestClient(t, nil)
+	ctx := context.Background()
+
+	config := client.ConsumerConfig{Group: "workers", MaxWait: 50 * time.Millisecond, HeartbeatInterval: 20 * time.Millisecond}
+	first := cl.NewConsumer(config)
+	defer first.Close()
+	first.Subscribe("test-topic")
+
+	if _, err := first.Poll(ctx); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if len(first.Assignment()) != 3 {
+		t.Fatalf("Expected all 3 partitions, got %v", first.Assignment())
+	}
+
+	second := cl.NewConsumer(config)
+	second.Subscribe("test-topic")
+	if _, err := second.Poll(ctx); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+
+	// The first consumer picks up the new generation from its heartbeats
+	deadline := time.Now().Add(2 * time.Second)
+	for first.Generation() != second.Generation() && time.Now().Before(deadline) {
+		first.Poll(ctx)
+	}
+	if first.Generation() != second.Generation() {
+		t.Fatalf("First consumer stuck on generation %d, group is at %d", first.Generation(), second.Generation())
+	}
+
+	owned := make(map[client.TopicPartition]bool)
+	for _, tp := range append(first.Assignment(), second.Assignment()...) {
+		if owned[tp] {
+			t.Errorf("Partition %s assigned twice", tp)
+		}
+		owned[tp] = true
+	}
+	if len(owned) != 3 || len(first.Assignment()) == 0 || len(second.Assignment()) == 0 {
+		t.Errorf("Expected the partitions split between both consumers, got %v and %v", first.Assignment(), second.Assignment())
+	}
+
+	// Once the second consumer leaves, the first gets everything back
+	second.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for len(first.Assignment()) != 3 && time.Now().Before(deadline) {
+		first.Poll(ctx)
+	}
+	if len(first.Assignment()) != 3 {
+		t.Errorf("Expected all 3 partitions after leave, got %v", first.Assignment())
+	}
+}
+
+// setupTestClient starts an in-memory broker with a three-partition test-topic and
+// returns a client for it, talking to it through a middleware if one is given.
+func setupTestClient(t *testing.T, middleware func(http.Handler) http.Handler) *client.Client {
+	t.Helper()
+
+	b := depstest.StartInMemory(t, depstest.Topic{Name: "test-topic", Partitions: 3})
+	if middleware == nil {
+		return b.Client()
+	}
+
+	target, err := url.Parse(b.URL)
+	if err != nil {
+		t.Fatalf("Invalid broker URL: %v", err)
+	}
+	server := httptest.NewServer(middleware(httputil.NewSingleHostReverseProxy(target)))
+	t.Cleanup(server.Close)
+	return client.New(server.URL)
+}
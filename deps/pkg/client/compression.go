@@ -0,0 +1,73 @@
+package client
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Codec values in the attributes of stored records, and the flag the broker sets
+// on records it encrypted (which it decrypts before sending).
+const (
+	codecGzip  = 1
+	codecZlib  = 2
+	codecFlate = 3
+
+	attributeCodecMask = 0x07
+	attributeEncrypted = 0x08
+)
+
+// Content-Encoding for each compression name a batch can be published with.
+var contentEncodings = map[string]string{
+	"gzip":  "gzip",
+	"zlib":  "deflate",
+	"flate": "flate",
+}
+
+// Compress a request body with the named codec: gzip, zlib or flate.
+func compressBody(compression string, data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case "gzip":
+		w = gzip.NewWriter(&buffer)
+	case "zlib":
+		w = zlib.NewWriter(&buffer)
+	case "flate":
+		w, _ = flate.NewWriter(&buffer, flate.DefaultCompression)
+	default:
+		return nil, fmt.Errorf("unknown compression %q (use gzip, zlib or flate)", compression)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Decompress the records of a stored batch.
+func decompress(codec byte, data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch codec {
+	case codecGzip:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case codecZlib:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	case codecFlate:
+		r = flate.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
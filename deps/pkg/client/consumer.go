@@ -0,0 +1,493 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrConsumerClosed = errors.New("consumer closed")
+
+// Consumer defaults.
+const (
+	defaultMaxBytes          = 1048576
+	defaultMaxWait           = 5 * time.Second
+	defaultHeartbeatInterval = 1 * time.Second
+)
+
+type ConsumerConfig struct {
+	// Consumer group whose offsets are committed and, with Subscribe, which assigns partitions.
+	Group string
+	// Member ID within the group. Default: hostname, process ID and a random number.
+	ConsumerID string
+	// Bytes fetched per partition per poll. Default 1MB.
+	MaxBytes int
+	// How long the broker may hold a fetch waiting for messages. Default 5s.
+	MaxWait time.Duration
+	// Where to start a partition with no committed offset: "earliest" (default) or "latest".
+	AutoOffsetReset string
+	// Interval between group heartbeats. Default 1s.
+	HeartbeatInterval time.Duration
+	// Called from Poll whenever the group assigns partitions, including after a rebalance.
+	OnAssign func(generation int, partitions []TopicPartition)
+}
+
+// Poll messages from a set of partitions and commit progress for a group.
+//
+// Partitions are either assigned by hand with Assign, or by the group coordinator
+// after Subscribe. Group members heartbeat in the background; when the group
+// rebalances, the next Poll commits the position of every partition it held and
+// switches to the new assignment. A partition with no committed offset starts
+// according to AutoOffsetReset.
+//
+// Not safe for concurrent use, except that Close may be called from any goroutine.
+type Consumer struct {
+	client *Client
+	config ConsumerConfig
+
+	// Positions: the next offset to fetch from each assigned partition. A partition
+	// missing from positions starts from its committed offset on the next Poll.
+	assigned  []TopicPartition
+	positions map[TopicPartition]int64
+	committed map[TopicPartition]int64
+
+	// Subscription set by Subscribe or SubscribePattern
+	topics  []string
+	pattern *regexp.Regexp
+
+	mu             sync.Mutex
+	member         bool             // joined the group and heartbeating
+	generation     int              // generation of the current assignment
+	next           *GroupAssignment // newer assignment reported by a heartbeat
+	rejoin         bool             // membership lost; join again
+	stopHeartbeats context.CancelFunc
+	heartbeatsDone chan struct{}
+	closed         bool
+}
+
+// New consumer reading through this client.
+func (c *Client) NewConsumer(config ConsumerConfig) *Consumer {
+	if config.ConsumerID == "" {
+		hostname, _ := os.Hostname()
+		config.ConsumerID = fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), rand.Int63())
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultMaxBytes
+	}
+	if config.MaxWait <= 0 {
+		config.MaxWait = defaultMaxWait
+	}
+	if config.AutoOffsetReset == "" {
+		config.AutoOffsetReset = "earliest"
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+
+	return &Consumer{
+		client:    c,
+		config:    config,
+		positions: make(map[TopicPartition]int64),
+		committed: make(map[TopicPartition]int64),
+	}
+}
+
+// Consume the given topics as a member of the group. The group is joined on the next Poll.
+func (c *Consumer) Subscribe(topics ...string) error {
+	if len(topics) == 0 {
+		return errors.New("no topics to subscribe to")
+	}
+	return c.subscribe(topics, nil)
+}
+
+// Consume every topic matching pattern as a member of the group. The pattern is
+// matched against the broker's topics each time the consumer (re)joins.
+func (c *Consumer) SubscribePattern(pattern *regexp.Regexp) error {
+	return c.subscribe(nil, pattern)
+}
+
+func (c *Consumer) subscribe(topics []string, pattern *regexp.Regexp) error {
+	if c.config.Group == "" {
+		return errors.New("subscribing requires a consumer group")
+	}
+	if len(c.assigned) > 0 && c.topics == nil && c.pattern == nil {
+		return errors.New("partitions were assigned manually")
+	}
+
+	c.topics, c.pattern = topics, pattern
+	c.mu.Lock()
+	c.rejoin = true
+	c.mu.Unlock()
+	return nil
+}
+
+// Consume exactly these partitions, outside of group management.
+func (c *Consumer) Assign(partitions ...TopicPartition) error {
+	if c.topics != nil || c.pattern != nil {
+		return errors.New("consumer is subscribed to a group")
+	}
+	c.setAssignment(partitions)
+	return nil
+}
+
+// The partitions currently assigned, sorted by topic and partition.
+func (c *Consumer) Assignment() []TopicPartition {
+	return append([]TopicPartition(nil), c.assigned...)
+}
+
+// Generation of the group assignment being consumed, or 0 outside of a group.
+func (c *Consumer) Generation() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Set the next offset Poll fetches from an assigned partition.
+func (c *Consumer) Seek(tp TopicPartition, offset int64) error {
+	if !c.isAssigned(tp) {
+		return fmt.Errorf("partition %s is not assigned", tp)
+	}
+	if offset < 0 {
+		return fmt.Errorf("invalid offset %d", offset)
+	}
+	c.positions[tp] = offset
+	return nil
+}
+
+// The next offset Poll fetches from a partition. ok is false until the position
+// has been resolved by the first Poll or set by Seek.
+func (c *Consumer) Position(tp TopicPartition) (offset int64, ok bool) {
+	offset, ok = c.positions[tp]
+	return offset, ok
+}
+
+// Fetch the next messages from the assigned partitions, waiting up to MaxWait for
+// any to arrive. Partitions are fetched concurrently; the poll returns as soon as
+// one has messages. Positions advance past the returned messages.
+func (c *Consumer) Poll(ctx context.Context) ([]Message, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, ErrConsumerClosed
+	}
+
+	if err := c.updateMembership(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.resolvePositions(ctx); err != nil {
+		return nil, err
+	}
+
+	if len(c.assigned) == 0 {
+		// Nothing to read; a group member keeps heartbeating meanwhile
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.config.MaxWait):
+			return nil, nil
+		}
+	}
+
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type fetched struct {
+		tp     TopicPartition
+		result *FetchResult
+		err    error
+	}
+	results := make(chan fetched, len(c.assigned))
+	opts := FetchOptions{MaxBytes: c.config.MaxBytes, MinBytes: 1, MaxWait: c.config.MaxWait}
+	for _, tp := range c.assigned {
+		go func(tp TopicPartition, offset int64) {
+			result, err := c.client.Fetch(fetchCtx, tp.Topic, tp.Partition, offset, opts)
+			results <- fetched{tp, result, err}
+		}(tp, c.positions[tp])
+	}
+
+	// Stop the other long polls once any partition has messages
+	var messages []Message
+	var firstErr error
+	for range c.assigned {
+		f := <-results
+		if f.err != nil {
+			if fetchCtx.Err() == nil && firstErr == nil {
+				firstErr = fmt.Errorf("failed to fetch %s: %w", f.tp, f.err)
+			}
+			continue
+		}
+		if len(f.result.Messages) == 0 {
+			continue
+		}
+		messages = append(messages, f.result.Messages...)
+		c.positions[f.tp] = f.result.Messages[len(f.result.Messages)-1].Offset + 1
+		cancel()
+	}
+
+	if len(messages) > 0 {
+		return messages, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, firstErr
+}
+
+// Commit the position of every assigned partition that moved since its last commit.
+func (c *Consumer) Commit(ctx context.Context) error {
+	if c.config.Group == "" {
+		return errors.New("committing requires a consumer group")
+	}
+
+	for _, tp := range c.assigned {
+		offset, ok := c.positions[tp]
+		if !ok {
+			continue
+		}
+		if committed, ok := c.committed[tp]; ok && committed == offset {
+			continue
+		}
+		if err := c.CommitOffset(ctx, tp, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit the next offset to read from a partition.
+func (c *Consumer) CommitOffset(ctx context.Context, tp TopicPartition, offset int64) error {
+	if err := c.client.CommitOffset(ctx, c.config.Group, tp.Topic, tp.Partition, offset); err != nil {
+		return fmt.Errorf("failed to commit %s: %w", tp, err)
+	}
+	c.committed[tp] = offset
+	return nil
+}
+
+// Stop heartbeating and leave the group. Positions are not committed; call Commit first.
+func (c *Consumer) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	member := c.member
+	c.member = false
+	stop, done := c.stopHeartbeats, c.heartbeatsDone
+	c.mu.Unlock()
+
+	if !member {
+		return nil
+	}
+	stop()
+	<-done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return c.client.LeaveGroup(ctx, c.config.Group, c.config.ConsumerID)
+}
+
+// Join the group if needed, or switch to the assignment of a newer generation.
+// The partitions held until now are committed before they are given up.
+func (c *Consumer) updateMembership(ctx context.Context) error {
+	c.mu.Lock()
+	rejoin, next := c.rejoin, c.next
+	c.rejoin, c.next = false, nil
+	c.mu.Unlock()
+
+	if !rejoin && next == nil {
+		return nil
+	}
+
+	// Every partition is revoked on a rebalance
+	var commitErr error
+	if len(c.assigned) > 0 {
+		commitErr = c.Commit(ctx)
+	}
+
+	if rejoin {
+		topics := c.topics
+		if c.pattern != nil {
+			var err error
+			if topics, err = c.matchTopics(ctx); err != nil {
+				c.requestRejoin()
+				return err
+			}
+		}
+
+		assignment, err := c.client.JoinGroup(ctx, c.config.Group, c.config.ConsumerID, topics)
+		if err != nil {
+			c.requestRejoin()
+			return fmt.Errorf("failed to join group %q: %w", c.config.Group, err)
+		}
+		next = assignment
+		c.startHeartbeats()
+	}
+
+	var partitions []TopicPartition
+	for topic, ids := range next.Partitions {
+		for _, id := range ids {
+			partitions = append(partitions, TopicPartition{topic, id})
+		}
+	}
+	c.setAssignment(partitions)
+
+	c.mu.Lock()
+	c.generation = next.Generation
+	if c.next != nil && c.next.Generation == c.generation {
+		c.next = nil // a heartbeat already reported this assignment
+	}
+	c.mu.Unlock()
+
+	if c.config.OnAssign != nil {
+		c.config.OnAssign(next.Generation, c.Assignment())
+	}
+
+	if commitErr != nil {
+		return fmt.Errorf("rebalanced without committing revoked partitions: %w", commitErr)
+	}
+	return nil
+}
+
+func (c *Consumer) requestRejoin() {
+	c.mu.Lock()
+	c.rejoin = true
+	c.mu.Unlock()
+}
+
+// Replace the assignment, keeping the positions of partitions still assigned.
+func (c *Consumer) setAssignment(partitions []TopicPartition) {
+	sorted := append([]TopicPartition(nil), partitions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Topic != sorted[j].Topic {
+			return sorted[i].Topic < sorted[j].Topic
+		}
+		return sorted[i].Partition < sorted[j].Partition
+	})
+	c.assigned = sorted
+
+	// Positions of revoked partitions are stale once another member has read them
+	positions := make(map[TopicPartition]int64)
+	if c.topics == nil && c.pattern == nil {
+		for _, tp := range sorted {
+			if offset, ok := c.positions[tp]; ok {
+				positions[tp] = offset
+			}
+		}
+	}
+	c.positions = positions
+	c.committed = make(map[TopicPartition]int64)
+}
+
+func (c *Consumer) isAssigned(tp TopicPartition) bool {
+	for _, assigned := range c.assigned {
+		if assigned == tp {
+			return true
+		}
+	}
+	return false
+}
+
+// Start each partition without a position from its committed offset, or the reset policy.
+func (c *Consumer) resolvePositions(ctx context.Context) error {
+	for _, tp := range c.assigned {
+		if _, ok := c.positions[tp]; ok {
+			continue
+		}
+
+		if c.config.Group != "" {
+			offset, ok, err := c.client.CommittedOffset(ctx, c.config.Group, tp.Topic, tp.Partition)
+			if err != nil {
+				return fmt.Errorf("failed to fetch committed offset for %s: %w", tp, err)
+			}
+			if ok {
+				c.positions[tp] = offset
+				c.committed[tp] = offset
+				continue
+			}
+		}
+
+		offsets, err := c.client.PartitionOffsets(ctx, tp.Topic, tp.Partition)
+		if err != nil {
+			return fmt.Errorf("failed to fetch offsets for %s: %w", tp, err)
+		}
+		if c.config.AutoOffsetReset == "latest" {
+			c.positions[tp] = offsets.EndOffset
+		} else {
+			c.positions[tp] = offsets.StartOffset
+		}
+	}
+	return nil
+}
+
+// The broker's topics that match the subscription pattern, sorted by name.
+func (c *Consumer) matchTopics(ctx context.Context) ([]string, error) {
+	metadata, err := c.client.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []string
+	for _, t := range metadata.Topics {
+		if c.pattern.MatchString(t.Name) {
+			topics = append(topics, t.Name)
+		}
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("no topics matching %s", c.pattern)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// Heartbeat in the background until Close, once the consumer has joined.
+func (c *Consumer) startHeartbeats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.member {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.member = true
+	c.stopHeartbeats = cancel
+	c.heartbeatsDone = make(chan struct{})
+	go c.heartbeatLoop(ctx, c.heartbeatsDone)
+}
+
+// Report a newer generation's assignment, or lost membership, to the next Poll.
+func (c *Consumer) heartbeatLoop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(c.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		assignment, err := c.client.Heartbeat(ctx, c.config.Group, c.config.ConsumerID)
+
+		c.mu.Lock()
+		switch {
+		case IsStatus(err, http.StatusConflict):
+			c.rejoin = true
+		case err != nil:
+			// Transient; the session survives a few missed heartbeats
+		case assignment.Generation != c.generation:
+			c.next = assignment
+		}
+		c.mu.Unlock()
+	}
+}
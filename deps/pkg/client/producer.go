@@ -0,0 +1,375 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrProducerClosed = errors.New("producer closed")
+
+// Producer defaults.
+const (
+	defaultBatchSize       = 100
+	defaultLinger          = 5 * time.Millisecond
+	defaultRetries         = 3
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultBufferedRecords = 10000
+)
+
+type ProducerConfig struct {
+	// Records per batch. A full batch is sent at once. Default 100.
+	BatchSize int
+	// How long a partial batch waits for more records before it is sent. Default 5ms.
+	Linger time.Duration
+	// Attempts after the first for a publish that failed with a network error or
+	// a 5xx/429 status. Default 3; negative disables retries. A retried publish
+	// may be stored twice if the first attempt reached the broker.
+	Retries int
+	// Delay before the first retry, doubled for each further one. Default 100ms.
+	RetryBackoff time.Duration
+	// Records sent but not yet delivered before Send blocks. Default 10000.
+	BufferedRecords int
+	// Compress each batch's request with gzip, zlib or flate. Default none.
+	Compression string
+}
+
+// A record to publish.
+type Record struct {
+	Topic string
+	Key   string
+	// Marshalled to a JSON object when the record is sent; a json.RawMessage is used as-is.
+	Payload interface{}
+}
+
+// Called once a record is stored, or has failed for good. Callbacks run on the
+// producer's goroutines and should return quickly.
+type DeliveryCallback func(result *PublishResult, err error)
+
+// Publish records asynchronously in batches.
+//
+// Records are collected into a batch until it holds BatchSize records or Linger
+// has passed. Batches are sent one after another, as one request per topic to the
+// batch endpoint, concurrently across topics; records with the same topic and key
+// keep the order they were sent in. Safe for concurrent use.
+type Producer struct {
+	client *Client
+	config ProducerConfig
+
+	mu     sync.Mutex
+	batch  []*pendingRecord
+	timer  *time.Timer // sends a partial batch once Linger passes
+	closed bool
+
+	queue [][]*pendingRecord // full batches waiting for the sender
+	wake  chan struct{}      // signals the sender that the queue or closed changed
+	slots chan struct{}      // one per record not yet delivered
+	done  chan struct{}      // closed when the sender exits
+
+	pending int             // records sent but not yet delivered or failed
+	idle    []chan struct{} // closed when pending drops to zero
+}
+
+type pendingRecord struct {
+	topic    string
+	key      string
+	payload  json.RawMessage
+	callback DeliveryCallback
+}
+
+// New producer publishing through this client. Close it to deliver any buffered records.
+func (c *Client) NewProducer(config ProducerConfig) *Producer {
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.Linger <= 0 {
+		config.Linger = defaultLinger
+	}
+	if config.Retries == 0 {
+		config.Retries = defaultRetries
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+	if config.BufferedRecords <= 0 {
+		config.BufferedRecords = defaultBufferedRecords
+	}
+
+	p := &Producer{
+		client: c,
+		config: config,
+		wake:   make(chan struct{}, 1),
+		slots:  make(chan struct{}, config.BufferedRecords),
+		done:   make(chan struct{}),
+	}
+	go p.sender()
+	return p
+}
+
+// Queue a record for publishing. The callback (if non-nil) reports the outcome.
+// Blocks while BufferedRecords records are waiting to be delivered.
+func (p *Producer) Send(record Record, callback DeliveryCallback) error {
+	if record.Topic == "" {
+		return errors.New("record has no topic")
+	}
+	payload, err := json.Marshal(record.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	p.slots <- struct{}{}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		<-p.slots
+		return ErrProducerClosed
+	}
+
+	p.pending++
+	p.batch = append(p.batch, &pendingRecord{
+		topic:    record.Topic,
+		key:      record.Key,
+		payload:  payload,
+		callback: callback,
+	})
+
+	if len(p.batch) >= p.config.BatchSize {
+		p.flushLocked()
+	} else if p.timer == nil {
+		p.timer = time.AfterFunc(p.config.Linger, p.lingerExpired)
+	}
+	return nil
+}
+
+// Send a record and wait for it to be stored.
+func (p *Producer) Publish(ctx context.Context, record Record) (*PublishResult, error) {
+	type outcome struct {
+		result *PublishResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+
+	err := p.Send(record, func(result *PublishResult, err error) {
+		done <- outcome{result, err}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.flushLocked()
+	p.mu.Unlock()
+
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Send any partial batch and wait until no records are left undelivered.
+func (p *Producer) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	p.flushLocked()
+	if p.pending == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	p.idle = append(p.idle, idle)
+	p.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Deliver buffered records and stop the producer. Send fails afterwards.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.flushLocked()
+	p.signal()
+	p.mu.Unlock()
+
+	<-p.done
+	return nil
+}
+
+func (p *Producer) lingerExpired() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flushLocked()
+}
+
+// Hand the current batch to the sender. Caller holds p.mu.
+func (p *Producer) flushLocked() {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if len(p.batch) == 0 {
+		return
+	}
+	p.queue = append(p.queue, p.batch)
+	p.batch = nil
+	p.signal()
+}
+
+func (p *Producer) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Send queued batches in order until the producer is closed and the queue is empty.
+func (p *Producer) sender() {
+	defer close(p.done)
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return
+			}
+			<-p.wake
+			continue
+		}
+		batch := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		p.sendBatch(batch)
+	}
+}
+
+// Publish a batch as one request per topic, concurrently across topics. The broker
+// keeps each partition's records in request order.
+func (p *Producer) sendBatch(batch []*pendingRecord) {
+	var order []string
+	topics := make(map[string][]*pendingRecord)
+	for _, r := range batch {
+		if _, ok := topics[r.topic]; !ok {
+			order = append(order, r.topic)
+		}
+		topics[r.topic] = append(topics[r.topic], r)
+	}
+
+	var wg sync.WaitGroup
+	for _, topic := range order {
+		wg.Add(1)
+		go func(records []*pendingRecord) {
+			defer wg.Done()
+			results, errs := p.publishBatch(records)
+			for i, r := range records {
+				<-p.slots
+				if r.callback != nil {
+					r.callback(results[i], errs[i])
+				}
+				p.delivered()
+			}
+		}(topics[topic])
+	}
+	wg.Wait()
+}
+
+// Count a record as delivered, waking Flush once none are left.
+func (p *Producer) delivered() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending--
+	if p.pending == 0 {
+		for _, idle := range p.idle {
+			close(idle)
+		}
+		p.idle = nil
+	}
+}
+
+// Publish records for one topic in one request, retrying transient
+// failures with exponential backoff. When the broker stores only some of them,
+// only the others are sent again, so none is stored twice. Returns each record's
+// result or error.
+func (p *Producer) publishBatch(records []*pendingRecord) ([]*PublishResult, []error) {
+	results := make([]*PublishResult, len(records))
+	errs := make([]error, len(records))
+	if _, ok := contentEncodings[p.config.Compression]; !ok && p.config.Compression != "" {
+		for i := range errs {
+			errs[i] = fmt.Errorf("unknown compression %q (use gzip, zlib or flate)", p.config.Compression)
+		}
+		return results, errs
+	}
+
+	// Indexes of the records not stored yet
+	pending := make([]int, len(records))
+	for i := range pending {
+		pending[i] = i
+	}
+	backoff := p.config.RetryBackoff
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		events := make([]BatchEvent, len(pending))
+		for i, index := range pending {
+			events[i] = BatchEvent{Key: records[index].key, Payload: records[index].payload}
+		}
+
+		stored, err := p.client.PublishBatch(context.Background(), records[0].topic, events, p.config.Compression)
+		var partial *PartialBatchError
+		if (err == nil || errors.As(err, &partial)) && len(stored) != len(pending) {
+			for _, index := range pending {
+				errs[index] = fmt.Errorf("broker returned %d results for %d records", len(stored), len(pending))
+			}
+			break
+		}
+
+		var retry []int
+		for i, index := range pending {
+			failure := err
+			if partial != nil {
+				failure = nil
+				if apiErr, ok := partial.Failed[i]; ok {
+					failure = apiErr
+				}
+			}
+			if failure == nil {
+				results[index], errs[index] = &stored[i], nil
+				continue
+			}
+			errs[index] = failure
+			if attempt < p.config.Retries && retryable(failure) {
+				retry = append(retry, index)
+			}
+		}
+		pending = retry
+	}
+	return results, errs
+}
+
+// Network errors and server-side failures may succeed on retry; rejected requests won't.
+func retryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+// Package depstest runs a real broker inside a test process, so services can run
+// integration tests against DEPS with plain `go test`.
+//
+//	func TestOrders(t *testing.T) {
+//		b := depstest.Start(t, depstest.Topic{Name: "orders", Partitions: 3})
+//		svc := orders.NewService(b.Addr)
+//		...
+//	}
+//
+// Each broker listens on a free port with its own temporary data directory, and is
+// shut down and removed when the test finishes. StartInMemory starts one that
+// keeps everything in memory instead, for tests that don't need data on disk.
+package depstest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/deps/internal/broker"
+	"example.com/deps/pkg/client"
+)
+
+// A topic to create before the broker starts.
+type Topic struct {
+	Name       string
+	Partitions int
+}
+
+// A broker running in the test process.
+type Broker struct {
+	// Address of the HTTP API, as "127.0.0.1:port"
+	Addr string
+	// Base URL of the HTTP API, as "http://127.0.0.1:port"
+	URL string
+	// Data directory, removed once the test and its cleanups finish; empty for a
+	// broker started with StartInMemory
+	DataDir string
+
+	broker    *broker.Broker
+	served    chan error
+	closeOnce sync.Once
+}
+
+// Start a broker with the given topics. It is closed by t.Cleanup; the test fails
+// immediately if the broker can't start.
+func Start(t testing.TB, topics ...Topic) *Broker {
+	t.Helper()
+
+	// Registered first so it runs last, after the broker has closed its files
+	dataDir := t.TempDir()
+	return start(t, broker.NewBroker(0, dataDir), dataDir, topics)
+}
+
+// Start a broker with the given topics that writes nothing to disk: events,
+// metadata and committed offsets are kept in memory and gone once it closes.
+func StartInMemory(t testing.TB, topics ...Topic) *Broker {
+	t.Helper()
+
+	b := broker.NewBroker(0, "")
+	b.SetStorage(broker.StorageMemory)
+	return start(t, b, "", topics)
+}
+
+func start(t testing.TB, b *broker.Broker, dataDir string, topics []Topic) *Broker {
+	t.Helper()
+
+	for _, topic := range topics {
+		if err := b.AddTopic(topic.Name, topic.Partitions); err != nil {
+			t.Fatalf("depstest: failed to create topic %q: %v", topic.Name, err)
+		}
+	}
+	if err := b.Listen(); err != nil {
+		b.Close()
+		t.Fatalf("depstest: failed to start broker: %v", err)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", b.Addr().(*net.TCPAddr).Port)
+	tb := &Broker{
+		Addr:    addr,
+		URL:     "http://" + addr,
+		DataDir: dataDir,
+		broker:  b,
+		served:  make(chan error, 1),
+	}
+	go func() { tb.served <- b.Serve() }()
+
+	t.Cleanup(func() {
+		if err := tb.Close(); err != nil {
+			t.Errorf("depstest: failed to close broker: %v", err)
+		}
+	})
+	return tb
+}
+
+// Create another topic on the running broker.
+func (b *Broker) CreateTopic(name string, partitions int) error {
+	return b.broker.AddTopic(name, partitions)
+}
+
+// A client for the broker's HTTP API.
+func (b *Broker) Client() *client.Client {
+	return client.New(b.Addr)
+}
+
+// How long Close waits for in-flight requests before dropping connections.
+const shutdownTimeout = 5 * time.Second
+
+// Shut the broker down gracefully and close its files. Called automatically at the
+// end of the test; safe to call earlier, for example to test how a service handles
+// an outage.
+func (b *Broker) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err = b.broker.Shutdown(ctx)
+		if serveErr := <-b.served; err == nil {
+			err = serveErr
+		}
+	})
+	return err
+}
@@ -0,0 +1,89 @@
+package depstest_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"example.com/deps/pkg/client"
+	"example.com/deps/pkg/depstest"
+)
+
+func TestStartPublishFetch(t *testing.T) {
+	b := depstest.Start(t, depstest.Topic{Name: "orders", Partitions: 2})
+	ctx := context.Background()
+	cl := b.Client()
+
+	metadata, err := cl.Metadata(ctx)
+	if err != nil || len(metadata.Topics) != 1 || metadata.Topics[0].Partitions != 2 {
+		t.Fatalf("Unexpected metadata %+v (%v)", metadata, err)
+	}
+
+	result, err := cl.Publish(ctx, "orders", "user123", map[string]int{"amount": 100})
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	fetched, err := cl.Fetch(ctx, "orders", result.Partition, result.Offset, client.FetchOptions{})
+	if err != nil || len(fetched.Messages) != 1 || fetched.Messages[0].Key != "user123" {
+		t.Fatalf("Unexpected fetch %+v (%v)", fetched, err)
+	}
+
+	// Topics can be added while the broker runs
+	if err := b.CreateTopic("payments", 1); err != nil {
+		t.Fatalf("CreateTopic failed: %v", err)
+	}
+	if _, err := cl.Publish(ctx, "payments", "", map[string]int{"amount": 5}); err != nil {
+		t.Errorf("Publish to new topic failed: %v", err)
+	}
+}
+
+func TestCloseAndCleanup(t *testing.T) {
+	var dataDir, addr string
+	t.Run("broker", func(t *testing.T) {
+		b := depstest.Start(t, depstest.Topic{Name: "orders", Partitions: 1})
+		dataDir, addr = b.DataDir, b.Addr
+
+		if _, err := os.Stat(dataDir); err != nil {
+			t.Fatalf("Data directory missing: %v", err)
+		}
+
+		// Closing early is allowed; the cleanup then does nothing
+		if err := b.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := client.New(addr).Health(ctx); err == nil {
+			t.Errorf("Expected the closed broker to refuse requests")
+		}
+	})
+
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed, got %v", dataDir, err)
+	}
+}
+
+func TestStartInMemory(t *testing.T) {
+	b := depstest.StartInMemory(t, depstest.Topic{Name: "orders", Partitions: 2})
+	ctx := context.Background()
+	cl := b.Client()
+	if b.DataDir != "" {
+		t.Errorf("Expected no data directory, got %q", b.DataDir)
+	}
+
+	result, err := cl.Publish(ctx, "orders", "user123", map[string]int{"amount": 100})
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	fetched, err := cl.Fetch(ctx, "orders", result.Partition, result.Offset, client.FetchOptions{})
+	if err != nil || len(fetched.Messages) != 1 || fetched.Messages[0].Key != "user123" {
+		t.Fatalf("Unexpected fetch %+v (%v)", fetched, err)
+	}
+	if err := cl.CommitOffset(ctx, "billing", "orders", result.Partition, result.Offset+1); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if offset, ok, err := cl.CommittedOffset(ctx, "billing", "orders", result.Partition); err != nil || !ok || offset != result.Offset+1 {
+		t.Errorf("Expected committed offset %d, got %d (%v)", result.Offset+1, offset, err)
+	}
+}